@@ -13,9 +13,13 @@ import (
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/proxy"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 	"go.uber.org/zap"
 )
 
+// how often CONFIG_DIR is polled for changes in limiter.yaml and proxy.yaml
+const configWatchInterval = 5 * time.Second
+
 const trafficCtrlArt = `
  _____           __  __ _      ____ _____ ____  _     
 |_   _| __ __ _ / _|/ _(_) ___ / ___|_   _|  _ \| |    
@@ -42,38 +46,96 @@ func main() {
 		_ = lgr.Sync() // flush buffered logs
 	}()
 
-	redisClient := limiter.NewRedisClient(cfg.Redis)
-	defer func() {
-		if err := redisClient.Close(); err != nil {
-			lgr.Warn("failed to close redis client", zap.Error(err))
-		}
-	}()
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rateLimiter := limiter.NewRateLimiter(redisClient)
+	var store limiter.Store
+	switch cfg.Redis.Backend {
+	case config.MemoryBackend:
+		store = limiter.NewMemoryStore()
+		lgr.Warn("using in-memory storage backend, limits are not shared between proxy instances")
+
+	default:
+		redisClient, err := limiter.NewRedisClient(cfg.Redis)
+		if err != nil {
+			lgr.Fatal("invalid redis tls config, terminating process", zap.Error(err))
+			os.Exit(1)
+		}
+
+		if cfg.Redis.UseTLS && cfg.Redis.TLSSkipVerify {
+			lgr.Warn("redis tls certificate verification is disabled (tls_skip_verify), do not use in production")
+		}
+
+		redisStore := limiter.NewRedisStore(redisClient)
+
+		if err := redisStore.Ping(ctx); err != nil {
+			lgr.Fatal("redis connection failed, terminating process",
+				zap.Error(err),
+				zap.String("mode", string(cfg.Redis.Mode)),
+				zap.String("address", cfg.Redis.Address),
+				zap.Int("db", cfg.Redis.DB))
+			os.Exit(1)
+		}
 
-	if err := rateLimiter.Ping(ctx); err != nil {
-		lgr.Fatal("redis connection failed, terminating process",
-			zap.Error(err),
+		lgr.Info("redis connection established",
+			zap.String("mode", string(cfg.Redis.Mode)),
 			zap.String("address", cfg.Redis.Address),
 			zap.Int("db", cfg.Redis.DB))
-		os.Exit(1)
+
+		// scripts missing here are loaded on first use, no need to stop
+		if err := redisStore.LoadScripts(ctx); err != nil {
+			lgr.Warn("failed to preload lua scripts", zap.Error(err))
+		}
+
+		store = redisStore
+
+		if cfg.Redis.FailureMode == config.LocalFallback {
+			store = limiter.NewFallbackStore(redisStore, limiter.NewMemoryStore(), func(fallback bool, err error) {
+				if fallback {
+					lgr.Error("redis unavailable, enforcing limits locally per instance {local fallback}",
+						zap.Error(err))
+					return
+				}
+				lgr.Info("redis available again, local fallback stopped")
+			})
+		}
 	}
 
-	lgr.Info("redis connection established",
-		zap.String("address", cfg.Redis.Address),
-		zap.Int("db", cfg.Redis.DB))
+	rateLimiter := limiter.NewRateLimiter(store)
+	defer func() {
+		if err := rateLimiter.Close(); err != nil {
+			lgr.Warn("failed to close storage backend", zap.Error(err))
+		}
+	}()
 
 	shutdownSignal := make(chan struct{})
 	serverErrChan := make(chan error, 1)
 	quit := make(chan os.Signal, 1)
+	reload := make(chan os.Signal, 1)
 
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	cfgStore := config.NewStore(cfg)
+	go cfgStore.Watch(configWatchInterval, reload, shutdownSignal, func(newCfg *config.Config, err error) {
+		if err != nil {
+			//=========================Metrics=========================
+			metrics.ConfigReloads.WithLabelValues("failure").Inc()
+			//=========================================================
+			lgr.Error("config reload rejected, keeping current config", zap.Error(err))
+			return
+		}
+		//=========================Metrics=========================
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+		//=========================================================
+		lgr.Info("config reloaded",
+			zap.String("target_url", newCfg.Proxy.TargetUrl),
+			zap.Bool("dry_run_mode", newCfg.Proxy.DryRunMode),
+			zap.Int("endpoint_rules", len(newCfg.Limiter.PerEndpoint.Rules)))
+	})
 
 	go func() {
-		serverErrChan <- proxy.StartServer(cfg, lgr, rateLimiter, shutdownSignal)
+		serverErrChan <- proxy.StartServer(cfgStore, lgr, rateLimiter, shutdownSignal)
 	}()
 
 	select {
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func getConfigPath(file string) string {
@@ -73,9 +74,33 @@ func loadRedisConfig() (*RedisConfig, error) {
 		return nil, err
 	}
 
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		cfg.Backend = BackendType(backend)
+	}
+	if failureMode := os.Getenv("REDIS_FAILURE_MODE"); failureMode != "" {
+		cfg.FailureMode = FailureModeType(failureMode)
+	}
+	if mode := os.Getenv("REDIS_MODE"); mode != "" {
+		cfg.Mode = RedisModeType(mode)
+	}
 	if address := os.Getenv("REDIS_ADDRESS"); address != "" {
 		cfg.Address = address
 	}
+	if masterName := os.Getenv("REDIS_MASTER_NAME"); masterName != "" {
+		cfg.MasterName = masterName
+	}
+	if sentinelAddresses := parseListEnv("REDIS_SENTINEL_ADDRESSES"); len(sentinelAddresses) > 0 {
+		cfg.SentinelAddresses = sentinelAddresses
+	}
+	if sentinelPassword := os.Getenv("REDIS_SENTINEL_PASSWORD"); sentinelPassword != "" {
+		cfg.SentinelPassword = sentinelPassword
+	}
+	if clusterAddresses := parseListEnv("REDIS_CLUSTER_ADDRESSES"); len(clusterAddresses) > 0 {
+		cfg.ClusterAddresses = clusterAddresses
+	}
+	if username := os.Getenv("REDIS_USERNAME"); username != "" {
+		cfg.Username = username
+	}
 	if password := os.Getenv("REDIS_PASSWORD"); password != "" {
 		cfg.Password = password
 	}
@@ -91,6 +116,18 @@ func loadRedisConfig() (*RedisConfig, error) {
 	if tlsSkipVerify := os.Getenv("REDIS_TLS_SKIP_VERIFY"); tlsSkipVerify != "" {
 		cfg.TLSSkipVerify = tlsSkipVerify == "true"
 	}
+	if tlsCAFile := os.Getenv("REDIS_TLS_CA_FILE"); tlsCAFile != "" {
+		cfg.TLSCAFile = tlsCAFile
+	}
+	if tlsCertFile := os.Getenv("REDIS_TLS_CERT_FILE"); tlsCertFile != "" {
+		cfg.TLSCertFile = tlsCertFile
+	}
+	if tlsKeyFile := os.Getenv("REDIS_TLS_KEY_FILE"); tlsKeyFile != "" {
+		cfg.TLSKeyFile = tlsKeyFile
+	}
+	if tlsServerName := os.Getenv("REDIS_TLS_SERVER_NAME"); tlsServerName != "" {
+		cfg.TLSServerName = tlsServerName
+	}
 
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -117,6 +154,18 @@ func loadProxyConfig() (*ProxyConfig, error) {
 	if dryRunStr := os.Getenv("DRY_RUN_MODE"); dryRunStr != "" {
 		cfg.DryRunMode = dryRunStr == "true"
 	}
+	if trustedProxies := parseListEnv("TRUSTED_PROXIES"); len(trustedProxies) > 0 {
+		cfg.TrustedProxies = trustedProxies
+	}
+	if adminEnabled := os.Getenv("ADMIN_ENABLED"); adminEnabled != "" {
+		cfg.Admin.Enabled = adminEnabled == "true"
+	}
+	if port, ok := parsePortEnv("ADMIN_PORT"); ok {
+		cfg.Admin.Port = port
+	}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		cfg.Admin.Token = adminToken
+	}
 
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -147,6 +196,17 @@ func parsePortEnv(envVar string) (uint16, bool) {
 	return 0, false
 }
 
+// comma separated, empty items are dropped
+func parseListEnv(envVar string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(envVar), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func parseIntEnv(envVar string) (int, bool) {
 	if s := os.Getenv(envVar); s != "" {
 		if i, err := strconv.Atoi(s); err == nil {
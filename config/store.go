@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// files that can change at runtime, logger.yaml and redis.yaml still need a restart
+var reloadableFiles = []string{"limiter.yaml", "proxy.yaml"}
+
+// Store holds the active config snapshot. Requests take the snapshot once and keep it,
+// a reload only swaps the pointer so in-flight requests finish on the config they started with.
+type Store struct {
+	current atomic.Pointer[Config]
+	mu      sync.Mutex
+}
+
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+func (s *Store) Load() *Config {
+	return s.current.Load()
+}
+
+// Reload re-reads limiter.yaml and proxy.yaml, validates them and swaps in the new snapshot.
+// On any error the old snapshot stays active.
+func (s *Store) Reload() (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.current.Load()
+
+	proxyCfg, err := loadProxyConfig()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't reload proxy config: %v", err)
+	}
+
+	if proxyCfg.ProxyPort != old.Proxy.ProxyPort || proxyCfg.MetricsPort != old.Proxy.MetricsPort ||
+		proxyCfg.Admin.Port != old.Proxy.Admin.Port {
+		return nil, fmt.Errorf("couldn't reload proxy config: proxy_port, metrics_port and admin.port cannot change without a restart")
+	}
+
+	limiterCfg, err := loadLimiterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't reload limiter config: %v", err)
+	}
+
+	next := &Config{
+		Logger:  old.Logger,
+		Redis:   old.Redis,
+		Proxy:   proxyCfg,
+		Limiter: limiterCfg,
+	}
+	s.current.Store(next)
+
+	return next, nil
+}
+
+// Watch polls the reloadable files every interval and reloads when one of them changes
+// or when trigger fires (SIGHUP). Every reload attempt is reported through onReload.
+func (s *Store) Watch(interval time.Duration, trigger <-chan os.Signal, done <-chan struct{},
+	onReload func(cfg *Config, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSeen := configFilesState()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-trigger:
+			lastSeen = configFilesState()
+			onReload(s.Reload())
+		case <-ticker.C:
+			state := configFilesState()
+			if state == lastSeen {
+				continue
+			}
+			lastSeen = state
+			onReload(s.Reload())
+		}
+	}
+}
+
+// fingerprint of the reloadable files, os.Stat follows symlinks so
+// kubernetes configmap swaps are picked up as well
+func configFilesState() string {
+	state := ""
+	for _, file := range reloadableFiles {
+		info, err := os.Stat(getConfigPath(file))
+		if err != nil {
+			state += file + ":missing;"
+			continue
+		}
+		state += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return state
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const storeTestProxy = `
+target_url: "http://localhost:5000"
+proxy_port: 8080
+metrics_port: 8090
+server_name: "trafficctrl:test"
+admin:
+  enabled: false
+  port: 0
+`
+
+func storeTestLimiter(limit int) string {
+	return `
+global:
+  enabled: false
+per_tenant:
+  enabled: true
+  algorithm: fixed_window
+  window_size: "1m"
+  limit: ` + strconv.Itoa(limit) + `
+per_endpoint:
+  rules: []
+`
+}
+
+func writeConfigFile(t *testing.T, dir, file, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(content), 0o600))
+}
+
+// config dir with the repo's logger.yaml and redis.yaml, the store of its snapshot
+func setupTestStore(t *testing.T) (*Store, string) {
+	dir := t.TempDir()
+	for _, file := range []string{"logger.yaml", "redis.yaml"} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		writeConfigFile(t, dir, file, string(data))
+	}
+	writeConfigFile(t, dir, "proxy.yaml", storeTestProxy)
+	writeConfigFile(t, dir, "limiter.yaml", storeTestLimiter(100))
+	t.Setenv("CONFIG_DIR", dir)
+
+	cfg, err := LoadConfigs()
+	require.NoError(t, err)
+	return NewStore(cfg), dir
+}
+
+func TestStore_Reload(t *testing.T) {
+	store, dir := setupTestStore(t)
+	initial := store.Load()
+
+	writeConfigFile(t, dir, "limiter.yaml", storeTestLimiter(200))
+	cfg, err := store.Reload()
+	require.NoError(t, err)
+	assert.Same(t, cfg, store.Load())
+	assert.Equal(t, 200, *cfg.Limiter.PerTenant.Limit)
+	// logger.yaml and redis.yaml need a restart
+	assert.Same(t, initial.Logger, cfg.Logger)
+	assert.Same(t, initial.Redis, cfg.Redis)
+}
+
+func TestStore_ReloadKeepsSnapshotOnInvalidLimiterConfig(t *testing.T) {
+	store, dir := setupTestStore(t)
+	initial := store.Load()
+
+	for name, content := range map[string]string{
+		"unparsable": "per_tenant: [",
+		"invalid":    strings.Replace(storeTestLimiter(100), "fixed_window", "unknown", 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeConfigFile(t, dir, "limiter.yaml", content)
+			cfg, err := store.Reload()
+			assert.Error(t, err)
+			assert.Nil(t, cfg)
+			assert.Same(t, initial, store.Load())
+		})
+	}
+}
+
+func TestStore_ReloadRejectsPortChanges(t *testing.T) {
+	store, dir := setupTestStore(t)
+	initial := store.Load()
+
+	for _, change := range [][2]string{
+		{"proxy_port: 8080", "proxy_port: 8081"},
+		{"metrics_port: 8090", "metrics_port: 8091"},
+		{"port: 0", "port: 9000"},
+	} {
+		t.Run(change[1], func(t *testing.T) {
+			writeConfigFile(t, dir, "proxy.yaml", strings.Replace(storeTestProxy, change[0], change[1], 1))
+			_, err := store.Reload()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "cannot change without a restart")
+			assert.Same(t, initial, store.Load())
+		})
+	}
+}
+
+func TestStore_Watch(t *testing.T) {
+	store, dir := setupTestStore(t)
+
+	reloads := make(chan *Config, 10)
+	trigger := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		store.Watch(10*time.Millisecond, trigger, done, func(cfg *Config, err error) {
+			assert.NoError(t, err)
+			reloads <- cfg
+		})
+	}()
+
+	waitReload := func(reason string) *Config {
+		t.Helper()
+		select {
+		case cfg := <-reloads:
+			return cfg
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no reload after %s", reason)
+			return nil
+		}
+	}
+
+	// SIGHUP reloads even without a change
+	trigger <- syscall.SIGHUP
+	waitReload("SIGHUP")
+
+	// A new size
+	writeConfigFile(t, dir, "limiter.yaml", storeTestLimiter(300))
+	assert.Equal(t, 300, *waitReload("size change").Limiter.PerTenant.Limit)
+
+	// Same size, new mtime
+	path := filepath.Join(dir, "limiter.yaml")
+	modTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	waitReload("mtime change")
+
+	// Unchanged files don't reload
+	select {
+	case <-reloads:
+		t.Fatal("reloaded without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watcher didn't stop")
+	}
+}
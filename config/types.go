@@ -2,7 +2,13 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net/netip"
+	"strings"
 	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/iptrie"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/jwt"
 )
 
 type LimitLevelType string
@@ -11,6 +17,44 @@ const (
 	GlobalLevel      LimitLevelType = "global"
 	PerTenantLevel   LimitLevelType = "per_tenant"
 	PerEndpointLevel LimitLevelType = "per_endpoint"
+	QuotaLevel       LimitLevelType = "quota"
+)
+
+type QuotaPeriod string
+
+const (
+	QuotaDay   QuotaPeriod = "day"
+	QuotaWeek  QuotaPeriod = "week"
+	QuotaMonth QuotaPeriod = "month"
+)
+
+// what happens to a request a limit denied
+type ActionType string
+
+const (
+	// 429 right away
+	ActionReject ActionType = "reject"
+	// held until it may retry (at most tarpit.max_delay), then forwarded
+	ActionDelay ActionType = "delay"
+	// held as long as delay would, then 429
+	ActionDelayThenReject ActionType = "delay_then_reject"
+)
+
+// tarpit defaults
+const (
+	DefaultTarpitMaxDelay      = 10 * time.Second
+	DefaultTarpitMaxConcurrent = 1000
+)
+
+// requests held by shaping leaky buckets at once across the proxy, by default
+const DefaultShapeMaxHeld = 1000
+
+// adaptive global limit defaults
+const (
+	DefaultAdaptiveInterval       = 5 * time.Second
+	DefaultAdaptiveMaxErrorRate   = 0.05
+	DefaultAdaptiveMinSamples     = 20
+	DefaultAdaptiveDecreaseFactor = 0.7
 )
 
 type AlgorithmType string
@@ -20,6 +64,65 @@ const (
 	LeakyBucket   AlgorithmType = "leaky_bucket"
 	FixedWindow   AlgorithmType = "fixed_window"
 	SlidingWindow AlgorithmType = "sliding_window"
+	GCRA          AlgorithmType = "gcra"
+	// caps requests in flight rather than their rate, per tenant or endpoint only
+	Concurrency AlgorithmType = "concurrency"
+)
+
+// slots of requests that are never released (crashed proxy) expire after the lease
+const DefaultConcurrencyLease = time.Minute
+
+type LeakyBucketMode string
+
+const (
+	// count the requests and reject the overflow
+	LeakyBucketPolice LeakyBucketMode = "police"
+	// hold the requests and release them at the leak rate, reject the overflow
+	LeakyBucketShape LeakyBucketMode = "shape"
+)
+
+type BackendType string
+
+const (
+	RedisBackend  BackendType = "redis"
+	MemoryBackend BackendType = "memory"
+)
+
+type RedisModeType string
+
+const (
+	RedisStandalone RedisModeType = "standalone"
+	RedisSentinel   RedisModeType = "sentinel"
+	RedisCluster    RedisModeType = "cluster"
+)
+
+// where the plan of a tenant comes from
+type PlanSourceType string
+
+const (
+	PlanSourceStatic PlanSourceType = "static"
+	PlanSourceFile   PlanSourceType = "file"
+	PlanSourceRedis  PlanSourceType = "redis"
+)
+
+// how long a plan read from redis is cached by each proxy instance
+const DefaultPlanCacheTTL = time.Minute
+
+type FailureModeType string
+
+const (
+	FailOpen      FailureModeType = "fail_open"
+	FailClosed    FailureModeType = "fail_closed"
+	LocalFallback FailureModeType = "local_fallback"
+)
+
+type AccessDecision string
+
+const (
+	// no allow or deny entry matched the client
+	AccessNoMatch AccessDecision = ""
+	AccessAllow   AccessDecision = "allow"
+	AccessDeny    AccessDecision = "deny"
 )
 
 type TenantStrategyType string
@@ -29,6 +132,37 @@ const (
 	TenantHeader         TenantStrategyType = "header"
 	TenantCookie         TenantStrategyType = "cookie"
 	TenantQueryParameter TenantStrategyType = "query_parameter"
+	TenantJWT            TenantStrategyType = "jwt"
+	TenantComposite      TenantStrategyType = "composite"
+)
+
+// ip tenant keys are the client address masked to these prefix lengths, one IPv6 /64 is one subscriber
+const (
+	DefaultIPv4PrefixLength = 32
+	DefaultIPv6PrefixLength = 64
+)
+
+// what the jwt strategy does with missing, invalid or expired tokens
+type InvalidTokenPolicy string
+
+const (
+	// 401, the request never reaches the limits
+	InvalidTokenReject InvalidTokenPolicy = "reject"
+	InvalidTokenIP     InvalidTokenPolicy = "ip"
+	// all such requests share one tenant
+	InvalidTokenAnonymous InvalidTokenPolicy = "anonymous"
+)
+
+// what the composite strategy does when one of its parts is missing
+type MissingPartPolicy string
+
+const (
+	// the whole tenant key falls back to the client ip
+	MissingPartIP MissingPartPolicy = "ip"
+	// the missing part stays empty, the other parts still separate tenants
+	MissingPartEmpty MissingPartPolicy = "empty"
+	// 400, the request never reaches the limits
+	MissingPartReject MissingPartPolicy = "reject"
 )
 
 type Duration struct {
@@ -61,21 +195,69 @@ type ProxyConfig struct {
 	MetricsPort uint16 `yaml:"metrics_port"`
 	ServerName  string `yaml:"server_name"`
 	DryRunMode  bool   `yaml:"dry_run_mode"`
+	// IPs/CIDRs of load balancers in front of the proxy, forwarding headers
+	// (Forwarded, X-Forwarded-For, X-Real-IP) are only honoured from these
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Admin          Admin    `yaml:"admin"`
+
+	// built by validate()
+	trustedProxies *iptrie.Trie[bool]
+}
+
+// Admin is the HTTP API to inspect and reset tenant state, served under /admin/.
+type Admin struct {
+	Enabled bool `yaml:"enabled"`
+	// own port for the api, 0 serves it on the metrics port
+	Port uint16 `yaml:"port"`
+	// bearer token every request must carry, usually set with ADMIN_TOKEN
+	Token string `yaml:"token"`
+}
+
+func (p *ProxyConfig) IsTrustedProxy(addr netip.Addr) bool {
+	if p.trustedProxies == nil {
+		return false
+	}
+	_, ok := p.trustedProxies.Lookup(addr)
+	return ok
 }
 
 type RateLimiterConfig struct {
-	Global      Global      `yaml:"global"`
-	PerTenant   PerTenant   `yaml:"per_tenant"`
-	PerEndpoint PerEndpoint `yaml:"per_endpoint"`
+	AccessControl AccessControl `yaml:"access_control"`
+	Plans         Plans         `yaml:"plans"`
+	Global        Global        `yaml:"global"`
+	PerTenant     PerTenant     `yaml:"per_tenant"`
+	PerEndpoint   PerEndpoint   `yaml:"per_endpoint"`
+	Quota         Quota         `yaml:"quota"`
+	Tarpit        Tarpit        `yaml:"tarpit"`
+	Shape         Shape         `yaml:"shape"`
+	Reputation    Reputation    `yaml:"reputation"`
 }
 
 type RedisConfig struct {
-	Address       string `yaml:"address"`
-	Password      string `yaml:"password"`
-	DB            int    `yaml:"db"`
-	PoolSize      int    `yaml:"pool_size"`
-	UseTLS        bool   `yaml:"use_tls"`
-	TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+	Backend       BackendType     `yaml:"backend"`
+	FailureMode   FailureModeType `yaml:"failure_mode"`
+	Mode          RedisModeType   `yaml:"mode"`
+	Address       string          `yaml:"address"`
+	Username      string          `yaml:"username"`
+	Password      string          `yaml:"password"`
+	DB            int             `yaml:"db"`
+	PoolSize      int             `yaml:"pool_size"`
+	UseTLS        bool            `yaml:"use_tls"`
+	TLSSkipVerify bool            `yaml:"tls_skip_verify"`
+
+	// tls, PEM files. the CA replaces the system roots, cert + key enable client authentication
+	TLSCAFile     string `yaml:"tls_ca_file"`
+	TLSCertFile   string `yaml:"tls_cert_file"`
+	TLSKeyFile    string `yaml:"tls_key_file"`
+	TLSServerName string `yaml:"tls_server_name"`
+
+	// sentinel mode
+	MasterName        string   `yaml:"master_name"`
+	SentinelAddresses []string `yaml:"sentinel_addresses"`
+	SentinelPassword  string   `yaml:"sentinel_password"`
+
+	// cluster mode, seed nodes
+	ClusterAddresses []string `yaml:"cluster_addresses"`
 }
 
 type LoggerConfig struct {
@@ -84,31 +266,607 @@ type LoggerConfig struct {
 	OutputPath  string `yaml:"output_path"`
 }
 
+// AccessControl lists client IPs and CIDRs (IPv4 and IPv6) that skip the rate limits (allow)
+// or are rejected with 403 (deny). When both lists match, the longest prefix decides.
+type AccessControl struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// built by validate()
+	rules *iptrie.Trie[AccessDecision]
+}
+
+// Check returns the decision for a client address, AccessNoMatch when no entry contains it.
+func (a *AccessControl) Check(addr netip.Addr) AccessDecision {
+	if a.rules == nil {
+		return AccessNoMatch
+	}
+	decision, _ := a.rules.Lookup(addr)
+	return decision
+}
+
+// Plans groups tenants into named tiers (free, pro, enterprise) with their own limits.
+// The limits of a plan are set in per_tenant and in the endpoint rules, under "plans".
+type Plans struct {
+	Names []string `yaml:"names"`
+	// plan of tenants without a mapping, empty keeps the base limits
+	Default string      `yaml:"default"`
+	Mapping PlanMapping `yaml:"mapping"`
+
+	// built by validate(), tenant -> plan for the static and file sources
+	tenants map[string]string
+}
+
+type PlanMapping struct {
+	Source PlanSourceType `yaml:"source"`
+	// static source
+	Tenants map[string]string `yaml:"tenants"`
+	// file source, yaml map of tenant: plan, read again on every config reload
+	File string `yaml:"file"`
+	// redis source, HGET <redis_hash> <tenant>
+	RedisHash string    `yaml:"redis_hash"`
+	CacheTTL  *Duration `yaml:"cache_ttl"`
+}
+
+func (p *Plans) Enabled() bool {
+	return len(p.Names) > 0
+}
+
+func (p *Plans) IsDefined(plan string) bool {
+	for _, name := range p.Names {
+		if name == plan {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the mapped plan of a tenant for the static and file sources.
+func (p *Plans) Lookup(tenantKey string) (string, bool) {
+	plan, ok := p.tenants[tenantKey]
+	return plan, ok
+}
+
+// PlanOverrides replaces the algorithm config of a limit level for tenants on a plan.
+type PlanOverrides map[string]AlgorithmConfig
+
+func (o PlanOverrides) resolve(base AlgorithmConfig, plan string) AlgorithmConfig {
+	if override, ok := o[plan]; ok && plan != "" {
+		return override
+	}
+	return base
+}
+
+// Schedule replaces the limit of a level during a time range of the day, e.g. a higher limit
+// overnight or a stricter one during business hours.
+type Schedule struct {
+	// shown in logs, optional
+	Name string `yaml:"name,omitempty"`
+	// mon, tue, ... sun or ranges like mon-fri, empty is every day. A range running past
+	// midnight belongs to the day it starts on
+	Days []string `yaml:"days,omitempty"`
+	// HH:MM, to may be 24:00. A range ending before it starts runs past midnight (22:00 - 06:00)
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// IANA time zone of the range, e.g. Europe/Berlin (default UTC)
+	Timezone string `yaml:"timezone,omitempty"`
+	// per-plan limits while the schedule is active, plans without one get the schedule's limit
+	Plans           PlanOverrides `yaml:"plans,omitempty"`
+	AlgorithmConfig `yaml:",inline"`
+
+	// built by validate()
+	location *time.Location
+	weekdays [7]bool
+	from, to time.Duration
+}
+
+// IsActive reports whether now falls in the schedule's range, on the wall clock of its time zone.
+func (s *Schedule) IsActive(now time.Time) bool {
+	location := s.location
+	if location == nil {
+		location = time.UTC
+	}
+	now = now.In(location)
+
+	hour, minute, second := now.Clock()
+	clock := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(second)*time.Second + time.Duration(now.Nanosecond())
+	weekday := now.Weekday()
+
+	if s.from < s.to {
+		return s.weekdays[weekday] && clock >= s.from && clock < s.to
+	}
+	// past midnight, the hours after midnight belong to the previous day
+	return (s.weekdays[weekday] && clock >= s.from) || (s.weekdays[(weekday+6)%7] && clock < s.to)
+}
+
+func (s *Schedule) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	days := "daily"
+	if len(s.Days) > 0 {
+		days = strings.Join(s.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s", days, s.From, s.To)
+}
+
+// Schedules are the time based limits of a level, the first active one replaces the level's limit.
+type Schedules []Schedule
+
+// Active returns the first schedule active at now, nil when none is.
+func (s Schedules) Active(now time.Time) *Schedule {
+	for i := range s {
+		if s[i].IsActive(now) {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// an active schedule replaces the level's limit and its plan overrides with its own
+func (s Schedules) resolve(base AlgorithmConfig, plans PlanOverrides, plan string, now time.Time) AlgorithmConfig {
+	if schedule := s.Active(now); schedule != nil {
+		return schedule.Plans.resolve(schedule.AlgorithmConfig, plan)
+	}
+	return plans.resolve(base, plan)
+}
+
 type Global struct {
-	Enabled         bool `yaml:"enabled"`
+	Enabled   bool      `yaml:"enabled"`
+	Schedules Schedules `yaml:"schedules,omitempty"`
+	// resizes the limit, it doesn't change what the state means (left out of the config hash)
+	Adaptive        Adaptive `yaml:"adaptive,omitempty" json:"-"`
 	AlgorithmConfig `yaml:",inline"`
 }
 
+// Adaptive resizes the global limit to the backend's health as seen by the proxy (AIMD): every
+// interval whose average latency or error rate is over its target multiplies the effective limit
+// by decrease_factor, every healthy one adds increase, within min_limit and max_limit. Limits are
+// in units of the configured limit's BaseLimit(), an active schedule is scaled the same way.
+// Every proxy instance adapts on its own.
+type Adaptive struct {
+	Enabled bool `yaml:"enabled"`
+	// floor, 10% of max_limit by default
+	MinLimit int `yaml:"min_limit"`
+	// ceiling and starting point, the configured limit by default
+	MaxLimit int `yaml:"max_limit"`
+	// average time until the backend's response headers
+	TargetLatency *Duration `yaml:"target_latency"`
+	// share of 5xx responses and upstream errors (default 0.05)
+	MaxErrorRate float64 `yaml:"max_error_rate"`
+	// how often the limit is adjusted (default 5s)
+	Interval *Duration `yaml:"interval"`
+	// an interval with fewer responses never decreases the limit (default 20)
+	MinSamples int `yaml:"min_samples"`
+	// added after a healthy interval (one without responses too), 5% of max_limit by default
+	Increase int `yaml:"increase"`
+	// applied after a degraded interval, between 0 and 1 (default 0.7)
+	DecreaseFactor float64 `yaml:"decrease_factor"`
+}
+
+// AlgorithmAt returns the global limit at now, the one of the active schedule when there is one.
+func (g *Global) AlgorithmAt(now time.Time) AlgorithmConfig {
+	return g.Schedules.resolve(g.AlgorithmConfig, nil, "", now)
+}
+
 type PerTenant struct {
-	Enabled         bool `yaml:"enabled"`
+	Enabled         bool          `yaml:"enabled"`
+	Plans           PlanOverrides `yaml:"plans,omitempty"`
+	Schedules       Schedules     `yaml:"schedules,omitempty"`
 	AlgorithmConfig `yaml:",inline"`
 }
 
+// AlgorithmFor returns the per-tenant limit of a plan at now: the active schedule's limit,
+// else the plan's override, else the base limit.
+func (t *PerTenant) AlgorithmFor(plan string, now time.Time) AlgorithmConfig {
+	return t.Schedules.resolve(t.AlgorithmConfig, t.Plans, plan, now)
+}
+
+// Quota is a request volume per tenant and calendar period (day, week, month), checked next
+// to the rate limits. Usage is kept when the limit changes, only a new period starts over.
+type Quota struct {
+	Enabled     bool `yaml:"enabled"`
+	QuotaConfig `yaml:",inline"`
+	// per-plan quotas, fields they don't set are taken from the base quota
+	Plans map[string]QuotaConfig `yaml:"plans,omitempty"`
+}
+
+// ConfigFor returns the quota of a plan, the base quota when the plan has no override.
+func (q *Quota) ConfigFor(plan string) QuotaConfig {
+	if override, ok := q.Plans[plan]; ok && plan != "" {
+		return override
+	}
+	return q.QuotaConfig
+}
+
+type QuotaConfig struct {
+	Period QuotaPeriod `yaml:"period"`
+	Limit  int         `yaml:"limit"`
+	// IANA time zone the periods are aligned to, e.g. Europe/Berlin (default UTC)
+	Timezone string `yaml:"timezone,omitempty"`
+	// first day of a period: 1 (monday) - 7 (sunday) for week, 1 - 31 for month
+	// (the last day of shorter months), default 1
+	ResetDay int `yaml:"reset_day,omitempty"`
+	// time of day a period starts, HH:MM (default 00:00)
+	ResetTime string `yaml:"reset_time,omitempty"`
+
+	// built by validate()
+	location *time.Location
+	resetAt  time.Duration
+}
+
+// Window returns the start and end of the period containing now.
+func (q QuotaConfig) Window(now time.Time) (time.Time, time.Time) {
+	location := q.location
+	if location == nil {
+		location = time.UTC
+	}
+	now = now.In(location)
+
+	hour, minute := int(q.resetAt/time.Hour), int(q.resetAt%time.Hour/time.Minute)
+	resetDay := q.ResetDay
+	if resetDay == 0 {
+		resetDay = 1
+	}
+	// time.Date normalizes days and months out of range, wall clock is kept across DST changes
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, location)
+	}
+
+	year, month, day := now.Date()
+
+	switch q.Period {
+	case QuotaWeek:
+		weekday := int(now.Weekday())
+		if weekday == 0 {
+			weekday = 7
+		}
+		offset := -((weekday - resetDay + 7) % 7)
+		if now.Before(at(year, month, day+offset)) {
+			offset -= 7
+		}
+		return at(year, month, day+offset), at(year, month, day+offset+7)
+
+	case QuotaMonth:
+		// reset_day 31 is the last day of shorter months
+		anchor := func(year int, month time.Month) time.Time {
+			lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, location).Day()
+			return at(year, month, min(resetDay, lastDay))
+		}
+		start := anchor(year, month)
+		if now.Before(start) {
+			start = anchor(year, month-1)
+		}
+		next := time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, location)
+		return start, anchor(next.Year(), next.Month())
+
+	default:
+		offset := 0
+		if now.Before(at(year, month, day)) {
+			offset = -1
+		}
+		return at(year, month, day+offset), at(year, month, day+offset+1)
+	}
+}
+
+// Tarpit holds requests denied by the global, per-tenant or per-endpoint limit instead of
+// answering right away, slowing clients down rather than handing them a retry signal.
+// The action comes from the first reputation band of the tenant, else from the endpoint rule.
+type Tarpit struct {
+	// longest a request is held (default 10s)
+	MaxDelay *Duration `yaml:"max_delay"`
+	// requests held at once across the proxy, denied requests beyond it are rejected right away (default 1000)
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// extra hold for bad reputation, penalty * (1 - score), a request waits for it or its retry after
+	Penalty         *Duration        `yaml:"penalty,omitempty"`
+	ReputationBands []ReputationBand `yaml:"reputation_bands,omitempty"`
+}
+
+// Shape bounds the requests held by leaky buckets in shape mode across the whole proxy, each
+// bucket only bounds its own key's queue.
+type Shape struct {
+	// requests held at once, allowed requests queued beyond it are rejected with 429 (default 1000)
+	MaxHeld int `yaml:"max_held"`
+}
+
+// Reputation is the model scoring tenants (1.0 good, 0.0 bot): violations (requests denied by
+// the per-tenant, quota or endpoint limit) take score, good requests and idle time give it back.
+// While the global limit is exceeded, tenants at or below the threshold are rejected. Keys left
+// out keep their default (DefaultReputation).
+type Reputation struct {
+	// disabled: no scores are kept and the global limit rejects every request over it
+	Enabled bool `yaml:"enabled"`
+	// score at or below which tenants are rejected while the global limit is exceeded (default 0.3)
+	Threshold float64            `yaml:"threshold"`
+	Penalty   ReputationPenalty  `yaml:"penalty"`
+	Recovery  ReputationRecovery `yaml:"recovery"`
+	TTL       ReputationTTL      `yaml:"ttl"`
+
+	// loaded from limiter.yaml or DefaultReputation, the zero value uses the defaults
+	set bool
+}
+
+// ReputationPenalty is the score a violation takes.
+type ReputationPenalty struct {
+	// 1 / (good requests + 1) within min and max (default 0.05 - 0.15)
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+	// repeat offenders: from suspicious_violations the penalty is multiplied by suspicious_factor
+	// (default 5 and 1.5), from persistent_violations by persistent_factor (default 10 and 2),
+	// persistent violators are kept twice as long too
+	SuspiciousViolations int     `yaml:"suspicious_violations"`
+	SuspiciousFactor     float64 `yaml:"suspicious_factor"`
+	PersistentViolations int     `yaml:"persistent_violations"`
+	PersistentFactor     float64 `yaml:"persistent_factor"`
+	// taken on top for a violation within rapid_fire_window of the previous one (default 0.2 and 1s)
+	RapidFire       float64  `yaml:"rapid_fire"`
+	RapidFireWindow Duration `yaml:"rapid_fire_window"`
+}
+
+// ReputationRecovery is the score given back.
+type ReputationRecovery struct {
+	// per good request of a tenant without violations (default 0.02)
+	Clean float64 `yaml:"clean"`
+	// per good request of a tenant with violations, 10% less per violation (at most 80% less)
+	// and divided by the square root of the violations, at most clean (default 0.005)
+	Violator float64 `yaml:"violator"`
+	// tenants without violations idle for longer than idle_after get idle_rate per idle hour,
+	// at most idle_max at once (default 10m, 0.1 and 0.05)
+	IdleAfter Duration `yaml:"idle_after"`
+	IdleRate  float64  `yaml:"idle_rate"`
+	IdleMax   float64  `yaml:"idle_max"`
+}
+
+// ReputationTTL is how long a reputation is kept after the tenant's last request, by score.
+type ReputationTTL struct {
+	// score below 0.1 (default 4h)
+	Bot Duration `yaml:"bot"`
+	// below 0.3 (default 2h)
+	Suspicious Duration `yaml:"suspicious"`
+	// below 0.7 (default 1h)
+	Questionable Duration `yaml:"questionable"`
+	// 0.7 and above (default 30m)
+	Good Duration `yaml:"good"`
+}
+
+// DefaultReputation returns the reputation model used without a reputation section.
+func DefaultReputation() Reputation {
+	return Reputation{
+		Enabled:   true,
+		Threshold: 0.3,
+		Penalty: ReputationPenalty{
+			Min:                  0.05,
+			Max:                  0.15,
+			SuspiciousViolations: 5,
+			SuspiciousFactor:     1.5,
+			PersistentViolations: 10,
+			PersistentFactor:     2.0,
+			RapidFire:            0.2,
+			RapidFireWindow:      Duration{Duration: time.Second},
+		},
+		Recovery: ReputationRecovery{
+			Clean:     0.02,
+			Violator:  0.005,
+			IdleAfter: Duration{Duration: 10 * time.Minute},
+			IdleRate:  0.1,
+			IdleMax:   0.05,
+		},
+		TTL: ReputationTTL{
+			Bot:          Duration{Duration: 4 * time.Hour},
+			Suspicious:   Duration{Duration: 2 * time.Hour},
+			Questionable: Duration{Duration: time.Hour},
+			Good:         Duration{Duration: 30 * time.Minute},
+		},
+		set: true,
+	}
+}
+
+var defaultReputation = DefaultReputation()
+
+func (r *Reputation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Reputation
+	value := plain(DefaultReputation())
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*r = Reputation(value)
+	return nil
+}
+
+// Model returns the reputation model in effect, the defaults for a nil or zero Reputation
+// (e.g. a config built in code). It must not be modified.
+func (r *Reputation) Model() *Reputation {
+	if r == nil || !r.set {
+		return &defaultReputation
+	}
+	return r
+}
+
+// ReputationBand sets the action for tenants with a score up to MaxScore, bands are in ascending order.
+type ReputationBand struct {
+	MaxScore float64    `yaml:"max_score"`
+	Action   ActionType `yaml:"action"`
+}
+
+// ActionFor returns the action for a denied request: the one of the first band containing the
+// score, else the rule's action, else reject.
+func (t *Tarpit) ActionFor(ruleAction ActionType, score float64) ActionType {
+	for _, band := range t.ReputationBands {
+		if score <= band.MaxScore {
+			return band.Action
+		}
+	}
+	if ruleAction == "" {
+		return ActionReject
+	}
+	return ruleAction
+}
+
+// Wait returns how long a denied request would have to wait: its retry after, or the reputation
+// penalty when that is longer. Holding it is capped at MaxDelay.
+func (t *Tarpit) Wait(retryAfter time.Duration, score float64) time.Duration {
+	if t.Penalty == nil {
+		return retryAfter
+	}
+	penalty := time.Duration(float64(t.Penalty.Duration) * (1 - score))
+	return max(retryAfter, penalty)
+}
+
 type PerEndpoint struct {
 	Rules []EndpointRule `yaml:"rules"`
 }
 
 type TenantStrategy struct {
 	Type string `yaml:"type" validate:"required"`
-	Key  string `yaml:"key,omitempty"`
+	// header, cookie or query parameter name, the header carrying the token for jwt
+	Key string `yaml:"key,omitempty"`
+
+	// network the client ip is masked to, for the ip strategy and the ip fallback of the others
+	IPv4PrefixLength *int `yaml:"ipv4_prefix_length,omitempty"`
+	IPv6PrefixLength *int `yaml:"ipv6_prefix_length,omitempty"`
+
+	// jwt strategy
+	Claim          string             `yaml:"claim,omitempty"`
+	HMACSecrets    []string           `yaml:"hmac_secrets,omitempty"`
+	HMACSecretsEnv []string           `yaml:"hmac_secrets_env,omitempty"`
+	JWKSFile       string             `yaml:"jwks_file,omitempty"`
+	OnInvalidToken InvalidTokenPolicy `yaml:"on_invalid_token,omitempty"`
+
+	// composite strategy, ordered ip/header/cookie/query_parameter strategies
+	Parts         []TenantStrategy  `yaml:"parts,omitempty"`
+	OnMissingPart MissingPartPolicy `yaml:"on_missing_part,omitempty"`
+
+	// built by validate()
+	verifier *jwt.Verifier
+}
+
+// JWTVerifier returns the verifier built from the configured secrets and jwks file, nil for other strategies.
+func (t *TenantStrategy) JWTVerifier() *jwt.Verifier {
+	return t.verifier
 }
 
 type EndpointRule struct {
-	Path            string          `yaml:"path" validate:"required"`
-	Methods         []string        `yaml:"methods,omitempty"`
-	Bypass          bool            `yaml:"bypass,omitempty"`
+	Path    string   `yaml:"path" validate:"required"`
+	Methods []string `yaml:"methods,omitempty"`
+	Bypass  bool     `yaml:"bypass,omitempty"`
+	// units a request consumes on every limit level, 1 when unset
+	Cost *Cost `yaml:"cost,omitempty" json:",omitempty"`
+	// forwarded requests ending this way get their units back: status codes (503), classes
+	// (5xx), upstream_error or cancelled
+	RefundOn []string `yaml:"refund_on,omitempty" json:",omitempty"`
+	// response: the rule's limit only counts requests whose backend response status is in
+	// CountStatuses (e.g. failed logins), default request
+	CountOn CountOnType `yaml:"count_on,omitempty" json:",omitempty"`
+	// status codes (401) and classes (4xx) counted with count_on: response
+	CountStatuses []string `yaml:"count_statuses,omitempty" json:",omitempty"`
+	// what happens to requests the per-tenant or this rule's limit denied, default reject
+	Action          ActionType      `yaml:"action,omitempty"`
 	TenantStrategy  *TenantStrategy `yaml:"tenant_strategy,omitempty"`
+	Plans           PlanOverrides   `yaml:"plans,omitempty"`
+	Schedules       Schedules       `yaml:"schedules,omitempty"`
 	AlgorithmConfig `yaml:",inline"`
+
+	// built by validate()
+	refundStatuses      statusMatcher
+	refundUpstreamError bool
+	refundCancelled     bool
+	countStatuses       statusMatcher
+}
+
+// AlgorithmFor returns the limit of the rule for a plan at now: the active schedule's limit,
+// else the plan's override, else the rule's own limit.
+func (e *EndpointRule) AlgorithmFor(plan string, now time.Time) AlgorithmConfig {
+	return e.Schedules.resolve(e.AlgorithmConfig, e.Plans, plan, now)
+}
+
+// refund_on entries besides status codes and classes
+const (
+	// the backend couldn't be reached or failed to answer, the proxy answered 502 itself
+	RefundUpstreamError = "upstream_error"
+	// the client went away before the backend answered
+	RefundCancelled = "cancelled"
+)
+
+type CountOnType string
+
+const (
+	// every admitted request counts
+	CountOnRequest CountOnType = "request"
+	// the limit is checked before forwarding, only responses matching count_statuses count
+	CountOnResponse CountOnType = "response"
+)
+
+// status codes (503) and classes (5xx) of refund_on and count_statuses
+type statusMatcher struct {
+	codes   map[int]bool
+	classes [6]bool
+}
+
+func (m *statusMatcher) matches(status int) bool {
+	return m.codes[status] || (status/100 < len(m.classes) && m.classes[status/100])
+}
+
+// RefundsStatus reports whether a response of the backend with status gives the request's
+// units back.
+func (e *EndpointRule) RefundsStatus(status int) bool {
+	return e.refundStatuses.matches(status)
+}
+
+// RefundsUpstreamError reports whether a request the backend never answered gives its units
+// back, cancelled tells a client that went away from a failed upstream.
+func (e *EndpointRule) RefundsUpstreamError(cancelled bool) bool {
+	if cancelled {
+		return e.refundCancelled
+	}
+	return e.refundUpstreamError
+}
+
+// CountsStatus reports whether a response of the backend with status counts against the rule's
+// limit, always false unless count_on is response.
+func (e *EndpointRule) CountsStatus(status int) bool {
+	return e.CountOn == CountOnResponse && e.countStatuses.matches(status)
+}
+
+type CostType string
+
+const (
+	CostConstant       CostType = "constant"
+	CostHeader         CostType = "header"
+	CostQueryParameter CostType = "query_parameter"
+	// request body size in KB (1024 bytes), rounded up
+	CostContentLength CostType = "content_length"
+	// number of items of an array in a JSON body
+	CostJSONArray CostType = "json_array"
+)
+
+// largest body read to count a json_array cost, larger bodies are rejected
+const MaxCostBodySize = 1 << 20
+
+// Cost is how many units a request of an endpoint rule consumes, e.g. the number of items of
+// a batch request. A plain number (cost: 5) is a constant cost.
+type Cost struct {
+	Type CostType `yaml:"type"`
+	// constant cost
+	Value int64 `yaml:"value,omitempty"`
+	// header, query parameter or json field holding the array (a.b for nested fields,
+	// empty when the body itself is the array)
+	Key string `yaml:"key,omitempty"`
+	// cost when the value is missing, default 1
+	Default int64 `yaml:"default,omitempty"`
+	// larger costs are rejected with 400, 0 is no limit. It can't exceed the capacity of a level
+	// the rule is counted on
+	Max int64 `yaml:"max,omitempty"`
+}
+
+func (c *Cost) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value int64
+	if err := unmarshal(&value); err == nil {
+		*c = Cost{Type: CostConstant, Value: value}
+		return nil
+	}
+	type plain Cost
+	return unmarshal((*plain)(c))
 }
 
 type AlgorithmConfig struct {
@@ -120,7 +878,78 @@ type AlgorithmConfig struct {
 
 	LeakRate   *int      `yaml:"leak_rate,omitempty"`
 	LeakPeriod *Duration `yaml:"leak_period,omitempty"`
+	// police by default, left out of the config hash when unset so existing state is kept
+	Mode LeakyBucketMode `yaml:"mode,omitempty" json:",omitempty"`
+	// shape mode: longest a request is held, by default as long as a full bucket takes to leak
+	MaxWait *Duration `yaml:"max_wait,omitempty" json:",omitempty"`
 
 	WindowSize *Duration `yaml:"window_size,omitempty"`
 	Limit      *int      `yaml:"limit,omitempty"`
+
+	Rate   *int      `yaml:"rate,omitempty"`
+	Period *Duration `yaml:"period,omitempty"`
+	Burst  *int      `yaml:"burst,omitempty"`
+
+	// left out of the config hash when unset, like mode and max_wait
+	MaxInFlight *int      `yaml:"max_in_flight,omitempty" json:",omitempty"`
+	Lease       *Duration `yaml:"lease,omitempty" json:",omitempty"`
+}
+
+// BaseLimit is the size of the limit: capacity (token and leaky bucket), limit (windows), rate
+// (gcra) or max_in_flight (concurrency). 0 for an incomplete config.
+func (a *AlgorithmConfig) BaseLimit() int {
+	var limit *int
+	switch AlgorithmType(a.Algorithm) {
+	case TokenBucket, LeakyBucket:
+		limit = a.Capacity
+	case FixedWindow, SlidingWindow:
+		limit = a.Limit
+	case GCRA:
+		limit = a.Rate
+	case Concurrency:
+		limit = a.MaxInFlight
+	}
+	if limit == nil {
+		return 0
+	}
+	return *limit
+}
+
+// MaxCost is the largest request cost the level can ever admit: capacity (token and leaky
+// bucket), limit (windows) or burst (gcra). 0 when there is no such bound, concurrency holds one
+// slot whatever the cost.
+func (a *AlgorithmConfig) MaxCost() int64 {
+	var ceiling *int
+	switch AlgorithmType(a.Algorithm) {
+	case TokenBucket, LeakyBucket:
+		ceiling = a.Capacity
+	case FixedWindow, SlidingWindow:
+		ceiling = a.Limit
+	case GCRA:
+		ceiling = a.Burst
+	}
+	if ceiling == nil {
+		return 0
+	}
+	return int64(*ceiling)
+}
+
+// Scaled returns a copy with the limit and its rates (refill_rate, leak_rate, burst) multiplied
+// by factor, each at least 1 unless it was 0. Periods and windows are kept.
+func (a AlgorithmConfig) Scaled(factor float64) AlgorithmConfig {
+	scale := func(v *int) *int {
+		if v == nil || *v <= 0 {
+			return v
+		}
+		scaled := max(1, int(math.Round(float64(*v)*factor)))
+		return &scaled
+	}
+	a.Capacity = scale(a.Capacity)
+	a.RefillRate = scale(a.RefillRate)
+	a.LeakRate = scale(a.LeakRate)
+	a.Limit = scale(a.Limit)
+	a.Rate = scale(a.Rate)
+	a.Burst = scale(a.Burst)
+	a.MaxInFlight = scale(a.MaxInFlight)
+	return a
 }
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
+
+func TestQuotaConfig_Window(t *testing.T) {
+	utc := time.UTC
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// wall clock in the quota's zone
+	at := func(location *time.Location, year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, location)
+	}
+
+	tests := []struct {
+		name          string
+		quota         QuotaConfig
+		now           time.Time
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{
+			name:          "T01_Day",
+			quota:         QuotaConfig{Period: QuotaDay},
+			now:           at(utc, 2026, 10, 17, 12, 0),
+			expectedStart: at(utc, 2026, 10, 17, 0, 0),
+			expectedEnd:   at(utc, 2026, 10, 18, 0, 0),
+		},
+		{
+			name:          "T02_Day_BeforeResetTime",
+			quota:         QuotaConfig{Period: QuotaDay, ResetTime: "06:00"},
+			now:           at(utc, 2026, 10, 17, 5, 59),
+			expectedStart: at(utc, 2026, 10, 16, 6, 0),
+			expectedEnd:   at(utc, 2026, 10, 17, 6, 0),
+		},
+		{
+			name:          "T03_Day_SpringForwardIs23Hours",
+			quota:         QuotaConfig{Period: QuotaDay, Timezone: "America/New_York"},
+			now:           at(newYork, 2026, 3, 8, 12, 0),
+			expectedStart: at(newYork, 2026, 3, 8, 0, 0),
+			expectedEnd:   at(newYork, 2026, 3, 9, 0, 0),
+		},
+		{
+			name:          "T04_Day_FallBackIs25Hours",
+			quota:         QuotaConfig{Period: QuotaDay, Timezone: "Europe/Berlin"},
+			now:           at(berlin, 2026, 10, 25, 12, 0),
+			expectedStart: at(berlin, 2026, 10, 25, 0, 0),
+			expectedEnd:   at(berlin, 2026, 10, 26, 0, 0),
+		},
+		{
+			name:          "T05_Week_Monday",
+			quota:         QuotaConfig{Period: QuotaWeek, ResetDay: 1},
+			now:           at(utc, 2026, 10, 17, 12, 0),
+			expectedStart: at(utc, 2026, 10, 12, 0, 0),
+			expectedEnd:   at(utc, 2026, 10, 19, 0, 0),
+		},
+		{
+			name:          "T06_Week_Sunday",
+			quota:         QuotaConfig{Period: QuotaWeek, ResetDay: 7},
+			now:           at(utc, 2026, 10, 17, 12, 0),
+			expectedStart: at(utc, 2026, 10, 11, 0, 0),
+			expectedEnd:   at(utc, 2026, 10, 18, 0, 0),
+		},
+		{
+			name:          "T07_Week_ResetDayBeforeResetTime",
+			quota:         QuotaConfig{Period: QuotaWeek, ResetDay: 6, ResetTime: "12:00"},
+			now:           at(utc, 2026, 10, 17, 11, 59),
+			expectedStart: at(utc, 2026, 10, 10, 12, 0),
+			expectedEnd:   at(utc, 2026, 10, 17, 12, 0),
+		},
+		{
+			name:          "T08_Week_ResetDayAtResetTime",
+			quota:         QuotaConfig{Period: QuotaWeek, ResetDay: 6, ResetTime: "12:00"},
+			now:           at(utc, 2026, 10, 17, 12, 0),
+			expectedStart: at(utc, 2026, 10, 17, 12, 0),
+			expectedEnd:   at(utc, 2026, 10, 24, 12, 0),
+		},
+		{
+			name:          "T09_Week_AcrossFallBack",
+			quota:         QuotaConfig{Period: QuotaWeek, ResetDay: 1, Timezone: "Europe/Berlin"},
+			now:           at(berlin, 2026, 10, 24, 12, 0),
+			expectedStart: at(berlin, 2026, 10, 19, 0, 0),
+			expectedEnd:   at(berlin, 2026, 10, 26, 0, 0),
+		},
+		{
+			name:          "T10_Month_FirstDay_YearRollover",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 1},
+			now:           at(utc, 2026, 12, 15, 12, 0),
+			expectedStart: at(utc, 2026, 12, 1, 0, 0),
+			expectedEnd:   at(utc, 2027, 1, 1, 0, 0),
+		},
+		{
+			name:          "T11_Month_MidMonthAcrossYear",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 15},
+			now:           at(utc, 2027, 1, 10, 12, 0),
+			expectedStart: at(utc, 2026, 12, 15, 0, 0),
+			expectedEnd:   at(utc, 2027, 1, 15, 0, 0),
+		},
+		{
+			name:          "T12_Month_Day31_InFebruary",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 31},
+			now:           at(utc, 2026, 2, 15, 12, 0),
+			expectedStart: at(utc, 2026, 1, 31, 0, 0),
+			expectedEnd:   at(utc, 2026, 2, 28, 0, 0),
+		},
+		{
+			name:          "T13_Month_Day31_LastDayOfFebruary",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 31},
+			now:           at(utc, 2026, 2, 28, 0, 0),
+			expectedStart: at(utc, 2026, 2, 28, 0, 0),
+			expectedEnd:   at(utc, 2026, 3, 31, 0, 0),
+		},
+		{
+			name:          "T14_Month_Day31_ThirtyDayMonth",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 31},
+			now:           at(utc, 2026, 4, 29, 12, 0),
+			expectedStart: at(utc, 2026, 3, 31, 0, 0),
+			expectedEnd:   at(utc, 2026, 4, 30, 0, 0),
+		},
+		{
+			name:          "T15_Month_Day30_LeapYear",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 30},
+			now:           at(utc, 2028, 2, 29, 12, 0),
+			expectedStart: at(utc, 2028, 2, 29, 0, 0),
+			expectedEnd:   at(utc, 2028, 3, 30, 0, 0),
+		},
+		{
+			name:          "T16_Month_AcrossSpringForward",
+			quota:         QuotaConfig{Period: QuotaMonth, ResetDay: 1, Timezone: "Europe/Berlin"},
+			now:           at(berlin, 2026, 3, 15, 12, 0),
+			expectedStart: at(berlin, 2026, 3, 1, 0, 0),
+			expectedEnd:   at(berlin, 2026, 4, 1, 0, 0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quota := tt.quota
+			quota.Limit = 100
+			require.NoError(t, quota.validate())
+
+			// now is passed in UTC, the window is aligned to the quota's zone
+			start, end := quota.Window(tt.now.UTC())
+			assert.True(t, tt.expectedStart.Equal(start), "start %s, expected %s", start, tt.expectedStart)
+			assert.True(t, tt.expectedEnd.Equal(end), "end %s, expected %s", end, tt.expectedEnd)
+		})
+	}
+
+	// Wall clock midnights, not 24 hours apart
+	quota := QuotaConfig{Period: QuotaDay, Limit: 100, Timezone: "Europe/Berlin"}
+	require.NoError(t, quota.validate())
+	start, end := quota.Window(at(berlin, 2026, 10, 25, 12, 0))
+	assert.Equal(t, 25*time.Hour, end.Sub(start))
+}
+
+func TestSchedule_IsActive(t *testing.T) {
+	utc := time.UTC
+
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, utc)
+	}
+
+	// 2026-10-16 is a friday
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		expected bool
+	}{
+		{"T01_Daily_BeforeFrom", Schedule{From: "09:00", To: "17:00"}, at(2026, 10, 16, 8, 59), false},
+		{"T02_Daily_AtFrom", Schedule{From: "09:00", To: "17:00"}, at(2026, 10, 16, 9, 0), true},
+		{"T03_Daily_AtTo", Schedule{From: "09:00", To: "17:00"}, at(2026, 10, 16, 17, 0), false},
+		{"T04_Weekdays_Friday", Schedule{Days: []string{"mon-fri"}, From: "09:00", To: "17:00"}, at(2026, 10, 16, 10, 0), true},
+		{"T05_Weekdays_Saturday", Schedule{Days: []string{"mon-fri"}, From: "09:00", To: "17:00"}, at(2026, 10, 17, 10, 0), false},
+		{"T06_RangeWrapsOverWeekend", Schedule{Days: []string{"fri-mon"}, From: "09:00", To: "17:00"}, at(2026, 10, 18, 10, 0), true},
+		{"T07_RangeWrapsOverWeekend_Wednesday", Schedule{Days: []string{"fri-mon"}, From: "09:00", To: "17:00"}, at(2026, 10, 14, 10, 0), false},
+		{"T08_EndOfDay", Schedule{From: "22:00", To: "24:00"}, at(2026, 10, 16, 23, 59), true},
+		{"T09_EndOfDay_Midnight", Schedule{From: "22:00", To: "24:00"}, at(2026, 10, 17, 0, 0), false},
+		{"T10_WholeDay", Schedule{Days: []string{"sat"}, From: "00:00", To: "24:00"}, at(2026, 10, 17, 0, 0), true},
+		{"T11_WholeDay_NextDay", Schedule{Days: []string{"sat"}, From: "00:00", To: "24:00"}, at(2026, 10, 18, 0, 0), false},
+		{"T12_PastMidnight_BeforeMidnight", Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(2026, 10, 16, 23, 0), true},
+		{"T13_PastMidnight_AfterMidnightBelongsToStartDay", Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(2026, 10, 17, 5, 59), true},
+		{"T14_PastMidnight_AtTo", Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(2026, 10, 17, 6, 0), false},
+		{"T15_PastMidnight_OtherDayEvening", Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(2026, 10, 17, 23, 0), false},
+		{"T16_PastMidnight_StartDayMorning", Schedule{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(2026, 10, 16, 5, 0), false},
+		{"T17_PastMidnight_SundayIntoMonday", Schedule{Days: []string{"sun"}, From: "22:00", To: "06:00"}, at(2026, 10, 19, 1, 0), true},
+		// 09:30 CEST
+		{"T18_Timezone_Summer", Schedule{Days: []string{"mon-fri"}, From: "09:00", To: "17:00", Timezone: "Europe/Berlin"}, at(2026, 7, 15, 7, 30), true},
+		// 08:30 CET
+		{"T19_Timezone_Winter", Schedule{Days: []string{"mon-fri"}, From: "09:00", To: "17:00", Timezone: "Europe/Berlin"}, at(2026, 1, 14, 7, 30), false},
+		// 02:30 CEST, then 03:30 CET an hour and a half later: both on the sunday of the fall back
+		{"T20_FallBack_BeforeChange", Schedule{Days: []string{"sun"}, From: "01:00", To: "04:00", Timezone: "Europe/Berlin"}, at(2026, 10, 25, 0, 30), true},
+		{"T21_FallBack_AfterChange", Schedule{Days: []string{"sun"}, From: "01:00", To: "04:00", Timezone: "Europe/Berlin"}, at(2026, 10, 25, 2, 30), true},
+		{"T22_FallBack_AfterTo", Schedule{Days: []string{"sun"}, From: "01:00", To: "04:00", Timezone: "Europe/Berlin"}, at(2026, 10, 25, 3, 30), false},
+		// 05:00 EDT on the sunday clocks sprang forward, still the saturday night's range
+		{"T23_SpringForward_PastMidnight", Schedule{Days: []string{"sat"}, From: "22:00", To: "06:00", Timezone: "America/New_York"}, at(2026, 3, 8, 9, 0), true},
+		{"T24_SpringForward_AfterTo", Schedule{Days: []string{"sat"}, From: "22:00", To: "06:00", Timezone: "America/New_York"}, at(2026, 3, 8, 10, 0), false},
+	}
+
+	limit := 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := tt.schedule
+			schedule.AlgorithmConfig = AlgorithmConfig{Algorithm: string(FixedWindow), Limit: &limit,
+				WindowSize: &Duration{Duration: time.Minute}}
+			require.NoError(t, schedule.validate(nil))
+
+			assert.Equal(t, tt.expected, schedule.IsActive(tt.now))
+		})
+	}
+}
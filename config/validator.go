@@ -2,8 +2,16 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/iptrie"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/jwt"
 )
 
 func (p *ProxyConfig) validate() error {
@@ -45,12 +53,105 @@ func (p *ProxyConfig) validate() error {
 		return fmt.Errorf("invalid proxy config (server_name): cannot be empty")
 	}
 
+	if err := p.Admin.validate(p.ProxyPort, p.MetricsPort); err != nil {
+		return err
+	}
+
+	trustedProxies := iptrie.New[bool]()
+	for _, entry := range p.TrustedProxies {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return fmt.Errorf("invalid proxy config (trusted_proxies): invalid entry %q: %w", entry, err)
+		}
+		trustedProxies.Insert(prefix, true)
+	}
+	p.trustedProxies = trustedProxies
+
+	return nil
+}
+
+// shortest admin token accepted, guessing it must not be feasible
+const minAdminTokenLength = 16
+
+func (a *Admin) validate(proxyPort, metricsPort uint16) error {
+	if !a.Enabled {
+		return nil
+	}
+
+	if len(a.Token) < minAdminTokenLength {
+		return fmt.Errorf("invalid proxy config (admin.token): must be at least %d characters when the admin api is enabled",
+			minAdminTokenLength)
+	}
+
+	if a.Port == 0 {
+		return nil
+	}
+
+	const minUserPort = 1024
+	if a.Port < minUserPort {
+		return fmt.Errorf("invalid proxy config (admin.port): must be 0 or between %d and 65535, got %d",
+			minUserPort, a.Port)
+	}
+
+	if a.Port == proxyPort || a.Port == metricsPort {
+		return fmt.Errorf("invalid proxy config (admin.port): cannot be the proxy or metrics port (%d)", a.Port)
+	}
+
 	return nil
 }
 
 func (r *RedisConfig) validate() error {
-	if r.Address == "" {
-		return fmt.Errorf("invalid redis config: address cannot be empty")
+	// redis stays the default for configs written before the backend setting existed
+	if r.Backend == "" {
+		r.Backend = RedisBackend
+	}
+
+	if r.FailureMode == "" {
+		r.FailureMode = FailOpen
+	}
+
+	switch r.FailureMode {
+	case FailOpen, FailClosed, LocalFallback:
+	default:
+		return fmt.Errorf("invalid redis config: failure_mode must be %s, %s or %s, got %s",
+			FailOpen, FailClosed, LocalFallback, r.FailureMode)
+	}
+
+	switch r.Backend {
+	case RedisBackend:
+	case MemoryBackend:
+		// state lives in the process, the connection settings are ignored
+		return nil
+	default:
+		return fmt.Errorf("invalid redis config: backend must be %s or %s, got %s", RedisBackend, MemoryBackend, r.Backend)
+	}
+
+	if r.Mode == "" {
+		r.Mode = RedisStandalone
+	}
+
+	switch r.Mode {
+	case RedisStandalone:
+		if r.Address == "" {
+			return fmt.Errorf("invalid redis config: address cannot be empty")
+		}
+	case RedisSentinel:
+		if r.MasterName == "" {
+			return fmt.Errorf("invalid redis config: master_name cannot be empty in sentinel mode")
+		}
+		if len(r.SentinelAddresses) == 0 {
+			return fmt.Errorf("invalid redis config: sentinel_addresses cannot be empty in sentinel mode")
+		}
+	case RedisCluster:
+		if len(r.ClusterAddresses) == 0 {
+			return fmt.Errorf("invalid redis config: cluster_addresses cannot be empty in cluster mode")
+		}
+		if r.DB != 0 {
+			return fmt.Errorf("invalid redis config: db must be 0 in cluster mode, got %d", r.DB)
+		}
+	default:
+		return fmt.Errorf("invalid redis config: mode must be %s, %s or %s, got %s",
+			RedisStandalone, RedisSentinel, RedisCluster, r.Mode)
 	}
 
 	if r.DB < 0 {
@@ -61,27 +162,122 @@ func (r *RedisConfig) validate() error {
 		return fmt.Errorf("invalid redis config: pool_size must be > 0, got %d", r.PoolSize)
 	}
 
+	return r.validateTLS()
+}
+
+func (r *RedisConfig) validateTLS() error {
+	tlsFiles := []struct{ name, path string }{
+		{"tls_ca_file", r.TLSCAFile},
+		{"tls_cert_file", r.TLSCertFile},
+		{"tls_key_file", r.TLSKeyFile},
+	}
+
+	if !r.UseTLS {
+		for _, file := range tlsFiles {
+			if file.path != "" {
+				return fmt.Errorf("invalid redis config: %s is set but use_tls is false", file.name)
+			}
+		}
+		if r.TLSServerName != "" {
+			return fmt.Errorf("invalid redis config: tls_server_name is set but use_tls is false")
+		}
+		return nil
+	}
+
+	if (r.TLSCertFile == "") != (r.TLSKeyFile == "") {
+		return fmt.Errorf("invalid redis config: tls_cert_file and tls_key_file must be set together")
+	}
+
+	for _, file := range tlsFiles {
+		if file.path == "" {
+			continue
+		}
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return fmt.Errorf("invalid redis config: %s: %w", file.name, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("invalid redis config: %s is a directory: %s", file.name, file.path)
+		}
+	}
+
 	return nil
 }
 
 func (l *RateLimiterConfig) validate() error {
+	if err := l.AccessControl.validate(); err != nil {
+		return fmt.Errorf("access control config validation failed: %w", err)
+	}
+
+	if err := l.Plans.validate(); err != nil {
+		return fmt.Errorf("plans config validation failed: %w", err)
+	}
+
 	if l.Global.Enabled {
 		if err := l.Global.AlgorithmConfig.validate(); err != nil {
 			return fmt.Errorf("global limiter config validation failed: %w", err)
 		}
+		if AlgorithmType(l.Global.Algorithm) == Concurrency {
+			return fmt.Errorf("global limiter config validation failed: %s algorithm is only supported per tenant and per endpoint",
+				Concurrency)
+		}
+		if err := l.Global.Schedules.validate(nil); err != nil {
+			return fmt.Errorf("global limiter config validation failed: %w", err)
+		}
+		if l.Global.Adaptive.Enabled {
+			if err := l.Global.Adaptive.validate(l.Global.BaseLimit()); err != nil {
+				return fmt.Errorf("global limiter config validation failed: %w", err)
+			}
+		}
 	}
 
 	if l.PerTenant.Enabled {
 		if err := l.PerTenant.AlgorithmConfig.validate(); err != nil {
 			return fmt.Errorf("per-tenant limiter config validation failed: %w", err)
 		}
+		if err := l.PerTenant.Plans.validate(&l.Plans); err != nil {
+			return fmt.Errorf("per-tenant limiter config validation failed: %w", err)
+		}
+		if err := l.PerTenant.Schedules.validate(&l.Plans); err != nil {
+			return fmt.Errorf("per-tenant limiter config validation failed: %w", err)
+		}
+	}
+
+	if l.Quota.Enabled {
+		if err := l.Quota.validate(&l.Plans); err != nil {
+			return fmt.Errorf("quota config validation failed: %w", err)
+		}
+	}
+
+	if err := l.Tarpit.validate(); err != nil {
+		return fmt.Errorf("tarpit config validation failed: %w", err)
+	}
+
+	if err := l.Shape.validate(); err != nil {
+		return fmt.Errorf("shape config validation failed: %w", err)
+	}
+
+	if err := l.Reputation.validate(); err != nil {
+		return fmt.Errorf("reputation config validation failed: %w", err)
 	}
 
 	seenPaths := make(map[string]bool)
-	for i, rule := range l.PerEndpoint.Rules {
+	for i := range l.PerEndpoint.Rules {
+		rule := &l.PerEndpoint.Rules[i]
 		if err := rule.validate(); err != nil {
 			return fmt.Errorf("per-endpoint rule %d validation failed: %w", i, err)
 		}
+		if !rule.Bypass {
+			if err := rule.Plans.validate(&l.Plans); err != nil {
+				return fmt.Errorf("per-endpoint rule %d validation failed: %w", i, err)
+			}
+			if err := rule.Schedules.validate(&l.Plans); err != nil {
+				return fmt.Errorf("per-endpoint rule %d validation failed: %w", i, err)
+			}
+			if err := l.validateCost(rule); err != nil {
+				return fmt.Errorf("per-endpoint rule %d validation failed: %w", i, err)
+			}
+		}
 
 		if seenPaths[rule.Path] {
 			fmt.Printf("Warning: duplicate path found: %s\n", rule.Path)
@@ -92,6 +288,583 @@ func (l *RateLimiterConfig) validate() error {
 	return nil
 }
 
+// the largest cost of a rule has to fit every level it is counted on, under every plan and
+// schedule: a request costing more than a level's capacity could never be admitted
+func (l *RateLimiterConfig) validateCost(rule *EndpointRule) error {
+	if rule.Cost == nil {
+		return nil
+	}
+	maxCost := rule.Cost.Max
+	if rule.Cost.Type == CostConstant {
+		maxCost = rule.Cost.Value
+	}
+	// no max: costs over a level's capacity are rejected per request
+	if maxCost == 0 {
+		return nil
+	}
+
+	ceilings := make(map[LimitLevelType]int64)
+	if l.Global.Enabled {
+		ceilings[GlobalLevel] = minMaxCost(l.Global.AlgorithmConfig, nil, l.Global.Schedules)
+	}
+	if l.PerTenant.Enabled {
+		ceilings[PerTenantLevel] = minMaxCost(l.PerTenant.AlgorithmConfig, l.PerTenant.Plans, l.PerTenant.Schedules)
+	}
+	if l.Quota.Enabled {
+		quotaCeiling := int64(l.Quota.Limit)
+		for _, override := range l.Quota.Plans {
+			quotaCeiling = min(quotaCeiling, int64(override.Limit))
+		}
+		ceilings[QuotaLevel] = quotaCeiling
+	}
+	ceilings[PerEndpointLevel] = minMaxCost(rule.AlgorithmConfig, rule.Plans, rule.Schedules)
+
+	for _, level := range []LimitLevelType{GlobalLevel, PerTenantLevel, QuotaLevel, PerEndpointLevel} {
+		if ceiling := ceilings[level]; ceiling > 0 && maxCost > ceiling {
+			return fmt.Errorf("invalid limiter config: cost of up to %d for path %s exceeds the %s limit of %d, such requests could never be admitted",
+				maxCost, rule.Path, level, ceiling)
+		}
+	}
+
+	return nil
+}
+
+// smallest MaxCost of a level over its plans and schedules, 0 when none has one
+func minMaxCost(base AlgorithmConfig, plans PlanOverrides, schedules Schedules) int64 {
+	configs := []AlgorithmConfig{base}
+	for _, override := range plans {
+		configs = append(configs, override)
+	}
+	for _, schedule := range schedules {
+		configs = append(configs, schedule.AlgorithmConfig)
+		for _, override := range schedule.Plans {
+			configs = append(configs, override)
+		}
+	}
+
+	var ceiling int64
+	for _, algoConfig := range configs {
+		if maxCost := algoConfig.MaxCost(); maxCost > 0 && (ceiling == 0 || maxCost < ceiling) {
+			ceiling = maxCost
+		}
+	}
+	return ceiling
+}
+
+func (p *Plans) validate() error {
+	p.tenants = nil
+
+	if !p.Enabled() {
+		// an empty mapping (the example config) is fine without plans
+		m := p.Mapping
+		if p.Default != "" || len(m.Tenants) > 0 || m.File != "" || m.RedisHash != "" {
+			return fmt.Errorf("invalid limiter config: plans.names is required when plans are used")
+		}
+		return nil
+	}
+
+	seen := make(map[string]bool, len(p.Names))
+	for _, name := range p.Names {
+		if name == "" {
+			return fmt.Errorf("invalid limiter config: plan name cannot be empty")
+		}
+		if seen[name] {
+			return fmt.Errorf("invalid limiter config: duplicate plan %s", name)
+		}
+		seen[name] = true
+	}
+
+	if p.Default != "" && !p.IsDefined(p.Default) {
+		return fmt.Errorf("invalid limiter config: default plan %s is not defined in plans.names", p.Default)
+	}
+
+	if p.Mapping.Source == "" {
+		p.Mapping.Source = PlanSourceStatic
+	}
+
+	switch p.Mapping.Source {
+	case PlanSourceStatic:
+		return p.buildTenants(p.Mapping.Tenants, "plans.mapping.tenants")
+	case PlanSourceFile:
+		if p.Mapping.File == "" {
+			return fmt.Errorf("invalid limiter config: plans.mapping.file is required for the file source")
+		}
+		tenants, err := loadFromFile[map[string]string](p.Mapping.File)
+		if err != nil {
+			return fmt.Errorf("invalid limiter config: plans mapping: %w", err)
+		}
+		return p.buildTenants(*tenants, p.Mapping.File)
+	case PlanSourceRedis:
+		if p.Mapping.RedisHash == "" {
+			return fmt.Errorf("invalid limiter config: plans.mapping.redis_hash is required for the redis source")
+		}
+		if p.Mapping.CacheTTL == nil {
+			p.Mapping.CacheTTL = &Duration{Duration: DefaultPlanCacheTTL}
+		}
+		if p.Mapping.CacheTTL.Duration < 0 {
+			return fmt.Errorf("invalid limiter config: plans.mapping.cache_ttl cannot be negative, got: %s",
+				p.Mapping.CacheTTL.Duration)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid limiter config: plans.mapping.source must be %s, %s or %s, got %s",
+			PlanSourceStatic, PlanSourceFile, PlanSourceRedis, p.Mapping.Source)
+	}
+}
+
+func (p *Plans) buildTenants(tenants map[string]string, origin string) error {
+	p.tenants = make(map[string]string, len(tenants))
+	for tenant, plan := range tenants {
+		if !p.IsDefined(plan) {
+			return fmt.Errorf("invalid limiter config: %s: tenant %s is mapped to undefined plan %s",
+				origin, tenant, plan)
+		}
+		p.tenants[tenant] = plan
+	}
+	return nil
+}
+
+// every override has to name a defined plan and be a complete algorithm config
+func (o PlanOverrides) validate(plans *Plans) error {
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !plans.IsDefined(name) {
+			return fmt.Errorf("invalid limiter config: plan %s is not defined in plans.names", name)
+		}
+		override := o[name]
+		if err := override.validate(); err != nil {
+			return fmt.Errorf("plan %s: %w", name, err)
+		}
+		o[name] = override
+	}
+
+	return nil
+}
+
+func (q *Quota) validate(plans *Plans) error {
+	if err := q.QuotaConfig.validate(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(q.Plans))
+	for name := range q.Plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !plans.IsDefined(name) {
+			return fmt.Errorf("invalid limiter config: plan %s is not defined in plans.names", name)
+		}
+
+		override := q.Plans[name]
+		if override.Period == "" {
+			override.Period = q.Period
+		}
+		if override.Limit == 0 {
+			override.Limit = q.Limit
+		}
+		if override.Timezone == "" {
+			override.Timezone = q.Timezone
+		}
+		if override.ResetDay == 0 && override.Period == q.Period {
+			override.ResetDay = q.ResetDay
+		}
+		if override.ResetTime == "" {
+			override.ResetTime = q.ResetTime
+		}
+
+		if err := override.validate(); err != nil {
+			return fmt.Errorf("plan %s: %w", name, err)
+		}
+		q.Plans[name] = override
+	}
+
+	return nil
+}
+
+func (q *QuotaConfig) validate() error {
+	if q.Limit <= 0 {
+		return fmt.Errorf("invalid limiter config: quota limit must be positive, got: %d", q.Limit)
+	}
+
+	switch q.Period {
+	case QuotaDay:
+		if q.ResetDay != 0 {
+			return fmt.Errorf("invalid limiter config: reset_day is only used by week and month quotas")
+		}
+	case QuotaWeek:
+		if q.ResetDay == 0 {
+			q.ResetDay = 1
+		}
+		if q.ResetDay < 1 || q.ResetDay > 7 {
+			return fmt.Errorf("invalid limiter config: reset_day of a week quota must be between 1 (monday) and 7 (sunday), got: %d",
+				q.ResetDay)
+		}
+	case QuotaMonth:
+		if q.ResetDay == 0 {
+			q.ResetDay = 1
+		}
+		if q.ResetDay < 1 || q.ResetDay > 31 {
+			return fmt.Errorf("invalid limiter config: reset_day of a month quota must be between 1 and 31, got: %d",
+				q.ResetDay)
+		}
+	default:
+		return fmt.Errorf("invalid limiter config: quota period must be %s, %s or %s, got %s",
+			QuotaDay, QuotaWeek, QuotaMonth, q.Period)
+	}
+
+	if q.Timezone == "" {
+		q.Timezone = "UTC"
+	}
+	location, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: quota timezone %s: %w", q.Timezone, err)
+	}
+	q.location = location
+
+	if q.ResetTime == "" {
+		q.ResetTime = "00:00"
+	}
+	resetAt, err := parseClock(q.ResetTime, false)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: quota reset_time %w", err)
+	}
+	q.resetAt = resetAt
+
+	return nil
+}
+
+func (t *Tarpit) validate() error {
+	if t.MaxDelay == nil {
+		t.MaxDelay = &Duration{Duration: DefaultTarpitMaxDelay}
+	}
+	if t.MaxDelay.Duration <= 0 {
+		return fmt.Errorf("invalid limiter config: tarpit max_delay must be positive, got: %s", t.MaxDelay.Duration)
+	}
+
+	if t.MaxConcurrent == 0 {
+		t.MaxConcurrent = DefaultTarpitMaxConcurrent
+	}
+	if t.MaxConcurrent < 0 {
+		return fmt.Errorf("invalid limiter config: tarpit max_concurrent must be positive, got: %d", t.MaxConcurrent)
+	}
+
+	if t.Penalty != nil && t.Penalty.Duration < 0 {
+		return fmt.Errorf("invalid limiter config: tarpit penalty cannot be negative, got: %s", t.Penalty.Duration)
+	}
+
+	previous := -1.0
+	for i, band := range t.ReputationBands {
+		if band.MaxScore < 0 || band.MaxScore > 1 {
+			return fmt.Errorf("invalid limiter config: tarpit reputation band %d: max_score must be between 0 and 1, got: %g",
+				i, band.MaxScore)
+		}
+		if band.MaxScore <= previous {
+			return fmt.Errorf("invalid limiter config: tarpit reputation bands must be in ascending max_score order")
+		}
+		previous = band.MaxScore
+
+		if err := band.Action.validate(); err != nil {
+			return fmt.Errorf("tarpit reputation band %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Shape) validate() error {
+	if s.MaxHeld == 0 {
+		s.MaxHeld = DefaultShapeMaxHeld
+	}
+	if s.MaxHeld < 0 {
+		return fmt.Errorf("invalid limiter config: shape max_held must be positive, got: %d", s.MaxHeld)
+	}
+	return nil
+}
+
+func (r *Reputation) validate() error {
+	// no reputation section
+	if !r.set {
+		*r = DefaultReputation()
+		return nil
+	}
+
+	scores := []struct {
+		name  string
+		value float64
+	}{
+		{"threshold", r.Threshold},
+		{"penalty min", r.Penalty.Min},
+		{"penalty max", r.Penalty.Max},
+		{"penalty rapid_fire", r.Penalty.RapidFire},
+		{"recovery clean", r.Recovery.Clean},
+		{"recovery violator", r.Recovery.Violator},
+		{"recovery idle_rate", r.Recovery.IdleRate},
+		{"recovery idle_max", r.Recovery.IdleMax},
+	}
+	for _, score := range scores {
+		if score.value < 0 || score.value > 1 {
+			return fmt.Errorf("invalid limiter config: reputation %s must be between 0 and 1, got: %g", score.name, score.value)
+		}
+	}
+	if r.Penalty.Max < r.Penalty.Min {
+		return fmt.Errorf("invalid limiter config: reputation penalty max can't be below min, got: %g and %g",
+			r.Penalty.Min, r.Penalty.Max)
+	}
+
+	if r.Penalty.SuspiciousViolations < 1 || r.Penalty.PersistentViolations < r.Penalty.SuspiciousViolations {
+		return fmt.Errorf("invalid limiter config: reputation penalty suspicious_violations must be at least 1 and persistent_violations at least suspicious_violations, got: %d and %d",
+			r.Penalty.SuspiciousViolations, r.Penalty.PersistentViolations)
+	}
+	if r.Penalty.SuspiciousFactor < 1 || r.Penalty.PersistentFactor < 1 {
+		return fmt.Errorf("invalid limiter config: reputation penalty suspicious_factor and persistent_factor must be at least 1, got: %g and %g",
+			r.Penalty.SuspiciousFactor, r.Penalty.PersistentFactor)
+	}
+
+	if r.Penalty.RapidFireWindow.Duration < 0 {
+		return fmt.Errorf("invalid limiter config: reputation penalty rapid_fire_window cannot be negative, got: %s",
+			r.Penalty.RapidFireWindow.Duration)
+	}
+	if r.Recovery.IdleAfter.Duration < 0 {
+		return fmt.Errorf("invalid limiter config: reputation recovery idle_after cannot be negative, got: %s",
+			r.Recovery.IdleAfter.Duration)
+	}
+
+	// redis expires keys in whole seconds
+	ttls := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"bot", r.TTL.Bot.Duration},
+		{"suspicious", r.TTL.Suspicious.Duration},
+		{"questionable", r.TTL.Questionable.Duration},
+		{"good", r.TTL.Good.Duration},
+	}
+	for _, ttl := range ttls {
+		if ttl.value < time.Second {
+			return fmt.Errorf("invalid limiter config: reputation ttl %s must be at least 1s, got: %s", ttl.name, ttl.value)
+		}
+	}
+
+	return nil
+}
+
+// baseLimit is the configured global limit, the default ceiling
+func (a *Adaptive) validate(baseLimit int) error {
+	if a.MaxLimit == 0 {
+		a.MaxLimit = baseLimit
+	}
+	if a.MinLimit == 0 {
+		a.MinLimit = max(1, a.MaxLimit/10)
+	}
+	if a.MinLimit < 1 || a.MaxLimit < a.MinLimit {
+		return fmt.Errorf("invalid limiter config: adaptive min_limit must be at least 1 and max_limit at least min_limit, got: %d and %d",
+			a.MinLimit, a.MaxLimit)
+	}
+
+	if a.TargetLatency == nil || a.TargetLatency.Duration <= 0 {
+		return fmt.Errorf("invalid limiter config: adaptive target_latency is required and must be positive")
+	}
+
+	if a.MaxErrorRate == 0 {
+		a.MaxErrorRate = DefaultAdaptiveMaxErrorRate
+	}
+	if a.MaxErrorRate < 0 || a.MaxErrorRate > 1 {
+		return fmt.Errorf("invalid limiter config: adaptive max_error_rate must be between 0 and 1, got: %g", a.MaxErrorRate)
+	}
+
+	if a.Interval == nil {
+		a.Interval = &Duration{Duration: DefaultAdaptiveInterval}
+	}
+	if a.Interval.Duration <= 0 {
+		return fmt.Errorf("invalid limiter config: adaptive interval must be positive, got: %s", a.Interval.Duration)
+	}
+
+	if a.MinSamples == 0 {
+		a.MinSamples = DefaultAdaptiveMinSamples
+	}
+	if a.MinSamples < 0 {
+		return fmt.Errorf("invalid limiter config: adaptive min_samples cannot be negative, got: %d", a.MinSamples)
+	}
+
+	if a.Increase == 0 {
+		a.Increase = max(1, a.MaxLimit/20)
+	}
+	if a.Increase < 0 {
+		return fmt.Errorf("invalid limiter config: adaptive increase cannot be negative, got: %d", a.Increase)
+	}
+
+	if a.DecreaseFactor == 0 {
+		a.DecreaseFactor = DefaultAdaptiveDecreaseFactor
+	}
+	if a.DecreaseFactor <= 0 || a.DecreaseFactor >= 1 {
+		return fmt.Errorf("invalid limiter config: adaptive decrease_factor must be between 0 and 1, got: %g", a.DecreaseFactor)
+	}
+
+	return nil
+}
+
+func (a ActionType) validate() error {
+	switch a {
+	case ActionReject, ActionDelay, ActionDelayThenReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid limiter config: action must be %s, %s or %s, got %s",
+			ActionReject, ActionDelay, ActionDelayThenReject, a)
+	}
+}
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// plans is nil for levels without plan overrides (global)
+func (s Schedules) validate(plans *Plans) error {
+	for i := range s {
+		if err := s[i].validate(plans); err != nil {
+			return fmt.Errorf("schedule %d (%s): %w", i, s[i].String(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Schedule) validate(plans *Plans) error {
+	from, err := parseClock(s.From, false)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: schedule from %w", err)
+	}
+	to, err := parseClock(s.To, true)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: schedule to %w", err)
+	}
+	if from == to {
+		return fmt.Errorf("invalid limiter config: schedule from and to cannot be equal, use 00:00 - 24:00 for whole days")
+	}
+	s.from, s.to = from, to
+
+	s.weekdays = [7]bool{}
+	if len(s.Days) == 0 {
+		s.weekdays = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, entry := range s.Days {
+		first, last, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(entry)), "-")
+		if !isRange {
+			last = first
+		}
+		start, okStart := scheduleWeekdays[first]
+		end, okEnd := scheduleWeekdays[last]
+		if !okStart || !okEnd {
+			return fmt.Errorf("invalid limiter config: schedule days must be mon, tue, wed, thu, fri, sat, sun or a range like mon-fri, got %s",
+				entry)
+		}
+		// fri-mon wraps over the weekend
+		for day := start; ; day = (day + 1) % 7 {
+			s.weekdays[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: schedule timezone %s: %w", s.Timezone, err)
+	}
+	s.location = location
+
+	if err := s.AlgorithmConfig.validate(); err != nil {
+		return err
+	}
+
+	if plans == nil {
+		if len(s.Plans) > 0 {
+			return fmt.Errorf("invalid limiter config: plans cannot be set on a global schedule")
+		}
+		if AlgorithmType(s.Algorithm) == Concurrency {
+			return fmt.Errorf("invalid limiter config: %s algorithm cannot be used on a global schedule", Concurrency)
+		}
+		return nil
+	}
+	return s.Plans.validate(plans)
+}
+
+// HH:MM as time of day, 24:00 (end of the day) only when endOfDay is set
+func parseClock(value string, endOfDay bool) (time.Duration, error) {
+	if endOfDay && value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("must be HH:MM, got %q", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// parses both lists into a prefix trie, single addresses become /32 (/128) prefixes
+func (a *AccessControl) validate() error {
+	rules := iptrie.New[AccessDecision]()
+	seen := make(map[netip.Prefix]AccessDecision, len(a.Allow)+len(a.Deny))
+
+	lists := []struct {
+		decision AccessDecision
+		entries  []string
+	}{
+		{AccessAllow, a.Allow},
+		{AccessDeny, a.Deny},
+	}
+
+	for _, list := range lists {
+		for _, entry := range list.entries {
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("invalid %s entry %q: %w", list.decision, entry, err)
+			}
+
+			if previous, ok := seen[prefix]; ok && previous != list.decision {
+				return fmt.Errorf("%s is in both allow and deny", prefix)
+			}
+			seen[prefix] = list.decision
+
+			rules.Insert(prefix, list.decision)
+		}
+	}
+
+	a.rules = rules
+	return nil
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		// ::ffff:10.0.0.0/104 is 10.0.0.0/8, clients are matched unmapped as well
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
 func (a *AlgorithmConfig) validate() error {
 	if a.Algorithm == "" {
 		return fmt.Errorf("invalid limiter config (algorithm): field is required")
@@ -99,6 +872,13 @@ func (a *AlgorithmConfig) validate() error {
 
 	algorithm := AlgorithmType(a.Algorithm)
 
+	if algorithm != LeakyBucket && (a.Mode != "" || a.MaxWait != nil) {
+		return fmt.Errorf("invalid limiter config: mode and max_wait are only supported by leaky_bucket algorithm")
+	}
+	if algorithm != Concurrency && (a.MaxInFlight != nil || a.Lease != nil) {
+		return fmt.Errorf("invalid limiter config: max_in_flight and lease are only supported by concurrency algorithm")
+	}
+
 	switch algorithm {
 	case TokenBucket:
 		return a.validateTokenBucket()
@@ -108,9 +888,13 @@ func (a *AlgorithmConfig) validate() error {
 		return a.validateFixedWindow()
 	case SlidingWindow:
 		return a.validateSlidingWindow()
+	case GCRA:
+		return a.validateGCRA()
+	case Concurrency:
+		return a.validateConcurrency()
 	default:
-		return fmt.Errorf("invalid limiter config (algorithm): unsupported algorithm: %s, must be one of [%s, %s, %s, %s]",
-			a.Algorithm, TokenBucket, LeakyBucket, FixedWindow, SlidingWindow)
+		return fmt.Errorf("invalid limiter config (algorithm): unsupported algorithm: %s, must be one of [%s, %s, %s, %s, %s, %s]",
+			a.Algorithm, TokenBucket, LeakyBucket, FixedWindow, SlidingWindow, GCRA, Concurrency)
 	}
 }
 
@@ -161,6 +945,20 @@ func (a *AlgorithmConfig) validateLeakyBucket() error {
 		return fmt.Errorf("invalid limiter config: leak_period must be positive, got: %d", *a.LeakPeriod)
 	}
 
+	switch a.Mode {
+	case "", LeakyBucketPolice:
+		if a.MaxWait != nil {
+			return fmt.Errorf("invalid limiter config: max_wait is only supported in %s mode", LeakyBucketShape)
+		}
+	case LeakyBucketShape:
+		if a.MaxWait != nil && a.MaxWait.Duration <= 0 {
+			return fmt.Errorf("invalid limiter config: max_wait must be positive, got: %s", a.MaxWait.Duration)
+		}
+	default:
+		return fmt.Errorf("invalid limiter config: unsupported leaky_bucket mode: %s, must be one of [%s, %s]",
+			a.Mode, LeakyBucketPolice, LeakyBucketShape)
+	}
+
 	return nil
 }
 
@@ -200,7 +998,52 @@ func (a *AlgorithmConfig) validateSlidingWindow() error {
 	return nil
 }
 
+func (a *AlgorithmConfig) validateGCRA() error {
+	if a.Rate == nil {
+		return fmt.Errorf("invalid limiter config: rate is required for gcra algorithm")
+	}
+	if *a.Rate <= 0 {
+		return fmt.Errorf("invalid limiter config: rate must be positive, got: %d", *a.Rate)
+	}
+
+	if a.Period == nil {
+		return fmt.Errorf("invalid limiter config: period is required for gcra algorithm")
+	}
+	if a.Period.Duration <= 0 {
+		return fmt.Errorf("invalid limiter config: period must be positive, got: %d", *a.Period)
+	}
+
+	if a.Burst == nil {
+		return fmt.Errorf("invalid limiter config: burst is required for gcra algorithm")
+	}
+	if *a.Burst <= 0 {
+		return fmt.Errorf("invalid limiter config: burst must be positive, got: %d", *a.Burst)
+	}
+
+	return nil
+}
+
+func (a *AlgorithmConfig) validateConcurrency() error {
+	if a.MaxInFlight == nil {
+		return fmt.Errorf("invalid limiter config: max_in_flight is required for concurrency algorithm")
+	}
+	if *a.MaxInFlight <= 0 {
+		return fmt.Errorf("invalid limiter config: max_in_flight must be positive, got: %d", *a.MaxInFlight)
+	}
+
+	// optional, DefaultConcurrencyLease when unset
+	if a.Lease != nil && a.Lease.Duration < time.Second {
+		return fmt.Errorf("invalid limiter config: lease must be at least 1s, got: %s", a.Lease.Duration)
+	}
+
+	return nil
+}
+
 func (t *TenantStrategy) validate() error {
+	if err := t.validatePrefixLengths(); err != nil {
+		return err
+	}
+
 	switch TenantStrategyType(t.Type) {
 	case TenantIP:
 		return nil
@@ -209,10 +1052,115 @@ func (t *TenantStrategy) validate() error {
 			return fmt.Errorf("invalid limiter config: key is required for tenant strategy type: %s", t.Type)
 		}
 		return nil
+	case TenantJWT:
+		return t.validateJWT()
+	case TenantComposite:
+		return t.validateComposite()
 	default:
-		return fmt.Errorf("invalid limiter config: unsupported tenant strategy type: %s, must be one of [%s, %s, %s, %s]",
-			t.Type, TenantIP, TenantHeader, TenantCookie, TenantQueryParameter)
+		return fmt.Errorf("invalid limiter config: unsupported tenant strategy type: %s, must be one of [%s, %s, %s, %s, %s, %s]",
+			t.Type, TenantIP, TenantHeader, TenantCookie, TenantQueryParameter, TenantJWT, TenantComposite)
+	}
+}
+
+func (t *TenantStrategy) validatePrefixLengths() error {
+	if t.IPv4PrefixLength == nil {
+		v4 := DefaultIPv4PrefixLength
+		t.IPv4PrefixLength = &v4
+	}
+	if t.IPv6PrefixLength == nil {
+		v6 := DefaultIPv6PrefixLength
+		t.IPv6PrefixLength = &v6
+	}
+
+	if *t.IPv4PrefixLength < 1 || *t.IPv4PrefixLength > 32 {
+		return fmt.Errorf("invalid limiter config: ipv4_prefix_length must be between 1 and 32, got: %d", *t.IPv4PrefixLength)
 	}
+	if *t.IPv6PrefixLength < 1 || *t.IPv6PrefixLength > 128 {
+		return fmt.Errorf("invalid limiter config: ipv6_prefix_length must be between 1 and 128, got: %d", *t.IPv6PrefixLength)
+	}
+
+	return nil
+}
+
+func (t *TenantStrategy) validateComposite() error {
+	if len(t.Parts) < 2 {
+		return fmt.Errorf("invalid limiter config: composite tenant strategy needs at least 2 parts, got %d", len(t.Parts))
+	}
+
+	if t.OnMissingPart == "" {
+		t.OnMissingPart = MissingPartIP
+	}
+
+	switch t.OnMissingPart {
+	case MissingPartIP, MissingPartEmpty, MissingPartReject:
+	default:
+		return fmt.Errorf("invalid limiter config: on_missing_part must be %s, %s or %s, got %s",
+			MissingPartIP, MissingPartEmpty, MissingPartReject, t.OnMissingPart)
+	}
+
+	for i := range t.Parts {
+		part := &t.Parts[i]
+		switch TenantStrategyType(part.Type) {
+		case TenantIP, TenantHeader, TenantCookie, TenantQueryParameter:
+		default:
+			return fmt.Errorf("invalid limiter config: composite part %d: type must be one of [%s, %s, %s, %s], got %s",
+				i, TenantIP, TenantHeader, TenantCookie, TenantQueryParameter, part.Type)
+		}
+		if err := part.validate(); err != nil {
+			return fmt.Errorf("composite part %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *TenantStrategy) validateJWT() error {
+	if t.Key == "" {
+		t.Key = "Authorization"
+	}
+	if t.Claim == "" {
+		t.Claim = "sub"
+	}
+	if t.OnInvalidToken == "" {
+		t.OnInvalidToken = InvalidTokenIP
+	}
+
+	switch t.OnInvalidToken {
+	case InvalidTokenReject, InvalidTokenIP, InvalidTokenAnonymous:
+	default:
+		return fmt.Errorf("invalid limiter config: on_invalid_token must be %s, %s or %s, got %s",
+			InvalidTokenReject, InvalidTokenIP, InvalidTokenAnonymous, t.OnInvalidToken)
+	}
+
+	secrets := append([]string{}, t.HMACSecrets...)
+	for _, name := range t.HMACSecretsEnv {
+		secret := os.Getenv(name)
+		if secret == "" {
+			return fmt.Errorf("invalid limiter config: hmac secret env %s is not set", name)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	var jwks []byte
+	if t.JWKSFile != "" {
+		data, err := os.ReadFile(t.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("invalid limiter config: jwks_file: %w", err)
+		}
+		jwks = data
+	}
+
+	if len(secrets) == 0 && jwks == nil {
+		return fmt.Errorf("invalid limiter config: jwt tenant strategy needs hmac_secrets, hmac_secrets_env or jwks_file")
+	}
+
+	verifier, err := jwt.NewVerifier(secrets, jwks)
+	if err != nil {
+		return fmt.Errorf("invalid limiter config: jwt tenant strategy: %w", err)
+	}
+	t.verifier = verifier
+
+	return nil
 }
 
 func (e *EndpointRule) validate() error {
@@ -236,12 +1184,33 @@ func (e *EndpointRule) validate() error {
 		}
 	}
 
+	if e.Action == "" {
+		e.Action = ActionReject
+	}
+	if err := e.Action.validate(); err != nil {
+		return fmt.Errorf("invalid action for path %s: %w", e.Path, err)
+	}
+
 	if e.TenantStrategy != nil {
 		if err := e.TenantStrategy.validate(); err != nil {
 			return fmt.Errorf("tenant strategy validation failed for path %s: %w", e.Path, err)
 		}
 	}
 
+	if e.Cost != nil {
+		if err := e.Cost.validate(); err != nil {
+			return fmt.Errorf("cost validation failed for path %s: %w", e.Path, err)
+		}
+	}
+
+	if err := e.validateRefundOn(); err != nil {
+		return fmt.Errorf("refund_on validation failed for path %s: %w", e.Path, err)
+	}
+
+	if err := e.validateCountOn(); err != nil {
+		return fmt.Errorf("count_on validation failed for path %s: %w", e.Path, err)
+	}
+
 	if err := e.AlgorithmConfig.validate(); err != nil {
 		return fmt.Errorf("algorithm config validation failed for path %s: %w", e.Path, err)
 	}
@@ -249,6 +1218,129 @@ func (e *EndpointRule) validate() error {
 	return nil
 }
 
+// builds the matchers of RefundsStatus and RefundsUpstreamError
+func (e *EndpointRule) validateRefundOn() error {
+	e.refundStatuses = statusMatcher{}
+	e.refundUpstreamError, e.refundCancelled = false, false
+
+	for _, entry := range e.RefundOn {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		switch {
+		case entry == RefundUpstreamError:
+			e.refundUpstreamError = true
+		case entry == RefundCancelled:
+			e.refundCancelled = true
+		case !e.refundStatuses.add(entry):
+			return fmt.Errorf("invalid limiter config: refund_on entry %q must be a status code (503), "+
+				"a status class (5xx), %s or %s", entry, RefundUpstreamError, RefundCancelled)
+		}
+	}
+
+	return nil
+}
+
+// builds the matcher of CountsStatus
+func (e *EndpointRule) validateCountOn() error {
+	e.countStatuses = statusMatcher{}
+
+	switch e.CountOn {
+	case "":
+		e.CountOn = CountOnRequest
+	case CountOnRequest, CountOnResponse:
+	default:
+		return fmt.Errorf("invalid limiter config: count_on must be %s or %s, got %s",
+			CountOnRequest, CountOnResponse, e.CountOn)
+	}
+
+	if e.CountOn == CountOnRequest {
+		if len(e.CountStatuses) > 0 {
+			return fmt.Errorf("invalid limiter config: count_statuses requires count_on: %s", CountOnResponse)
+		}
+		return nil
+	}
+
+	if len(e.CountStatuses) == 0 {
+		return fmt.Errorf("invalid limiter config: count_on: %s requires count_statuses", CountOnResponse)
+	}
+	for _, entry := range e.CountStatuses {
+		if !e.countStatuses.add(strings.ToLower(strings.TrimSpace(entry))) {
+			return fmt.Errorf("invalid limiter config: count_statuses entry %q must be a status code (401) "+
+				"or a status class (4xx)", entry)
+		}
+	}
+
+	// the response comes after a concurrency slot is released and after a shaped request left
+	algorithms := []AlgorithmConfig{e.AlgorithmConfig}
+	for _, override := range e.Plans {
+		algorithms = append(algorithms, override)
+	}
+	for _, schedule := range e.Schedules {
+		algorithms = append(algorithms, schedule.AlgorithmConfig)
+		for _, override := range schedule.Plans {
+			algorithms = append(algorithms, override)
+		}
+	}
+	for _, algoConfig := range algorithms {
+		if AlgorithmType(algoConfig.Algorithm) == Concurrency || algoConfig.Mode == LeakyBucketShape {
+			return fmt.Errorf("invalid limiter config: count_on: %s cannot be used with %s or a %s in %s mode",
+				CountOnResponse, Concurrency, LeakyBucket, LeakyBucketShape)
+		}
+	}
+
+	return nil
+}
+
+// adds a status code (100-599) or class (1xx-5xx), false when entry is neither
+func (m *statusMatcher) add(entry string) bool {
+	if len(entry) == 3 && entry[1:] == "xx" && entry[0] >= '1' && entry[0] <= '5' {
+		m.classes[entry[0]-'0'] = true
+		return true
+	}
+
+	code, err := strconv.Atoi(entry)
+	if err != nil || code < 100 || code > 599 {
+		return false
+	}
+	if m.codes == nil {
+		m.codes = make(map[int]bool)
+	}
+	m.codes[code] = true
+	return true
+}
+
+func (c *Cost) validate() error {
+	switch c.Type {
+	case CostConstant:
+		if c.Value <= 0 {
+			return fmt.Errorf("invalid limiter config: cost value must be positive, got: %d", c.Value)
+		}
+	case CostHeader, CostQueryParameter:
+		if c.Key == "" {
+			return fmt.Errorf("invalid limiter config: cost key is required for %s cost", c.Type)
+		}
+	case CostContentLength, CostJSONArray:
+	default:
+		return fmt.Errorf("invalid limiter config: unsupported cost type: %s, must be one of [%s, %s, %s, %s, %s]",
+			c.Type, CostConstant, CostHeader, CostQueryParameter, CostContentLength, CostJSONArray)
+	}
+
+	if c.Default == 0 {
+		c.Default = 1
+	}
+	if c.Default < 0 {
+		return fmt.Errorf("invalid limiter config: cost default must be positive, got: %d", c.Default)
+	}
+	if c.Max < 0 {
+		return fmt.Errorf("invalid limiter config: cost max cannot be negative, got: %d", c.Max)
+	}
+	if c.Max > 0 && (c.Default > c.Max || (c.Type == CostConstant && c.Value > c.Max)) {
+		return fmt.Errorf("invalid limiter config: cost max %d is below the default or constant cost", c.Max)
+	}
+
+	return nil
+}
+
 func (l *LoggerConfig) validate() error {
 	validLevels := []string{"trace", "debug", "info", "warn", "error", "fatal"}
 
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessControl_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		wantErr bool
+		// client ip -> decision
+		expected map[string]AccessDecision
+	}{
+		{
+			name:  "T01_LongestPrefixWins",
+			allow: []string{"10.0.0.0/8", "10.1.9.0/24"},
+			deny:  []string{"10.1.0.0/16"},
+			expected: map[string]AccessDecision{
+				"10.2.0.1":    AccessAllow,
+				"10.1.2.3":    AccessDeny,
+				"10.1.9.9":    AccessAllow,
+				"192.168.0.1": AccessNoMatch,
+			},
+		},
+		{
+			name: "T02_SingleIPs",
+			deny: []string{"198.51.100.7", "2001:db8::1"},
+			expected: map[string]AccessDecision{
+				"198.51.100.7": AccessDeny,
+				"198.51.100.8": AccessNoMatch,
+				"2001:db8::1":  AccessDeny,
+				"2001:db8::2":  AccessNoMatch,
+			},
+		},
+		{
+			name:  "T03_MappedIPv4Prefix",
+			allow: []string{"::ffff:10.0.0.0/104"},
+			expected: map[string]AccessDecision{
+				"10.3.0.1": AccessAllow,
+			},
+		},
+		{
+			name:  "T04_UnmaskedPrefix",
+			allow: []string{"10.1.2.3/16"},
+			expected: map[string]AccessDecision{
+				"10.1.200.1": AccessAllow,
+			},
+		},
+		{
+			name:    "T05_SamePrefixInBothLists",
+			allow:   []string{"10.0.0.0/8"},
+			deny:    []string{"10.1.2.3/8"},
+			wantErr: true,
+		},
+		{
+			name:    "T06_InvalidEntry",
+			deny:    []string{"10.0.0.0/33"},
+			wantErr: true,
+		},
+		{
+			name:    "T07_NotAnIP",
+			allow:   []string{"localhost"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessControl := &AccessControl{Allow: tt.allow, Deny: tt.deny}
+			err := accessControl.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			for ip, decision := range tt.expected {
+				assert.Equal(t, decision, accessControl.Check(netip.MustParseAddr(ip)), ip)
+			}
+		})
+	}
+}
+
+func fixedWindowConfig(limit int) AlgorithmConfig {
+	return AlgorithmConfig{
+		Algorithm:  string(FixedWindow),
+		Limit:      &limit,
+		WindowSize: &Duration{Duration: time.Minute},
+	}
+}
+
+func gcraConfig(burst int) AlgorithmConfig {
+	rate := 10
+	return AlgorithmConfig{
+		Algorithm: string(GCRA),
+		Rate:      &rate,
+		Burst:     &burst,
+		Period:    &Duration{Duration: time.Second},
+	}
+}
+
+func TestMinMaxCost(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      AlgorithmConfig
+		plans     PlanOverrides
+		schedules Schedules
+		expected  int64
+	}{
+		{
+			name:     "T01_BaseOnly",
+			base:     fixedWindowConfig(100),
+			expected: 100,
+		},
+		{
+			name:     "T02_SmallerPlan",
+			base:     fixedWindowConfig(100),
+			plans:    PlanOverrides{"free": fixedWindowConfig(10), "pro": fixedWindowConfig(1000)},
+			expected: 10,
+		},
+		{
+			name:      "T03_SmallerSchedule",
+			base:      fixedWindowConfig(100),
+			plans:     PlanOverrides{"free": fixedWindowConfig(50)},
+			schedules: Schedules{{From: "09:00", To: "17:00", AlgorithmConfig: fixedWindowConfig(20)}},
+			expected:  20,
+		},
+		{
+			name: "T04_SmallerSchedulePlan",
+			base: fixedWindowConfig(100),
+			schedules: Schedules{{From: "09:00", To: "17:00", AlgorithmConfig: fixedWindowConfig(80),
+				Plans: PlanOverrides{"free": fixedWindowConfig(5)}}},
+			expected: 5,
+		},
+		{
+			name:     "T05_GCRABurst",
+			base:     gcraConfig(15),
+			plans:    PlanOverrides{"pro": fixedWindowConfig(40)},
+			expected: 15,
+		},
+		{
+			name:     "T06_ConcurrencyHasNoCapacity",
+			base:     AlgorithmConfig{Algorithm: string(Concurrency)},
+			expected: 0,
+		},
+		{
+			name:     "T07_ConcurrencyBaseWithPlan",
+			base:     AlgorithmConfig{Algorithm: string(Concurrency)},
+			plans:    PlanOverrides{"free": fixedWindowConfig(30)},
+			expected: 30,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, minMaxCost(tt.base, tt.plans, tt.schedules))
+		})
+	}
+}
+
+func TestRateLimiterConfig_ValidateCost(t *testing.T) {
+	limiterConfig := func() *RateLimiterConfig {
+		return &RateLimiterConfig{
+			Global: Global{Enabled: true, AlgorithmConfig: fixedWindowConfig(1000)},
+			PerTenant: PerTenant{Enabled: true, AlgorithmConfig: fixedWindowConfig(100),
+				Plans: PlanOverrides{"free": fixedWindowConfig(20)}},
+			Quota: Quota{Enabled: true, QuotaConfig: QuotaConfig{Period: QuotaMonth, Limit: 5000},
+				Plans: map[string]QuotaConfig{"trial": {Period: QuotaMonth, Limit: 15}}},
+		}
+	}
+	rule := func(cost *Cost) *EndpointRule {
+		return &EndpointRule{Path: "/api/batch", Cost: cost, AlgorithmConfig: fixedWindowConfig(50)}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(l *RateLimiterConfig)
+		cost    *Cost
+		wantErr bool
+	}{
+		{name: "T01_NoCost", cost: nil},
+		{name: "T02_NoMax", cost: &Cost{Type: CostHeader, Key: "X-Cost"}},
+		{name: "T03_MaxWithinEveryLevel", cost: &Cost{Type: CostHeader, Key: "X-Cost", Max: 15}},
+		{name: "T04_MaxOverTenantPlan", cost: &Cost{Type: CostHeader, Key: "X-Cost", Max: 21}, wantErr: true},
+		{name: "T05_MaxOverQuotaPlan", cost: &Cost{Type: CostJSONArray, Max: 16}, wantErr: true},
+		{name: "T06_ConstantOverEndpoint", cost: &Cost{Type: CostConstant, Value: 51}, wantErr: true},
+		{
+			name: "T07_DisabledLevelsDontCount",
+			modify: func(l *RateLimiterConfig) {
+				l.PerTenant.Enabled = false
+				l.Quota.Enabled = false
+			},
+			cost: &Cost{Type: CostHeader, Key: "X-Cost", Max: 50},
+		},
+		{
+			name: "T08_MaxOverGlobalSchedule",
+			modify: func(l *RateLimiterConfig) {
+				l.PerTenant.Enabled = false
+				l.Quota.Enabled = false
+				l.Global.Schedules = Schedules{{From: "22:00", To: "06:00", AlgorithmConfig: fixedWindowConfig(10)}}
+			},
+			cost:    &Cost{Type: CostHeader, Key: "X-Cost", Max: 11},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := limiterConfig()
+			if tt.modify != nil {
+				tt.modify(l)
+			}
+			err := l.validateCost(rule(tt.cost))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
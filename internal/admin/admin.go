@@ -0,0 +1,263 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTopViolators = 10
+	maxTopViolators     = 1000
+)
+
+type handler struct {
+	cfgStore    *config.Store
+	rateLimiter *limiter.RateLimiter
+	lgr         *logger.Logger
+}
+
+// NewHandler returns the admin api, every route is under /admin/. Tenant keys are the ones
+// the limiter uses (after ip prefix masking, composite joining, ...), path escaped.
+func NewHandler(cfgStore *config.Store, rateLimiter *limiter.RateLimiter, lgr *logger.Logger) http.Handler {
+	h := &handler{cfgStore: cfgStore, rateLimiter: rateLimiter, lgr: lgr}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tenants/top", h.topViolators)
+	mux.HandleFunc("GET /admin/tenants/{tenant}/limits", h.getLimits)
+	mux.HandleFunc("DELETE /admin/tenants/{tenant}/limits", h.resetLimits)
+	mux.HandleFunc("GET /admin/tenants/{tenant}/reputation", h.getReputation)
+	mux.HandleFunc("DELETE /admin/tenants/{tenant}/reputation", h.resetReputation)
+	mux.HandleFunc("GET /admin/tenants/{tenant}/ban", h.getBan)
+	mux.HandleFunc("PUT /admin/tenants/{tenant}/ban", h.ban)
+	mux.HandleFunc("DELETE /admin/tenants/{tenant}/ban", h.unban)
+
+	return h.authenticate(mux)
+}
+
+// checks the bearer token against the current config, a reload can rotate it or disable the api
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		admin := h.cfgStore.Load().Proxy.Admin
+		if !admin.Enabled {
+			http.NotFound(res, req)
+			return
+		}
+
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(admin.Token)) != 1 {
+			h.lgr.Warn("admin api request rejected, invalid token",
+				zap.String("remote_addr", req.RemoteAddr),
+				zap.String("path", req.URL.Path))
+			res.Header().Set("WWW-Authenticate", `Bearer realm="trafficctrl-admin"`)
+			writeError(res, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+func (h *handler) getLimits(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	tenantKey := req.PathValue("tenant")
+	limiterConfig := h.cfgStore.Load().Limiter
+
+	plan, err := h.rateLimiter.ResolvePlan(ctx, tenantKey, &limiterConfig.Plans)
+	if err != nil {
+		h.lgr.Warn("failed to resolve tenant plan, using default plan", zap.String("tenant_key", tenantKey),
+			zap.Error(err))
+	}
+
+	states, err := h.rateLimiter.InspectTenant(ctx, tenantKey, plan, limiterConfig)
+	if err != nil {
+		h.internalError(res, "failed to read tenant limits", err)
+		return
+	}
+
+	bannedFor, err := h.rateLimiter.GetTenantBan(ctx, tenantKey)
+	if err != nil {
+		h.internalError(res, "failed to read tenant ban", err)
+		return
+	}
+
+	levels := make([]map[string]interface{}, 0, len(states))
+	for _, state := range states {
+		level := map[string]interface{}{
+			"level":       state.Level,
+			"algorithm":   state.Algorithm,
+			"allowed":     state.Result.Allowed,
+			"remaining":   state.Result.Remaining,
+			"retry_after": state.Result.RetryAfter.Seconds(),
+		}
+		if state.Level == config.PerEndpointLevel {
+			level["path"] = state.Path
+			level["methods"] = state.Methods
+		}
+		if state.Schedule != "" {
+			level["schedule"] = state.Schedule
+		}
+		if state.Result.Delay > 0 {
+			level["delay"] = state.Result.Delay.Seconds()
+		}
+		levels = append(levels, level)
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"tenant_key": tenantKey,
+		"plan":       plan,
+		"banned_for": bannedFor.Seconds(),
+		"levels":     levels,
+	})
+}
+
+func (h *handler) resetLimits(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	if err := h.rateLimiter.ResetTenantLimits(req.Context(), tenantKey, h.cfgStore.Load().Limiter); err != nil {
+		h.internalError(res, "failed to reset tenant limits", err)
+		return
+	}
+
+	h.lgr.Info("admin: tenant limits reset", zap.String("tenant_key", tenantKey),
+		zap.String("remote_addr", req.RemoteAddr))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getReputation(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	reputation, err := h.rateLimiter.GetTenantReputation(req.Context(), tenantKey)
+	if err != nil {
+		h.internalError(res, "failed to read tenant reputation", err)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, reputationBody(tenantKey, reputation))
+}
+
+func (h *handler) resetReputation(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	if err := h.rateLimiter.ResetTenantReputation(req.Context(), tenantKey); err != nil {
+		h.internalError(res, "failed to reset tenant reputation", err)
+		return
+	}
+
+	h.lgr.Info("admin: tenant reputation reset", zap.String("tenant_key", tenantKey),
+		zap.String("remote_addr", req.RemoteAddr))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) getBan(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	bannedFor, err := h.rateLimiter.GetTenantBan(req.Context(), tenantKey)
+	if err != nil {
+		h.internalError(res, "failed to read tenant ban", err)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"tenant_key": tenantKey,
+		"banned":     bannedFor > 0,
+		"banned_for": bannedFor.Seconds(),
+	})
+}
+
+// PUT /admin/tenants/{tenant}/ban?duration=1h
+func (h *handler) ban(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	duration, err := time.ParseDuration(req.URL.Query().Get("duration"))
+	if err != nil || duration <= 0 {
+		writeError(res, http.StatusBadRequest, "duration query parameter must be a positive duration, e.g. 30m or 24h")
+		return
+	}
+
+	if err := h.rateLimiter.BanTenant(req.Context(), tenantKey, duration); err != nil {
+		h.internalError(res, "failed to ban tenant", err)
+		return
+	}
+
+	h.lgr.Info("admin: tenant banned", zap.String("tenant_key", tenantKey),
+		zap.Duration("duration", duration),
+		zap.String("remote_addr", req.RemoteAddr))
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"tenant_key": tenantKey,
+		"banned":     true,
+		"banned_for": duration.Seconds(),
+	})
+}
+
+func (h *handler) unban(res http.ResponseWriter, req *http.Request) {
+	tenantKey := req.PathValue("tenant")
+
+	if err := h.rateLimiter.UnbanTenant(req.Context(), tenantKey); err != nil {
+		h.internalError(res, "failed to unban tenant", err)
+		return
+	}
+
+	h.lgr.Info("admin: tenant unbanned", zap.String("tenant_key", tenantKey),
+		zap.String("remote_addr", req.RemoteAddr))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/tenants/top?limit=10
+func (h *handler) topViolators(res http.ResponseWriter, req *http.Request) {
+	limit := defaultTopViolators
+	if value := req.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTopViolators {
+			writeError(res, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxTopViolators))
+			return
+		}
+		limit = parsed
+	}
+
+	tenants, err := h.rateLimiter.TopViolators(req.Context(), limit)
+	if err != nil {
+		h.internalError(res, "failed to list tenants", err)
+		return
+	}
+
+	body := make([]map[string]interface{}, 0, len(tenants))
+	for _, tenant := range tenants {
+		body = append(body, reputationBody(tenant.TenantKey, tenant.Reputation))
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{"tenants": body})
+}
+
+func (h *handler) internalError(res http.ResponseWriter, message string, err error) {
+	h.lgr.Error("admin: "+message, zap.Error(err))
+	writeError(res, http.StatusInternalServerError, message)
+}
+
+func reputationBody(tenantKey string, reputation *limiter.Reputation) map[string]interface{} {
+	return map[string]interface{}{
+		"tenant_key":       tenantKey,
+		"reputation_score": reputation.Score,
+		"violations_count": reputation.ViolationCount,
+		"good_requests":    reputation.GoodRequests,
+		"reputation_ttl":   reputation.TTL,
+	}
+}
+
+func writeError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, map[string]interface{}{"error": message})
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_ = json.NewEncoder(res).Encode(body)
+}
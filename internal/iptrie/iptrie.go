@@ -0,0 +1,144 @@
+package iptrie
+
+import "net/netip"
+
+// Trie maps IP prefixes to values and finds the longest prefix containing an address.
+// It's a path compressed binary trie, one per address family: a lookup walks at most
+// one node per stored prefix length on its path (<= 33 for IPv4, <= 129 for IPv6),
+// independent of how many prefixes are stored.
+// A Trie is not safe for concurrent writes, lookups on a finished trie are.
+type Trie[V any] struct {
+	v4   *node[V]
+	v6   *node[V]
+	size int
+}
+
+type node[V any] struct {
+	// masked, a node only matches addresses inside it
+	prefix   netip.Prefix
+	value    V
+	hasValue bool
+	children [2]*node[V]
+}
+
+func New[V any]() *Trie[V] {
+	return &Trie[V]{}
+}
+
+// Len returns the number of stored prefixes.
+func (t *Trie[V]) Len() int {
+	return t.size
+}
+
+// Insert stores value for prefix, replacing the value of an equal prefix.
+// IPv4-mapped IPv6 prefixes are stored as IPv4.
+func (t *Trie[V]) Insert(prefix netip.Prefix, value V) {
+	prefix = normalize(prefix)
+	root := t.root(prefix.Addr())
+	*root = t.insert(*root, prefix, value)
+}
+
+// Lookup returns the value of the longest stored prefix containing addr.
+func (t *Trie[V]) Lookup(addr netip.Addr) (value V, ok bool) {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return value, false
+	}
+
+	n := *t.root(addr)
+	for n != nil && n.prefix.Contains(addr) {
+		if n.hasValue {
+			value, ok = n.value, true
+		}
+		if n.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		n = n.children[bit(addr, n.prefix.Bits())]
+	}
+	return value, ok
+}
+
+func (t *Trie[V]) root(addr netip.Addr) **node[V] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *Trie[V]) insert(n *node[V], prefix netip.Prefix, value V) *node[V] {
+	if n == nil {
+		t.size++
+		return &node[V]{prefix: prefix, value: value, hasValue: true}
+	}
+
+	common := commonBits(n.prefix, prefix)
+
+	switch {
+	case common == n.prefix.Bits() && common == prefix.Bits():
+		// same prefix
+		if !n.hasValue {
+			t.size++
+		}
+		n.value, n.hasValue = value, true
+		return n
+
+	case common == n.prefix.Bits():
+		// prefix is inside n
+		b := bit(prefix.Addr(), common)
+		n.children[b] = t.insert(n.children[b], prefix, value)
+		return n
+
+	case common == prefix.Bits():
+		// n is inside prefix
+		t.size++
+		parent := &node[V]{prefix: prefix, value: value, hasValue: true}
+		parent.children[bit(n.prefix.Addr(), common)] = n
+		return parent
+
+	default:
+		// they diverge, join them under a branch node without a value
+		branch := &node[V]{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+		branch.children[bit(n.prefix.Addr(), common)] = n
+		branch.children[bit(prefix.Addr(), common)] = t.insert(nil, prefix, value)
+		return branch
+	}
+}
+
+func normalize(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			bits = 0
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	return prefix.Masked()
+}
+
+// number of leading bits a and b share, at most the shorter prefix length
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	aBytes, bBytes := a.Addr().AsSlice(), b.Addr().AsSlice()
+
+	common := 0
+	for i := 0; i < len(aBytes) && common < limit; i++ {
+		diff := aBytes[i] ^ bBytes[i]
+		if diff == 0 {
+			common += 8
+			continue
+		}
+		for diff&0x80 == 0 {
+			common++
+			diff <<= 1
+		}
+		break
+	}
+	return min(common, limit)
+}
+
+// bit i of addr, counted from the most significant bit
+func bit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
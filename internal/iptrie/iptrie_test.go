@@ -0,0 +1,125 @@
+package iptrie
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustInsert(t *testing.T, trie *Trie[string], prefix, value string) {
+	t.Helper()
+	p, err := netip.ParsePrefix(prefix)
+	require.NoError(t, err)
+	trie.Insert(p, value)
+}
+
+func lookup(trie *Trie[string], addr string) string {
+	value, ok := trie.Lookup(netip.MustParseAddr(addr))
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+func TestTrie_LongestPrefixWins(t *testing.T) {
+	trie := New[string]()
+	mustInsert(t, trie, "10.0.0.0/8", "deny")
+	mustInsert(t, trie, "10.1.0.0/16", "allow")
+	mustInsert(t, trie, "10.1.2.3/32", "deny")
+	mustInsert(t, trie, "192.168.0.0/24", "allow")
+
+	assert.Equal(t, "deny", lookup(trie, "10.200.0.1"))
+	assert.Equal(t, "allow", lookup(trie, "10.1.0.1"))
+	assert.Equal(t, "deny", lookup(trie, "10.1.2.3"))
+	assert.Equal(t, "allow", lookup(trie, "192.168.0.255"))
+	assert.Equal(t, "", lookup(trie, "192.168.1.0"))
+	assert.Equal(t, "", lookup(trie, "11.0.0.0"))
+	assert.Equal(t, 4, trie.Len())
+}
+
+func TestTrie_InsertOrderDoesNotMatter(t *testing.T) {
+	trie := New[string]()
+	// More specific first, the /8 has to become their parent
+	mustInsert(t, trie, "10.1.2.0/24", "a")
+	mustInsert(t, trie, "10.3.0.0/16", "b")
+	mustInsert(t, trie, "10.0.0.0/8", "c")
+
+	assert.Equal(t, "a", lookup(trie, "10.1.2.9"))
+	assert.Equal(t, "b", lookup(trie, "10.3.9.9"))
+	assert.Equal(t, "c", lookup(trie, "10.2.0.0"))
+	assert.Equal(t, 3, trie.Len())
+}
+
+func TestTrie_ReplaceValue(t *testing.T) {
+	trie := New[string]()
+	mustInsert(t, trie, "10.0.0.0/8", "a")
+	mustInsert(t, trie, "10.0.0.1/8", "b")
+
+	assert.Equal(t, "b", lookup(trie, "10.9.9.9"))
+	assert.Equal(t, 1, trie.Len())
+}
+
+func TestTrie_IPv6AndMappedAddresses(t *testing.T) {
+	trie := New[string]()
+	mustInsert(t, trie, "2001:db8::/32", "v6")
+	mustInsert(t, trie, "::ffff:203.0.113.0/120", "mapped")
+	mustInsert(t, trie, "0.0.0.0/0", "any4")
+
+	assert.Equal(t, "v6", lookup(trie, "2001:db8:1::1"))
+	assert.Equal(t, "", lookup(trie, "2001:db9::1"))
+	// Mapped prefixes and addresses are treated as IPv4
+	assert.Equal(t, "mapped", lookup(trie, "203.0.113.7"))
+	assert.Equal(t, "mapped", lookup(trie, "::ffff:203.0.113.7"))
+	assert.Equal(t, "any4", lookup(trie, "::ffff:8.8.8.8"))
+	// IPv4 prefixes never match IPv6 addresses
+	assert.Equal(t, "", lookup(trie, "::1"))
+}
+
+func TestTrie_MatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	trie := New[int]()
+	prefixes := make([]netip.Prefix, 0, 2000)
+
+	for i := 0; i < 2000; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+		prefix := netip.PrefixFrom(addr, 8+rnd.Intn(25)).Masked()
+		prefixes = append(prefixes, prefix)
+		trie.Insert(prefix, i)
+	}
+
+	for i := 0; i < 5000; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+
+		want, found := -1, false
+		bestBits := -1
+		for j, prefix := range prefixes {
+			// Later inserts of an equal prefix replace earlier ones
+			if prefix.Contains(addr) && prefix.Bits() >= bestBits {
+				want, found, bestBits = j, true, prefix.Bits()
+			}
+		}
+
+		got, ok := trie.Lookup(addr)
+		require.Equal(t, found, ok, addr.String())
+		if found {
+			require.Equal(t, want, got, addr.String())
+		}
+	}
+}
+
+func BenchmarkTrie_Lookup(b *testing.B) {
+	trie := New[bool]()
+	for i := 0; i < 50000; i++ {
+		trie.Insert(netip.MustParsePrefix(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)), true)
+	}
+	addr := netip.MustParseAddr("10.100.42.7")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Lookup(addr)
+	}
+}
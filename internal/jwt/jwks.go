@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec and okp
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// keys of a JWKS document (RFC 7517), encryption keys are skipped
+func parseJWKS(data []byte) ([]key, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	keys := make([]key, 0, len(set.Keys))
+	for i, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		if jwk.Alg != "" {
+			if _, ok := algorithms[jwk.Alg]; !ok {
+				return nil, fmt.Errorf("invalid jwks key %d (kid %q): unsupported alg %s", i, jwk.Kid, jwk.Alg)
+			}
+		}
+
+		k, err := jwk.key()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwks key %d (kid %q): %w", i, jwk.Kid, err)
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks contains no signing keys")
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) key() (key, error) {
+	k := key{kid: jwk.Kid, alg: jwk.Alg}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return key{}, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return key{}, fmt.Errorf("invalid e")
+		}
+		if n.BitLen() < 2048 {
+			return key{}, fmt.Errorf("rsa keys must be at least 2048 bits, got %d", n.BitLen())
+		}
+		k.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		pub, err := ecdsaKey(jwk.Crv, jwk.X, jwk.Y)
+		if err != nil {
+			return key{}, err
+		}
+		k.public = pub
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return key{}, fmt.Errorf("unsupported OKP curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key{}, fmt.Errorf("invalid Ed25519 x")
+		}
+		k.public = ed25519.PublicKey(x)
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(secret) == 0 {
+			return key{}, fmt.Errorf("invalid k")
+		}
+		k.secret = secret
+
+	default:
+		return key{}, fmt.Errorf("unsupported kty %q", jwk.Kty)
+	}
+
+	return k, nil
+}
+
+func ecdsaKey(crv, xParam, yParam string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported EC curve %q", crv)
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	x, errX := base64.RawURLEncoding.DecodeString(xParam)
+	y, errY := base64.RawURLEncoding.DecodeString(yParam)
+	if errX != nil || errY != nil || len(x) != size || len(y) != size {
+		return nil, fmt.Errorf("invalid EC coordinates")
+	}
+
+	// uncompressed point, rejected when it isn't on the curve
+	pub, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, append(x, y...)...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC point for curve %s: %w", crv, err)
+	}
+	return pub, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,221 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed            = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrExpired              = errors.New("token expired")
+	ErrNotValidYet          = errors.New("token not valid yet")
+)
+
+// allowed clock difference to the issuer for exp and nbf
+const clockSkew = 30 * time.Second
+
+type algorithm struct {
+	hash crypto.Hash
+	// key type that can verify it
+	family string
+	// ecdsa only, byte size of r and s
+	curveBytes int
+}
+
+var algorithms = map[string]algorithm{
+	"HS256": {crypto.SHA256, "hmac", 0},
+	"HS384": {crypto.SHA384, "hmac", 0},
+	"HS512": {crypto.SHA512, "hmac", 0},
+	"RS256": {crypto.SHA256, "rsa", 0},
+	"RS384": {crypto.SHA384, "rsa", 0},
+	"RS512": {crypto.SHA512, "rsa", 0},
+	"PS256": {crypto.SHA256, "rsa-pss", 0},
+	"PS384": {crypto.SHA384, "rsa-pss", 0},
+	"PS512": {crypto.SHA512, "rsa-pss", 0},
+	"ES256": {crypto.SHA256, "ecdsa", 32},
+	"ES384": {crypto.SHA384, "ecdsa", 48},
+	"ES512": {crypto.SHA512, "ecdsa", 66},
+	"EdDSA": {0, "ed25519", 0},
+}
+
+type key struct {
+	kid string
+	// restricts the key to one algorithm when set (jwks "alg")
+	alg    string
+	secret []byte
+	public crypto.PublicKey
+}
+
+// Verifier checks JWT signatures (HMAC secrets and JWKS public keys) and the time claims.
+// It never calls out to the network, keys are loaded once when the config is built.
+type Verifier struct {
+	keys []key
+}
+
+// NewVerifier takes the accepted HMAC secrets (several during a rotation) and the content of a
+// JWKS file, either may be empty but not both.
+func NewVerifier(hmacSecrets []string, jwks []byte) (*Verifier, error) {
+	v := &Verifier{}
+
+	for _, secret := range hmacSecrets {
+		if secret == "" {
+			return nil, fmt.Errorf("hmac secret cannot be empty")
+		}
+		v.keys = append(v.keys, key{secret: []byte(secret)})
+	}
+
+	if len(jwks) > 0 {
+		keys, err := parseJWKS(jwks)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no verification keys configured")
+	}
+
+	return v, nil
+}
+
+// Verify checks the signature, exp and nbf of a compact JWS and returns its claims.
+// Numbers are returned as json.Number.
+func (v *Verifier) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		// "none" ends up here as well
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.verifySignature(header.Alg, header.Kid, alg, signed, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if exp, ok := numericDate(claims["exp"]); ok && !now.Before(exp.Add(clockSkew)) {
+		return nil, ErrExpired
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, ErrNotValidYet
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) verifySignature(algName, kid string, alg algorithm, signed, signature []byte) bool {
+	var digest []byte
+	if alg.hash != 0 {
+		h := alg.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	for _, k := range v.keys {
+		// a kid in the token only selects keys with the same kid, keys without kid always qualify
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != algName {
+			continue
+		}
+
+		switch alg.family {
+		case "hmac":
+			if k.secret == nil {
+				continue
+			}
+			mac := hmac.New(alg.hash.New, k.secret)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case "rsa":
+			if pub, ok := k.public.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(pub, alg.hash, digest, signature) == nil {
+				return true
+			}
+		case "rsa-pss":
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: alg.hash}
+			if pub, ok := k.public.(*rsa.PublicKey); ok && rsa.VerifyPSS(pub, alg.hash, digest, signature, opts) == nil {
+				return true
+			}
+		case "ecdsa":
+			pub, ok := k.public.(*ecdsa.PublicKey)
+			if !ok || (pub.Curve.Params().BitSize+7)/8 != alg.curveBytes || len(signature) != 2*alg.curveBytes {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:alg.curveBytes])
+			s := new(big.Int).SetBytes(signature[alg.curveBytes:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return true
+			}
+		case "ed25519":
+			if pub, ok := k.public.(ed25519.PublicKey); ok && ed25519.Verify(pub, signed, signature) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// exp/nbf as seconds since epoch, fractions allowed
+func numericDate(value interface{}) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
@@ -0,0 +1,217 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var b64 = base64.RawURLEncoding
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return b64.EncodeToString(data)
+}
+
+// signs header.claims with signer, which gets the signing input
+func sign(t *testing.T, header, claims map[string]interface{}, signer func([]byte) []byte) string {
+	input := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	return input + "." + b64.EncodeToString(signer([]byte(input)))
+}
+
+func hmacSigner(secret string) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(crypto.SHA256.New, []byte(secret))
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func digest(hash crypto.Hash, input []byte) []byte {
+	h := hash.New()
+	h.Write(input)
+	return h.Sum(nil)
+}
+
+func jwksOf(t *testing.T, keys ...map[string]interface{}) []byte {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	return data
+}
+
+func TestVerify_HMAC(t *testing.T) {
+	v, err := NewVerifier([]string{"old-secret", "new-secret"}, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	claims := map[string]interface{}{"sub": "user-1", "org_id": 42, "exp": now.Add(time.Hour).Unix()}
+
+	// Both secrets of a rotation are accepted
+	for _, secret := range []string{"old-secret", "new-secret"} {
+		got, err := v.Verify(sign(t, header, claims, hmacSigner(secret)), now)
+		require.NoError(t, err)
+		assert.Equal(t, "user-1", got["sub"])
+		assert.Equal(t, json.Number("42"), got["org_id"])
+	}
+
+	_, err = v.Verify(sign(t, header, claims, hmacSigner("other-secret")), now)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestVerify_TimeClaims(t *testing.T) {
+	v, err := NewVerifier([]string{"secret"}, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	header := map[string]interface{}{"alg": "HS256"}
+
+	_, err = v.Verify(sign(t, header, map[string]interface{}{"sub": "a", "exp": now.Add(-time.Minute).Unix()},
+		hmacSigner("secret")), now)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	_, err = v.Verify(sign(t, header, map[string]interface{}{"sub": "a", "nbf": now.Add(time.Minute).Unix()},
+		hmacSigner("secret")), now)
+	assert.ErrorIs(t, err, ErrNotValidYet)
+
+	// Within the allowed clock skew
+	_, err = v.Verify(sign(t, header, map[string]interface{}{"sub": "a", "exp": now.Add(-10 * time.Second).Unix()},
+		hmacSigner("secret")), now)
+	assert.NoError(t, err)
+}
+
+func TestVerify_RejectsNoneAndMalformed(t *testing.T) {
+	v, err := NewVerifier([]string{"secret"}, nil)
+	require.NoError(t, err)
+
+	unsigned := encodeSegment(t, map[string]interface{}{"alg": "none"}) + "." +
+		encodeSegment(t, map[string]interface{}{"sub": "admin"}) + "."
+	_, err = v.Verify(unsigned, time.Now())
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+
+	for _, token := range []string{"", "abc", "a.b", "a.b.c.d", "!!.??.**"} {
+		_, err = v.Verify(token, time.Now())
+		assert.ErrorIs(t, err, ErrMalformed, token)
+	}
+
+	// Claims changed after signing
+	parts := strings.Split(sign(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "a"},
+		hmacSigner("secret")), ".")
+	parts[1] = encodeSegment(t, map[string]interface{}{"sub": "b"})
+	_, err = v.Verify(strings.Join(parts, "."), time.Now())
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestVerify_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ecPoint, err := ecKey.PublicKey.Bytes()
+	require.NoError(t, err)
+
+	jwks := jwksOf(t,
+		map[string]interface{}{
+			"kty": "RSA", "kid": "rsa-1",
+			"n": b64.EncodeToString(rsaKey.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		map[string]interface{}{
+			"kty": "EC", "kid": "ec-1", "crv": "P-256", "alg": "ES256",
+			"x": b64.EncodeToString(ecPoint[1:33]), "y": b64.EncodeToString(ecPoint[33:]),
+		},
+		map[string]interface{}{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": b64.EncodeToString(edPublic)},
+		map[string]interface{}{"kty": "RSA", "kid": "enc-1", "use": "enc"},
+	)
+
+	v, err := NewVerifier(nil, jwks)
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "user-1"}
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		signer func([]byte) []byte
+	}{
+		{"RS256", map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, func(input []byte) []byte {
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(crypto.SHA256, input))
+			require.NoError(t, err)
+			return sig
+		}},
+		{"PS384", map[string]interface{}{"alg": "PS384"}, func(input []byte) []byte {
+			sig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA384, digest(crypto.SHA384, input),
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			require.NoError(t, err)
+			return sig
+		}},
+		{"ES256", map[string]interface{}{"alg": "ES256", "kid": "ec-1"}, func(input []byte) []byte {
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest(crypto.SHA256, input))
+			require.NoError(t, err)
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}},
+		{"EdDSA", map[string]interface{}{"alg": "EdDSA", "kid": "ed-1"}, func(input []byte) []byte {
+			return ed25519.Sign(edPrivate, input)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Verify(sign(t, tt.header, claims, tt.signer), time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, "user-1", got["sub"])
+		})
+	}
+
+	t.Run("WrongKid", func(t *testing.T) {
+		header := map[string]interface{}{"alg": "EdDSA", "kid": "rsa-1"}
+		_, err := v.Verify(sign(t, header, claims, func(input []byte) []byte {
+			return ed25519.Sign(edPrivate, input)
+		}), time.Now())
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("HMACWithoutSecrets", func(t *testing.T) {
+		// The public key can't be used as an hmac secret (algorithm confusion)
+		header := map[string]interface{}{"alg": "HS256", "kid": "rsa-1"}
+		_, err := v.Verify(sign(t, header, claims, hmacSigner(string(rsaKey.N.Bytes()))), time.Now())
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	})
+}
+
+func TestNewVerifier_InvalidKeys(t *testing.T) {
+	_, err := NewVerifier(nil, nil)
+	assert.Error(t, err)
+
+	_, err = NewVerifier([]string{""}, nil)
+	assert.Error(t, err)
+
+	_, err = NewVerifier(nil, []byte("not json"))
+	assert.Error(t, err)
+
+	_, err = NewVerifier(nil, jwksOf(t, map[string]interface{}{"kty": "EC", "crv": "P-256",
+		"x": b64.EncodeToString(make([]byte, 32)), "y": b64.EncodeToString(make([]byte, 32))}))
+	assert.Error(t, err, "point not on curve")
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = NewVerifier(nil, jwksOf(t, map[string]interface{}{"kty": "RSA",
+		"n": b64.EncodeToString(small.N.Bytes()), "e": "AQAB"}))
+	assert.Error(t, err, "rsa key too small")
+}
@@ -0,0 +1,109 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+)
+
+// adaptiveLimit is the controller of the adaptive global limit, per proxy instance. The zero
+// value is ready to use.
+type adaptiveLimit struct {
+	mu sync.Mutex
+	// effective limit, 0 until first used (starts at the ceiling)
+	limit float64
+	// current interval
+	intervalStart time.Time
+	responses     int
+	failures      int
+	latency       time.Duration
+}
+
+// at returns the effective limit at now, closing the current interval once it's over
+func (a *adaptiveLimit) at(cfg *config.Adaptive, now time.Time) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.adjust(cfg, now)
+	return a.limit
+}
+
+func (a *adaptiveLimit) observe(cfg *config.Adaptive, now time.Time, latency time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.adjust(cfg, now)
+	a.responses++
+	a.latency += latency
+	if failed {
+		a.failures++
+	}
+}
+
+// expects a.mu to be locked
+func (a *adaptiveLimit) adjust(cfg *config.Adaptive, now time.Time) {
+	limit := a.limit
+	if limit == 0 {
+		limit = float64(cfg.MaxLimit)
+	}
+
+	if a.intervalStart.IsZero() {
+		a.intervalStart = now
+	} else if elapsed := now.Sub(a.intervalStart); elapsed >= cfg.Interval.Duration {
+		intervals := int64(elapsed / cfg.Interval.Duration)
+
+		degraded := false
+		if a.responses > 0 {
+			averageLatency := a.latency / time.Duration(a.responses)
+			errorRate := float64(a.failures) / float64(a.responses)
+			degraded = averageLatency > cfg.TargetLatency.Duration || errorRate > cfg.MaxErrorRate
+		}
+
+		// a few slow responses aren't enough to shed load
+		if !degraded {
+			limit += float64(cfg.Increase)
+		} else if a.responses >= cfg.MinSamples {
+			limit *= cfg.DecreaseFactor
+		}
+		// the intervals after it had no responses, nothing says the backend is still struggling:
+		// each one is a healthy step so the limit recovers at the same pace with or without traffic
+		limit += float64(intervals-1) * float64(cfg.Increase)
+
+		a.intervalStart = a.intervalStart.Add(time.Duration(intervals) * cfg.Interval.Duration)
+		a.responses, a.failures, a.latency = 0, 0, 0
+	}
+
+	// a reload can move the floor and ceiling
+	limit = min(max(limit, float64(cfg.MinLimit)), float64(cfg.MaxLimit))
+	if limit == a.limit {
+		return
+	}
+	a.limit = limit
+
+	//==========================Metrics=============================
+	metrics.AdaptiveGlobalLimit.Set(a.limit)
+	//==============================================================
+}
+
+// ObserveResponse feeds a backend response to the adaptive global limit: how long until the
+// backend answered and whether it failed (5xx or no answer). Nothing happens unless the global
+// limit is adaptive.
+func (rl *RateLimiter) ObserveResponse(global *config.Global, latency time.Duration, failed bool) {
+	if !global.Enabled || !global.Adaptive.Enabled {
+		return
+	}
+	rl.adaptive.observe(&global.Adaptive, time.Now(), latency, failed)
+}
+
+// adaptGlobal scales the global limit in effect (algoConfig, a schedule's when one is active)
+// by the adaptive limit's share of the configured limit
+func (rl *RateLimiter) adaptGlobal(global *config.Global, algoConfig config.AlgorithmConfig,
+	now time.Time) config.AlgorithmConfig {
+	baseLimit := global.BaseLimit()
+	if !global.Adaptive.Enabled || baseLimit <= 0 {
+		return algoConfig
+	}
+	return algoConfig.Scaled(rl.adaptive.at(&global.Adaptive, now) / float64(baseLimit))
+}
@@ -0,0 +1,148 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adaptiveTestConfig() *config.Adaptive {
+	return &config.Adaptive{
+		Enabled:        true,
+		MinLimit:       10,
+		MaxLimit:       100,
+		TargetLatency:  &config.Duration{Duration: 100 * time.Millisecond},
+		MaxErrorRate:   0.1,
+		Interval:       &config.Duration{Duration: 5 * time.Second},
+		MinSamples:     5,
+		Increase:       10,
+		DecreaseFactor: 0.5,
+	}
+}
+
+func observeInterval(a *adaptiveLimit, cfg *config.Adaptive, start time.Time, responses, failures int,
+	latency time.Duration) {
+	for i := 0; i < responses; i++ {
+		a.observe(cfg, start, latency, i < failures)
+	}
+}
+
+func TestAdaptiveLimit_DecreasesAndRecovers(t *testing.T) {
+	cfg := adaptiveTestConfig()
+	a := &adaptiveLimit{}
+	now := time.Now()
+
+	// Starts at the ceiling
+	assert.Equal(t, 100.0, a.at(cfg, now))
+
+	// Slow backend
+	observeInterval(a, cfg, now, 10, 0, 300*time.Millisecond)
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 50.0, a.at(cfg, now))
+
+	// Failing backend
+	observeInterval(a, cfg, now, 10, 2, 10*time.Millisecond)
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 25.0, a.at(cfg, now))
+
+	// Never below the floor
+	for i := 0; i < 5; i++ {
+		observeInterval(a, cfg, now, 10, 10, 10*time.Millisecond)
+		now = now.Add(cfg.Interval.Duration)
+	}
+	assert.Equal(t, 10.0, a.at(cfg, now))
+
+	// Healthy again, grows back additively up to the ceiling
+	observeInterval(a, cfg, now, 10, 0, 10*time.Millisecond)
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 20.0, a.at(cfg, now))
+	for i := 0; i < 20; i++ {
+		now = now.Add(cfg.Interval.Duration)
+		a.at(cfg, now)
+	}
+	assert.Equal(t, 100.0, a.at(cfg, now))
+}
+
+func TestAdaptiveLimit_MinSamplesAndInterval(t *testing.T) {
+	cfg := adaptiveTestConfig()
+	a := &adaptiveLimit{}
+	now := time.Now()
+	a.at(cfg, now)
+
+	// Too few slow responses don't decrease the limit
+	observeInterval(a, cfg, now, 4, 4, time.Second)
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 100.0, a.at(cfg, now))
+
+	// Only adjusted once the interval is over
+	observeInterval(a, cfg, now, 10, 10, time.Second)
+	assert.Equal(t, 100.0, a.at(cfg, now.Add(time.Second)))
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 50.0, a.at(cfg, now))
+
+	// A reload moving the ceiling applies right away
+	cfg.MaxLimit = 40
+	assert.Equal(t, 40.0, a.at(cfg, now))
+}
+
+func TestAdaptiveLimit_RecoversWithoutTraffic(t *testing.T) {
+	cfg := adaptiveTestConfig()
+	a := &adaptiveLimit{}
+	now := time.Now()
+	a.at(cfg, now)
+
+	observeInterval(a, cfg, now, 10, 10, time.Second)
+	now = now.Add(cfg.Interval.Duration)
+	assert.Equal(t, 50.0, a.at(cfg, now))
+
+	// Three intervals without a request are three increases
+	now = now.Add(3*cfg.Interval.Duration + time.Second)
+	assert.Equal(t, 80.0, a.at(cfg, now))
+
+	// The interval started on the grid, not at the request
+	now = now.Add(cfg.Interval.Duration - time.Second)
+	assert.Equal(t, 90.0, a.at(cfg, now))
+
+	// A long idle period stops at the ceiling
+	now = now.Add(time.Hour)
+	assert.Equal(t, 100.0, a.at(cfg, now))
+}
+
+func TestCheckLimits_AdaptiveGlobalLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(10, 100, 100)
+		limiterConfig.Global.Adaptive = *adaptiveTestConfig()
+		limiterConfig.Global.Adaptive.MinLimit = 4
+		limiterConfig.Global.Adaptive.MaxLimit = 10
+
+		// The backend degrades, the global limit is halved
+		start := time.Now()
+		rl.adaptive.at(&limiterConfig.Global.Adaptive, start)
+		observeInterval(&rl.adaptive, &limiterConfig.Global.Adaptive, start, 10, 10, time.Second)
+		rl.adaptive.intervalStart = start.Add(-limiterConfig.Global.Adaptive.Interval.Duration)
+
+		for i := 0; i < 5; i++ {
+			result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, int64(4-i), result.Levels[config.GlobalLevel].Remaining)
+		}
+
+		// Low reputation tenants are shed at the effective limit
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Levels[config.GlobalLevel].Allowed)
+
+		// Resizing keeps the window's count, the soft denied request wasn't counted
+		limiterConfig.Global.Adaptive.MinLimit = 10
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Levels[config.GlobalLevel].Allowed)
+		assert.Equal(t, int64(4), result.Levels[config.GlobalLevel].Remaining)
+	})
+}
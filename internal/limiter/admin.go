@@ -0,0 +1,166 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// LevelState is a tenant's state on one limit level, as its next request would see it.
+type LevelState struct {
+	Level config.LimitLevelType
+	// endpoint rule of a per_endpoint level
+	Path      string
+	Methods   []string
+	Algorithm string
+	// active schedule of the level, empty when the base limit applies
+	Schedule string
+	Result   *LimitResult
+}
+
+type TenantReputation struct {
+	TenantKey  string
+	Reputation *Reputation
+}
+
+// InspectTenant returns the per-tenant, quota and per-endpoint state of a tenant (whichever are
+// enabled, one entry per endpoint rule) without consuming anything. A level whose limit changed
+// since the tenant's last request is reported as it will start over.
+func (rl *RateLimiter) InspectTenant(ctx context.Context, tenantKey, plan string,
+	limiterConfig *config.RateLimiterConfig) ([]LevelState, error) {
+	var states []LevelState
+	now := time.Now()
+
+	// one call per level, the endpoint levels would share a result in a single admission
+	inspect := func(level LevelCheck, path string, methods []string, schedules config.Schedules) error {
+		result, err := rl.peekLevel(ctx, level)
+		if err != nil {
+			return err
+		}
+		// remaining after the peeked request, which wasn't made
+		if result.Allowed {
+			result.Remaining++
+		}
+		state := LevelState{Level: level.Level, Path: path, Methods: methods,
+			Algorithm: level.Algorithm.Algorithm, Result: result}
+		if schedule := schedules.Active(now); schedule != nil {
+			state.Schedule = schedule.String()
+		}
+		states = append(states, state)
+		return nil
+	}
+
+	if limiterConfig.PerTenant.Enabled {
+		perTenant := &limiterConfig.PerTenant
+		level, err := newLevelCheck(config.PerTenantLevel, constructRedisKey(config.PerTenantLevel, "", []string{}, tenantKey),
+			perTenant.AlgorithmFor(plan, now), perTenant.Schedules, perTenant)
+		if err != nil {
+			return nil, err
+		}
+		if err := inspect(level, "", nil, perTenant.Schedules); err != nil {
+			return nil, err
+		}
+	}
+
+	if limiterConfig.Quota.Enabled {
+		level := newQuotaCheck(tenantKey, limiterConfig.Quota.ConfigFor(plan), now)
+		if err := inspect(level, "", nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range limiterConfig.PerEndpoint.Rules {
+		rule := &limiterConfig.PerEndpoint.Rules[i]
+		if rule.Bypass {
+			continue
+		}
+
+		level, err := newLevelCheck(config.PerEndpointLevel,
+			constructRedisKey(config.PerEndpointLevel, rule.Path, rule.Methods, tenantKey),
+			rule.AlgorithmFor(plan, now), rule.Schedules, rule)
+		if err != nil {
+			return nil, err
+		}
+		if err := inspect(level, rule.Path, rule.Methods, rule.Schedules); err != nil {
+			return nil, err
+		}
+	}
+
+	return states, nil
+}
+
+// ResetTenantLimits clears the per-tenant, quota and per-endpoint state of a tenant,
+// its next request starts with full limits.
+func (rl *RateLimiter) ResetTenantLimits(ctx context.Context, tenantKey string,
+	limiterConfig *config.RateLimiterConfig) error {
+	keys := []string{
+		constructRedisKey(config.PerTenantLevel, "", []string{}, tenantKey),
+		constructQuotaKey(tenantKey),
+	}
+	for _, rule := range limiterConfig.PerEndpoint.Rules {
+		if !rule.Bypass {
+			keys = append(keys, constructRedisKey(config.PerEndpointLevel, rule.Path, rule.Methods, tenantKey))
+		}
+	}
+
+	return rl.store.Delete(ctx, keys...)
+}
+
+func (rl *RateLimiter) ResetTenantReputation(ctx context.Context, tenantKey string) error {
+	return rl.store.Delete(ctx, constructReputationKey(tenantKey))
+}
+
+// BanTenant denies every request of a tenant for the duration, whatever its limits and reputation.
+func (rl *RateLimiter) BanTenant(ctx context.Context, tenantKey string, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("ban duration must be positive, got %s", duration)
+	}
+	return rl.store.SetBan(ctx, tenantKey, duration)
+}
+
+func (rl *RateLimiter) UnbanTenant(ctx context.Context, tenantKey string) error {
+	return rl.store.Delete(ctx, constructBanKey(tenantKey))
+}
+
+// GetTenantBan returns the remaining ban of a tenant, 0 when it isn't banned.
+func (rl *RateLimiter) GetTenantBan(ctx context.Context, tenantKey string) (time.Duration, error) {
+	return rl.store.GetBan(ctx, tenantKey)
+}
+
+// TopViolators returns up to limit tenants with the most violations, lowest score first on ties.
+// Only tenants whose reputation hasn't expired yet are known.
+func (rl *RateLimiter) TopViolators(ctx context.Context, limit int) ([]TenantReputation, error) {
+	var tenants []TenantReputation
+	err := rl.store.ScanReputations(ctx, func(tenantKey string, reputation *Reputation) {
+		if reputation.ViolationCount > 0 {
+			tenants = append(tenants, TenantReputation{TenantKey: tenantKey, Reputation: reputation})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		a, b := tenants[i].Reputation, tenants[j].Reputation
+		if a.ViolationCount != b.ViolationCount {
+			return a.ViolationCount > b.ViolationCount
+		}
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		return tenants[i].TenantKey < tenants[j].TenantKey
+	})
+
+	if len(tenants) > limit {
+		tenants = tenants[:limit]
+	}
+	return tenants, nil
+}
+
+func constructBanKey(tenantKey string) string {
+	//ctrl:ban:{user123}, same hash slot as the tenant's limiter keys
+	return fmt.Sprintf("ctrl:ban:{%s}", tenantKey)
+}
@@ -0,0 +1,188 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adminTestConfig() *config.RateLimiterConfig {
+	limiterConfig, rule := quotaTestConfig(100)
+	limiterConfig.PerTenant.AlgorithmConfig = fixedWindowConfig(10)
+	rule.AlgorithmConfig = fixedWindowConfig(5)
+	limiterConfig.PerEndpoint.Rules = []config.EndpointRule{
+		*rule,
+		{Path: "/health", Bypass: true},
+		{Path: "*", AlgorithmConfig: fixedWindowConfig(3)},
+	}
+	return limiterConfig
+}
+
+func TestInspectTenant_DoesNotConsume(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig := adminTestConfig()
+		rule := &limiterConfig.PerEndpoint.Rules[0]
+
+		for i := 0; i < 2; i++ {
+			_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			states, err := rl.InspectTenant(ctx, "user1", "", limiterConfig)
+			require.NoError(t, err)
+			require.Len(t, states, 4)
+
+			assert.Equal(t, config.PerTenantLevel, states[0].Level)
+			assert.Equal(t, int64(8), states[0].Result.Remaining)
+			assert.Equal(t, config.QuotaLevel, states[1].Level)
+			assert.Equal(t, int64(98), states[1].Result.Remaining)
+
+			assert.Equal(t, "/api/test", states[2].Path)
+			assert.Equal(t, []string{"GET"}, states[2].Methods)
+			assert.Equal(t, string(config.FixedWindow), states[2].Algorithm)
+			assert.Equal(t, int64(3), states[2].Result.Remaining)
+
+			// untouched rule, bypass rules are skipped
+			assert.Equal(t, "*", states[3].Path)
+			assert.Equal(t, int64(3), states[3].Result.Remaining)
+		}
+
+		reputation, err := rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), reputation.GoodRequests, "inspection doesn't count as a request")
+	})
+}
+
+func TestInspectTenant_ExhaustedLevel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig := adminTestConfig()
+		rule := &limiterConfig.PerEndpoint.Rules[2]
+
+		for i := 0; i < 3; i++ {
+			_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+		}
+
+		states, err := rl.InspectTenant(ctx, "user1", "", limiterConfig)
+		require.NoError(t, err)
+		assert.False(t, states[3].Result.Allowed)
+		assert.Greater(t, states[3].Result.RetryAfter, time.Duration(0))
+	})
+}
+
+func TestResetTenantLimits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig := adminTestConfig()
+		rule := &limiterConfig.PerEndpoint.Rules[2]
+
+		for i := 0; i < 4; i++ {
+			_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+		}
+		_, err := rl.CheckLimits(ctx, "user2", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+
+		require.NoError(t, rl.ResetTenantLimits(ctx, "user1", limiterConfig))
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(9), result.Levels[config.PerTenantLevel].Remaining)
+		assert.Equal(t, int64(99), result.Levels[config.QuotaLevel].Remaining)
+		assert.Equal(t, int64(2), result.Levels[config.PerEndpointLevel].Remaining)
+
+		// other tenants and the reputation are kept
+		reputation, err := rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), reputation.ViolationCount)
+
+		states, err := rl.InspectTenant(ctx, "user2", "", limiterConfig)
+		require.NoError(t, err)
+		assert.Equal(t, int64(9), states[0].Result.Remaining)
+
+		require.NoError(t, rl.ResetTenantReputation(ctx, "user1"))
+		reputation, err = rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, 1.0, reputation.Score)
+		assert.Equal(t, int64(0), reputation.ViolationCount)
+	})
+}
+
+func TestBanTenant(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig := adminTestConfig()
+		rule := &limiterConfig.PerEndpoint.Rules[0]
+
+		assert.Error(t, rl.BanTenant(ctx, "user1", 0))
+		require.NoError(t, rl.BanTenant(ctx, "user1", time.Hour))
+
+		bannedFor, err := rl.GetTenantBan(ctx, "user1")
+		require.NoError(t, err)
+		assert.InDelta(t, time.Hour.Seconds(), bannedFor.Seconds(), 1)
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Empty(t, result.DeniedLevel)
+		assert.InDelta(t, time.Hour.Seconds(), result.BannedFor.Seconds(), 1)
+
+		// nothing was consumed or counted while banned
+		reputation, err := rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), reputation.ViolationCount)
+		assert.Equal(t, int64(0), reputation.GoodRequests)
+
+		result, err = rl.CheckLimits(ctx, "user2", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Zero(t, result.BannedFor)
+
+		require.NoError(t, rl.UnbanTenant(ctx, "user1"))
+		bannedFor, err = rl.GetTenantBan(ctx, "user1")
+		require.NoError(t, err)
+		assert.Zero(t, bannedFor)
+
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(9), result.Levels[config.PerTenantLevel].Remaining)
+	})
+}
+
+func TestTopViolators(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+
+		violations := map[string]int{"clean": 0, "bot": 5, "abuser": 3, "mild": 1}
+		for tenantKey, count := range violations {
+			_, err := rl.UpdateReputation(ctx, tenantKey, false)
+			require.NoError(t, err)
+			for i := 0; i < count; i++ {
+				_, err := rl.UpdateReputation(ctx, tenantKey, true)
+				require.NoError(t, err)
+			}
+		}
+
+		top, err := rl.TopViolators(ctx, 2)
+		require.NoError(t, err)
+		require.Len(t, top, 2)
+		assert.Equal(t, "bot", top[0].TenantKey)
+		assert.Equal(t, int64(5), top[0].Reputation.ViolationCount)
+		assert.Equal(t, "abuser", top[1].TenantKey)
+		assert.Greater(t, top[1].Reputation.TTL, int64(0))
+
+		// tenants without violations aren't listed
+		top, err = rl.TopViolators(ctx, 10)
+		require.NoError(t, err)
+		assert.Len(t, top, 3)
+	})
+}
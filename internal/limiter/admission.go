@@ -0,0 +1,307 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// ErrCostExceedsLimit is returned for a request costing more than a level can ever admit, it would
+// be rejected whatever the state so retrying can't help.
+var ErrCostExceedsLimit = errors.New("request cost exceeds the limit")
+
+// LevelCheck is one limit level of an admission.
+type LevelCheck struct {
+	Level      config.LimitLevelType
+	Key        string
+	Algorithm  config.AlgorithmConfig
+	ConfigHash string
+	// numeric parameters of the algorithm, see algorithmParams
+	Params [3]float64
+	// concurrency levels: id of the slot the request takes, drawn by Admit
+	LeaseID string
+	// consumed at admission like any level, given back by ReleaseReservation when the backend's
+	// response doesn't count, for endpoint rules with count_on: response
+	Reserved bool
+}
+
+// name of the lua (and memory store) function evaluating the level
+func (l LevelCheck) function() string {
+	if config.AlgorithmType(l.Algorithm.Algorithm) == config.LeakyBucket && l.Algorithm.Mode == config.LeakyBucketShape {
+		return leakyBucketShapeAlgorithm
+	}
+	return l.Algorithm.Algorithm
+}
+
+type AdmissionRequest struct {
+	Levels []LevelCheck
+	// reputation is read and updated in the same call, empty skips it
+	TenantKey string
+	// reputation model of TenantKey, the defaults when nil. Disabled, the reputation is neither
+	// read nor updated and the global level rejects like any other (bans still apply)
+	Reputation *config.Reputation
+	// every level is evaluated but nothing is consumed or denied and reputation isn't tracked
+	Peek bool
+	// units the request consumes on every level (concurrency: one slot), 0 is 1
+	Cost int64
+}
+
+func (r *AdmissionRequest) units() float64 {
+	return float64(max(1, r.Cost))
+}
+
+type AdmissionResult struct {
+	Allowed bool
+	// level that rejected the request, empty when allowed
+	DeniedLevel config.LimitLevelType
+	// results of the evaluated levels, levels after the denied one are missing
+	Levels map[config.LimitLevelType]*LimitResult
+	// nil when the request didn't track reputation
+	Reputation *Reputation
+	// remaining ban of the tenant, a banned request is denied before any level is checked
+	BannedFor time.Duration
+
+	// unix milliseconds the store evaluated the levels at
+	admittedAt float64
+	// units the request counts on every level
+	cost int64
+	// the request of an allowed admission, what Refund gives back
+	consumed *AdmissionRequest
+}
+
+// CheckLimits evaluates global, tenant and endpoint limits (whichever are enabled)
+// and the tenant reputation in a single atomic round trip. The tenant and endpoint
+// limits are the overrides of the tenant's plan when it has them. cost is the number
+// of units the request consumes on every level, see config.Cost. A cost larger than a level's
+// capacity fails with ErrCostExceedsLimit before anything is evaluated.
+func (rl *RateLimiter) CheckLimits(ctx context.Context, tenantKey, plan string,
+	limiterConfig *config.RateLimiterConfig, endpointConfig *config.EndpointRule, cost int64) (*AdmissionResult, error) {
+	req, err := rl.admissionRequest(tenantKey, plan, limiterConfig, endpointConfig, cost)
+	if err != nil {
+		return nil, err
+	}
+	return rl.Admit(ctx, req)
+}
+
+// PeekLimits evaluates the levels CheckLimits would in one call, without consuming or denying
+// anything and without reputation tracking. Every level is evaluated, dry run mode reports them.
+func (rl *RateLimiter) PeekLimits(ctx context.Context, tenantKey, plan string,
+	limiterConfig *config.RateLimiterConfig, endpointConfig *config.EndpointRule, cost int64) (*AdmissionResult, error) {
+	req, err := rl.admissionRequest(tenantKey, plan, limiterConfig, endpointConfig, cost)
+	if err != nil {
+		return nil, err
+	}
+	req.Peek = true
+	return rl.Admit(ctx, req)
+}
+
+func (rl *RateLimiter) admissionRequest(tenantKey, plan string, limiterConfig *config.RateLimiterConfig,
+	endpointConfig *config.EndpointRule, cost int64) (*AdmissionRequest, error) {
+	levels := make([]LevelCheck, 0, 3)
+	// every level is resolved at the same instant, schedules and quota periods included
+	now := time.Now()
+
+	if limiterConfig.Global.Enabled {
+		global := &limiterConfig.Global
+		level, err := newLevelCheck(config.GlobalLevel, constructRedisKey(config.GlobalLevel, "", []string{}, ""),
+			global.AlgorithmAt(now), global.Schedules, global)
+		if err != nil {
+			return nil, err
+		}
+		// the configured capacity, a shrunk adaptive limit grows back
+		if err := checkCost(level, level.Algorithm.MaxCost(), cost); err != nil {
+			return nil, err
+		}
+		if global.Adaptive.Enabled {
+			// the hash is the configured limit's, resizing keeps the state
+			level.Algorithm = rl.adaptGlobal(global, level.Algorithm, now)
+			if level.Params, err = algorithmParams(level.Algorithm); err != nil {
+				return nil, err
+			}
+		}
+		levels = append(levels, level)
+	}
+
+	if limiterConfig.PerTenant.Enabled {
+		perTenant := &limiterConfig.PerTenant
+		level, err := newLevelCheck(config.PerTenantLevel, constructRedisKey(config.PerTenantLevel, "", []string{}, tenantKey),
+			perTenant.AlgorithmFor(plan, now), perTenant.Schedules, perTenant)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCost(level, level.Algorithm.MaxCost(), cost); err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	if limiterConfig.Quota.Enabled {
+		quotaConfig := limiterConfig.Quota.ConfigFor(plan)
+		level := newQuotaCheck(tenantKey, quotaConfig, now)
+		if err := checkCost(level, int64(quotaConfig.Limit), cost); err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	if endpointConfig != nil && !endpointConfig.Bypass {
+		level, err := newLevelCheck(config.PerEndpointLevel,
+			constructRedisKey(config.PerEndpointLevel, endpointConfig.Path, endpointConfig.Methods, tenantKey),
+			endpointConfig.AlgorithmFor(plan, now), endpointConfig.Schedules, endpointConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCost(level, level.Algorithm.MaxCost(), cost); err != nil {
+			return nil, err
+		}
+		level.Reserved = endpointConfig.CountOn == config.CountOnResponse
+		levels = append(levels, level)
+	}
+
+	return &AdmissionRequest{Levels: levels, TenantKey: tenantKey, Cost: cost,
+		Reputation: limiterConfig.Reputation.Model()}, nil
+}
+
+// a level never admits more than ceiling units at once (see config.AlgorithmConfig.MaxCost),
+// 0 is no bound
+func checkCost(level LevelCheck, ceiling, cost int64) error {
+	if ceiling > 0 && max(1, cost) > ceiling {
+		return fmt.Errorf("%w: cost %d, the %s limit admits at most %d at once", ErrCostExceedsLimit,
+			cost, level.Level, ceiling)
+	}
+	return nil
+}
+
+func (rl *RateLimiter) Admit(ctx context.Context, req *AdmissionRequest) (*AdmissionResult, error) {
+	// every concurrency level takes its slot under a new lease id
+	for i := range req.Levels {
+		if req.Levels[i].function() == string(config.Concurrency) {
+			req.Levels[i].LeaseID = newLeaseID()
+		}
+	}
+
+	admission, err := rl.store.Admit(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	admission.cost = int64(req.units())
+	if !admission.Allowed || req.Peek {
+		return admission, nil
+	}
+
+	admission.consumed = req
+
+	// slots are only taken when the whole admission was consumed
+	for _, level := range req.Levels {
+		if level.function() == string(config.Concurrency) {
+			if result, ok := admission.Levels[level.Level]; ok && result.Allowed {
+				result.Lease = &Lease{Key: level.Key, ID: level.LeaseID,
+					Duration: time.Duration(level.Params[1]) * time.Millisecond}
+			}
+		}
+	}
+	return admission, nil
+}
+
+// runs a single level without reputation tracking, used by the per-algorithm limiters
+func (rl *RateLimiter) checkSingleLevel(ctx context.Context, key string, algoConfig config.AlgorithmConfig,
+	configHash string) (*LimitResult, error) {
+	params, err := algorithmParams(algoConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return rl.checkLevel(ctx, LevelCheck{Level: config.PerEndpointLevel, Key: key, Algorithm: algoConfig,
+		ConfigHash: configHash, Params: params})
+}
+
+func (rl *RateLimiter) checkLevel(ctx context.Context, level LevelCheck) (*LimitResult, error) {
+	return rl.runLevel(ctx, &AdmissionRequest{Levels: []LevelCheck{level}})
+}
+
+// like checkLevel, but the request isn't consumed
+func (rl *RateLimiter) peekLevel(ctx context.Context, level LevelCheck) (*LimitResult, error) {
+	return rl.runLevel(ctx, &AdmissionRequest{Levels: []LevelCheck{level}, Peek: true})
+}
+
+func (rl *RateLimiter) runLevel(ctx context.Context, req *AdmissionRequest) (*LimitResult, error) {
+	level := req.Levels[0]
+	admission, err := rl.Admit(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := admission.Levels[level.Level]
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from Redis script")
+	}
+	return result, nil
+}
+
+// schedules and definition are the level's schedules and config, see levelConfigHash
+func newLevelCheck(level config.LimitLevelType, key string, algoConfig config.AlgorithmConfig,
+	schedules config.Schedules, definition interface{}) (LevelCheck, error) {
+	configHash, err := levelConfigHash(algoConfig, schedules, definition)
+	if err != nil {
+		return LevelCheck{}, fmt.Errorf("error generating config hash")
+	}
+	params, err := algorithmParams(algoConfig)
+	if err != nil {
+		return LevelCheck{}, err
+	}
+	return LevelCheck{Level: level, Key: key, Algorithm: algoConfig, ConfigHash: configHash, Params: params}, nil
+}
+
+// the three numeric parameters (p1, p2, p3) of every algorithm, durations in milliseconds
+func algorithmParams(algoConfig config.AlgorithmConfig) ([3]float64, error) {
+	switch config.AlgorithmType(algoConfig.Algorithm) {
+	case config.TokenBucket:
+		if algoConfig.Capacity == nil || algoConfig.RefillRate == nil || algoConfig.RefillPeriod == nil {
+			return [3]float64{}, fmt.Errorf("incomplete token_bucket config")
+		}
+		return [3]float64{float64(*algoConfig.Capacity), float64(*algoConfig.RefillRate),
+			float64(algoConfig.RefillPeriod.Milliseconds())}, nil
+	case config.LeakyBucket:
+		if algoConfig.Capacity == nil || algoConfig.LeakRate == nil || algoConfig.LeakPeriod == nil {
+			return [3]float64{}, fmt.Errorf("incomplete leaky_bucket config")
+		}
+		if algoConfig.Mode == config.LeakyBucketShape {
+			// requests leave one interval apart, in (fractional) milliseconds
+			interval := float64(algoConfig.LeakPeriod.Duration) / float64(time.Millisecond) / float64(*algoConfig.LeakRate)
+			maxWait := float64(*algoConfig.Capacity) * interval
+			if algoConfig.MaxWait != nil {
+				maxWait = float64(algoConfig.MaxWait.Milliseconds())
+			}
+			return [3]float64{float64(*algoConfig.Capacity), interval, maxWait}, nil
+		}
+		return [3]float64{float64(*algoConfig.Capacity), float64(*algoConfig.LeakRate),
+			float64(algoConfig.LeakPeriod.Milliseconds())}, nil
+	case config.FixedWindow, config.SlidingWindow:
+		if algoConfig.Limit == nil || algoConfig.WindowSize == nil {
+			return [3]float64{}, fmt.Errorf("incomplete %s config", algoConfig.Algorithm)
+		}
+		return [3]float64{float64(*algoConfig.Limit), float64(algoConfig.WindowSize.Milliseconds()), 0}, nil
+	case config.GCRA:
+		if algoConfig.Rate == nil || algoConfig.Period == nil || algoConfig.Burst == nil {
+			return [3]float64{}, fmt.Errorf("incomplete gcra config")
+		}
+		// time between two requests at the sustained rate, in (fractional) milliseconds
+		emissionInterval := float64(algoConfig.Period.Duration) / float64(time.Millisecond) / float64(*algoConfig.Rate)
+		return [3]float64{emissionInterval, float64(*algoConfig.Burst), 0}, nil
+	case config.Concurrency:
+		if algoConfig.MaxInFlight == nil {
+			return [3]float64{}, fmt.Errorf("incomplete concurrency config")
+		}
+		lease := config.DefaultConcurrencyLease
+		if algoConfig.Lease != nil {
+			lease = algoConfig.Lease.Duration
+		}
+		// p3 is the lease id, set per admission
+		return [3]float64{float64(*algoConfig.MaxInFlight), float64(lease.Milliseconds()), 0}, nil
+	default:
+		return [3]float64{}, fmt.Errorf("unknown rate limiting algorithm")
+	}
+}
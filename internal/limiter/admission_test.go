@@ -0,0 +1,430 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fixedWindowConfig(limit int) config.AlgorithmConfig {
+	return config.AlgorithmConfig{
+		Algorithm:  string(config.FixedWindow),
+		Limit:      &limit,
+		WindowSize: &config.Duration{Duration: time.Minute},
+	}
+}
+
+func admissionTestConfig(globalLimit, tenantLimit, endpointLimit int) (*config.RateLimiterConfig, *config.EndpointRule) {
+	limiterConfig := &config.RateLimiterConfig{
+		Global:    config.Global{Enabled: true, AlgorithmConfig: fixedWindowConfig(globalLimit)},
+		PerTenant: config.PerTenant{Enabled: true, AlgorithmConfig: fixedWindowConfig(tenantLimit)},
+	}
+	rule := &config.EndpointRule{
+		Path:            "/api/test",
+		Methods:         []string{"GET"},
+		AlgorithmConfig: fixedWindowConfig(endpointLimit),
+	}
+	return limiterConfig, rule
+}
+
+func TestCheckLimits_AllLevelsAllowed(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Empty(t, result.DeniedLevel)
+	require.Len(t, result.Levels, 3)
+	assert.Equal(t, int64(99), result.Levels[config.GlobalLevel].Remaining)
+	assert.Equal(t, int64(9), result.Levels[config.PerTenantLevel].Remaining)
+	assert.Equal(t, int64(4), result.Levels[config.PerEndpointLevel].Remaining)
+
+	// Reputation is updated in the same call
+	require.NotNil(t, result.Reputation)
+	assert.Equal(t, 1.0, result.Reputation.Score)
+	assert.Equal(t, int64(1), result.Reputation.GoodRequests)
+	assert.Equal(t, int64(0), result.Reputation.ViolationCount)
+}
+
+func TestCheckLimits_LaterRejectionDoesNotConsume(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 2)
+
+	for i := 0; i < 2; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	// Endpoint limit is exhausted, global and tenant quota must stay untouched
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+		assert.Greater(t, result.Levels[config.PerEndpointLevel].RetryAfter, time.Duration(0))
+	}
+
+	globalCount := mr.HGet(constructRedisKey(config.GlobalLevel, "", []string{}, ""), "count")
+	tenantCount := mr.HGet(constructRedisKey(config.PerTenantLevel, "", []string{}, "user1"), "count")
+	assert.Equal(t, "2", globalCount)
+	assert.Equal(t, "2", tenantCount)
+
+	// One violation per rejected request, no double counting across levels
+	reputation, err := rl.GetTenantReputation(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), reputation.ViolationCount)
+	assert.Equal(t, int64(2), reputation.GoodRequests)
+}
+
+func TestCheckLimits_TenantRejectionStopsEvaluation(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 1, 10)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.PerTenantLevel, result.DeniedLevel)
+	assert.Contains(t, result.Levels, config.GlobalLevel)
+	assert.NotContains(t, result.Levels, config.PerEndpointLevel)
+
+	// Other tenants are not affected
+	result, err = rl.CheckLimits(ctx, "user2", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestCheckLimits_GlobalLimitOnlyRejectsBadReputation(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1, 100, 100)
+
+	result, err := rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// Global limit is reached, a tenant with good reputation still passes
+	result, err = rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.False(t, result.Levels[config.GlobalLevel].Allowed)
+	assert.Empty(t, result.DeniedLevel)
+
+	// Push a tenant below the reputation threshold
+	for i := 0; i < 10; i++ {
+		_, err := rl.UpdateReputation(ctx, "bad_user", true)
+		require.NoError(t, err)
+	}
+	before, err := rl.GetTenantReputation(ctx, "bad_user")
+	require.NoError(t, err)
+	require.LessOrEqual(t, before.Score, limiterConfig.Reputation.Model().Threshold)
+
+	result, err = rl.CheckLimits(ctx, "bad_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.GlobalLevel, result.DeniedLevel)
+
+	// Global rejections don't count as tenant violations
+	assert.Equal(t, before.ViolationCount, result.Reputation.ViolationCount)
+	assert.NotContains(t, result.Levels, config.PerTenantLevel)
+}
+
+func TestCheckLimits_DisabledLevelsSkipped(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1, 1, 10)
+	limiterConfig.Global.Enabled = false
+	limiterConfig.PerTenant.Enabled = false
+
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Len(t, result.Levels, 1)
+	}
+
+	assert.False(t, mr.Exists(constructRedisKey(config.GlobalLevel, "", []string{}, "")))
+	assert.False(t, mr.Exists(constructRedisKey(config.PerTenantLevel, "", []string{}, "user1")))
+}
+
+func TestCheckLimits_MixedAlgorithms(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	capacity, refillRate := 3, 1
+	limiterConfig.PerTenant.AlgorithmConfig = config.AlgorithmConfig{
+		Algorithm:    string(config.TokenBucket),
+		Capacity:     &capacity,
+		RefillRate:   &refillRate,
+		RefillPeriod: &config.Duration{Duration: time.Minute},
+	}
+	rate, burst := 10, 2
+	rule.AlgorithmConfig = config.AlgorithmConfig{
+		Algorithm: string(config.GCRA),
+		Rate:      &rate,
+		Period:    &config.Duration{Duration: time.Second},
+		Burst:     &burst,
+	}
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int64(2), result.Levels[config.PerTenantLevel].Remaining)
+	assert.Equal(t, int64(1), result.Levels[config.PerEndpointLevel].Remaining)
+}
+
+func TestCheckLimits_Cost(t *testing.T) {
+	for name, algoConfig := range memoryTestAlgorithms() {
+		if name == "concurrency" || name == "gcra" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+				ctx := context.Background()
+				limiterConfig, rule := quotaTestConfig(100)
+				rule.AlgorithmConfig = algoConfig
+
+				// all limits are 3 per minute
+				result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 2)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, int64(1), result.Levels[config.PerEndpointLevel].Remaining)
+				assert.Equal(t, int64(998), result.Levels[config.GlobalLevel].Remaining)
+				assert.Equal(t, int64(98), result.Levels[config.QuotaLevel].Remaining)
+
+				result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 2)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+				assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+				assert.Greater(t, result.Levels[config.PerEndpointLevel].RetryAfter, time.Duration(0))
+
+				// the remaining unit is still there for a cheaper request
+				result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, int64(0), result.Levels[config.PerEndpointLevel].Remaining)
+				assert.Equal(t, int64(97), result.Levels[config.QuotaLevel].Remaining)
+			})
+		})
+	}
+}
+
+func TestCheckLimits_CostRetryAfter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1000, 1000, 1000)
+		capacity, refillRate := 10, 2
+		rule.AlgorithmConfig = config.AlgorithmConfig{Algorithm: string(config.TokenBucket), Capacity: &capacity,
+			RefillRate: &refillRate, RefillPeriod: &config.Duration{Duration: time.Minute}}
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 9)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+
+		// 1 token left, 5 more need three refills of 2
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 6)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.InDelta(t, (3 * time.Minute).Seconds(), result.Levels[config.PerEndpointLevel].RetryAfter.Seconds(), 1)
+	})
+}
+
+func TestCheckLimits_CostGCRA(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1000, 1000, 1000)
+		rate, burst := 60, 5
+		rule.AlgorithmConfig = config.AlgorithmConfig{Algorithm: string(config.GCRA), Rate: &rate,
+			Period: &config.Duration{Duration: time.Minute}, Burst: &burst}
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(2), result.Levels[config.PerEndpointLevel].Remaining)
+
+		// 3 more is one second of pacing too many
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.InDelta(t, 1, result.Levels[config.PerEndpointLevel].RetryAfter.Seconds(), 0.05)
+	})
+}
+
+func TestCheckLimits_CostOverCapacity(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1000, 1000, 1000)
+		capacity, refillRate := 10, 2
+		rule.AlgorithmConfig = config.AlgorithmConfig{Algorithm: string(config.TokenBucket), Capacity: &capacity,
+			RefillRate: &refillRate, RefillPeriod: &config.Duration{Duration: time.Minute}}
+
+		// a full bucket can't hold it, no retry would ever pass
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 11)
+		assert.ErrorIs(t, err, ErrCostExceedsLimit)
+		assert.Nil(t, result)
+
+		// nothing was consumed
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 10)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(990), result.Levels[config.GlobalLevel].Remaining)
+
+		limiterConfig, rule = quotaTestConfig(5)
+		_, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 6)
+		assert.ErrorIs(t, err, ErrCostExceedsLimit)
+
+		_, err = rl.PeekLimits(ctx, "user1", "", limiterConfig, rule, 6)
+		assert.ErrorIs(t, err, ErrCostExceedsLimit)
+	})
+}
+
+func TestCheckLimits_RedisError(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	mr.Close()
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	assert.Error(t, err)
+	assert.Nil(t, result)
+}
+
+func BenchmarkCheckLimits(b *testing.B) {
+	rl, mr := setupTestRateLimiter(nil)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1000000, 1000000, 1000000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = rl.CheckLimits(ctx, "bench_user", "", limiterConfig, rule, 1)
+	}
+}
+
+func TestReleaseReservation_ReservedEndpointLevel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 100, 2)
+		rule.CountOn = config.CountOnResponse
+
+		// Reserved at admission, requests in flight can't overshoot the limit
+		var allowed []*AdmissionResult
+		for i := 0; i < 2; i++ {
+			result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+			require.True(t, result.Allowed)
+			assert.Equal(t, int64(99-i), result.Levels[config.PerTenantLevel].Remaining)
+			assert.Equal(t, int64(1-i), result.Levels[config.PerEndpointLevel].Remaining)
+			allowed = append(allowed, result)
+		}
+
+		denied, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, denied.Allowed)
+		assert.Equal(t, config.PerEndpointLevel, denied.DeniedLevel)
+
+		// An uncounted response gives the endpoint level back, not the tenant level
+		require.NoError(t, rl.ReleaseReservation(ctx, allowed[1]))
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		assert.Equal(t, int64(97), result.Levels[config.PerTenantLevel].Remaining)
+		assert.Equal(t, int64(0), result.Levels[config.PerEndpointLevel].Remaining)
+
+		// A refund leaves the reserved level to the response
+		require.NoError(t, rl.Refund(ctx, allowed[0]))
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+
+		// Nothing reserved by a denied admission
+		require.NoError(t, rl.ReleaseReservation(ctx, denied))
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+	})
+}
+
+func TestReleaseReservation_NoReservedLevel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 100, 2)
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		require.NoError(t, rl.ReleaseReservation(ctx, result))
+
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(0), result.Levels[config.PerEndpointLevel].Remaining)
+	})
+}
+
+func TestPeekLimits_EvaluatesEveryLevelWithoutConsuming(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 10, 1)
+		limiterConfig.Quota = config.Quota{
+			Enabled:     true,
+			QuotaConfig: config.QuotaConfig{Period: config.QuotaMonth, Limit: 5},
+		}
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+
+		// remaining is what would be left had the request counted
+		for i := 0; i < 2; i++ {
+			peek, err := rl.PeekLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+			assert.True(t, peek.Allowed, "a peek never denies")
+			assert.Nil(t, peek.Reputation)
+			require.Len(t, peek.Levels, 4)
+			assert.Equal(t, int64(98), peek.Levels[config.GlobalLevel].Remaining)
+			assert.Equal(t, int64(8), peek.Levels[config.PerTenantLevel].Remaining)
+			assert.Equal(t, int64(3), peek.Levels[config.QuotaLevel].Remaining)
+			assert.False(t, peek.Levels[config.PerEndpointLevel].Allowed)
+		}
+
+		// Disabled levels aren't evaluated
+		limiterConfig.Global.Enabled = false
+		peek, err := rl.PeekLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.NotContains(t, peek.Levels, config.GlobalLevel)
+
+		reputation, err := rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), reputation.GoodRequests, "peeks don't count as requests")
+	})
+}
@@ -3,30 +3,91 @@ package limiter
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/redis/go-redis/v9"
 )
 
-func NewRedisClient(config *config.RedisConfig) *redis.Client {
-	opts := &redis.Options{
-		Addr:     config.Address,
-		Password: config.Password,
-		DB:       config.DB,
-		PoolSize: config.PoolSize,
+func NewRedisClient(redisConfig *config.RedisConfig) (redis.UniversalClient, error) {
+	tlsConfig, err := newTLSConfig(redisConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.UseTLS {
-		opts.TLSConfig = &tls.Config{
-			MinVersion:         tls.VersionTLS12,
-			InsecureSkipVerify: config.TLSSkipVerify,
+	switch redisConfig.Mode {
+	case config.RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       redisConfig.MasterName,
+			SentinelAddrs:    redisConfig.SentinelAddresses,
+			SentinelPassword: redisConfig.SentinelPassword,
+			Username:         redisConfig.Username,
+			Password:         redisConfig.Password,
+			DB:               redisConfig.DB,
+			PoolSize:         redisConfig.PoolSize,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case config.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     redisConfig.ClusterAddresses,
+			Username:  redisConfig.Username,
+			Password:  redisConfig.Password,
+			PoolSize:  redisConfig.PoolSize,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      redisConfig.Address,
+			Username:  redisConfig.Username,
+			Password:  redisConfig.Password,
+			DB:        redisConfig.DB,
+			PoolSize:  redisConfig.PoolSize,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+}
+
+// nil when tls is disabled
+func newTLSConfig(redisConfig *config.RedisConfig) (*tls.Config, error) {
+	if !redisConfig.UseTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: redisConfig.TLSSkipVerify,
+		ServerName:         redisConfig.TLSServerName,
+	}
+
+	if redisConfig.TLSCAFile != "" {
+		caPEM, err := os.ReadFile(redisConfig.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis tls_ca_file: %w", err)
 		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in redis tls_ca_file %s", redisConfig.TLSCAFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if redisConfig.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(redisConfig.TLSCertFile, redisConfig.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return redis.NewClient(opts)
+	return tlsConfig, nil
 }
 
 func (r *RateLimiter) Ping(ctx context.Context) error {
-	_, err := r.redisClient.Ping(ctx).Result()
-	return err
+	return r.store.Ping(ctx)
+}
+
+func (r *RateLimiter) Close() error {
+	return r.store.Close()
 }
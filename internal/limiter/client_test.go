@@ -0,0 +1,151 @@
+package limiter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// signs with parent, self signed when parent is nil
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writes cert.pem and key.pem into dir, returns their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestNewRedisClient_MutualTLSWithACLUser(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+
+	ca := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "redis.internal"},
+		DNSNames:     []string{"redis.internal"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "trafficctrl"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := client.write(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	mr, err := miniredis.RunTLS(&tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	defer mr.Close()
+	mr.RequireUserAuth("limiter", "secret")
+
+	// the listener address is an IP, the server name makes the certificate match
+	_, port, err := net.SplitHostPort(mr.Addr())
+	require.NoError(t, err)
+
+	redisConfig := &config.RedisConfig{
+		Mode:          config.RedisStandalone,
+		Address:       net.JoinHostPort("127.0.0.1", port),
+		Username:      "limiter",
+		Password:      "secret",
+		PoolSize:      1,
+		UseTLS:        true,
+		TLSCAFile:     caPath,
+		TLSCertFile:   certPath,
+		TLSKeyFile:    keyPath,
+		TLSServerName: "redis.internal",
+	}
+
+	rdb, err := NewRedisClient(redisConfig)
+	require.NoError(t, err)
+	defer rdb.Close()
+	assert.NoError(t, rdb.Ping(context.Background()).Err())
+
+	// without the client certificate the server rejects the handshake
+	redisConfig.TLSCertFile, redisConfig.TLSKeyFile = "", ""
+	rdb, err = NewRedisClient(redisConfig)
+	require.NoError(t, err)
+	defer rdb.Close()
+	assert.Error(t, rdb.Ping(context.Background()).Err())
+}
+
+func TestNewRedisClient_InvalidCAFile(t *testing.T) {
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, []byte("not a certificate"), 0o600))
+
+	_, err := NewRedisClient(&config.RedisConfig{
+		Address:   "localhost:6379",
+		PoolSize:  1,
+		UseTLS:    true,
+		TLSCAFile: caPath,
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// The concurrency key is a sorted set of leases, one per request in flight, scored by the time
+// the lease expires. A lease is taken by the admission, renewed by RenewLeases while the request
+// is in flight and given back by ReleaseLeases once the response is written, a lease that is
+// never given back (crashed proxy) expires on its own. The key lives as long as its latest lease.
+// Leases are requests really in flight, they are kept when the config changes. A request
+// takes one slot whatever its cost.
+const concurrencyLua = `
+local function concurrency_expire(key, now)
+    local latest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+    if latest[2] then
+        redis.call('PEXPIRE', key, math.ceil(tonumber(latest[2]) - now))
+    end
+end
+
+local function concurrency(key, config_hash, now, cost, max_in_flight, lease, _, lease_id)
+    -- Expired leases belong to requests that were never released
+    redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+    local in_flight = redis.call('ZCARD', key)
+
+    if in_flight >= max_in_flight then
+        -- A slot frees up when a request finishes, which can't be known ahead: retry within a second
+        local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+        return 0, 0, math.min(tonumber(oldest[2]) - now, 1000), nil
+    end
+
+    local commit = function()
+        redis.call('ZADD', key, now + lease, lease_id)
+        concurrency_expire(key, now)
+    end
+
+    return 1, max_in_flight - in_flight - 1, 0, commit
+end
+`
+
+// KEYS[1] = concurrency key, ARGV = now, lease, lease id. An expired or released lease isn't
+// renewed, its slot may be someone else's by now.
+const renewLeaseScript = concurrencyLua + `
+local now = tonumber(ARGV[1])
+local expires_at = tonumber(redis.call('ZSCORE', KEYS[1], ARGV[3]))
+if expires_at == nil or expires_at <= now then
+    return 0
+end
+
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[3])
+concurrency_expire(KEYS[1], now)
+return 1
+`
+
+// Lease is the slot of a request in a concurrency level, held until ReleaseLeases or its expiry.
+type Lease struct {
+	Key string
+	ID  string
+	// how long the lease lasts from its last renewal
+	Duration time.Duration
+}
+
+func newLeaseID() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// ConcurrencyLimiter takes a slot of the key, the result's Lease has to be given back with
+// ReleaseLeases when the request is done.
+func (rl *RateLimiter) ConcurrencyLimiter(ctx context.Context, key string,
+	algoConfig config.AlgorithmConfig, configHash string) (*LimitResult, error) {
+	algoConfig.Algorithm = string(config.Concurrency)
+	return rl.checkSingleLevel(ctx, key, algoConfig, configHash)
+}
+
+// ReleaseLeases gives the slots back, nil leases are skipped.
+func (rl *RateLimiter) ReleaseLeases(ctx context.Context, leases ...*Lease) error {
+	for _, lease := range leases {
+		if lease == nil {
+			continue
+		}
+		if err := rl.store.ReleaseLease(ctx, lease.Key, lease.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenewLeases extends the leases to their duration from now, requests running longer than
+// a lease keep their slot as long as they are renewed. Released and expired leases are skipped.
+func (rl *RateLimiter) RenewLeases(ctx context.Context, leases ...*Lease) error {
+	for _, lease := range leases {
+		if lease == nil {
+			continue
+		}
+		if err := rl.store.RenewLease(ctx, lease.Key, lease.ID, lease.Duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Leases returns the slots taken by the admission, nil when it took none.
+func (a *AdmissionResult) Leases() []*Lease {
+	var leases []*Lease
+	for _, result := range a.Levels {
+		if result.Lease != nil {
+			leases = append(leases, result.Lease)
+		}
+	}
+	return leases
+}
+
+type concurrencyState struct {
+	// lease id -> expiry
+	leases map[string]float64
+}
+
+// memory store version of the concurrency lua function
+func concurrencyMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	maxInFlight, lease := p[0], p[1]
+
+	state, ok := ms.get(key, now).(*concurrencyState)
+	if !ok {
+		state = &concurrencyState{leases: map[string]float64{}}
+	}
+
+	// Expired leases belong to requests that were never released
+	oldest := math.Inf(1)
+	for id, expiresAt := range state.leases {
+		if expiresAt <= now {
+			delete(state.leases, id)
+			continue
+		}
+		oldest = math.Min(oldest, expiresAt)
+	}
+	inFlight := float64(len(state.leases))
+
+	if inFlight >= maxInFlight {
+		// A slot frees up when a request finishes, which can't be known ahead: retry within a second
+		return false, 0, math.Min(oldest-now, 1000), nil
+	}
+
+	commit := func() {
+		state.leases[leaseID] = now + lease
+		ms.set(key, state, now, state.latest()-now)
+	}
+
+	return true, maxInFlight - inFlight - 1, 0, commit
+}
+
+// expiry of the latest lease, the key lives until then
+func (s *concurrencyState) latest() float64 {
+	latest := 0.0
+	for _, expiresAt := range s.leases {
+		latest = math.Max(latest, expiresAt)
+	}
+	return latest
+}
@@ -0,0 +1,180 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func concurrencyConfig(maxInFlight int, lease time.Duration) config.AlgorithmConfig {
+	algoConfig := config.AlgorithmConfig{Algorithm: string(config.Concurrency), MaxInFlight: &maxInFlight}
+	if lease > 0 {
+		algoConfig.Lease = &config.Duration{Duration: lease}
+	}
+	return algoConfig
+}
+
+func TestConcurrencyLimiter_AcquireAndRelease(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := concurrencyConfig(2, 0)
+
+		first, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, first.Allowed)
+		assert.Equal(t, int64(1), first.Remaining)
+		require.NotNil(t, first.Lease)
+
+		second, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, second.Allowed)
+		assert.NotEqual(t, first.Lease.ID, second.Lease.ID)
+
+		result, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Nil(t, result.Lease)
+		assert.Greater(t, result.RetryAfter, time.Duration(0))
+		assert.LessOrEqual(t, result.RetryAfter, time.Second)
+
+		require.NoError(t, rl.ReleaseLeases(ctx, first.Lease, nil))
+		// releasing twice is harmless
+		require.NoError(t, rl.ReleaseLeases(ctx, first.Lease))
+
+		result, err = rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(0), result.Remaining)
+	})
+}
+
+func TestConcurrencyLimiter_LeaseExpires(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := concurrencyConfig(1, 50*time.Millisecond)
+
+		result, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+
+		result, err = rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+
+		// never released, e.g. the proxy holding it crashed
+		time.Sleep(60 * time.Millisecond)
+
+		result, err = rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	})
+}
+
+func TestCheckLimits_DeniedAdmissionTakesNoSlot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 100, 1)
+		limiterConfig.PerTenant.AlgorithmConfig = concurrencyConfig(1, 0)
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		leases := result.Leases()
+		require.Len(t, leases, 1)
+		require.NoError(t, rl.ReleaseLeases(ctx, leases...))
+
+		// the endpoint rejects it, the tenant slot isn't taken
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Empty(t, result.Leases())
+
+		states, err := rl.InspectTenant(ctx, "user1", "", limiterConfig)
+		require.NoError(t, err)
+		assert.Equal(t, config.PerTenantLevel, states[0].Level)
+		assert.True(t, states[0].Result.Allowed)
+		assert.Equal(t, int64(1), states[0].Result.Remaining, "one slot, none taken")
+	})
+}
+
+func TestConcurrencyLimiter_RenewedLeaseKeepsSlot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := concurrencyConfig(1, 100*time.Millisecond)
+
+		held, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		require.NotNil(t, held.Lease)
+		assert.Equal(t, 100*time.Millisecond, held.Lease.Duration)
+
+		// a request running for longer than its lease
+		for i := 0; i < 3; i++ {
+			time.Sleep(60 * time.Millisecond)
+			require.NoError(t, rl.RenewLeases(ctx, held.Lease, nil))
+		}
+
+		result, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+
+		// a released lease isn't renewed, its slot stays free
+		require.NoError(t, rl.ReleaseLeases(ctx, held.Lease))
+		require.NoError(t, rl.RenewLeases(ctx, held.Lease))
+
+		result, err = rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	})
+}
+
+func TestConcurrencyLimiter_ExpiredLeaseIsNotRenewed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := concurrencyConfig(1, 50*time.Millisecond)
+
+		lost, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+
+		time.Sleep(60 * time.Millisecond)
+		require.NoError(t, rl.RenewLeases(ctx, lost.Lease))
+
+		result, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", algoConfig, "")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	})
+}
+
+func TestConcurrencyLimiter_KeyLivesAsLongAsLatestLease(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+
+	_, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", concurrencyConfig(2, time.Minute), "")
+	require.NoError(t, err)
+	// a shorter lease taken later doesn't shorten the key
+	_, err = rl.ConcurrencyLimiter(ctx, "test:concurrency", concurrencyConfig(2, time.Second), "")
+	require.NoError(t, err)
+
+	assert.InDelta(t, time.Minute.Seconds(), mr.TTL("test:concurrency").Seconds(), 1)
+}
+
+func TestConcurrencyLimiter_LeaseIDIsTheSortedSetMember(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+
+	result, err := rl.ConcurrencyLimiter(ctx, "test:concurrency", concurrencyConfig(2, time.Minute), "")
+	require.NoError(t, err)
+	require.NotNil(t, result.Lease)
+
+	// passed as a string, the id isn't rounded on its way through lua
+	members, err := mr.ZMembers("test:concurrency")
+	require.NoError(t, err)
+	assert.Equal(t, []string{result.Lease.ID}, members)
+}
@@ -0,0 +1,279 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+)
+
+const (
+	// consecutive primary errors before the breaker opens
+	fallbackFailureThreshold = 3
+	// while open, one call per interval probes the primary
+	fallbackProbeInterval = 5 * time.Second
+)
+
+// FallbackStore is a circuit breaker around a shared store (redis). Calls failing on the
+// primary are served by the local store, after fallbackFailureThreshold failures in a row
+// the primary is skipped and only probed once per interval until it answers again.
+// The local store only knows this instance's traffic, so limits become per instance.
+type FallbackStore struct {
+	primary Store
+	local   Store
+	// called when the breaker opens (fallback = true, with the last error) or closes again
+	onStateChange func(fallback bool, err error)
+
+	probeInterval time.Duration
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+func NewFallbackStore(primary, local Store, onStateChange func(fallback bool, err error)) *FallbackStore {
+	return &FallbackStore{
+		primary:       primary,
+		local:         local,
+		onStateChange: onStateChange,
+		probeInterval: fallbackProbeInterval,
+	}
+}
+
+func (fs *FallbackStore) Admit(ctx context.Context, req *AdmissionRequest) (*AdmissionResult, error) {
+	if fs.usePrimary() {
+		result, err := fs.primary.Admit(ctx, req)
+		if err == nil {
+			fs.recordSuccess()
+			return result, nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+
+	//==========================Metrics=======================
+	metrics.FallbackRequests.Inc()
+	//========================================================
+	return fs.local.Admit(ctx, req)
+}
+
+func (fs *FallbackStore) UpdateReputation(ctx context.Context, tenantKey string, isViolation bool,
+	model *config.Reputation) (*Reputation, error) {
+	if fs.usePrimary() {
+		reputation, err := fs.primary.UpdateReputation(ctx, tenantKey, isViolation, model)
+		if err == nil {
+			fs.recordSuccess()
+			return reputation, nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.UpdateReputation(ctx, tenantKey, isViolation, model)
+}
+
+func (fs *FallbackStore) GetReputation(ctx context.Context, tenantKey string) (*Reputation, error) {
+	if fs.usePrimary() {
+		reputation, err := fs.primary.GetReputation(ctx, tenantKey)
+		if err == nil {
+			fs.recordSuccess()
+			return reputation, nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.GetReputation(ctx, tenantKey)
+}
+
+func (fs *FallbackStore) GetTenantPlan(ctx context.Context, hashKey, tenantKey string) (string, error) {
+	if fs.usePrimary() {
+		plan, err := fs.primary.GetTenantPlan(ctx, hashKey, tenantKey)
+		if err == nil {
+			fs.recordSuccess()
+			return plan, nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.GetTenantPlan(ctx, hashKey, tenantKey)
+}
+
+func (fs *FallbackStore) SetBan(ctx context.Context, tenantKey string, duration time.Duration) error {
+	if fs.usePrimary() {
+		err := fs.primary.SetBan(ctx, tenantKey, duration)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.SetBan(ctx, tenantKey, duration)
+}
+
+func (fs *FallbackStore) GetBan(ctx context.Context, tenantKey string) (time.Duration, error) {
+	if fs.usePrimary() {
+		bannedFor, err := fs.primary.GetBan(ctx, tenantKey)
+		if err == nil {
+			fs.recordSuccess()
+			return bannedFor, nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.GetBan(ctx, tenantKey)
+}
+
+func (fs *FallbackStore) Delete(ctx context.Context, keys ...string) error {
+	if fs.usePrimary() {
+		err := fs.primary.Delete(ctx, keys...)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.Delete(ctx, keys...)
+}
+
+// a lease taken before the breaker switched stores expires on the other one
+func (fs *FallbackStore) ReleaseLease(ctx context.Context, key, leaseID string) error {
+	if fs.usePrimary() {
+		err := fs.primary.ReleaseLease(ctx, key, leaseID)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.ReleaseLease(ctx, key, leaseID)
+}
+
+// like releases, a renewal goes to the store in use now
+func (fs *FallbackStore) RenewLease(ctx context.Context, key, leaseID string, lease time.Duration) error {
+	if fs.usePrimary() {
+		err := fs.primary.RenewLease(ctx, key, leaseID, lease)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.RenewLease(ctx, key, leaseID, lease)
+}
+
+// like leases, units consumed before the breaker switched stores are refunded to the store in use now
+func (fs *FallbackStore) Refund(ctx context.Context, req *RefundRequest) error {
+	if fs.usePrimary() {
+		err := fs.primary.Refund(ctx, req)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.Refund(ctx, req)
+}
+
+func (fs *FallbackStore) ScanReputations(ctx context.Context,
+	visit func(tenantKey string, reputation *Reputation)) error {
+	if fs.usePrimary() {
+		err := fs.primary.ScanReputations(ctx, visit)
+		if err == nil {
+			fs.recordSuccess()
+			return nil
+		}
+		fs.recordFailure(ctx, err)
+	}
+	return fs.local.ScanReputations(ctx, visit)
+}
+
+func (fs *FallbackStore) Ping(ctx context.Context) error {
+	return fs.primary.Ping(ctx)
+}
+
+func (fs *FallbackStore) Close() error {
+	localErr := fs.local.Close()
+	if err := fs.primary.Close(); err != nil {
+		return err
+	}
+	return localErr
+}
+
+// Fallback reports whether calls are currently served by the local store.
+func (fs *FallbackStore) Fallback() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.open
+}
+
+func (fs *FallbackStore) usePrimary() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.open {
+		return true
+	}
+
+	// only one probe at a time, everything else stays local
+	if !fs.probing && time.Since(fs.openedAt) >= fs.probeInterval {
+		fs.probing = true
+		return true
+	}
+	return false
+}
+
+func (fs *FallbackStore) recordSuccess() {
+	fs.mu.Lock()
+	fs.failures = 0
+	recovered := fs.open
+	fs.open = false
+	fs.probing = false
+	fs.mu.Unlock()
+
+	if recovered {
+		//==========================Metrics=======================
+		metrics.StorageFailovers.WithLabelValues("recovery").Inc()
+		metrics.FallbackActive.Set(0)
+		//========================================================
+		if fs.onStateChange != nil {
+			fs.onStateChange(false, nil)
+		}
+	}
+}
+
+// ctx is the call's, a caller that went away (cancelled) isn't a store failure. A deadline that
+// passed is: a stalled store runs every call into it.
+func (fs *FallbackStore) recordFailure(ctx context.Context, err error) {
+	fs.mu.Lock()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// a probe cut short by its caller says nothing, the next call probes again
+		fs.probing = false
+		fs.mu.Unlock()
+		return
+	}
+	fs.failures++
+
+	if fs.open {
+		// failed probe, wait another interval
+		fs.probing = false
+		fs.openedAt = time.Now()
+		fs.mu.Unlock()
+		return
+	}
+
+	tripped := fs.failures >= fallbackFailureThreshold
+	if tripped {
+		fs.open = true
+		fs.openedAt = time.Now()
+	}
+	fs.mu.Unlock()
+
+	if tripped {
+		//==========================Metrics=======================
+		metrics.StorageFailovers.WithLabelValues("failover").Inc()
+		metrics.FallbackActive.Set(1)
+		//========================================================
+		if fs.onStateChange != nil {
+			fs.onStateChange(true, err)
+		}
+	}
+}
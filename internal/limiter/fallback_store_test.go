@@ -0,0 +1,247 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stateChanges struct {
+	mu     sync.Mutex
+	events []bool
+}
+
+func (s *stateChanges) record(fallback bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, fallback)
+}
+
+func (s *stateChanges) get() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.events...)
+}
+
+func setupTestFallbackRateLimiter(t *testing.T) (*RateLimiter, *FallbackStore, *miniredis.Miniredis, *stateChanges) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:       mr.Addr(),
+		MaxRetries: -1,
+	})
+
+	changes := &stateChanges{}
+	store := NewFallbackStore(NewRedisStore(rdb), NewMemoryStore(), changes.record)
+	store.probeInterval = 50 * time.Millisecond
+	t.Cleanup(func() { _ = store.Close() })
+
+	return NewRateLimiter(store), store, mr, changes
+}
+
+func TestFallbackStore_UsesPrimaryWhenHealthy(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	assert.False(t, store.Fallback())
+	assert.Empty(t, changes.get())
+	assert.True(t, mr.Exists(constructReputationKey("user1")))
+}
+
+func TestFallbackStore_FailsOverAndEnforcesLocally(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 3)
+
+	mr.Close()
+
+	// Every request is still checked, the first ones while the breaker counts failures
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+	assert.True(t, store.Fallback())
+	assert.Equal(t, []bool{true}, changes.get())
+
+	// Limits are enforced by the local store
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, "per_endpoint", string(result.DeniedLevel))
+}
+
+func TestFallbackStore_RecoversAfterProbe(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	addr := mr.Addr()
+	mr.Close()
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+	}
+	require.True(t, store.Fallback())
+
+	require.NoError(t, mr.StartAddr(addr))
+
+	// Before the probe interval the primary isn't tried
+	_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, store.Fallback())
+	assert.False(t, mr.Exists(constructReputationKey("user1")))
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, store.Fallback())
+	assert.Equal(t, []bool{true, false}, changes.get())
+	assert.True(t, mr.Exists(constructReputationKey("user1")))
+}
+
+func TestFallbackStore_FailedProbeStaysLocal(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	mr.Close()
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, store.Fallback())
+	assert.Equal(t, []bool{true}, changes.get())
+}
+
+func TestFallbackStore_ReadProbeRecovers(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	addr := mr.Addr()
+	mr.Close()
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+	}
+	require.True(t, store.Fallback())
+
+	require.NoError(t, mr.StartAddr(addr))
+	time.Sleep(60 * time.Millisecond)
+
+	// The probe is a read, it closes the breaker like any other call
+	_, err := store.GetReputation(ctx, "user1")
+	require.NoError(t, err)
+	assert.False(t, store.Fallback())
+	assert.Equal(t, []bool{true, false}, changes.get())
+}
+
+func TestFallbackStore_CancelledCallsDontTrip(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	mr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		_, _ = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	}
+	assert.False(t, store.Fallback())
+	assert.Empty(t, changes.get())
+}
+
+func TestFallbackStore_StalledPrimaryTrips(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	// Calls give up at their context's deadline
+	rdb := redis.NewClient(&redis.Options{
+		Addr:                  mr.Addr(),
+		MaxRetries:            -1,
+		ContextTimeoutEnabled: true,
+	})
+	changes := &stateChanges{}
+	store := NewFallbackStore(NewRedisStore(rdb), NewMemoryStore(), changes.record)
+	t.Cleanup(func() { _ = store.Close() })
+	rl := NewRateLimiter(store)
+
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	// Redis accepts the commands but never answers
+	stall := make(chan struct{})
+	defer close(stall)
+	mr.Server().SetPreHook(func(*server.Peer, string, ...string) bool {
+		<-stall
+		return true
+	})
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, _ = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		cancel()
+	}
+	assert.True(t, store.Fallback(), "timed out calls are store failures")
+	assert.Equal(t, []bool{true}, changes.get())
+}
+
+func TestFallbackStore_PlanLookupProbeRecovers(t *testing.T) {
+	rl, store, mr, changes := setupTestFallbackRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	plans := redisPlans(0)
+
+	addr := mr.Addr()
+	mr.Close()
+
+	for i := 0; i < fallbackFailureThreshold; i++ {
+		_, _ = rl.ResolvePlan(ctx, "user1", plans)
+	}
+	require.True(t, store.Fallback())
+
+	require.NoError(t, mr.StartAddr(addr))
+	mr.HSet("ctrl:plans", "user1", "pro")
+	time.Sleep(60 * time.Millisecond)
+
+	// Plans are resolved before every admission, the lookup is usually the probe
+	plan, err := rl.ResolvePlan(ctx, "user1", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", plan)
+	assert.False(t, store.Fallback())
+	assert.Equal(t, []bool{true, false}, changes.get())
+}
@@ -2,103 +2,112 @@ package limiter
 
 import (
 	"context"
-	"fmt"
-	"strconv"
-	"time"
+	"math"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 )
 
-const fixedWindowScript = `
-local key = KEYS[1]
-local config_hash = ARGV[1]
-local limit = tonumber(ARGV[2])
-local window_size = tonumber(ARGV[3])
-local now = tonumber(ARGV[4])
-
--- Calculate current window start
-local window_start = math.floor(now / window_size) * window_size
-
--- Get current state
-local bucket = redis.call('HMGET', key, 'count', 'window_start', 'config_hash')
-local current_count = tonumber(bucket[1]) or 0
-local stored_window_start = tonumber(bucket[2]) or 0
-local stored_config = bucket[3]
-
--- Check if config changed
-if stored_config and stored_config ~= config_hash then
-    -- Reset everything for new config
-    current_count = 0
-    stored_window_start = window_start
-    redis.call('HMSET', key, 'count', 0, 'window_start', window_start, 'config_hash', config_hash)
-end
+const fixedWindowLua = `
+local function fixed_window(key, config_hash, now, cost, limit, window_size)
+    -- Calculate current window start
+    local window_start = math.floor(now / window_size) * window_size
 
--- Check if window has rolled over (new window)
-if stored_window_start < window_start then
-    current_count = 0
-    stored_window_start = window_start
-    redis.call('HMSET', key, 'count', 0, 'window_start', window_start, 'config_hash', config_hash)
-end
+    -- Get current state
+    local bucket = redis.call('HMGET', key, 'count', 'window_start', 'config_hash')
+    local current_count = tonumber(bucket[1]) or 0
+    local stored_window_start = tonumber(bucket[2]) or 0
+    local stored_config = bucket[3]
 
--- Initialize if this is the first request
-if stored_window_start == 0 then
-    stored_window_start = window_start
-    redis.call('HSET', key, 'window_start', window_start)
-    if not stored_config then
-        redis.call('HSET', key, 'config_hash', config_hash)
+    -- Config changed or window rolled over (also covers the first request): start counting again
+    if (stored_config and stored_config ~= config_hash) or stored_window_start < window_start then
+        current_count = 0
+        stored_window_start = window_start
     end
-end
 
--- Check if request can be allowed
-if current_count < limit then
-    -- Increment count and allow request
-    local new_count = redis.call('HINCRBY', key, 'count', 1)
-    
-    -- Set expiration to window end + buffer
-    local window_end = stored_window_start + window_size
-    local ttl_seconds = math.ceil((window_end - now) / 1000) + 60
-    redis.call('EXPIRE', key, ttl_seconds)
-    
-    return {1, limit - new_count, 0}
-else
-    -- Request denied - calculate retry after
     local window_end = stored_window_start + window_size
-    local retry_after = window_end - now
-    
-    return {0, 0, math.max(0, retry_after)}
+
+    if current_count + cost > limit then
+        -- Request denied, retry when the window ends
+        return 0, 0, math.max(0, window_end - now), nil
+    end
+
+    local commit = function()
+        redis.call('HMSET', key, 'count', current_count + cost, 'window_start', stored_window_start, 'config_hash', config_hash)
+        -- Set expiration to window end + buffer
+        redis.call('EXPIRE', key, math.ceil((window_end - now) / 1000) + 60)
+    end
+
+    return 1, limit - (current_count + cost), 0, commit
+end
+`
+
+// Refunds only go to the window the request was counted in, a later one starts from zero anyway.
+const fixedWindowRefundLua = `
+local function fixed_window_refund(key, config_hash, now, admitted_at, cost, limit, window_size)
+    local bucket = redis.call('HMGET', key, 'count', 'window_start', 'config_hash')
+    local current_count = tonumber(bucket[1])
+    local window_start = math.floor(admitted_at / window_size) * window_size
+
+    if current_count == nil or bucket[3] ~= config_hash or tonumber(bucket[2]) ~= window_start then
+        return
+    end
+
+    redis.call('HSET', key, 'count', math.max(0, current_count - cost))
 end
 `
 
 func (rl *RateLimiter) FixedWindowLimiter(ctx context.Context, key string,
 	algoConfig config.AlgorithmConfig, configHash string) (*LimitResult, error) {
-	now := time.Now().UnixMilli()
+	algoConfig.Algorithm = string(config.FixedWindow)
+	return rl.checkSingleLevel(ctx, key, algoConfig, configHash)
+}
+
+type fixedWindowState struct {
+	count       float64
+	windowStart float64
+	configHash  string
+}
+
+// memory store version of the fixed_window lua function
+func fixedWindowMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	limit, windowSize := p[0], p[1]
+	windowStart := math.Floor(now/windowSize) * windowSize
 
-	result := rl.redisClient.Eval(ctx, fixedWindowScript, []string{key},
-		configHash, *algoConfig.Limit, algoConfig.WindowSize.Milliseconds(), now)
+	// Config changed or window rolled over (also covers the first request): start counting again
+	currentCount, storedWindowStart := 0.0, windowStart
+	if state, ok := ms.get(key, now).(*fixedWindowState); ok && state.configHash == configHash &&
+		state.windowStart >= windowStart {
+		currentCount, storedWindowStart = state.count, state.windowStart
+	}
+
+	windowEnd := storedWindowStart + windowSize
 
-	if result.Err() != nil {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, result.Err()
+	if currentCount+cost > limit {
+		// Request denied, retry when the window ends
+		return false, 0, math.Max(0, windowEnd-now), nil
 	}
 
-	values, ok := result.Val().([]interface{})
-	if !ok || len(values) != 3 {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, fmt.Errorf("unexpected response format from Redis script")
+	commit := func() {
+		// Expire at window end + buffer
+		ttl := math.Ceil((windowEnd-now)/1000) + 60
+		ms.set(key, &fixedWindowState{count: currentCount + cost, windowStart: storedWindowStart, configHash: configHash},
+			now, ttl*1000)
 	}
 
-	allowedInt, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
-	remaining, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
-	retryAfterMs, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	return true, limit - (currentCount + cost), 0, commit
+}
+
+// memory store version of the fixed_window_refund lua function
+func fixedWindowRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	windowSize := p[1]
+	windowStart := math.Floor(admittedAt/windowSize) * windowSize
+
+	state, ok := ms.get(key, now).(*fixedWindowState)
+	if !ok || state.configHash != configHash || state.windowStart != windowStart {
+		return
+	}
 
-	return &LimitResult{
-		Allowed:    allowedInt == 1,
-		Remaining:  remaining,
-		RetryAfter: time.Duration(retryAfterMs) * time.Millisecond,
-	}, nil
+	state.count = math.Max(0, state.count-cost)
 }
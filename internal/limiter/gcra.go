@@ -0,0 +1,109 @@
+package limiter
+
+import (
+	"context"
+	"math"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// GCRA keeps a single value per key: the theoretical arrival time (tat) of the next request.
+// The tat is plain time, so it stays meaningful when the config changes and no config hash is stored.
+const gcraLua = `
+local function gcra(key, config_hash, now, cost, emission_interval, burst)
+    -- How far ahead of now the tat may run before requests are rejected
+    local tolerance = emission_interval * burst
+
+    local tat = tonumber(redis.call('GET', key)) or now
+    if tat < now then
+        tat = now
+    end
+
+    local new_tat = tat + emission_interval * cost
+    local allow_at = new_tat - tolerance
+
+    if now < allow_at then
+        -- Request denied, state is untouched so rejected requests don't push the tat further
+        return 0, 0, math.ceil(allow_at - now), nil
+    end
+
+    local commit = function()
+        -- Store with millisecond fractions, the key expires once the tat is in the past
+        redis.call('SET', key, string.format('%.3f', new_tat), 'PX', math.ceil(new_tat - now))
+    end
+
+    -- Every emission_interval between allow_at and now is one more request that fits
+    return 1, math.floor((now - allow_at) / emission_interval), 0, commit
+end
+`
+
+// Refunds move the tat back, never before now: time that already passed isn't credited.
+const gcraRefundLua = `
+local function gcra_refund(key, config_hash, now, admitted_at, cost, emission_interval)
+    local tat = tonumber(redis.call('GET', key))
+    if tat == nil then
+        return
+    end
+
+    local new_tat = tat - emission_interval * cost
+    if new_tat <= now then
+        redis.call('DEL', key)
+    else
+        redis.call('SET', key, string.format('%.3f', new_tat), 'PX', math.ceil(new_tat - now))
+    end
+end
+`
+
+func (rl *RateLimiter) GCRALimiter(ctx context.Context, key string,
+	algoConfig config.AlgorithmConfig) (*LimitResult, error) {
+	algoConfig.Algorithm = string(config.GCRA)
+	return rl.checkSingleLevel(ctx, key, algoConfig, "")
+}
+
+// memory store version of the gcra lua function, the stored value is the tat
+func gcraMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	emissionInterval, burst := p[0], p[1]
+	// How far ahead of now the tat may run before requests are rejected
+	tolerance := emissionInterval * burst
+
+	tat, ok := ms.get(key, now).(float64)
+	if !ok || tat < now {
+		tat = now
+	}
+
+	newTat := tat + emissionInterval*cost
+	allowAt := newTat - tolerance
+
+	if now < allowAt {
+		// Request denied, state is untouched so rejected requests don't push the tat further
+		return false, 0, math.Ceil(allowAt - now), nil
+	}
+
+	commit := func() {
+		// Same millisecond fractions as the lua version, the key expires once the tat is in the past
+		storedTat := math.Round(newTat*1000) / 1000
+		ms.set(key, storedTat, now, math.Ceil(newTat-now))
+	}
+
+	// Every emission_interval between allow_at and now is one more request that fits
+	return true, math.Floor((now - allowAt) / emissionInterval), 0, commit
+}
+
+// memory store version of the gcra_refund lua function
+func gcraRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	emissionInterval := p[0]
+
+	tat, ok := ms.get(key, now).(float64)
+	if !ok {
+		return
+	}
+
+	newTat := tat - emissionInterval*cost
+	if newTat <= now {
+		ms.del(key)
+		return
+	}
+	ms.set(key, math.Round(newTat*1000)/1000, now, math.Ceil(newTat-now))
+}
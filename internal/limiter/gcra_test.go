@@ -0,0 +1,214 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCRALimiter_BasicFunctionality(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "test:gcra:basic"
+
+	rate := 10
+	burst := 5
+	period := &config.Duration{Duration: 1000 * time.Millisecond}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	// First request should be allowed with burst - 1 left
+	result, err := rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int64(4), result.Remaining)
+	assert.Equal(t, time.Duration(0), result.RetryAfter)
+}
+
+func TestGCRALimiter_BurstExhaustion(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "test:gcra:burst"
+
+	rate := 1
+	burst := 3
+	period := &config.Duration{Duration: 10 * time.Second}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	// Remaining counts down exactly through the burst
+	for i := int64(3); i > 0; i-- {
+		result, err := rl.GCRALimiter(ctx, key, algoConfig)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i-1, result.Remaining)
+	}
+
+	// Next request is denied until one emission interval (10s) has passed
+	result, err := rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, int64(0), result.Remaining)
+	assert.Greater(t, result.RetryAfter, 9*time.Second)
+	assert.LessOrEqual(t, result.RetryAfter, 10*time.Second)
+}
+
+func TestGCRALimiter_SmoothPacing(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "test:gcra:pacing"
+
+	rate := 10
+	burst := 1
+	period := &config.Duration{Duration: 1000 * time.Millisecond} // one request every 100ms
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	result, err := rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int64(0), result.Remaining)
+
+	// Immediately after, the request has to wait for the rest of the interval
+	result, err = rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.LessOrEqual(t, result.RetryAfter, 100*time.Millisecond)
+
+	// No refill period quantization: one interval later one more request fits
+	time.Sleep(110 * time.Millisecond)
+
+	result, err = rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestGCRALimiter_DeniedRequestsDontAccumulate(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "test:gcra:denied"
+
+	rate := 10
+	burst := 1
+	period := &config.Duration{Duration: 1000 * time.Millisecond}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	result, err := rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// Hammering while denied must not push the next allowed time further out
+	for i := 0; i < 20; i++ {
+		result, err = rl.GCRALimiter(ctx, key, algoConfig)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.LessOrEqual(t, result.RetryAfter, 100*time.Millisecond)
+	}
+}
+
+func TestGCRALimiter_SingleKeyState(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "test:gcra:state"
+
+	rate := 5
+	burst := 2
+	period := &config.Duration{Duration: 1000 * time.Millisecond}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	_, err := rl.GCRALimiter(ctx, key, algoConfig)
+	require.NoError(t, err)
+
+	// State is a plain string value (the tat) with an expiry, not a hash
+	assert.True(t, mr.Exists(key))
+	value, err := mr.Get(key)
+	require.NoError(t, err)
+	assert.NotEmpty(t, value)
+	assert.Greater(t, mr.TTL(key), time.Duration(0))
+}
+
+func TestGCRALimiter_RedisError(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	mr.Close() // Close Redis to simulate error
+
+	ctx := context.Background()
+	key := "test:gcra:error"
+
+	rate := 5
+	burst := 2
+	period := &config.Duration{Duration: 1000 * time.Millisecond}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	result, err := rl.GCRALimiter(ctx, key, algoConfig)
+	assert.Error(t, err)
+	assert.Nil(t, result)
+}
+
+func BenchmarkGCRALimiter(b *testing.B) {
+	rl, mr := setupTestRateLimiter(nil)
+	defer mr.Close()
+
+	ctx := context.Background()
+	key := "bench:gcra"
+
+	rate := 1000000
+	burst := 1000000
+	period := &config.Duration{Duration: 1000 * time.Millisecond}
+
+	algoConfig := config.AlgorithmConfig{
+		Rate:   &rate,
+		Period: period,
+		Burst:  &burst,
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := rl.GCRALimiter(ctx, key, algoConfig)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
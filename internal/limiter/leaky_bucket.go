@@ -2,109 +2,200 @@ package limiter
 
 import (
 	"context"
-	"fmt"
-	"strconv"
-	"time"
+	"math"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 )
 
-const leakyBucketScript = `
-local key = KEYS[1]
-local config_hash = ARGV[1]
-local capacity = tonumber(ARGV[2])
-local leak_rate = tonumber(ARGV[3])
-local leak_period = tonumber(ARGV[4])
-local now = tonumber(ARGV[5])
-
--- Check if config has changed
-local stored_config = redis.call('HGET', key, 'config_hash')
-if stored_config and stored_config ~= config_hash then
-    -- Config changed, reset the bucket to empty and add current request
-    redis.call('HMSET', key, 'level', 1, 'last_leak', now, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / leak_rate) * (leak_period / 1000)) + 60)
-    return {1, capacity - 1, 0}
-end
+const leakyBucketLua = `
+local function leaky_bucket(key, config_hash, now, cost, capacity, leak_rate, leak_period)
+    local ttl = math.ceil((capacity / leak_rate) * (leak_period / 1000)) + 60
+
+    -- Get current bucket state
+    local bucket = redis.call('HMGET', key, 'level', 'last_leak', 'config_hash')
+    local current_level = tonumber(bucket[1])
+    local last_leak = tonumber(bucket[2])
+    local stored_config = bucket[3]
+
+    -- First request or config changed (hash mismatch): start from an empty bucket
+    if current_level == nil or last_leak == nil or (stored_config and stored_config ~= config_hash) then
+        current_level = 0
+        last_leak = now
+    end
+
+    -- Calculate leaking based on elapsed time
+    local time_elapsed = now - last_leak
+    if time_elapsed > 0 then
+        local periods_elapsed = math.floor(time_elapsed / leak_period)
+        if periods_elapsed > 0 then
+            local amount_to_leak = periods_elapsed * leak_rate
+            current_level = math.max(0, current_level - amount_to_leak)
+            last_leak = last_leak + (periods_elapsed * leak_period)
+        end
+    end
 
--- Get current bucket state
-local bucket = redis.call('HMGET', key, 'level', 'last_leak')
-local current_level = tonumber(bucket[1])
-local last_leak = tonumber(bucket[2])
-
--- Initialize if this is the first request
-if current_level == nil or last_leak == nil then
-    current_level = 0
-    last_leak = now
-    redis.call('HMSET', key, 'level', current_level, 'last_leak', last_leak, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / leak_rate) * (leak_period / 1000)) + 60)
+    if current_level + cost > capacity then
+        -- Bucket is full, we need to wait until enough leaked out for the cost (an empty bucket at most)
+        -- A cost over the capacity only gets here while the adaptive global limit is shrunk
+        local leaks = math.max(1, math.ceil((current_level + math.min(cost, capacity) - capacity) / leak_rate))
+        local next_leak = last_leak + leaks * leak_period
+        return 0, 0, math.max(0, next_leak - now), nil
+    end
+
+    local commit = function()
+        redis.call('HMSET', key, 'level', current_level + cost, 'last_leak', last_leak, 'config_hash', config_hash)
+        redis.call('EXPIRE', key, ttl)
+    end
+
+    -- Return remaining capacity after adding this request
+    return 1, capacity - (current_level + cost), 0, commit
 end
+`
+
+// Refunds take the units out of the stored level, the pending leak is applied on the next request.
+// Shape mode has nothing to refund, a request's departure has passed once its response is written.
+const leakyBucketRefundLua = `
+local function leaky_bucket_refund(key, config_hash, now, admitted_at, cost)
+    local bucket = redis.call('HMGET', key, 'level', 'config_hash')
+    local current_level = tonumber(bucket[1])
 
--- Calculate leaking based on elapsed time
-local time_elapsed = now - last_leak
-if time_elapsed > 0 then
-    local periods_elapsed = math.floor(time_elapsed / leak_period)
-    if periods_elapsed > 0 then
-        local amount_to_leak = periods_elapsed * leak_rate
-        current_level = math.max(0, current_level - amount_to_leak)
-        last_leak = last_leak + (periods_elapsed * leak_period)
+    -- Expired or config changed: the bucket the units were added to is gone
+    if current_level == nil or bucket[2] ~= config_hash then
+        return
     end
+
+    redis.call('HSET', key, 'level', math.max(0, current_level - cost))
 end
+`
+
+// not an algorithm of config.AlgorithmConfig, leaky_bucket with mode: shape
+const leakyBucketShapeAlgorithm = "leaky_bucket_shape"
+
+// Shape mode queues instead of counting: every admitted request gets a departure time one
+// interval (leak_period / leak_rate) after the previous one and is held by the proxy until
+// then, so the backend sees an even pace and each tenant's requests leave in arrival order.
+// Like gcra's tat the departure time is plain time. A request that would wait longer than
+// max_wait, or find capacity requests ahead of it, is rejected.
+const leakyBucketShapeLua = `
+local function leaky_bucket_shape(key, config_hash, now, cost, capacity, interval, max_wait)
+    local bucket = redis.call('HMGET', key, 'next_departure', 'config_hash')
+    local next_departure = tonumber(bucket[1]) or now
+    local stored_config = bucket[2]
+
+    -- Config changed (hash mismatch): the queue of the old pace is dropped
+    if (stored_config and stored_config ~= config_hash) or next_departure < now then
+        next_departure = now
+    end
+
+    -- Longest wait accepted: capacity - cost units ahead of this one, and max_wait
+    local wait = next_departure - now
+    local longest_wait = math.min((capacity - cost) * interval, max_wait)
+
+    if wait > longest_wait then
+        -- Queue is full, retry once enough requests have left it
+        return 0, 0, math.max(0, wait - longest_wait), nil
+    end
+
+    local commit = function()
+        redis.call('HMSET', key, 'next_departure', next_departure + cost * interval, 'config_hash', config_hash)
+        redis.call('PEXPIRE', key, math.ceil(next_departure + cost * interval - now) + 60000)
+    end
 
--- Check if we can add the request (bucket has space)
-if current_level < capacity then
-    -- Add request to bucket
-    current_level = current_level + 1
-    
-    -- Update state
-    redis.call('HMSET', key, 'level', current_level, 'last_leak', last_leak, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / leak_rate) * (leak_period / 1000)) + 60)
-    
-    -- Return remaining capacity
-    return {1, capacity - current_level, 0}
-else
-    -- Bucket is full, request rejected
-    redis.call('HMSET', key, 'level', current_level, 'last_leak', last_leak, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / leak_rate) * (leak_period / 1000)) + 60)
-    
-    -- Calculate when space will be available
-    -- We need to wait for at least one item to leak out
-    local next_leak = last_leak + leak_period
-    local retry_after = math.max(0, next_leak - now)
-    
-    return {0, 0, retry_after}
+    -- An admitted request with a retry after is held that long, see LimitResult.Delay
+    return 1, capacity - cost - math.ceil(wait / interval), wait, commit
 end
 `
 
 func (rl *RateLimiter) LeakyBucketLimiter(ctx context.Context, key string,
 	algoConfig config.AlgorithmConfig, configHash string) (*LimitResult, error) {
-	now := time.Now().UnixMilli()
+	algoConfig.Algorithm = string(config.LeakyBucket)
+	return rl.checkSingleLevel(ctx, key, algoConfig, configHash)
+}
+
+type leakyBucketState struct {
+	level      float64
+	lastLeak   float64
+	configHash string
+}
+
+// memory store version of the leaky_bucket lua function
+func leakyBucketMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	capacity, leakRate, leakPeriod := p[0], p[1], p[2]
+	ttl := math.Ceil((capacity/leakRate)*(leakPeriod/1000)) + 60
+
+	// First request or config changed (hash mismatch): start from an empty bucket
+	currentLevel, lastLeak := 0.0, now
+	if state, ok := ms.get(key, now).(*leakyBucketState); ok && state.configHash == configHash {
+		currentLevel, lastLeak = state.level, state.lastLeak
+	}
+
+	// Calculate leaking based on elapsed time
+	if timeElapsed := now - lastLeak; timeElapsed > 0 {
+		periodsElapsed := math.Floor(timeElapsed / leakPeriod)
+		if periodsElapsed > 0 {
+			currentLevel = math.Max(0, currentLevel-periodsElapsed*leakRate)
+			lastLeak = lastLeak + periodsElapsed*leakPeriod
+		}
+	}
+
+	if currentLevel+cost > capacity {
+		// Bucket is full, we need to wait until enough leaked out for the cost (an empty bucket at most)
+		// A cost over the capacity only gets here while the adaptive global limit is shrunk
+		leaks := math.Max(1, math.Ceil((currentLevel+math.Min(cost, capacity)-capacity)/leakRate))
+		return false, 0, math.Max(0, lastLeak+leaks*leakPeriod-now), nil
+	}
+
+	commit := func() {
+		ms.set(key, &leakyBucketState{level: currentLevel + cost, lastLeak: lastLeak, configHash: configHash},
+			now, ttl*1000)
+	}
 
-	result := rl.redisClient.Eval(ctx, leakyBucketScript, []string{key},
-		configHash, *algoConfig.Capacity, *algoConfig.LeakRate, algoConfig.LeakPeriod.Milliseconds(), now)
+	return true, capacity - (currentLevel + cost), 0, commit
+}
 
-	if result.Err() != nil {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, result.Err()
+// memory store version of the leaky_bucket_refund lua function
+func leakyBucketRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	// Expired or config changed: the bucket the units were added to is gone
+	state, ok := ms.get(key, now).(*leakyBucketState)
+	if !ok || state.configHash != configHash {
+		return
 	}
 
-	values, ok := result.Val().([]interface{})
-	if !ok || len(values) != 3 {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, fmt.Errorf("unexpected response format from Redis script")
+	state.level = math.Max(0, state.level-cost)
+}
+
+type leakyBucketShapeState struct {
+	nextDeparture float64
+	configHash    string
+}
+
+// memory store version of the leaky_bucket_shape lua function
+func leakyBucketShapeMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	capacity, interval, maxWait := p[0], p[1], p[2]
+
+	// Config changed (hash mismatch): the queue of the old pace is dropped
+	nextDeparture := now
+	if state, ok := ms.get(key, now).(*leakyBucketShapeState); ok && state.configHash == configHash {
+		nextDeparture = math.Max(now, state.nextDeparture)
 	}
 
-	allowedInt, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
-	remaining, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
-	retryAfterMs, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	// Longest wait accepted: capacity - cost units ahead of this one, and max_wait
+	wait := nextDeparture - now
+	longestWait := math.Min((capacity-cost)*interval, maxWait)
+
+	if wait > longestWait {
+		// Queue is full, retry once enough requests have left it
+		return false, 0, math.Max(0, wait-longestWait), nil
+	}
+
+	commit := func() {
+		ms.set(key, &leakyBucketShapeState{nextDeparture: nextDeparture + cost*interval, configHash: configHash},
+			now, math.Ceil(nextDeparture+cost*interval-now)+60000)
+	}
 
-	return &LimitResult{
-		Allowed:    allowedInt == 1,
-		Remaining:  remaining,
-		RetryAfter: time.Duration(retryAfterMs) * time.Millisecond,
-	}, nil
+	// An admitted request with a retry after is held that long, see LimitResult.Delay
+	return true, capacity - cost - math.Ceil(wait/interval), wait, commit
 }
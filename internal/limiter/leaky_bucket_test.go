@@ -21,7 +21,7 @@ func setupTestRateLimiterleaky(t *testing.T) (*RateLimiter, *miniredis.Miniredis
 	})
 
 	rl := &RateLimiter{
-		redisClient: rdb,
+		store: NewRedisStore(rdb),
 	}
 
 	return rl, mr
@@ -200,6 +200,91 @@ func TestLeakyBucketLimiter_RedisError(t *testing.T) {
 	assert.Nil(t, result)
 }
 
+func shapeConfig(capacity int, maxWait time.Duration) config.AlgorithmConfig {
+	leakRate := 10
+	algoConfig := config.AlgorithmConfig{
+		Algorithm:  string(config.LeakyBucket),
+		Capacity:   &capacity,
+		LeakRate:   &leakRate,
+		LeakPeriod: &config.Duration{Duration: time.Second},
+		Mode:       config.LeakyBucketShape,
+	}
+	if maxWait > 0 {
+		algoConfig.MaxWait = &config.Duration{Duration: maxWait}
+	}
+	return algoConfig
+}
+
+func TestLeakyBucketShape_QueuesAndPaces(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := shapeConfig(3, 0)
+
+		// one departure every 100ms, in arrival order
+		for i := 0; i < 3; i++ {
+			result, err := rl.LeakyBucketLimiter(ctx, "test:shape:pace", algoConfig, "shape_v1")
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, int64(2-i), result.Remaining)
+			assert.InDelta(t, float64(i*100), float64(result.Delay.Milliseconds()), 20, "request %d", i)
+			assert.Zero(t, result.RetryAfter)
+		}
+
+		// only the overflow is rejected, until the first queued request left
+		result, err := rl.LeakyBucketLimiter(ctx, "test:shape:pace", algoConfig, "shape_v1")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Zero(t, result.Delay)
+		assert.InDelta(t, 100, float64(result.RetryAfter.Milliseconds()), 20)
+
+		time.Sleep(120 * time.Millisecond)
+
+		result, err = rl.LeakyBucketLimiter(ctx, "test:shape:pace", algoConfig, "shape_v1")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.InDelta(t, 180, float64(result.Delay.Milliseconds()), 20)
+	})
+}
+
+func TestLeakyBucketShape_MaxWait(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		algoConfig := shapeConfig(10, 150*time.Millisecond)
+
+		for i := 0; i < 2; i++ {
+			result, err := rl.LeakyBucketLimiter(ctx, "test:shape:wait", algoConfig, "shape_v1")
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+		}
+
+		// the third would wait 200ms
+		result, err := rl.LeakyBucketLimiter(ctx, "test:shape:wait", algoConfig, "shape_v1")
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.InDelta(t, 50, float64(result.RetryAfter.Milliseconds()), 20)
+	})
+}
+
+func TestLeakyBucketShape_DeniedRequestKeepsNoDeparture(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 100, 1)
+		limiterConfig.PerTenant.AlgorithmConfig = shapeConfig(5, 0)
+
+		for i := 0; i < 3; i++ {
+			_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+		}
+
+		// the endpoint rejected the last two, they never took a place in the queue
+		rule.Path = "/api/other"
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.InDelta(t, 100, float64(result.Levels[config.PerTenantLevel].Delay.Milliseconds()), 20)
+	})
+}
+
 func BenchmarkLeakyBucketLimiter(b *testing.B) {
 	rl, mr := setupTestRateLimiterleaky(nil)
 	defer mr.Close()
@@ -9,22 +9,38 @@ import (
 	"time"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
-	"github.com/redis/go-redis/v9"
 )
 
 type RateLimiter struct {
-	redisClient *redis.Client
+	store    Store
+	plans    planCache
+	adaptive adaptiveLimit
 }
 
 type LimitResult struct {
 	Allowed    bool
 	Remaining  int64
 	RetryAfter time.Duration
+	// allowed but held that long before it is forwarded, set by leaky_bucket in shape mode
+	Delay time.Duration
+	// slot taken by a concurrency level, nil for every other algorithm and when nothing was consumed
+	Lease *Lease
 }
 
-func NewRateLimiter(redisClient *redis.Client) *RateLimiter {
+// result of an algorithm function, the retry after of an allowed request is its delay
+func newLimitResult(allowed bool, remaining int64, retryAfterMs int64) *LimitResult {
+	result := &LimitResult{Allowed: allowed, Remaining: remaining}
+	if allowed {
+		result.Delay = time.Duration(retryAfterMs) * time.Millisecond
+	} else {
+		result.RetryAfter = time.Duration(retryAfterMs) * time.Millisecond
+	}
+	return result
+}
+
+func NewRateLimiter(store Store) *RateLimiter {
 	return &RateLimiter{
-		redisClient: redisClient,
+		store: store,
 	}
 }
 
@@ -32,21 +48,24 @@ func (rl *RateLimiter) CheckGlobalLimit(ctx context.Context,
 	globalConfig *config.Global) (*LimitResult, error) {
 
 	redisKey := constructRedisKey(config.GlobalLevel, "", []string{}, "")
-	algoConfig := globalConfig.AlgorithmConfig
-	configHash, err := generateConfigHash(algoConfig)
+	now := time.Now()
+	algoConfig := globalConfig.AlgorithmAt(now)
+	configHash, err := levelConfigHash(algoConfig, globalConfig.Schedules, globalConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error generating config hash")
 	}
 
-	return rl.checkLimit(ctx, redisKey, algoConfig, configHash)
+	// the hash is the configured limit's, resizing keeps the state
+	return rl.checkLimit(ctx, redisKey, rl.adaptGlobal(globalConfig, algoConfig, now), configHash)
 }
 
-func (rl *RateLimiter) CheckTenantLimit(ctx context.Context, tenantKey string,
+// plan selects the per-plan override of the tenant limit, empty uses the base limit
+func (rl *RateLimiter) CheckTenantLimit(ctx context.Context, tenantKey, plan string,
 	tenantConfig *config.PerTenant) (*LimitResult, error) {
 
 	redisKey := constructRedisKey(config.PerTenantLevel, "", []string{}, tenantKey)
-	algoConfig := tenantConfig.AlgorithmConfig
-	configHash, err := generateConfigHash(algoConfig)
+	algoConfig := tenantConfig.AlgorithmFor(plan, time.Now())
+	configHash, err := levelConfigHash(algoConfig, tenantConfig.Schedules, tenantConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error generating config hash")
 	}
@@ -54,14 +73,14 @@ func (rl *RateLimiter) CheckTenantLimit(ctx context.Context, tenantKey string,
 	return rl.checkLimit(ctx, redisKey, algoConfig, configHash)
 }
 
-func (rl *RateLimiter) CheckEndpointLimit(ctx context.Context, tenantKey string,
+func (rl *RateLimiter) CheckEndpointLimit(ctx context.Context, tenantKey, plan string,
 	endpointConfig *config.EndpointRule) (*LimitResult, error) {
 
 	methods := endpointConfig.Methods
 	path := endpointConfig.Path
 	redisKey := constructRedisKey(config.PerEndpointLevel, path, methods, tenantKey)
-	algoConfig := endpointConfig.AlgorithmConfig
-	configHash, err := generateConfigHash(algoConfig)
+	algoConfig := endpointConfig.AlgorithmFor(plan, time.Now())
+	configHash, err := levelConfigHash(algoConfig, endpointConfig.Schedules, endpointConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error generating config hash")
 	}
@@ -80,11 +99,17 @@ func (rl *RateLimiter) checkLimit(ctx context.Context, redisKey string,
 		return rl.FixedWindowLimiter(ctx, redisKey, algoConfig, configHash)
 	case string(config.SlidingWindow):
 		return rl.SlidingWindowLimiter(ctx, redisKey, algoConfig, configHash)
+	case string(config.GCRA):
+		return rl.GCRALimiter(ctx, redisKey, algoConfig)
+	case string(config.Concurrency):
+		return rl.ConcurrencyLimiter(ctx, redisKey, algoConfig, configHash)
 	default:
 		return nil, fmt.Errorf("unknown rate limiting algorithm")
 	}
 }
 
+// Tenant keys carry the tenant as hash tag ({...}) right after the fixed prefix, so every key
+// of one tenant maps to the same redis cluster slot whatever the path contains.
 func constructRedisKey(LevelType config.LimitLevelType, endpointPath string, endpointMethod []string,
 	tenantKey string) string {
 	prefix := "ctrl:limiter:"
@@ -92,21 +117,36 @@ func constructRedisKey(LevelType config.LimitLevelType, endpointPath string, end
 
 	switch LevelType {
 	case config.GlobalLevel:
-		//ctrl:limiter:global
-		return fmt.Sprintf("%sglobal", prefix)
+		//ctrl:limiter:{global}
+		return fmt.Sprintf("%s{global}", prefix)
 	case config.PerTenantLevel:
-		//ctrl:limiter:pertenant:user123
-		return fmt.Sprintf("%spertenant:%s", prefix, tenantKey)
+		//ctrl:limiter:pertenant:{user123}
+		return fmt.Sprintf("%spertenant:{%s}", prefix, tenantKey)
 	case config.PerEndpointLevel:
-		//ctrl:limiter:perendpoint:GET_POST|/api/v2|user123
-		return fmt.Sprintf("%sperendpoint:%s:%s:%s", prefix, methodsString, endpointPath, tenantKey)
+		//ctrl:limiter:perendpoint:{user123}:GET_POST:/api/v2
+		return fmt.Sprintf("%sperendpoint:{%s}:%s:%s", prefix, tenantKey, methodsString, endpointPath)
 	default:
 		return ""
 	}
 }
 
-func generateConfigHash(algoConfig config.AlgorithmConfig) (string, error) {
-	data, err := json.Marshal(algoConfig)
+// levelConfigHash is the hash the state of a level is kept under, a changed hash starts it over.
+// A level with schedules hashes its whole definition and the active algorithm rather than the
+// active limit: a schedule switch keeps the state and the new limit applies to it right away,
+// a config reload or a switch to another algorithm starts over.
+func levelConfigHash(algoConfig config.AlgorithmConfig, schedules config.Schedules,
+	definition interface{}) (string, error) {
+	if len(schedules) == 0 {
+		return generateConfigHash(algoConfig)
+	}
+	return generateConfigHash(struct {
+		Algorithm string
+		Level     interface{}
+	}{algoConfig.Algorithm, definition})
+}
+
+func generateConfigHash(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return "", err
 	}
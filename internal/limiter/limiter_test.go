@@ -1,10 +1,14 @@
 package limiter
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,8 +22,96 @@ func setupTestRateLimiter(t *testing.T) (*RateLimiter, *miniredis.Miniredis) {
 	})
 
 	rl := &RateLimiter{
-		redisClient: rdb,
+		store: NewRedisStore(rdb),
 	}
 
 	return rl, mr
 }
+
+func scheduledRule() *config.EndpointRule {
+	return &config.EndpointRule{
+		Path:            "/api/batch",
+		AlgorithmConfig: fixedWindowConfig(10),
+		Schedules: config.Schedules{
+			{Name: "night", From: "22:00", To: "06:00", AlgorithmConfig: fixedWindowConfig(100)},
+			{Name: "business", Days: []string{"mon-fri"}, From: "09:00", To: "17:00",
+				AlgorithmConfig: fixedWindowConfig(5)},
+		},
+	}
+}
+
+func TestLevelConfigHash_Schedules(t *testing.T) {
+	rule := scheduledRule()
+
+	base, err := levelConfigHash(rule.AlgorithmConfig, rule.Schedules, rule)
+	require.NoError(t, err)
+	night, err := levelConfigHash(rule.Schedules[0].AlgorithmConfig, rule.Schedules, rule)
+	require.NoError(t, err)
+	assert.Equal(t, base, night, "a schedule switch with the same algorithm keeps the state")
+
+	tokenBucket := config.AlgorithmConfig{Algorithm: string(config.TokenBucket)}
+	switched, err := levelConfigHash(tokenBucket, rule.Schedules, rule)
+	require.NoError(t, err)
+	assert.NotEqual(t, base, switched, "another algorithm starts over")
+
+	reloaded := scheduledRule()
+	reloaded.Schedules[1].AlgorithmConfig = fixedWindowConfig(3)
+	changed, err := levelConfigHash(reloaded.AlgorithmConfig, reloaded.Schedules, reloaded)
+	require.NoError(t, err)
+	assert.NotEqual(t, base, changed, "a changed definition starts over")
+
+	unscheduled, err := levelConfigHash(rule.AlgorithmConfig, nil, rule)
+	require.NoError(t, err)
+	plain, err := generateConfigHash(rule.AlgorithmConfig)
+	require.NoError(t, err)
+	assert.Equal(t, plain, unscheduled, "levels without schedules hash their limit")
+}
+
+func TestCheckLevel_ScheduleSwitchKeepsState(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		rule := scheduledRule()
+		key := constructRedisKey(config.PerEndpointLevel, rule.Path, rule.Methods, "user1")
+
+		check := func(algoConfig config.AlgorithmConfig) *LimitResult {
+			level, err := newLevelCheck(config.PerEndpointLevel, key, algoConfig, rule.Schedules, rule)
+			require.NoError(t, err)
+			result, err := rl.checkLevel(ctx, level)
+			require.NoError(t, err)
+			return result
+		}
+
+		for i := 0; i < 7; i++ {
+			require.True(t, check(rule.AlgorithmConfig).Allowed)
+		}
+
+		// business hours start: the 7 requests count against the stricter limit
+		result := check(rule.Schedules[1].AlgorithmConfig)
+		assert.False(t, result.Allowed)
+		assert.Greater(t, result.RetryAfter, time.Duration(0))
+
+		// back to the base limit, the window goes on
+		result = check(rule.AlgorithmConfig)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(2), result.Remaining)
+	})
+}
+
+func TestTokenBucket_LoweredCapacityAppliesToStoredTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		bucket := func(capacity int) config.AlgorithmConfig {
+			refillRate := 1
+			return config.AlgorithmConfig{Algorithm: string(config.TokenBucket), Capacity: &capacity,
+				RefillRate: &refillRate, RefillPeriod: &config.Duration{Duration: time.Hour}}
+		}
+
+		result, err := rl.TokenBucketLimiter(ctx, "ctrl:test", bucket(100), "scheduled")
+		require.NoError(t, err)
+		assert.Equal(t, int64(99), result.Remaining)
+
+		result, err = rl.TokenBucketLimiter(ctx, "ctrl:test", bucket(10), "scheduled")
+		require.NoError(t, err)
+		assert.Equal(t, int64(9), result.Remaining)
+	})
+}
@@ -0,0 +1,407 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+const (
+	memoryShardCount = 64
+	// expired entries are skipped on read, the sweep only frees their memory
+	memorySweepInterval = time.Minute
+)
+
+// Go version of a lua algorithm function, same parameters and results:
+// only reads state, commit() writes the consumed request back.
+type memoryLimitFunc func(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (allowed bool, remaining, retryAfter float64, commit func())
+
+var memoryAlgorithms = map[config.AlgorithmType]memoryLimitFunc{
+	config.TokenBucket:   tokenBucketMemory,
+	config.LeakyBucket:   leakyBucketMemory,
+	config.FixedWindow:   fixedWindowMemory,
+	config.SlidingWindow: slidingWindowMemory,
+	config.GCRA:          gcraMemory,
+	config.Concurrency:   concurrencyMemory,
+	quotaAlgorithm:       quotaMemory,
+
+	leakyBucketShapeAlgorithm: leakyBucketShapeMemory,
+}
+
+type memoryEntry struct {
+	value interface{}
+	// unix milliseconds, 0 never expires
+	expiresAt float64
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// MemoryStore keeps the state in process with the same semantics as the redis scripts,
+// for single node deployments and runs without redis. Keys are spread over lock shards,
+// an admission locks the shards of all its keys.
+type MemoryStore struct {
+	shards    [memoryShardCount]*memoryShard
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryStore() *MemoryStore {
+	ms := &MemoryStore{
+		done: make(chan struct{}),
+	}
+	for i := range ms.shards {
+		ms.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+
+	go ms.sweep()
+
+	return ms
+}
+
+func (ms *MemoryStore) Admit(ctx context.Context, req *AdmissionRequest) (*AdmissionResult, error) {
+	now := float64(time.Now().UnixMilli())
+
+	keys := make([]string, 0, len(req.Levels)+1)
+	limitFuncs := make([]memoryLimitFunc, len(req.Levels))
+	params := make([][3]float64, len(req.Levels))
+
+	for i, level := range req.Levels {
+		limitFunc, ok := memoryAlgorithms[config.AlgorithmType(level.function())]
+		if !ok {
+			return nil, fmt.Errorf("unknown rate limiting algorithm")
+		}
+		limitFuncs[i] = limitFunc
+		params[i] = level.Params
+		keys = append(keys, level.Key)
+	}
+
+	model := req.Reputation.Model()
+	checkBan := req.TenantKey != "" && !req.Peek
+	trackReputation := checkBan && model.Enabled
+	reputationKey := constructReputationKey(req.TenantKey)
+	banKey := constructBanKey(req.TenantKey)
+	if checkBan {
+		keys = append(keys, reputationKey, banKey)
+	}
+
+	unlock := ms.lock(keys)
+	defer unlock()
+
+	reputation := &Reputation{Score: 1.0}
+	if checkBan {
+		if trackReputation {
+			reputation = readReputationMemory(ms, reputationKey, now)
+		}
+
+		// Banned tenants are denied before any level is checked, nothing is consumed
+		if bannedFor := ms.pttl(banKey, now); bannedFor > 0 {
+			return &AdmissionResult{
+				Levels:     map[config.LimitLevelType]*LimitResult{},
+				Reputation: reputation,
+				BannedFor:  time.Duration(bannedFor) * time.Millisecond,
+			}, nil
+		}
+	}
+
+	admission := &AdmissionResult{
+		Allowed:    true,
+		Levels:     make(map[config.LimitLevelType]*LimitResult, len(req.Levels)),
+		admittedAt: now,
+	}
+	commits := make([]func(), 0, len(req.Levels))
+	softDenied := false
+
+	for i, level := range req.Levels {
+		allowed, remaining, retryAfter, commit := limitFuncs[i](ms, level.Key, level.ConfigHash, now, req.units(), params[i],
+			level.LeaseID)
+
+		admission.Levels[level.Level] = newLimitResult(allowed, int64(remaining), int64(retryAfter))
+
+		if req.Peek {
+			// Only reported, never consumed
+			continue
+		}
+
+		if allowed {
+			commits = append(commits, commit)
+			continue
+		}
+
+		// without reputation the global level is hard
+		soft := level.Level == config.GlobalLevel && model.Enabled
+		if !soft || (trackReputation && reputation.Score <= model.Threshold) {
+			admission.Allowed = false
+			admission.DeniedLevel = level.Level
+			softDenied = soft
+			break
+		}
+	}
+
+	if admission.Allowed {
+		for _, commit := range commits {
+			commit()
+		}
+	}
+
+	// Rejections by a soft level don't count as violations, the tenant didn't exceed its own limits
+	if trackReputation && !softDenied {
+		reputation = updateReputationMemory(ms, reputationKey, !admission.Allowed, now, model)
+	}
+	if checkBan {
+		admission.Reputation = reputation
+	}
+
+	return admission, nil
+}
+
+func (ms *MemoryStore) UpdateReputation(ctx context.Context, tenantKey string, isViolation bool,
+	model *config.Reputation) (*Reputation, error) {
+	reputationKey := constructReputationKey(tenantKey)
+
+	unlock := ms.lock([]string{reputationKey})
+	defer unlock()
+
+	return updateReputationMemory(ms, reputationKey, isViolation, float64(time.Now().UnixMilli()), model), nil
+}
+
+func (ms *MemoryStore) GetReputation(ctx context.Context, tenantKey string) (*Reputation, error) {
+	reputationKey := constructReputationKey(tenantKey)
+
+	unlock := ms.lock([]string{reputationKey})
+	defer unlock()
+
+	return readReputationMemory(ms, reputationKey, float64(time.Now().UnixMilli())), nil
+}
+
+// there is no shared plan mapping without redis, every tenant gets the default plan
+func (ms *MemoryStore) GetTenantPlan(ctx context.Context, hashKey, tenantKey string) (string, error) {
+	return "", nil
+}
+
+func (ms *MemoryStore) SetBan(ctx context.Context, tenantKey string, duration time.Duration) error {
+	banKey := constructBanKey(tenantKey)
+
+	unlock := ms.lock([]string{banKey})
+	defer unlock()
+
+	ms.set(banKey, true, float64(time.Now().UnixMilli()), float64(duration.Milliseconds()))
+	return nil
+}
+
+func (ms *MemoryStore) GetBan(ctx context.Context, tenantKey string) (time.Duration, error) {
+	banKey := constructBanKey(tenantKey)
+
+	unlock := ms.lock([]string{banKey})
+	defer unlock()
+
+	// negative for a ban without expiry, like the redis store
+	return time.Duration(max(ms.pttl(banKey, float64(time.Now().UnixMilli())), 0)) * time.Millisecond, nil
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	unlock := ms.lock(keys)
+	defer unlock()
+
+	for _, key := range keys {
+		ms.del(key)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ReleaseLease(ctx context.Context, key, leaseID string) error {
+	unlock := ms.lock([]string{key})
+	defer unlock()
+
+	if state, ok := ms.get(key, float64(time.Now().UnixMilli())).(*concurrencyState); ok {
+		delete(state.leases, leaseID)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) RenewLease(ctx context.Context, key, leaseID string, lease time.Duration) error {
+	now := float64(time.Now().UnixMilli())
+
+	unlock := ms.lock([]string{key})
+	defer unlock()
+
+	state, ok := ms.get(key, now).(*concurrencyState)
+	if !ok {
+		return nil
+	}
+	// released or expired, its slot may be someone else's by now
+	if expiresAt, ok := state.leases[leaseID]; !ok || expiresAt <= now {
+		return nil
+	}
+	state.leases[leaseID] = now + float64(lease.Milliseconds())
+	ms.set(key, state, now, state.latest()-now)
+	return nil
+}
+
+func (ms *MemoryStore) Refund(ctx context.Context, req *RefundRequest) error {
+	now := float64(time.Now().UnixMilli())
+
+	keys := make([]string, 0, len(req.Levels))
+	for _, level := range req.Levels {
+		keys = append(keys, level.Key)
+	}
+
+	unlock := ms.lock(keys)
+	defer unlock()
+
+	for _, level := range req.Levels {
+		if refund, ok := memoryRefunds[config.AlgorithmType(level.function())]; ok {
+			refund(ms, level.Key, level.ConfigHash, now, req.AdmittedAt, req.units(), level.Params)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ScanReputations(ctx context.Context,
+	visit func(tenantKey string, reputation *Reputation)) error {
+	now := float64(time.Now().UnixMilli())
+
+	type tenantReputation struct {
+		tenantKey  string
+		reputation *Reputation
+	}
+
+	for _, shard := range ms.shards {
+		// visited after unlocking, visit may be slow
+		var found []tenantReputation
+
+		shard.mu.Lock()
+		for key := range shard.entries {
+			tenantKey, ok := tenantFromReputationKey(key)
+			if !ok || ms.get(key, now) == nil {
+				continue
+			}
+			found = append(found, tenantReputation{tenantKey, readReputationMemory(ms, key, now)})
+		}
+		shard.mu.Unlock()
+
+		for _, entry := range found {
+			visit(entry.tenantKey, entry.reputation)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	ms.closeOnce.Do(func() {
+		close(ms.done)
+	})
+	return nil
+}
+
+func (ms *MemoryStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % memoryShardCount)
+}
+
+// locks the shards of all keys once each, always in index order so concurrent admissions can't deadlock
+func (ms *MemoryStore) lock(keys []string) func() {
+	indexes := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		index := ms.shardIndex(key)
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		ms.shards[index].mu.Lock()
+	}
+
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			ms.shards[indexes[i]].mu.Unlock()
+		}
+	}
+}
+
+// get, set, del, ttl and pttl expect the shard of the key to be locked
+
+func (ms *MemoryStore) get(key string, now float64) interface{} {
+	entry, ok := ms.shards[ms.shardIndex(key)].entries[key]
+	if !ok || (entry.expiresAt > 0 && entry.expiresAt <= now) {
+		return nil
+	}
+	return entry.value
+}
+
+// a ttl of 0 (or less) never expires, like a redis SET without PX
+func (ms *MemoryStore) set(key string, value interface{}, now, ttlMs float64) {
+	expiresAt := 0.0
+	if ttlMs > 0 {
+		expiresAt = now + ttlMs
+	}
+	ms.shards[ms.shardIndex(key)].entries[key] = &memoryEntry{value: value, expiresAt: expiresAt}
+}
+
+func (ms *MemoryStore) del(key string) {
+	delete(ms.shards[ms.shardIndex(key)].entries, key)
+}
+
+// remaining seconds like redis TTL, 0 for missing keys and -1 for keys that never expire
+func (ms *MemoryStore) ttl(key string, now float64) int64 {
+	entry, ok := ms.shards[ms.shardIndex(key)].entries[key]
+	if ok && entry.expiresAt == 0 {
+		return -1
+	}
+	if !ok || entry.expiresAt <= now {
+		return 0
+	}
+	return int64((entry.expiresAt - now + 500) / 1000)
+}
+
+// remaining milliseconds like redis PTTL, 0 for missing keys and -1 for keys that never expire
+func (ms *MemoryStore) pttl(key string, now float64) int64 {
+	entry, ok := ms.shards[ms.shardIndex(key)].entries[key]
+	if ok && entry.expiresAt == 0 {
+		return -1
+	}
+	if !ok || entry.expiresAt <= now {
+		return 0
+	}
+	return int64(entry.expiresAt - now)
+}
+
+func (ms *MemoryStore) sweep() {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.done:
+			return
+		case <-ticker.C:
+			now := float64(time.Now().UnixMilli())
+			for _, shard := range ms.shards {
+				shard.mu.Lock()
+				for key, entry := range shard.entries {
+					if entry.expiresAt > 0 && entry.expiresAt <= now {
+						delete(shard.entries, key)
+					}
+				}
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
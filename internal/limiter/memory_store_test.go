@@ -0,0 +1,221 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestMemoryRateLimiter(t *testing.T) *RateLimiter {
+	store := NewMemoryStore()
+	if t != nil {
+		t.Cleanup(func() { _ = store.Close() })
+	}
+	return NewRateLimiter(store)
+}
+
+// runs test once against a redis (miniredis) and once against a memory backed limiter
+func forEachStore(t *testing.T, test func(t *testing.T, rl *RateLimiter)) {
+	t.Run("Redis", func(t *testing.T) {
+		rl, mr := setupTestRateLimiter(t)
+		defer mr.Close()
+		test(t, rl)
+	})
+	t.Run("Memory", func(t *testing.T) {
+		test(t, setupTestMemoryRateLimiter(t))
+	})
+}
+
+func memoryTestAlgorithms() map[string]config.AlgorithmConfig {
+	capacity, rate, limit, burst := 3, 1, 3, 2
+	minute := &config.Duration{Duration: time.Minute}
+
+	return map[string]config.AlgorithmConfig{
+		"token_bucket": {Algorithm: string(config.TokenBucket), Capacity: &capacity, RefillRate: &rate,
+			RefillPeriod: minute},
+		"leaky_bucket": {Algorithm: string(config.LeakyBucket), Capacity: &capacity, LeakRate: &rate,
+			LeakPeriod: minute},
+		"leaky_bucket_shape": {Algorithm: string(config.LeakyBucket), Capacity: &capacity, LeakRate: &rate,
+			LeakPeriod: minute, Mode: config.LeakyBucketShape},
+		"fixed_window":   {Algorithm: string(config.FixedWindow), Limit: &limit, WindowSize: minute},
+		"sliding_window": {Algorithm: string(config.SlidingWindow), Limit: &limit, WindowSize: minute},
+		"gcra":           {Algorithm: string(config.GCRA), Rate: &rate, Period: minute, Burst: &burst},
+		"concurrency":    {Algorithm: string(config.Concurrency), MaxInFlight: &limit},
+	}
+}
+
+func TestMemoryStore_MatchesRedisStore(t *testing.T) {
+	for name, algoConfig := range memoryTestAlgorithms() {
+		t.Run(name, func(t *testing.T) {
+			redisLimiter, mr := setupTestRateLimiter(t)
+			defer mr.Close()
+			memoryLimiter := setupTestMemoryRateLimiter(t)
+
+			ctx := context.Background()
+			limiterConfig, rule := admissionTestConfig(100, 100, 100)
+			rule.AlgorithmConfig = algoConfig
+
+			for i := 0; i < 6; i++ {
+				expected, err := redisLimiter.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+				require.NoError(t, err)
+				actual, err := memoryLimiter.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+				require.NoError(t, err)
+
+				assert.Equal(t, expected.Allowed, actual.Allowed, "request %d", i)
+				assert.Equal(t, expected.DeniedLevel, actual.DeniedLevel, "request %d", i)
+				require.Equal(t, len(expected.Levels), len(actual.Levels), "request %d", i)
+				for level, result := range expected.Levels {
+					assert.Equal(t, result.Allowed, actual.Levels[level].Allowed, "request %d %s", i, level)
+					assert.Equal(t, result.Remaining, actual.Levels[level].Remaining, "request %d %s", i, level)
+				}
+				assert.Equal(t, expected.Reputation.Score, actual.Reputation.Score, "request %d", i)
+				assert.Equal(t, expected.Reputation.ViolationCount, actual.Reputation.ViolationCount, "request %d", i)
+				assert.Equal(t, expected.Reputation.GoodRequests, actual.Reputation.GoodRequests, "request %d", i)
+				assert.Equal(t, expected.Reputation.TTL, actual.Reputation.TTL, "request %d", i)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_LaterRejectionDoesNotConsume(t *testing.T) {
+	rl := setupTestMemoryRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 3, 1)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	for i := 0; i < 5; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+	}
+
+	// Tenant quota only paid for the allowed request
+	rule.Path = "/api/other"
+	result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int64(1), result.Levels[config.PerTenantLevel].Remaining)
+	assert.Equal(t, int64(98), result.Levels[config.GlobalLevel].Remaining)
+}
+
+func TestMemoryStore_GlobalLimitOnlyRejectsBadReputation(t *testing.T) {
+	rl := setupTestMemoryRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1, 100, 100)
+
+	_, err := rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+
+	result, err := rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.False(t, result.Levels[config.GlobalLevel].Allowed)
+
+	for i := 0; i < 10; i++ {
+		_, err := rl.UpdateReputation(ctx, "bad_user", true)
+		require.NoError(t, err)
+	}
+	before, err := rl.GetTenantReputation(ctx, "bad_user")
+	require.NoError(t, err)
+
+	result, err = rl.CheckLimits(ctx, "bad_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.GlobalLevel, result.DeniedLevel)
+	assert.Equal(t, before.ViolationCount, result.Reputation.ViolationCount)
+}
+
+func TestMemoryStore_ConfigChange(t *testing.T) {
+	rl := setupTestMemoryRateLimiter(t)
+
+	ctx := context.Background()
+	algoConfig := memoryTestAlgorithms()["token_bucket"]
+
+	for i := 0; i < 3; i++ {
+		result, err := rl.TokenBucketLimiter(ctx, "test:key", algoConfig, "config_hash_v1")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	result, err := rl.TokenBucketLimiter(ctx, "test:key", algoConfig, "config_hash_v1")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// New config hash resets the bucket
+	result, err = rl.TokenBucketLimiter(ctx, "test:key", algoConfig, "config_hash_v2")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int64(2), result.Remaining)
+}
+
+func TestMemoryStore_Expiry(t *testing.T) {
+	ms := NewMemoryStore()
+	defer ms.Close()
+
+	unlock := ms.lock([]string{"test:key"})
+	defer unlock()
+
+	ms.set("test:key", 1.0, 1000, 500)
+	assert.Equal(t, 1.0, ms.get("test:key", 1499))
+	assert.Equal(t, int64(1), ms.ttl("test:key", 1000))
+	assert.Nil(t, ms.get("test:key", 1500))
+	assert.Equal(t, int64(0), ms.ttl("test:key", 1500))
+
+	// No ttl never expires
+	ms.set("test:key", 2.0, 1000, 0)
+	assert.Equal(t, 2.0, ms.get("test:key", 1e12))
+	assert.Equal(t, int64(-1), ms.ttl("test:key", 1e12))
+	assert.Equal(t, int64(-1), ms.pttl("test:key", 1e12))
+}
+
+func TestMemoryStore_ConcurrentAccess(t *testing.T) {
+	rl := setupTestMemoryRateLimiter(t)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1000, 50, 1000)
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			if err == nil && result.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(50), allowed.Load())
+
+	reputation, err := rl.GetTenantReputation(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), reputation.GoodRequests)
+	assert.Equal(t, int64(150), reputation.ViolationCount)
+}
+
+func BenchmarkMemoryStore_CheckLimits(b *testing.B) {
+	rl := setupTestMemoryRateLimiter(nil)
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1000000, 1000000, 1000000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = rl.CheckLimits(ctx, "bench_user", "", limiterConfig, rule, 1)
+	}
+}
@@ -0,0 +1,87 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// entries kept before the plan cache is dropped, bounds memory under many distinct tenants
+const planCacheMaxEntries = 100000
+
+type planCacheEntry struct {
+	plan      string
+	expiresAt time.Time
+}
+
+// plans read from redis, per proxy instance. The zero value is ready to use.
+type planCache struct {
+	mu      sync.Mutex
+	entries map[string]planCacheEntry
+}
+
+func (pc *planCache) get(key string, now time.Time) (string, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	entry, ok := pc.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		return "", false
+	}
+	return entry.plan, true
+}
+
+func (pc *planCache) set(key, plan string, expiresAt time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.entries == nil || len(pc.entries) >= planCacheMaxEntries {
+		pc.entries = make(map[string]planCacheEntry)
+	}
+	pc.entries[key] = planCacheEntry{plan: plan, expiresAt: expiresAt}
+}
+
+// ResolvePlan returns the plan of a tenant, the default plan when it isn't mapped and an
+// empty plan when no plans are configured. On a failed redis lookup or an unknown plan
+// the default plan is returned together with the error.
+func (rl *RateLimiter) ResolvePlan(ctx context.Context, tenantKey string, plans *config.Plans) (string, error) {
+	if !plans.Enabled() {
+		return "", nil
+	}
+
+	if plans.Mapping.Source != config.PlanSourceRedis {
+		if plan, ok := plans.Lookup(tenantKey); ok {
+			return plan, nil
+		}
+		return plans.Default, nil
+	}
+
+	now := time.Now()
+	cacheKey := plans.Mapping.RedisHash + "\x00" + tenantKey
+	if plan, ok := rl.plans.get(cacheKey, now); ok {
+		return plan, nil
+	}
+
+	plan, err := rl.store.GetTenantPlan(ctx, plans.Mapping.RedisHash, tenantKey)
+	if err != nil {
+		return plans.Default, fmt.Errorf("failed to read tenant plan: %w", err)
+	}
+
+	var unknown error
+	if plan == "" {
+		plan = plans.Default
+	} else if !plans.IsDefined(plan) {
+		unknown = fmt.Errorf("tenant is mapped to undefined plan %q", plan)
+		plan = plans.Default
+	}
+
+	// unmapped tenants are cached too, most traffic usually comes from them
+	if ttl := plans.Mapping.CacheTTL; ttl != nil && ttl.Duration > 0 {
+		rl.plans.set(cacheKey, plan, now.Add(ttl.Duration))
+	}
+
+	return plan, unknown
+}
@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func redisPlans(cacheTTL time.Duration) *config.Plans {
+	return &config.Plans{
+		Names:   []string{"free", "pro"},
+		Default: "free",
+		Mapping: config.PlanMapping{
+			Source:    config.PlanSourceRedis,
+			RedisHash: "ctrl:plans",
+			CacheTTL:  &config.Duration{Duration: cacheTTL},
+		},
+	}
+}
+
+func TestResolvePlan_NoPlansConfigured(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	plan, err := rl.ResolvePlan(context.Background(), "user1", &config.Plans{})
+	require.NoError(t, err)
+	assert.Empty(t, plan)
+}
+
+func TestResolvePlan_RedisHash(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	plans := redisPlans(0)
+	mr.HSet("ctrl:plans", "user1", "pro")
+	mr.HSet("ctrl:plans", "user2", "platinum")
+
+	plan, err := rl.ResolvePlan(ctx, "user1", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", plan)
+
+	// Unmapped tenants get the default plan
+	plan, err = rl.ResolvePlan(ctx, "user3", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "free", plan)
+
+	// Plans missing from plans.names fall back to the default plan
+	plan, err = rl.ResolvePlan(ctx, "user2", plans)
+	assert.Error(t, err)
+	assert.Equal(t, "free", plan)
+}
+
+func TestResolvePlan_RedisHashCached(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	plans := redisPlans(time.Minute)
+	mr.HSet("ctrl:plans", "user1", "pro")
+
+	plan, err := rl.ResolvePlan(ctx, "user1", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", plan)
+
+	// A downgrade is only seen once the cached plan expires
+	mr.HSet("ctrl:plans", "user1", "free")
+	plan, err = rl.ResolvePlan(ctx, "user1", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", plan)
+
+	rl.plans = planCache{}
+	plan, err = rl.ResolvePlan(ctx, "user1", plans)
+	require.NoError(t, err)
+	assert.Equal(t, "free", plan)
+}
+
+func TestResolvePlan_RedisUnavailable(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+
+	mr.Close()
+	plan, err := rl.ResolvePlan(context.Background(), "user1", redisPlans(time.Minute))
+	assert.Error(t, err)
+	assert.Equal(t, "free", plan)
+}
+
+func TestCheckLimits_PlanOverrides(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 2, 10)
+	limiterConfig.PerTenant.Plans = config.PlanOverrides{"pro": fixedWindowConfig(5)}
+	rule.Plans = config.PlanOverrides{"pro": fixedWindowConfig(20)}
+
+	// free has no override and keeps the base limits
+	for i := 0; i < 2; i++ {
+		result, err := rl.CheckLimits(ctx, "free_user", "free", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+	result, err := rl.CheckLimits(ctx, "free_user", "free", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.PerTenantLevel, result.DeniedLevel)
+
+	for i := 0; i < 5; i++ {
+		result, err := rl.CheckLimits(ctx, "pro_user", "pro", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed, "request %d", i)
+		assert.Equal(t, int64(19-i), result.Levels[config.PerEndpointLevel].Remaining)
+	}
+	result, err = rl.CheckLimits(ctx, "pro_user", "pro", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.PerTenantLevel, result.DeniedLevel)
+}
@@ -0,0 +1,136 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// not an algorithm of config.AlgorithmConfig, only used by the quota level
+const quotaAlgorithm = "quota"
+
+// The period boundaries are computed in Go (time zones, month lengths) and passed in.
+// Usage isn't reset by a changed config hash, only by a new period, so raising or
+// lowering a quota (or a plan change) keeps what the tenant already used.
+const quotaLua = `
+local function quota(key, config_hash, now, cost, limit, period_start, period_end)
+    local bucket = redis.call('HMGET', key, 'count', 'period_start')
+    local current_count = tonumber(bucket[1]) or 0
+    local stored_period_start = tonumber(bucket[2]) or 0
+
+    -- New period (also covers the first request): start counting again.
+    -- A later stored start means another instance is already in the next period
+    if stored_period_start < period_start then
+        current_count = 0
+        stored_period_start = period_start
+    end
+
+    if current_count + cost > limit then
+        -- Request denied, retry when the period ends
+        return 0, 0, math.max(0, period_end - now), nil
+    end
+
+    local commit = function()
+        redis.call('HMSET', key, 'count', current_count + cost, 'period_start', stored_period_start)
+        -- Set expiration to period end + buffer
+        redis.call('EXPIRE', key, math.ceil((period_end - now) / 1000) + 60)
+    end
+
+    return 1, limit - (current_count + cost), 0, commit
+end
+`
+
+// Refunds only go to the period the request was counted in (period_start of the admission).
+const quotaRefundLua = `
+local function quota_refund(key, config_hash, now, admitted_at, cost, limit, period_start)
+    local bucket = redis.call('HMGET', key, 'count', 'period_start')
+    local current_count = tonumber(bucket[1])
+
+    if current_count == nil or tonumber(bucket[2]) ~= period_start then
+        return
+    end
+
+    redis.call('HSET', key, 'count', math.max(0, current_count - cost))
+end
+`
+
+// CheckQuota checks the quota of a tenant's plan on its own.
+func (rl *RateLimiter) CheckQuota(ctx context.Context, tenantKey, plan string,
+	quotaConfig *config.Quota) (*LimitResult, error) {
+	return rl.checkLevel(ctx, newQuotaCheck(tenantKey, quotaConfig.ConfigFor(plan), time.Now()))
+}
+
+// QuotaRemaining returns what is left of the tenant's quota after the admission, false without
+// a quota level. The levels of an admission are only consumed together: the quota result of a
+// request another level denied (or of a peek) counts units that were never used.
+func (a *AdmissionResult) QuotaRemaining() (int64, bool) {
+	result, ok := a.Levels[config.QuotaLevel]
+	if !ok {
+		return 0, false
+	}
+	if result.Allowed && a.consumed == nil {
+		return result.Remaining + a.cost, true
+	}
+	return result.Remaining, true
+}
+
+func newQuotaCheck(tenantKey string, quotaConfig config.QuotaConfig, now time.Time) LevelCheck {
+	start, end := quotaConfig.Window(now)
+	return LevelCheck{
+		Level:     config.QuotaLevel,
+		Key:       constructQuotaKey(tenantKey),
+		Algorithm: config.AlgorithmConfig{Algorithm: quotaAlgorithm},
+		Params:    [3]float64{float64(quotaConfig.Limit), float64(start.UnixMilli()), float64(end.UnixMilli())},
+	}
+}
+
+func constructQuotaKey(tenantKey string) string {
+	//ctrl:quota:{user123}, same hash slot as the tenant's limiter keys
+	return fmt.Sprintf("ctrl:quota:{%s}", tenantKey)
+}
+
+type quotaState struct {
+	count       float64
+	periodStart float64
+}
+
+// memory store version of the quota lua function
+func quotaMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	limit, periodStart, periodEnd := p[0], p[1], p[2]
+
+	// New period (also covers the first request): start counting again
+	currentCount, storedPeriodStart := 0.0, periodStart
+	if state, ok := ms.get(key, now).(*quotaState); ok && state.periodStart >= periodStart {
+		currentCount, storedPeriodStart = state.count, state.periodStart
+	}
+
+	if currentCount+cost > limit {
+		// Request denied, retry when the period ends
+		return false, 0, math.Max(0, periodEnd-now), nil
+	}
+
+	commit := func() {
+		// Expire at period end + buffer
+		ttl := math.Ceil((periodEnd-now)/1000) + 60
+		ms.set(key, &quotaState{count: currentCount + cost, periodStart: storedPeriodStart}, now, ttl*1000)
+	}
+
+	return true, limit - (currentCount + cost), 0, commit
+}
+
+// memory store version of the quota_refund lua function
+func quotaRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	periodStart := p[1]
+
+	state, ok := ms.get(key, now).(*quotaState)
+	if !ok || state.periodStart != periodStart {
+		return
+	}
+
+	state.count = math.Max(0, state.count-cost)
+}
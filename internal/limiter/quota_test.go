@@ -0,0 +1,193 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewQuotaCheck_Window(t *testing.T) {
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse(time.DateTime, value)
+		require.NoError(t, err)
+		return parsed
+	}
+
+	tests := []struct {
+		name          string
+		quota         config.QuotaConfig
+		now           string
+		expectedStart string
+		expectedEnd   string
+	}{
+		{"Day", config.QuotaConfig{Period: config.QuotaDay}, "2025-03-10 15:04:05",
+			"2025-03-10 00:00:00", "2025-03-11 00:00:00"},
+		// 2025-03-10 is a monday
+		{"WeekFromMonday", config.QuotaConfig{Period: config.QuotaWeek, ResetDay: 1}, "2025-03-16 23:59:59",
+			"2025-03-10 00:00:00", "2025-03-17 00:00:00"},
+		{"WeekFromSundayAcrossMonths", config.QuotaConfig{Period: config.QuotaWeek, ResetDay: 7}, "2025-03-01 12:00:00",
+			"2025-02-23 00:00:00", "2025-03-02 00:00:00"},
+		{"Month", config.QuotaConfig{Period: config.QuotaMonth, ResetDay: 1}, "2025-12-31 23:59:59",
+			"2025-12-01 00:00:00", "2026-01-01 00:00:00"},
+		{"MonthAnchorBeforeResetDay", config.QuotaConfig{Period: config.QuotaMonth, ResetDay: 15}, "2025-01-10 00:00:00",
+			"2024-12-15 00:00:00", "2025-01-15 00:00:00"},
+		{"MonthAnchorClampedToShortMonth", config.QuotaConfig{Period: config.QuotaMonth, ResetDay: 31}, "2025-02-28 08:00:00",
+			"2025-02-28 00:00:00", "2025-03-31 00:00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.quota.Limit = 10
+			level := newQuotaCheck("user1", tt.quota, utc(tt.now))
+
+			assert.Equal(t, config.QuotaLevel, level.Level)
+			assert.Equal(t, "ctrl:quota:{user1}", level.Key)
+			assert.Equal(t, float64(10), level.Params[0])
+			assert.Equal(t, float64(utc(tt.expectedStart).UnixMilli()), level.Params[1], "period start")
+			assert.Equal(t, float64(utc(tt.expectedEnd).UnixMilli()), level.Params[2], "period end")
+		})
+	}
+}
+
+func quotaTestConfig(limit int) (*config.RateLimiterConfig, *config.EndpointRule) {
+	limiterConfig, rule := admissionTestConfig(1000, 1000, 1000)
+	limiterConfig.Quota = config.Quota{
+		Enabled:     true,
+		QuotaConfig: config.QuotaConfig{Period: config.QuotaMonth, Limit: limit},
+	}
+	return limiterConfig, rule
+}
+
+func TestCheckLimits_QuotaExhausted(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := quotaTestConfig(3)
+
+		for i := 0; i < 3; i++ {
+			result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, int64(2-i), result.Levels[config.QuotaLevel].Remaining)
+		}
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.QuotaLevel, result.DeniedLevel)
+
+		_, end := limiterConfig.Quota.Window(time.Now())
+		retryAfter := result.Levels[config.QuotaLevel].RetryAfter
+		assert.Greater(t, retryAfter, time.Duration(0))
+		assert.LessOrEqual(t, retryAfter, time.Until(end)+time.Second)
+
+		// Raising the quota keeps the usage of the period
+		limiterConfig.Quota.Limit = 5
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, int64(1), result.Levels[config.QuotaLevel].Remaining)
+	})
+}
+
+func TestCheckLimits_QuotaNotConsumedByRejectedRequests(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := quotaTestConfig(10)
+	rule.AlgorithmConfig = fixedWindowConfig(1)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// Denied by the endpoint level, the quota stays where it was
+	for i := 0; i < 3; i++ {
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+	}
+
+	quota, err := rl.CheckQuota(ctx, "user1", "", &limiterConfig.Quota)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), quota.Remaining)
+}
+
+func TestAdmissionResult_QuotaRemaining(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := quotaTestConfig(10)
+		rule.AlgorithmConfig = fixedWindowConfig(3)
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		remaining, ok := result.QuotaRemaining()
+		require.True(t, ok)
+		assert.Equal(t, int64(7), remaining)
+
+		// Denied by the endpoint level: the quota result counts the request, nothing was used
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		require.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+		assert.Equal(t, int64(4), result.Levels[config.QuotaLevel].Remaining)
+		remaining, _ = result.QuotaRemaining()
+		assert.Equal(t, int64(7), remaining)
+
+		peek, err := rl.PeekLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		remaining, _ = peek.QuotaRemaining()
+		assert.Equal(t, int64(7), remaining)
+
+		// Denied by the quota itself, its result is what is left
+		limiterConfig.Quota.Limit = 5
+		rule.AlgorithmConfig = fixedWindowConfig(100)
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 3)
+		require.NoError(t, err)
+		require.Equal(t, config.QuotaLevel, result.DeniedLevel)
+		remaining, _ = result.QuotaRemaining()
+		assert.Equal(t, result.Levels[config.QuotaLevel].Remaining, remaining)
+
+		// No quota level
+		limiterConfig.Quota.Enabled = false
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		_, ok = result.QuotaRemaining()
+		assert.False(t, ok)
+	})
+}
+
+func TestCheckQuota_NewPeriodStartsOver(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	quotaConfig := config.QuotaConfig{Period: config.QuotaDay, Limit: 1}
+
+	result, err := rl.checkLevel(ctx, newQuotaCheck("user1", quotaConfig, time.Now()))
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = rl.checkLevel(ctx, newQuotaCheck("user1", quotaConfig, time.Now()))
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	result, err = rl.checkLevel(ctx, newQuotaCheck("user1", quotaConfig, time.Now().Add(24*time.Hour)))
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestQuotaConfigFor_Plans(t *testing.T) {
+	quota := config.Quota{
+		QuotaConfig: config.QuotaConfig{Period: config.QuotaMonth, Limit: 1000},
+		Plans:       map[string]config.QuotaConfig{"pro": {Period: config.QuotaMonth, Limit: 100000}},
+	}
+
+	assert.Equal(t, 1000, quota.ConfigFor("").Limit)
+	assert.Equal(t, 1000, quota.ConfigFor("free").Limit)
+	assert.Equal(t, 100000, quota.ConfigFor("pro").Limit)
+}
@@ -0,0 +1,590 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// number of ARGV slots per level: algorithm, config_hash, mode, cost, p1, p2, p3, lease_id
+const admissionLevelArgs = 8
+
+// fields before the level results in the admission reply:
+// denied, score, violation_count, good_requests, ttl, banned_for
+const admissionReplyHeader = 6
+
+// keys per SCAN call and per pipelined read when scanning reputations
+const reputationScanBatch = 1000
+
+// how the admission script treats a level
+const (
+	// a rejection denies the request
+	levelModeHard = "0"
+	// a rejection only denies tenants at or below the reputation threshold (global level)
+	levelModeSoft = "1"
+	// checked but never consumed and never denies, cluster mode reads the global level this way
+	levelModePeek = "2"
+)
+
+// takes its result from the parameters (allowed, remaining, retry_after) instead of a key,
+// cluster mode passes the peeked global level into the tenant's call this way
+const precomputedLua = `
+local function precomputed(key, config_hash, now, cost, allowed, remaining, retry_after)
+    return allowed, remaining, retry_after, function() end
+end
+`
+
+// Every algorithm is a lua function with the same signature:
+//
+//	fn(key, config_hash, now, cost, p1, p2, p3) -> allowed, remaining, retry_after, commit
+//
+// it only reads state, commit() writes the consumed request back. cost is the number of
+// units the request consumes (see AdmissionRequest.Cost), remaining is counted in units. The driver checks all
+// levels first and commits only when none of them rejected, so a request denied by a
+// later level never consumes quota from an earlier one.
+const admissionDriverLua = `
+local algorithms = {
+    token_bucket = token_bucket,
+    leaky_bucket = leaky_bucket,
+    fixed_window = fixed_window,
+    sliding_window = sliding_window,
+    gcra = gcra,
+    concurrency = concurrency,
+    quota = quota,
+    leaky_bucket_shape = leaky_bucket_shape,
+    precomputed = precomputed,
+}
+
+local now = tonumber(ARGV[1])
+-- 0 no tenant, 1 tenant with reputation, 2 tenant without reputation (bans only)
+local check_ban = ARGV[2] ~= '0'
+local track_reputation = ARGV[2] == '1'
+local reputation_threshold = tonumber(ARGV[3])
+local level_count = tonumber(ARGV[4])
+local reputation_key = KEYS[level_count + 1]
+local ban_key = KEYS[level_count + 2]
+
+local score, violation_count, good_requests, ttl = 1.0, 0, 0, 0
+local model
+if track_reputation then
+    model = read_reputation_model(4 + level_count * 8)
+    score, violation_count, good_requests, ttl = read_reputation(reputation_key)
+end
+
+if check_ban then
+    -- Banned tenants are denied before any level is checked, nothing is consumed
+    local banned_for = redis.call('PTTL', ban_key)
+    if banned_for > 0 then
+        return {-1, tostring(score), violation_count, good_requests, ttl, banned_for}
+    end
+end
+
+local results = {}
+local commits = {}
+local denied = 0
+
+for i = 1, level_count do
+    local base = 4 + (i - 1) * 8
+    local algorithm = algorithms[ARGV[base + 1]]
+    local soft = ARGV[base + 3] == '1'
+    local peek = ARGV[base + 3] == '2'
+
+    local allowed, remaining, retry_after, commit = algorithm(KEYS[i], ARGV[base + 2], now,
+        tonumber(ARGV[base + 4]), tonumber(ARGV[base + 5]), tonumber(ARGV[base + 6]), tonumber(ARGV[base + 7]),
+        ARGV[base + 8])
+
+    table.insert(results, allowed)
+    table.insert(results, remaining)
+    table.insert(results, retry_after)
+
+    if peek then
+        -- Only reported, never consumed
+    elseif allowed == 1 then
+        table.insert(commits, commit)
+    elseif not soft then
+        denied = i
+        break
+    elseif track_reputation and score <= reputation_threshold then
+        -- Soft level (global) exceeded: only tenants with bad reputation are rejected
+        denied = i
+        break
+    end
+end
+
+if denied == 0 then
+    for _, commit in ipairs(commits) do
+        commit()
+    end
+end
+
+-- Rejections by a soft level don't count as violations, the tenant didn't exceed its own limits
+if track_reputation and (denied == 0 or ARGV[4 + (denied - 1) * 8 + 3] ~= '1') then
+    score, violation_count, good_requests, ttl = update_reputation(reputation_key, denied == 0 and 0 or 1, now, model)
+end
+
+-- scores are returned as strings, redis truncates lua numbers to integers in replies
+local reply = {denied, tostring(score), violation_count, good_requests, ttl, 0}
+for _, value in ipairs(results) do
+    table.insert(reply, value)
+end
+return reply
+`
+
+const admissionScript = tokenBucketLua + leakyBucketLua + fixedWindowLua + slidingWindowLua + gcraLua + concurrencyLua +
+	leakyBucketShapeLua + quotaLua + precomputedLua + reputationLua + admissionDriverLua
+
+// RedisStore keeps the state in redis, shared by every proxy instance.
+type RedisStore struct {
+	client redis.UniversalClient
+	// keys of one script call must share a hash slot, the global key never shares the tenant's
+	cluster bool
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	_, cluster := client.(*redis.ClusterClient)
+	return &RedisStore{
+		client:  client,
+		cluster: cluster,
+	}
+}
+
+// one level of an admission script call
+type scriptLevel struct {
+	level      config.LimitLevelType
+	key        string
+	algorithm  string
+	configHash string
+	mode       string
+	cost       float64
+	params     [3]float64
+	leaseID    string
+}
+
+func (rs *RedisStore) Admit(ctx context.Context, req *AdmissionRequest) (*AdmissionResult, error) {
+	levels := make([]scriptLevel, 0, len(req.Levels))
+	globalIndex := -1
+
+	for i, level := range req.Levels {
+		mode := levelModeHard
+		if level.Level == config.GlobalLevel {
+			// without reputation the global level is hard
+			if req.Reputation.Model().Enabled {
+				mode = levelModeSoft
+			}
+			globalIndex = i
+		}
+		if req.Peek {
+			mode = levelModePeek
+		}
+
+		levels = append(levels, scriptLevel{
+			level:      level.Level,
+			key:        level.Key,
+			algorithm:  level.function(),
+			configHash: level.ConfigHash,
+			mode:       mode,
+			cost:       req.units(),
+			params:     level.Params,
+			leaseID:    level.LeaseID,
+		})
+	}
+
+	if req.Peek {
+		if rs.cluster && globalIndex >= 0 && len(levels) > 1 {
+			return rs.peekCluster(ctx, levels, globalIndex)
+		}
+		return rs.runAdmission(ctx, levels, "", nil)
+	}
+
+	if rs.cluster && globalIndex >= 0 && req.TenantKey != "" {
+		return rs.admitCluster(ctx, levels, globalIndex, req)
+	}
+
+	return rs.runAdmission(ctx, levels, req.TenantKey, req.Reputation.Model())
+}
+
+// peeks the global level and the tenant's levels in their own slots
+func (rs *RedisStore) peekCluster(ctx context.Context, levels []scriptLevel, globalIndex int) (*AdmissionResult, error) {
+	tenantLevels := append(append([]scriptLevel(nil), levels[:globalIndex]...), levels[globalIndex+1:]...)
+	admission, err := rs.runAdmission(ctx, tenantLevels, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	global, err := rs.runAdmission(ctx, levels[globalIndex:globalIndex+1], "", nil)
+	if err != nil {
+		return nil, err
+	}
+	admission.Levels[config.GlobalLevel] = global.Levels[config.GlobalLevel]
+
+	return admission, nil
+}
+
+// The global key lives in its own slot, so the levels can't be checked in one call:
+// the global level is peeked first, its result passed into the tenant's call and consumed
+// afterwards if the request was admitted. A concurrent request may take the last global
+// unit in between, the global limit is approximate in cluster mode.
+func (rs *RedisStore) admitCluster(ctx context.Context, levels []scriptLevel, globalIndex int,
+	req *AdmissionRequest) (*AdmissionResult, error) {
+	global := levels[globalIndex]
+
+	peek := global
+	peek.mode = levelModePeek
+	peekResult, err := rs.runAdmission(ctx, []scriptLevel{peek}, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	globalResult := peekResult.Levels[config.GlobalLevel]
+
+	allowed := 0.0
+	if globalResult.Allowed {
+		allowed = 1
+	}
+	tenantLevels := append([]scriptLevel(nil), levels...)
+	tenantLevels[globalIndex] = scriptLevel{
+		level: config.GlobalLevel,
+		// never read, only routes the call to the tenant's slot
+		key:       constructReputationKey(req.TenantKey),
+		algorithm: "precomputed",
+		mode:      global.mode,
+		params:    [3]float64{allowed, float64(globalResult.Remaining), float64(globalResult.RetryAfter.Milliseconds())},
+	}
+
+	admission, err := rs.runAdmission(ctx, tenantLevels, req.TenantKey, req.Reputation.Model())
+	if err != nil {
+		return nil, err
+	}
+
+	if admission.Allowed && globalResult.Allowed {
+		committed, err := rs.runAdmission(ctx, []scriptLevel{global}, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		// a shaped global level reserves the departure when it is consumed, not when peeked
+		if result := committed.Levels[config.GlobalLevel]; result.Allowed {
+			admission.Levels[config.GlobalLevel] = result
+		}
+	}
+
+	return admission, nil
+}
+
+// model is the tenant's reputation model, unused without a tenant
+func (rs *RedisStore) runAdmission(ctx context.Context, levels []scriptLevel, tenantKey string,
+	model *config.Reputation) (*AdmissionResult, error) {
+	now := time.Now().UnixMilli()
+
+	keys := make([]string, 0, len(levels)+2)
+	args := make([]interface{}, 0, 4+len(levels)*admissionLevelArgs+reputationModelArgs)
+
+	tenantMode, threshold := 0, 0.0
+	if tenantKey != "" {
+		tenantMode = 2
+		if model.Enabled {
+			tenantMode, threshold = 1, model.Threshold
+		}
+	}
+	args = append(args, now, tenantMode, threshold, len(levels))
+
+	for _, level := range levels {
+		keys = append(keys, level.key)
+		args = append(args, level.algorithm, level.configHash, level.mode, level.cost,
+			level.params[0], level.params[1], level.params[2], level.leaseID)
+	}
+
+	if tenantMode == 1 {
+		args = append(args, reputationArgs(model)...)
+	}
+
+	if tenantKey != "" {
+		keys = append(keys, constructReputationKey(tenantKey), constructBanKey(tenantKey))
+	}
+
+	result := rs.runScript(ctx, admissionLuaScript, keys, args...)
+
+	if result.Err() != nil {
+		//==========================Metrics=======================
+		metrics.RedisErrors.Inc()
+		//========================================================
+		return nil, result.Err()
+	}
+
+	values, ok := result.Val().([]interface{})
+	if !ok || len(values) < admissionReplyHeader || (len(values)-admissionReplyHeader)%3 != 0 ||
+		(len(values)-admissionReplyHeader)/3 > len(levels) {
+		//==========================Metrics=======================
+		metrics.RedisErrors.Inc()
+		//========================================================
+		return nil, fmt.Errorf("unexpected response format from Redis script")
+	}
+
+	denied, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+
+	admission := &AdmissionResult{
+		Allowed:    denied == 0,
+		Levels:     make(map[config.LimitLevelType]*LimitResult, len(levels)),
+		admittedAt: float64(now),
+	}
+	if denied > 0 {
+		admission.DeniedLevel = levels[denied-1].level
+	}
+
+	if tenantKey != "" {
+		admission.Reputation = parseReputation(values[1:5])
+		bannedForMs, _ := strconv.ParseInt(fmt.Sprint(values[5]), 10, 64)
+		admission.BannedFor = time.Duration(bannedForMs) * time.Millisecond
+	}
+
+	for i := 0; admissionReplyHeader+i*3 < len(values); i++ {
+		base := admissionReplyHeader + i*3
+		allowedInt, _ := strconv.ParseInt(fmt.Sprint(values[base]), 10, 64)
+		remaining, _ := strconv.ParseInt(fmt.Sprint(values[base+1]), 10, 64)
+		retryAfterMs, _ := strconv.ParseInt(fmt.Sprint(values[base+2]), 10, 64)
+
+		admission.Levels[levels[i].level] = newLimitResult(allowedInt == 1, remaining, retryAfterMs)
+	}
+
+	return admission, nil
+}
+
+func (rs *RedisStore) UpdateReputation(ctx context.Context, tenantKey string, isViolation bool,
+	model *config.Reputation) (*Reputation, error) {
+	reputationKey := constructReputationKey(tenantKey)
+
+	now := time.Now().UnixMilli()
+	violationFlag := 0
+	if isViolation {
+		violationFlag = 1
+	}
+
+	result := rs.runScript(ctx, reputationLuaScript,
+		[]string{reputationKey},
+		append([]interface{}{violationFlag, now}, reputationArgs(model)...)...)
+
+	if result.Err() != nil {
+		//==========================Metrics=======================
+		metrics.RedisErrors.Inc()
+		//========================================================
+		return nil, result.Err()
+	}
+
+	values, ok := result.Val().([]interface{})
+	if !ok || len(values) < 4 {
+		//==========================Metrics=======================
+		metrics.RedisErrors.Inc()
+		//========================================================
+		return nil, fmt.Errorf("unexpected result from lua script: %v", result.Val())
+	}
+
+	return parseReputation(values), nil
+}
+
+func (rs *RedisStore) GetReputation(ctx context.Context, tenantKey string) (*Reputation, error) {
+	reputationKey := constructReputationKey(tenantKey)
+
+	result := rs.client.HMGet(ctx, reputationKey, "score", "violation_count", "good_requests")
+
+	if result.Err() != nil {
+		return &Reputation{Score: 1.0, TTL: 0}, nil
+	}
+
+	ttlCmd := rs.client.TTL(ctx, reputationKey)
+	ttl := time.Duration(0)
+	if err := ttlCmd.Err(); err == nil {
+		ttl = ttlCmd.Val()
+	}
+
+	return reputationFromHash(result.Val(), ttl), nil
+}
+
+func (rs *RedisStore) GetTenantPlan(ctx context.Context, hashKey, tenantKey string) (string, error) {
+	plan, err := rs.client.HGet(ctx, hashKey, tenantKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return plan, err
+}
+
+func (rs *RedisStore) SetBan(ctx context.Context, tenantKey string, duration time.Duration) error {
+	return rs.client.Set(ctx, constructBanKey(tenantKey), 1, duration).Err()
+}
+
+func (rs *RedisStore) GetBan(ctx context.Context, tenantKey string) (time.Duration, error) {
+	ttl, err := rs.client.PTTL(ctx, constructBanKey(tenantKey)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// negative for missing keys
+	return max(ttl, 0), nil
+}
+
+func (rs *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	// one DEL per key, the keys may live in different cluster slots
+	pipe := rs.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (rs *RedisStore) ReleaseLease(ctx context.Context, key, leaseID string) error {
+	return rs.client.ZRem(ctx, key, leaseID).Err()
+}
+
+func (rs *RedisStore) RenewLease(ctx context.Context, key, leaseID string, lease time.Duration) error {
+	return rs.runScript(ctx, leaseLuaScript, []string{key}, time.Now().UnixMilli(), lease.Milliseconds(),
+		leaseID).Err()
+}
+
+// the tenant's keys share its hash slot, so a refund is a single call in cluster mode too
+func (rs *RedisStore) Refund(ctx context.Context, req *RefundRequest) error {
+	now := time.Now().UnixMilli()
+
+	keys := make([]string, 0, len(req.Levels))
+	args := make([]interface{}, 0, 3+len(req.Levels)*refundLevelArgs)
+	args = append(args, now, req.AdmittedAt, req.units())
+
+	for _, level := range req.Levels {
+		keys = append(keys, level.Key)
+		args = append(args, level.function(), level.ConfigHash, level.Params[0], level.Params[1], level.Params[2])
+	}
+
+	if err := rs.runScript(ctx, refundLuaScript, keys, args...).Err(); err != nil {
+		//==========================Metrics=======================
+		metrics.RedisErrors.Inc()
+		//========================================================
+		return err
+	}
+	return nil
+}
+
+// Scans the reputation keys with SCAN (on every master in cluster mode), so it doesn't
+// block redis but a tenant can be visited twice when keys are rehashed during the scan.
+func (rs *RedisStore) ScanReputations(ctx context.Context,
+	visit func(tenantKey string, reputation *Reputation)) error {
+	clusterClient, ok := rs.client.(*redis.ClusterClient)
+	if !ok {
+		return scanReputations(ctx, rs.client, visit)
+	}
+
+	// masters are scanned concurrently
+	var mu sync.Mutex
+	return clusterClient.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		return scanReputations(ctx, client, func(tenantKey string, reputation *Reputation) {
+			mu.Lock()
+			defer mu.Unlock()
+			visit(tenantKey, reputation)
+		})
+	})
+}
+
+func scanReputations(ctx context.Context, client redis.Cmdable,
+	visit func(tenantKey string, reputation *Reputation)) error {
+	iter := client.Scan(ctx, 0, constructReputationKey("*"), reputationScanBatch).Iterator()
+
+	keys := make([]string, 0, reputationScanBatch)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		pipe := client.Pipeline()
+		fields := make([]*redis.SliceCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			fields[i] = pipe.HMGet(ctx, key, "score", "violation_count", "good_requests")
+			ttls[i] = pipe.TTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		for i, key := range keys {
+			tenantKey, ok := tenantFromReputationKey(key)
+			// expired between SCAN and HMGET
+			if !ok || fields[i].Val()[0] == nil {
+				continue
+			}
+			visit(tenantKey, reputationFromHash(fields[i].Val(), ttls[i].Val()))
+		}
+
+		keys = keys[:0]
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == reputationScanBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func (rs *RedisStore) Ping(ctx context.Context) error {
+	_, err := rs.client.Ping(ctx).Result()
+	return err
+}
+
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
+
+// score, violation_count, good_requests fields of a reputation hash, missing fields keep their defaults
+func reputationFromHash(values []interface{}, ttl time.Duration) *Reputation {
+	score := 1.0
+	if values[0] != nil {
+		if s, err := strconv.ParseFloat(values[0].(string), 64); err == nil {
+			score = s
+		}
+	}
+
+	violationCount := int64(0)
+	if values[1] != nil {
+		if v, err := strconv.ParseInt(values[1].(string), 10, 64); err == nil {
+			violationCount = v
+		}
+	}
+
+	goodRequests := int64(0)
+	if values[2] != nil {
+		if g, err := strconv.ParseInt(values[2].(string), 10, 64); err == nil {
+			goodRequests = g
+		}
+	}
+
+	return &Reputation{
+		Score:          score,
+		ViolationCount: violationCount,
+		GoodRequests:   goodRequests,
+		TTL:            max(int64(ttl.Seconds()), 0),
+	}
+}
+
+// score, violation_count, good_requests, ttl as returned by the lua scripts
+func parseReputation(values []interface{}) *Reputation {
+	score, _ := strconv.ParseFloat(fmt.Sprint(values[0]), 64)
+	violationCount, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	goodRequests, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	ttl, _ := strconv.ParseInt(fmt.Sprint(values[3]), 10, 64)
+
+	return &Reputation{
+		Score:          score,
+		ViolationCount: violationCount,
+		GoodRequests:   goodRequests,
+		TTL:            ttl,
+	}
+}
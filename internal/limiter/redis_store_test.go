@@ -0,0 +1,146 @@
+package limiter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cluster mode code path on a single miniredis node
+func setupTestClusterRateLimiter(t *testing.T) (*RateLimiter, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+
+	store := NewRedisStore(rdb)
+	store.cluster = true
+
+	return NewRateLimiter(store), mr
+}
+
+// the part of the key redis cluster hashes
+func hashTag(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+func TestConstructRedisKey_TenantKeysShareHashSlot(t *testing.T) {
+	for _, tenantKey := range []string{"user123", "192.168.1.1", "Bearer abc}def", "a{b"} {
+		tenantTag := hashTag(constructRedisKey(config.PerTenantLevel, "", []string{}, tenantKey))
+
+		// Paths with braces must not change the tag
+		endpointKey := constructRedisKey(config.PerEndpointLevel, "/api/{id}/items", []string{"GET"}, tenantKey)
+		assert.Equal(t, tenantTag, hashTag(endpointKey), tenantKey)
+		assert.Equal(t, tenantTag, hashTag(constructReputationKey(tenantKey)), tenantKey)
+	}
+
+	assert.Equal(t, "global", hashTag(constructRedisKey(config.GlobalLevel, "", []string{}, "")))
+}
+
+func TestRedisStore_ClusterModeAllLevelsAllowed(t *testing.T) {
+	rl, mr := setupTestClusterRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	for i := int64(1); i <= 3; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 100-i, result.Levels[config.GlobalLevel].Remaining)
+		assert.Equal(t, 10-i, result.Levels[config.PerTenantLevel].Remaining)
+		assert.Equal(t, 5-i, result.Levels[config.PerEndpointLevel].Remaining)
+		assert.Equal(t, i, result.Reputation.GoodRequests)
+	}
+
+	assert.Equal(t, "3", mr.HGet(constructRedisKey(config.GlobalLevel, "", []string{}, ""), "count"))
+}
+
+func TestRedisStore_ClusterModeLaterRejectionDoesNotConsume(t *testing.T) {
+	rl, mr := setupTestClusterRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 1)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	for i := 0; i < 3; i++ {
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+	}
+
+	assert.Equal(t, "1", mr.HGet(constructRedisKey(config.GlobalLevel, "", []string{}, ""), "count"))
+	assert.Equal(t, "1", mr.HGet(constructRedisKey(config.PerTenantLevel, "", []string{}, "user1"), "count"))
+}
+
+func TestRedisStore_ClusterModeGlobalLimitOnlyRejectsBadReputation(t *testing.T) {
+	rl, mr := setupTestClusterRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(1, 100, 100)
+
+	_, err := rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+
+	result, err := rl.CheckLimits(ctx, "good_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.False(t, result.Levels[config.GlobalLevel].Allowed)
+
+	for i := 0; i < 10; i++ {
+		_, err := rl.UpdateReputation(ctx, "bad_user", true)
+		require.NoError(t, err)
+	}
+	before, err := rl.GetTenantReputation(ctx, "bad_user")
+	require.NoError(t, err)
+
+	result, err = rl.CheckLimits(ctx, "bad_user", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, config.GlobalLevel, result.DeniedLevel)
+	assert.Equal(t, before.ViolationCount, result.Reputation.ViolationCount)
+	assert.False(t, mr.Exists(constructRedisKey(config.PerTenantLevel, "", []string{}, "bad_user")))
+}
+
+func TestRedisStore_ClusterModePeekLimits(t *testing.T) {
+	rl, mr := setupTestClusterRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+
+	_, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+
+	peek, err := rl.PeekLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	require.Len(t, peek.Levels, 3)
+	assert.Equal(t, int64(98), peek.Levels[config.GlobalLevel].Remaining)
+	assert.Equal(t, int64(8), peek.Levels[config.PerTenantLevel].Remaining)
+	assert.Equal(t, int64(3), peek.Levels[config.PerEndpointLevel].Remaining)
+
+	assert.Equal(t, "1", mr.HGet(constructRedisKey(config.GlobalLevel, "", []string{}, ""), "count"))
+}
@@ -0,0 +1,116 @@
+package limiter
+
+import (
+	"context"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// number of ARGV slots per level of the refund script: algorithm, config_hash, p1, p2, p3
+const refundLevelArgs = 5
+
+// Every refundable algorithm has a lua function with the same signature:
+//
+//	fn(key, config_hash, now, admitted_at, cost, p1, p2, p3)
+//
+// it gives cost units back to the state the admission at admitted_at consumed them from. A
+// level whose config changed or whose window moved on since is left alone. Algorithms without
+// a refund function (concurrency, leaky_bucket_shape) are skipped.
+const refundDriverLua = `
+local refunds = {
+    token_bucket = token_bucket_refund,
+    leaky_bucket = leaky_bucket_refund,
+    fixed_window = fixed_window_refund,
+    sliding_window = sliding_window_refund,
+    gcra = gcra_refund,
+    quota = quota_refund,
+}
+
+local now = tonumber(ARGV[1])
+local admitted_at = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+for i = 1, #KEYS do
+    local base = 3 + (i - 1) * 5
+    local refund = refunds[ARGV[base + 1]]
+    if refund then
+        refund(KEYS[i], ARGV[base + 2], now, admitted_at, cost,
+            tonumber(ARGV[base + 3]), tonumber(ARGV[base + 4]), tonumber(ARGV[base + 5]))
+    end
+end
+
+return #KEYS
+`
+
+const refundScript = tokenBucketRefundLua + leakyBucketRefundLua + fixedWindowRefundLua + slidingWindowRefundLua +
+	gcraRefundLua + quotaRefundLua + refundDriverLua
+
+// Go version of a lua refund function, same parameters
+type memoryRefundFunc func(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64, p [3]float64)
+
+var memoryRefunds = map[config.AlgorithmType]memoryRefundFunc{
+	config.TokenBucket:   tokenBucketRefundMemory,
+	config.LeakyBucket:   leakyBucketRefundMemory,
+	config.FixedWindow:   fixedWindowRefundMemory,
+	config.SlidingWindow: slidingWindowRefundMemory,
+	config.GCRA:          gcraRefundMemory,
+	quotaAlgorithm:       quotaRefundMemory,
+}
+
+// RefundRequest gives back the units an admission consumed.
+type RefundRequest struct {
+	Levels []LevelCheck
+	// units consumed on every level, 0 is 1
+	Cost int64
+	// unix milliseconds of the admission, windows only get back what was counted in them
+	AdmittedAt float64
+}
+
+func (r *RefundRequest) units() float64 {
+	return float64(max(1, r.Cost))
+}
+
+// Refund gives back the units an allowed admission consumed on the tenant's levels (per-tenant,
+// quota and endpoint), e.g. when the backend failed to answer the request. The global level is
+// left alone, it protects the backend rather than metering the tenant, and concurrency slots are
+// given back by ReleaseLeases. Reserved levels (count_on: response) are settled by the response, see ReleaseReservation
+// and aren't refunded. Nothing happens for a denied or peeked admission.
+func (rl *RateLimiter) Refund(ctx context.Context, admission *AdmissionResult) error {
+	if admission == nil || admission.consumed == nil {
+		return nil
+	}
+
+	req := &RefundRequest{Cost: admission.consumed.Cost, AdmittedAt: admission.admittedAt}
+	for _, level := range admission.consumed.Levels {
+		if level.Level != config.GlobalLevel && !level.Reserved {
+			req.Levels = append(req.Levels, level)
+		}
+	}
+	if len(req.Levels) == 0 {
+		return nil
+	}
+
+	return rl.store.Refund(ctx, req)
+}
+
+// ReleaseReservation gives back the reserved levels of an allowed admission (the endpoint level of
+// a count_on: response rule) once the backend's response didn't match the rule's count_statuses,
+// so only matching responses stay counted. Requests in flight hold their units until then, the
+// limit can't be overshot by concurrent requests.
+func (rl *RateLimiter) ReleaseReservation(ctx context.Context, admission *AdmissionResult) error {
+	if admission == nil || admission.consumed == nil {
+		return nil
+	}
+
+	req := &RefundRequest{Cost: admission.consumed.Cost, AdmittedAt: admission.admittedAt}
+	for _, level := range admission.consumed.Levels {
+		if level.Reserved {
+			req.Levels = append(req.Levels, level)
+		}
+	}
+	if len(req.Levels) == 0 {
+		return nil
+	}
+
+	return rl.store.Refund(ctx, req)
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefund_GivesUnitsBack(t *testing.T) {
+	for name, algoConfig := range memoryTestAlgorithms() {
+		if name == "concurrency" || name == "leaky_bucket_shape" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+				ctx := context.Background()
+				limiterConfig, rule := admissionTestConfig(100, 100, 100)
+				rule.AlgorithmConfig = algoConfig
+
+				// Exhaust the endpoint limit
+				var last *AdmissionResult
+				for {
+					result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+					require.NoError(t, err)
+					if !result.Allowed {
+						assert.Equal(t, config.PerEndpointLevel, result.DeniedLevel)
+						break
+					}
+					last = result
+				}
+				require.NotNil(t, last)
+
+				require.NoError(t, rl.Refund(ctx, last))
+
+				result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+
+				// The global level isn't refunded, one unit per admitted request
+				allowed := 100 - result.Levels[config.GlobalLevel].Remaining
+				assert.Equal(t, 100-result.Levels[config.PerTenantLevel].Remaining+1, allowed)
+
+				result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+				require.NoError(t, err)
+				assert.False(t, result.Allowed)
+			})
+		})
+	}
+}
+
+func TestRefund_CostAndQuota(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := quotaTestConfig(10)
+
+		first, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 4)
+		require.NoError(t, err)
+		require.True(t, first.Allowed)
+		assert.Equal(t, int64(6), first.Levels[config.QuotaLevel].Remaining)
+
+		require.NoError(t, rl.Refund(ctx, first))
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.Equal(t, int64(9), result.Levels[config.QuotaLevel].Remaining)
+		assert.Equal(t, int64(999), result.Levels[config.PerTenantLevel].Remaining)
+		assert.Equal(t, int64(999), result.Levels[config.PerEndpointLevel].Remaining)
+		assert.Equal(t, int64(995), result.Levels[config.GlobalLevel].Remaining)
+	})
+}
+
+func TestRefund_SkipsChangedConfigAndDeniedAdmissions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(100, 100, 2)
+
+		old, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, old.Allowed)
+
+		// A new endpoint limit starts over, the old admission's units aren't in it
+		rule.AlgorithmConfig = fixedWindowConfig(3)
+		for i := 0; i < 3; i++ {
+			result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+			require.NoError(t, err)
+			require.True(t, result.Allowed)
+		}
+		require.NoError(t, rl.Refund(ctx, old))
+
+		denied, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, denied.Allowed)
+
+		// Nothing was consumed, nothing is given back
+		require.NoError(t, rl.Refund(ctx, denied))
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+	})
+}
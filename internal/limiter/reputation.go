@@ -3,10 +3,10 @@ package limiter
 import (
 	"context"
 	"fmt"
-	"strconv"
-	"time"
+	"math"
+	"strings"
 
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
 )
 
 type Reputation struct {
@@ -16,202 +16,287 @@ type Reputation struct {
 	TTL            int64
 }
 
-const improvedReputationScript = `
-local reputation_key = KEYS[1]
-local is_violation = tonumber(ARGV[1])
-local now = tonumber(ARGV[2])
-
--- Get current reputation data
-local rep_data = redis.call('HMGET', reputation_key, 'score', 'violation_count', 'good_requests', 'last_activity')
-local current_score = tonumber(rep_data[1]) or 1.0
-local violation_count = tonumber(rep_data[2]) or 0
-local good_requests = tonumber(rep_data[3]) or 0
-local last_activity = tonumber(rep_data[4]) or now
-
--- Time-based reputation decay for legitimate users caught in bot traffic
--- Only apply if no violations in last 10 minutes (600000ms) and score < 1.0
-local time_since_last = now - last_activity
-if violation_count == 0 and current_score < 1.0 and time_since_last > 600000 then
-    -- Slow natural recovery for users with no violations
-    local time_recovery = math.min(0.05, (time_since_last / 3600000) * 0.1) -- Max 0.05 per hour
-    current_score = math.min(1.0, current_score + time_recovery)
+// number of ARGV slots of the reputation model, see reputationArgs
+const reputationModelArgs = 17
+
+const reputationLua = `
+-- the reputation model, passed from offset + 1 on (reputationArgs)
+local function read_reputation_model(offset)
+    local v = {}
+    for i = 1, 17 do
+        v[i] = tonumber(ARGV[offset + i])
+    end
+    return {
+        min_penalty = v[1], max_penalty = v[2],
+        suspicious_violations = v[3], suspicious_factor = v[4],
+        persistent_violations = v[5], persistent_factor = v[6],
+        rapid_fire = v[7], rapid_fire_window = v[8],
+        clean_recovery = v[9], violator_recovery = v[10],
+        idle_after = v[11], idle_rate = v[12], idle_max = v[13],
+        bot_ttl = v[14], suspicious_ttl = v[15], questionable_ttl = v[16], good_ttl = v[17],
+    }
 end
 
-if is_violation == 1 then
-    -- Anti-bot violation handling
-    violation_count = violation_count + 1
-    
-    -- Progressive punishment - gets worse with each violation
-    local base_impact = math.max(0.05, math.min(0.15, 1.0 / (good_requests + 1)))
-    
-    -- Escalating punishment for repeat offenders (bot-like behavior)
-    local escalation_factor = 1.0
-    if violation_count >= 10 then
-        escalation_factor = 2.0  -- Double punishment for persistent bots
-    elseif violation_count >= 5 then
-        escalation_factor = 1.5  -- 50% more punishment for suspicious behavior
+local function read_reputation(reputation_key)
+    local rep_data = redis.call('HMGET', reputation_key, 'score', 'violation_count', 'good_requests')
+    local ttl = redis.call('TTL', reputation_key)
+    if ttl < 0 then
+        ttl = 0
     end
-    
-    local violation_impact = base_impact * escalation_factor
-    current_score = math.max(0.0, current_score - violation_impact)
-    
-    -- Immediate severe punishment for rapid-fire violations (bot detection)
-    -- If multiple violations within 1 second, assume bot behavior
-    local last_violation = tonumber(redis.call('HGET', reputation_key, 'last_violation') or 0)
-    if last_violation > 0 and (now - last_violation) < 1000 then
-        current_score = math.max(0.0, current_score - 0.2) -- Extra 20% penalty
+    return tonumber(rep_data[1]) or 1.0, tonumber(rep_data[2]) or 0, tonumber(rep_data[3]) or 0, ttl
+end
+
+local function update_reputation(reputation_key, is_violation, now, model)
+    -- Get current reputation data
+    local rep_data = redis.call('HMGET', reputation_key, 'score', 'violation_count', 'good_requests', 'last_activity')
+    local current_score = tonumber(rep_data[1]) or 1.0
+    local violation_count = tonumber(rep_data[2]) or 0
+    local good_requests = tonumber(rep_data[3]) or 0
+    local last_activity = tonumber(rep_data[4]) or now
+
+    -- Time-based reputation decay for legitimate users caught in bot traffic
+    -- Only apply if idle for longer than idle_after and score < 1.0
+    local time_since_last = now - last_activity
+    if violation_count == 0 and current_score < 1.0 and time_since_last > model.idle_after then
+        -- Slow natural recovery for users with no violations, idle_rate per hour up to idle_max
+        local time_recovery = math.min(model.idle_max, (time_since_last / 3600000) * model.idle_rate)
+        current_score = math.min(1.0, current_score + time_recovery)
     end
-    
-    redis.call('HMSET', reputation_key, 
-        'score', current_score,
-        'violation_count', violation_count,
-        'last_violation', now,
-        'good_requests', good_requests,
-        'last_activity', now)
-else
-    -- Handle good request
-    good_requests = good_requests + 1
-    
-    -- Recovery system - slower for users with violations (anti-bot)
-    if violation_count > 0 then
-        -- Very slow recovery for violators to prevent bot adaptation
-        local recovery_rate = 0.005  -- Base recovery rate (0.5%)
-        
-        -- Reduce recovery rate based on violation count (punish bots more)
-        local violation_penalty = math.min(0.8, violation_count * 0.1)
-        recovery_rate = recovery_rate * (1.0 - violation_penalty)
-        
-        -- Apply recovery
-        local improvement = math.min(0.02, recovery_rate / math.sqrt(violation_count))
-        current_score = math.min(1.0, current_score + improvement)
+
+    if is_violation == 1 then
+        -- Anti-bot violation handling
+        violation_count = violation_count + 1
+
+        -- Progressive punishment - gets worse with each violation
+        local base_impact = math.max(model.min_penalty, math.min(model.max_penalty, 1.0 / (good_requests + 1)))
+
+        -- Escalating punishment for repeat offenders (bot-like behavior)
+        local escalation_factor = 1.0
+        if violation_count >= model.persistent_violations then
+            escalation_factor = model.persistent_factor  -- Persistent bots
+        elseif violation_count >= model.suspicious_violations then
+            escalation_factor = model.suspicious_factor  -- Suspicious behavior
+        end
+
+        local violation_impact = base_impact * escalation_factor
+        current_score = math.max(0.0, current_score - violation_impact)
+
+        -- Immediate severe punishment for rapid-fire violations (bot detection)
+        -- If multiple violations within rapid_fire_window, assume bot behavior
+        local last_violation = tonumber(redis.call('HGET', reputation_key, 'last_violation') or 0)
+        if last_violation > 0 and (now - last_violation) < model.rapid_fire_window then
+            current_score = math.max(0.0, current_score - model.rapid_fire)
+        end
+
+        redis.call('HMSET', reputation_key,
+            'score', current_score,
+            'violation_count', violation_count,
+            'last_violation', now,
+            'good_requests', good_requests,
+            'last_activity', now)
     else
-        -- Fast recovery for clean users (likely legitimate users caught in traffic)
-        if current_score < 1.0 then
-            current_score = math.min(1.0, current_score + 0.02)
+        -- Handle good request
+        good_requests = good_requests + 1
+
+        -- Recovery system - slower for users with violations (anti-bot)
+        if violation_count > 0 then
+            -- Very slow recovery for violators to prevent bot adaptation
+            local recovery_rate = model.violator_recovery  -- Base recovery rate
+
+            -- Reduce recovery rate based on violation count (punish bots more)
+            local violation_penalty = math.min(0.8, violation_count * 0.1)
+            recovery_rate = recovery_rate * (1.0 - violation_penalty)
+
+            -- Apply recovery
+            local improvement = math.min(model.clean_recovery, recovery_rate / math.sqrt(violation_count))
+            current_score = math.min(1.0, current_score + improvement)
+        else
+            -- Fast recovery for clean users (likely legitimate users caught in traffic)
+            if current_score < 1.0 then
+                current_score = math.min(1.0, current_score + model.clean_recovery)
+            end
         end
+
+        redis.call('HMSET', reputation_key,
+            'score', current_score,
+            'violation_count', violation_count,
+            'good_requests', good_requests,
+            'last_activity', now)
     end
-    
-    redis.call('HMSET', reputation_key,
-        'score', current_score,
-        'violation_count', violation_count,
-        'good_requests', good_requests,
-        'last_activity', now)
-end
 
--- Anti-bot TTL strategy
-local ttl
-if current_score < 0.1 then
-    ttl = 14400   -- 4h for confirmed bots (very long monitoring)
-elseif current_score < 0.3 then
-    ttl = 7200    -- 2h for suspicious actors
-elseif current_score < 0.7 then
-    ttl = 3600    -- 1h for questionable actors
-else
-    ttl = 1800    -- 30min for good actors
-end
+    -- Anti-bot TTL strategy
+    local ttl
+    if current_score < 0.1 then
+        ttl = model.bot_ttl           -- confirmed bots (very long monitoring)
+    elseif current_score < 0.3 then
+        ttl = model.suspicious_ttl    -- suspicious actors
+    elseif current_score < 0.7 then
+        ttl = model.questionable_ttl  -- questionable actors
+    else
+        ttl = model.good_ttl          -- good actors
+    end
 
--- Extend TTL for repeat offenders (bot-like patterns)
-if violation_count >= 10 then
-    ttl = ttl * 2  -- Double monitoring time for persistent violators
-end
+    -- Extend TTL for repeat offenders (bot-like patterns)
+    if violation_count >= model.persistent_violations then
+        ttl = ttl * 2  -- Double monitoring time for persistent violators
+    end
 
-redis.call('EXPIRE', reputation_key, ttl)
+    redis.call('EXPIRE', reputation_key, ttl)
 
-return {
-    math.floor(current_score * 1000) / 1000,
-    violation_count,
-    good_requests,
-    ttl
-}
+    return math.floor(current_score * 1000) / 1000, violation_count, good_requests, ttl
+end
 `
 
-func (rl *RateLimiter) UpdateReputation(ctx context.Context, tenantKey string, isViolation bool) (*Reputation, error) {
-	reputationKey := fmt.Sprintf("ctrl:reputation:%s", tenantKey)
+// scores are returned as strings, redis truncates lua numbers to integers in replies
+const improvedReputationScript = reputationLua + `
+local score, violation_count, good_requests, ttl = update_reputation(KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]),
+    read_reputation_model(2))
+return {tostring(score), violation_count, good_requests, ttl}
+`
 
-	now := time.Now().UnixMilli()
-	violationFlag := 0
-	if isViolation {
-		violationFlag = 1
-	}
+// UpdateReputation scores a request of the tenant on its own, with the default reputation model
+// (config.DefaultReputation). Admissions score with the configured model.
+func (rl *RateLimiter) UpdateReputation(ctx context.Context, tenantKey string, isViolation bool) (*Reputation, error) {
+	return rl.store.UpdateReputation(ctx, tenantKey, isViolation, (*config.Reputation)(nil).Model())
+}
 
-	result := rl.redisClient.Eval(ctx, improvedReputationScript,
-		[]string{reputationKey},
-		violationFlag, now)
+func (rl *RateLimiter) GetTenantReputation(ctx context.Context, tenantKey string) (*Reputation, error) {
+	return rl.store.GetReputation(ctx, tenantKey)
+}
 
-	if result.Err() != nil {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, result.Err()
+// the reputation model as ARGV of read_reputation_model, durations in milliseconds and TTLs in seconds
+func reputationArgs(model *config.Reputation) []interface{} {
+	return []interface{}{
+		model.Penalty.Min, model.Penalty.Max,
+		model.Penalty.SuspiciousViolations, model.Penalty.SuspiciousFactor,
+		model.Penalty.PersistentViolations, model.Penalty.PersistentFactor,
+		model.Penalty.RapidFire, model.Penalty.RapidFireWindow.Milliseconds(),
+		model.Recovery.Clean, model.Recovery.Violator,
+		model.Recovery.IdleAfter.Milliseconds(), model.Recovery.IdleRate, model.Recovery.IdleMax,
+		int64(model.TTL.Bot.Seconds()), int64(model.TTL.Suspicious.Seconds()),
+		int64(model.TTL.Questionable.Seconds()), int64(model.TTL.Good.Seconds()),
 	}
+}
+
+func constructReputationKey(tenantKey string) string {
+	//ctrl:reputation:{user123}, same hash slot as the tenant's limiter keys
+	return fmt.Sprintf("ctrl:reputation:{%s}", tenantKey)
+}
 
-	values, ok := result.Val().([]interface{})
-	if !ok || len(values) < 4 {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, fmt.Errorf("unexpected result from lua script: %v", result.Val())
+func tenantFromReputationKey(key string) (string, bool) {
+	tenantKey, ok := strings.CutPrefix(key, "ctrl:reputation:{")
+	if !ok {
+		return "", false
 	}
+	return strings.CutSuffix(tenantKey, "}")
+}
 
-	score, _ := strconv.ParseFloat(fmt.Sprint(values[0]), 64)
-	violationCount, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
-	goodRequests, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
-	ttl, _ := strconv.ParseInt(fmt.Sprint(values[3]), 10, 64)
+type reputationState struct {
+	score          float64
+	violationCount float64
+	goodRequests   float64
+	lastActivity   float64
+	lastViolation  float64
+}
 
+// memory store version of the read_reputation lua function
+func readReputationMemory(ms *MemoryStore, reputationKey string, now float64) *Reputation {
+	state, ok := ms.get(reputationKey, now).(*reputationState)
+	if !ok {
+		return &Reputation{Score: 1.0}
+	}
 	return &Reputation{
-		Score:          score,
-		ViolationCount: violationCount,
-		GoodRequests:   goodRequests,
-		TTL:            ttl,
-	}, nil
+		Score:          state.score,
+		ViolationCount: int64(state.violationCount),
+		GoodRequests:   int64(state.goodRequests),
+		TTL:            ms.ttl(reputationKey, now),
+	}
 }
 
-func (rl *RateLimiter) GetTenantReputation(ctx context.Context, tenantKey string) (*Reputation, error) {
-	reputationKey := fmt.Sprintf("ctrl:reputation:%s", tenantKey)
-
-	result := rl.redisClient.HMGet(ctx, reputationKey, "score", "violation_count", "good_requests")
+// memory store version of the update_reputation lua function
+func updateReputationMemory(ms *MemoryStore, reputationKey string, isViolation bool, now float64,
+	model *config.Reputation) *Reputation {
+	state, ok := ms.get(reputationKey, now).(*reputationState)
+	if !ok {
+		state = &reputationState{score: 1.0, lastActivity: now}
+	}
 
-	if result.Err() != nil {
-		return &Reputation{Score: 1.0, TTL: 0}, nil
+	// Time-based reputation decay for legitimate users caught in bot traffic
+	// Only apply if idle for longer than idle_after and score < 1.0
+	timeSinceLast := now - state.lastActivity
+	if state.violationCount == 0 && state.score < 1.0 && timeSinceLast > float64(model.Recovery.IdleAfter.Milliseconds()) {
+		// Slow natural recovery for users with no violations, idle_rate per hour up to idle_max
+		timeRecovery := math.Min(model.Recovery.IdleMax, (timeSinceLast/3600000)*model.Recovery.IdleRate)
+		state.score = math.Min(1.0, state.score+timeRecovery)
 	}
 
-	values := result.Val()
+	if isViolation {
+		// Anti-bot violation handling
+		state.violationCount++
+
+		// Progressive punishment - gets worse with each violation
+		baseImpact := math.Max(model.Penalty.Min, math.Min(model.Penalty.Max, 1.0/(state.goodRequests+1)))
 
-	score := 1.0
-	if values[0] != nil {
-		if s, err := strconv.ParseFloat(values[0].(string), 64); err == nil {
-			score = s
+		// Escalating punishment for repeat offenders (bot-like behavior)
+		escalationFactor := 1.0
+		if state.violationCount >= float64(model.Penalty.PersistentViolations) {
+			escalationFactor = model.Penalty.PersistentFactor
+		} else if state.violationCount >= float64(model.Penalty.SuspiciousViolations) {
+			escalationFactor = model.Penalty.SuspiciousFactor
 		}
-	}
 
-	violationCount := int64(0)
-	if values[1] != nil {
-		if v, err := strconv.ParseInt(values[1].(string), 10, 64); err == nil {
-			violationCount = v
+		state.score = math.Max(0.0, state.score-baseImpact*escalationFactor)
+
+		// Immediate severe punishment for rapid-fire violations (bot detection)
+		// If multiple violations within rapid_fire_window, assume bot behavior
+		if state.lastViolation > 0 && now-state.lastViolation < float64(model.Penalty.RapidFireWindow.Milliseconds()) {
+			state.score = math.Max(0.0, state.score-model.Penalty.RapidFire)
 		}
-	}
 
-	goodRequests := int64(0)
-	if values[2] != nil {
-		if g, err := strconv.ParseInt(values[2].(string), 10, 64); err == nil {
-			goodRequests = g
+		state.lastViolation = now
+	} else {
+		// Handle good request
+		state.goodRequests++
+
+		// Recovery system - slower for users with violations (anti-bot)
+		if state.violationCount > 0 {
+			// Very slow recovery for violators to prevent bot adaptation,
+			// reduced further based on violation count (punish bots more)
+			recoveryRate := model.Recovery.Violator * (1.0 - math.Min(0.8, state.violationCount*0.1))
+			improvement := math.Min(model.Recovery.Clean, recoveryRate/math.Sqrt(state.violationCount))
+			state.score = math.Min(1.0, state.score+improvement)
+		} else if state.score < 1.0 {
+			// Fast recovery for clean users (likely legitimate users caught in traffic)
+			state.score = math.Min(1.0, state.score+model.Recovery.Clean)
 		}
 	}
 
-	ttlCmd := rl.redisClient.TTL(ctx, reputationKey)
-	ttlSeconds := int64(0)
-	if err := ttlCmd.Err(); err == nil {
-		ttlSeconds = int64(ttlCmd.Val().Seconds())
+	state.lastActivity = now
+
+	// Anti-bot TTL strategy
+	var ttl int64
+	switch {
+	case state.score < 0.1:
+		ttl = int64(model.TTL.Bot.Seconds()) // confirmed bots (very long monitoring)
+	case state.score < 0.3:
+		ttl = int64(model.TTL.Suspicious.Seconds()) // suspicious actors
+	case state.score < 0.7:
+		ttl = int64(model.TTL.Questionable.Seconds()) // questionable actors
+	default:
+		ttl = int64(model.TTL.Good.Seconds()) // good actors
+	}
+
+	// Extend TTL for repeat offenders (bot-like patterns)
+	if state.violationCount >= float64(model.Penalty.PersistentViolations) {
+		ttl = ttl * 2
 	}
 
-	return &Reputation{
-		Score:          score,
-		ViolationCount: violationCount,
-		GoodRequests:   goodRequests,
-		TTL:            ttlSeconds,
-	}, nil
-}
+	ms.set(reputationKey, state, now, float64(ttl*1000))
 
-func (rl *RateLimiter) GetReputationThreshold() float64 {
-	return 0.3 // Block requests from users with reputation below 30%
+	return &Reputation{
+		Score:          math.Floor(state.score*1000) / 1000,
+		ViolationCount: int64(state.violationCount),
+		GoodRequests:   int64(state.goodRequests),
+		TTL:            ttl,
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -451,3 +452,81 @@ func BenchmarkReputation_MixedTraffic(b *testing.B) {
 		}
 	})
 }
+
+func TestReputation_ConfiguredModel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1000, 1, 1000)
+		limiterConfig.Reputation = config.DefaultReputation()
+		limiterConfig.Reputation.Penalty.Min = 0.4
+		limiterConfig.Reputation.Penalty.Max = 0.4
+		limiterConfig.Reputation.Penalty.RapidFire = 0
+		limiterConfig.Reputation.TTL.Good = config.Duration{Duration: 10 * time.Minute}
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		assert.Equal(t, int64(600), result.Reputation.TTL)
+
+		// One violation takes the configured penalty, no rapid fire penalty on top
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.False(t, result.Allowed)
+		assert.InDelta(t, 0.6, result.Reputation.Score, 0.002)
+
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.InDelta(t, 0.2, result.Reputation.Score, 0.002)
+		assert.Equal(t, int64(2), result.Reputation.ViolationCount)
+	})
+}
+
+func TestReputation_ConfiguredThreshold(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1, 100, 100)
+		limiterConfig.Reputation = config.DefaultReputation()
+		limiterConfig.Reputation.Threshold = 1.0
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+
+		// Even a perfect score is at the threshold
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.GlobalLevel, result.DeniedLevel)
+	})
+}
+
+func TestReputation_Disabled(t *testing.T) {
+	forEachStore(t, func(t *testing.T, rl *RateLimiter) {
+		ctx := context.Background()
+		limiterConfig, rule := admissionTestConfig(1, 1, 100)
+		limiterConfig.Reputation = config.DefaultReputation()
+		limiterConfig.Reputation.Enabled = false
+
+		result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		assert.Equal(t, 1.0, result.Reputation.Score)
+
+		// The global level rejects like any other, violations aren't tracked
+		result, err = rl.CheckLimits(ctx, "user2", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, config.GlobalLevel, result.DeniedLevel)
+
+		reputation, err := rl.GetTenantReputation(ctx, "user1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), reputation.GoodRequests)
+
+		// Bans still apply
+		require.NoError(t, rl.store.SetBan(ctx, "user1", time.Minute))
+		result, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+		require.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Greater(t, result.BannedFor, time.Duration(0))
+	})
+}
@@ -0,0 +1,51 @@
+package limiter
+
+import (
+	"context"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+type luaScript struct {
+	name   string
+	script *redis.Script
+}
+
+var (
+	admissionLuaScript  = &luaScript{name: "admission", script: redis.NewScript(admissionScript)}
+	reputationLuaScript = &luaScript{name: "reputation", script: redis.NewScript(improvedReputationScript)}
+	refundLuaScript     = &luaScript{name: "refund", script: redis.NewScript(refundScript)}
+	leaseLuaScript      = &luaScript{name: "lease", script: redis.NewScript(renewLeaseScript)}
+)
+
+var luaScripts = []*luaScript{admissionLuaScript, reputationLuaScript, refundLuaScript, leaseLuaScript}
+
+// LoadScripts registers all lua scripts in redis (SCRIPT LOAD), requests only send the sha afterwards.
+func (rs *RedisStore) LoadScripts(ctx context.Context) error {
+	for _, s := range luaScripts {
+		if err := s.script.Load(ctx, rs.client).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runs the script by sha, redis drops its script cache on restart or failover,
+// in that case the script is loaded again and retried once
+func (rs *RedisStore) runScript(ctx context.Context, s *luaScript, keys []string, args ...interface{}) *redis.Cmd {
+	result := s.script.EvalSha(ctx, rs.client, keys, args...)
+	if !redis.HasErrorPrefix(result.Err(), "NOSCRIPT") {
+		return result
+	}
+
+	//==========================Metrics=======================
+	metrics.ScriptReloads.WithLabelValues(s.name).Inc()
+	//========================================================
+
+	if err := s.script.Load(ctx, rs.client).Err(); err != nil {
+		result.SetErr(err)
+		return result
+	}
+	return s.script.EvalSha(ctx, rs.client, keys, args...)
+}
@@ -0,0 +1,74 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scriptReloads(t *testing.T, s *luaScript) float64 {
+	var m dto.Metric
+	require.NoError(t, metrics.ScriptReloads.WithLabelValues(s.name).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestLoadScripts_RegistersAllScripts(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	rs := rl.store.(*RedisStore)
+
+	require.NoError(t, rs.LoadScripts(ctx))
+
+	for _, s := range luaScripts {
+		exists, err := s.script.Exists(ctx, rs.client).Result()
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true}, exists, s.name)
+	}
+}
+
+func TestRunScript_ReloadsAfterNoScript(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	limiterConfig, rule := admissionTestConfig(100, 10, 5)
+	rs := rl.store.(*RedisStore)
+
+	require.NoError(t, rs.LoadScripts(ctx))
+
+	// Simulates a redis restart or failover to a replica without the scripts
+	require.NoError(t, rs.client.ScriptFlush(ctx).Err())
+
+	before := scriptReloads(t, admissionLuaScript)
+
+	result, err := rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, before+1, scriptReloads(t, admissionLuaScript))
+
+	// Script is cached again, no further reloads
+	_, err = rl.CheckLimits(ctx, "user1", "", limiterConfig, rule, 1)
+	require.NoError(t, err)
+	assert.Equal(t, before+1, scriptReloads(t, admissionLuaScript))
+}
+
+func TestRunScript_ReputationReloadsAfterNoScript(t *testing.T) {
+	rl, mr := setupTestRateLimiter(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+
+	before := scriptReloads(t, reputationLuaScript)
+
+	// Scripts were never loaded
+	reputation, err := rl.UpdateReputation(ctx, "user1", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), reputation.GoodRequests)
+	assert.Equal(t, before+1, scriptReloads(t, reputationLuaScript))
+}
@@ -2,119 +2,194 @@ package limiter
 
 import (
 	"context"
-	"fmt"
-	"strconv"
-	"time"
+	"math"
+	"slices"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 )
 
-const slidingWindowScript = `
-local key = KEYS[1]
-local config_hash = ARGV[1]
-local limit = tonumber(ARGV[2])
-local window_size = tonumber(ARGV[3])
-local now = tonumber(ARGV[4])
-
--- Use 1-second buckets for granularity
-local bucket_size = 1000
-local current_bucket = math.floor(now / bucket_size) * bucket_size
-local window_start = now - window_size
-
--- Check if config has changed
-local stored_config = redis.call('HGET', key, 'config_hash')
-if stored_config and stored_config ~= config_hash then
-    -- Config changed, clear all data
-    redis.call('DEL', key)
-    redis.call('HSET', key, 'config_hash', config_hash)
-end
-
--- Ensure config hash is set
-if not stored_config then
-    redis.call('HSET', key, 'config_hash', config_hash)
-end
+const slidingWindowLua = `
+local function sliding_window(key, config_hash, now, cost, limit, window_size)
+    -- Use 1-second buckets for granularity
+    local bucket_size = 1000
+    local current_bucket = math.floor(now / bucket_size) * bucket_size
+    local window_start = now - window_size
+
+    -- Config changed (hash mismatch): all stored buckets belong to the old config
+    local stored_config = redis.call('HGET', key, 'config_hash')
+    local reset = stored_config and stored_config ~= config_hash
+
+    -- Count requests in sliding window and collect old buckets
+    local total_requests = 0
+    local window_buckets = {}
+    local buckets_to_delete = {}
+
+    if not reset then
+        local all_data = redis.call('HGETALL', key)
+        for i = 1, #all_data, 2 do
+            local field = all_data[i]
+
+            -- Skip config_hash field
+            if field ~= 'config_hash' then
+                local bucket_time = tonumber(field)
+                local value = tonumber(all_data[i + 1])
+
+                if bucket_time and bucket_time >= window_start then
+                    -- Bucket is within sliding window
+                    total_requests = total_requests + value
+                    table.insert(window_buckets, {bucket_time, value})
+                elseif bucket_time then
+                    -- Bucket is outside window, mark for deletion
+                    table.insert(buckets_to_delete, field)
+                end
+            end
+        end
+    end
 
--- Count requests in sliding window and clean up old buckets
-local total_requests = 0
-local oldest_request_time = now
-local buckets_to_delete = {}
-
--- Get all fields (buckets)
-local all_data = redis.call('HGETALL', key)
-for i = 1, #all_data, 2 do
-    local field = all_data[i]
-    local value = tonumber(all_data[i + 1])
-    
-    -- Skip config_hash field
-    if field ~= 'config_hash' then
-        local bucket_time = tonumber(field)
-        
-        if bucket_time and bucket_time >= window_start then
-            -- Bucket is within sliding window
-            total_requests = total_requests + value
-            if bucket_time < oldest_request_time then
-                oldest_request_time = bucket_time
+    if total_requests + cost > limit then
+        -- Request denied - calculate when enough of the oldest requests expire for the cost
+        table.sort(window_buckets, function(a, b) return a[1] < b[1] end)
+        local excess = total_requests + cost - limit
+        local retry_at = now + window_size
+        local freed = 0
+        for _, bucket in ipairs(window_buckets) do
+            freed = freed + bucket[2]
+            retry_at = bucket[1] + window_size
+            if freed >= excess then
+                break
             end
-        elseif bucket_time then
-            -- Bucket is outside window, mark for deletion
-            table.insert(buckets_to_delete, field)
         end
+        return 0, 0, math.max(0, retry_at - now), nil
     end
-end
 
--- Clean up old buckets
-if #buckets_to_delete > 0 then
-    redis.call('HDEL', key, unpack(buckets_to_delete))
+    local commit = function()
+        if reset then
+            redis.call('DEL', key)
+        elseif #buckets_to_delete > 0 then
+            redis.call('HDEL', key, unpack(buckets_to_delete))
+        end
+
+        redis.call('HSET', key, 'config_hash', config_hash)
+        redis.call('HINCRBY', key, tostring(current_bucket), cost)
+        redis.call('EXPIRE', key, math.ceil(window_size / 1000) + 60)
+    end
+
+    return 1, math.max(0, limit - total_requests - cost), 0, commit
 end
+`
+
+// Refunds come out of the 1-second bucket the request was counted in, nothing is left to
+// refund once that bucket slid out of the window.
+const slidingWindowRefundLua = `
+local function sliding_window_refund(key, config_hash, now, admitted_at, cost)
+    if redis.call('HGET', key, 'config_hash') ~= config_hash then
+        return
+    end
 
--- Check if request can be allowed
-if total_requests < limit then
-    -- Increment current bucket
-    redis.call('HINCRBY', key, tostring(current_bucket), 1)
-    
-    -- Set appropriate TTL
-    redis.call('EXPIRE', key, math.ceil(window_size / 1000) + 60)
-    
-    -- Calculate remaining (note: this is approximate since we just added one)
-    local remaining = limit - total_requests - 1
-    return {1, math.max(0, remaining), 0}
-else
-    -- Request denied - calculate when oldest request will expire
-    local retry_after = (oldest_request_time + window_size) - now
-    return {0, 0, math.max(0, retry_after)}
+    local bucket = tostring(math.floor(admitted_at / 1000) * 1000)
+    local count = tonumber(redis.call('HGET', key, bucket))
+    if count == nil then
+        return
+    end
+
+    if count <= cost then
+        redis.call('HDEL', key, bucket)
+    else
+        redis.call('HINCRBY', key, bucket, -cost)
+    end
 end
 `
 
 func (rl *RateLimiter) SlidingWindowLimiter(ctx context.Context, key string,
 	algoConfig config.AlgorithmConfig, configHash string) (*LimitResult, error) {
-	now := time.Now().UnixMilli()
+	algoConfig.Algorithm = string(config.SlidingWindow)
+	return rl.checkSingleLevel(ctx, key, algoConfig, configHash)
+}
+
+type slidingWindowState struct {
+	// request count per 1-second bucket start
+	buckets    map[float64]float64
+	configHash string
+}
+
+// memory store version of the sliding_window lua function
+func slidingWindowMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	limit, windowSize := p[0], p[1]
+
+	// Use 1-second buckets for granularity
+	const bucketSize = 1000
+	currentBucket := math.Floor(now/bucketSize) * bucketSize
+	windowStart := now - windowSize
+
+	// Config changed (hash mismatch): all stored buckets belong to the old config
+	state, ok := ms.get(key, now).(*slidingWindowState)
+	reset := !ok || state.configHash != configHash
+
+	// Count requests in sliding window and collect old buckets
+	totalRequests := 0.0
+	var windowBuckets []float64
+	var bucketsToDelete []float64
+
+	if !reset {
+		for bucketTime, value := range state.buckets {
+			if bucketTime >= windowStart {
+				totalRequests += value
+				windowBuckets = append(windowBuckets, bucketTime)
+			} else {
+				bucketsToDelete = append(bucketsToDelete, bucketTime)
+			}
+		}
+	}
+
+	if totalRequests+cost > limit {
+		// Request denied - calculate when enough of the oldest requests expire for the cost
+		slices.Sort(windowBuckets)
+		excess := totalRequests + cost - limit
+		retryAt := now + windowSize
+		freed := 0.0
+		for _, bucketTime := range windowBuckets {
+			freed += state.buckets[bucketTime]
+			retryAt = bucketTime + windowSize
+			if freed >= excess {
+				break
+			}
+		}
+		return false, 0, math.Max(0, retryAt-now), nil
+	}
 
-	result := rl.redisClient.Eval(ctx, slidingWindowScript, []string{key},
-		configHash, *algoConfig.Limit, algoConfig.WindowSize.Milliseconds(), now)
+	commit := func() {
+		if reset {
+			state = &slidingWindowState{buckets: make(map[float64]float64), configHash: configHash}
+		}
+		for _, bucketTime := range bucketsToDelete {
+			delete(state.buckets, bucketTime)
+		}
 
-	if result.Err() != nil {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, result.Err()
+		state.buckets[currentBucket] += cost
+		ms.set(key, state, now, (math.Ceil(windowSize/1000)+60)*1000)
 	}
 
-	values, ok := result.Val().([]interface{})
-	if !ok || len(values) != 3 {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, fmt.Errorf("unexpected response format from Redis script")
+	return true, math.Max(0, limit-totalRequests-cost), 0, commit
+}
+
+// memory store version of the sliding_window_refund lua function
+func slidingWindowRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	state, ok := ms.get(key, now).(*slidingWindowState)
+	if !ok || state.configHash != configHash {
+		return
 	}
 
-	allowedInt, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
-	remaining, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
-	retryAfterMs, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	bucketTime := math.Floor(admittedAt/1000) * 1000
+	count, ok := state.buckets[bucketTime]
+	if !ok {
+		return
+	}
 
-	return &LimitResult{
-		Allowed:    allowedInt == 1,
-		Remaining:  remaining,
-		RetryAfter: time.Duration(retryAfterMs) * time.Millisecond,
-	}, nil
+	if count <= cost {
+		delete(state.buckets, bucketTime)
+	} else {
+		state.buckets[bucketTime] = count - cost
+	}
 }
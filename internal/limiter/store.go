@@ -0,0 +1,35 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// Store keeps the limiter and reputation state. Every call is atomic: all levels of an
+// admission and the reputation update see the same state and are written together.
+type Store interface {
+	Admit(ctx context.Context, req *AdmissionRequest) (*AdmissionResult, error)
+	// scores one request of the tenant with the given model
+	UpdateReputation(ctx context.Context, tenantKey string, isViolation bool, model *config.Reputation) (*Reputation, error)
+	GetReputation(ctx context.Context, tenantKey string) (*Reputation, error)
+	// plan of a tenant in a redis hash, empty when the tenant isn't mapped
+	GetTenantPlan(ctx context.Context, hashKey, tenantKey string) (string, error)
+	// admissions of a banned tenant are denied until the ban expires
+	SetBan(ctx context.Context, tenantKey string, duration time.Duration) error
+	// remaining ban of a tenant, 0 when it isn't banned
+	GetBan(ctx context.Context, tenantKey string) (time.Duration, error)
+	// removes keys of any kind, missing keys are ignored
+	Delete(ctx context.Context, keys ...string) error
+	// frees the slot of a concurrency level, an expired lease is ignored
+	ReleaseLease(ctx context.Context, key, leaseID string) error
+	// extends an unexpired lease to lease from now, a released or expired one is left alone
+	RenewLease(ctx context.Context, key, leaseID string, lease time.Duration) error
+	// gives consumed units back, atomically for all levels
+	Refund(ctx context.Context, req *RefundRequest) error
+	// calls visit for every tenant with a tracked reputation
+	ScanReputations(ctx context.Context, visit func(tenantKey string, reputation *Reputation)) error
+	Ping(ctx context.Context) error
+	Close() error
+}
@@ -2,115 +2,132 @@ package limiter
 
 import (
 	"context"
-	"fmt"
-	"strconv"
-	"time"
+	"math"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 )
 
-const tokenBucketScript = `
-local key = KEYS[1]
-local config_hash = ARGV[1]
-local capacity = tonumber(ARGV[2])
-local refill_rate = tonumber(ARGV[3])
-local refill_period = tonumber(ARGV[4])
-local now = tonumber(ARGV[5])
-
--- Check if config has changed by comparing the hash
-local stored_config = redis.call('HGET', key, 'config_hash')
-
-if stored_config and stored_config ~= config_hash then
-    -- Config changed, reset the bucket
-    redis.call('HMSET', key, 'tokens', capacity, 'last_refill', now, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / refill_rate) * (refill_period / 1000)) + 60)
-    
-    -- Now consume a token for this request
-    if capacity >= 1 then
-        redis.call('HSET', key, 'tokens', capacity - 1)
-        return {1, capacity - 1, 0}
-    else
-        return {0, 0, refill_period}
+const tokenBucketLua = `
+local function token_bucket(key, config_hash, now, cost, capacity, refill_rate, refill_period)
+    local ttl = math.ceil((capacity / refill_rate) * (refill_period / 1000)) + 60
+
+    -- Get current bucket state
+    local bucket = redis.call('HMGET', key, 'tokens', 'last_refill', 'config_hash')
+    local current_tokens = tonumber(bucket[1])
+    local last_refill = tonumber(bucket[2])
+    local stored_config = bucket[3]
+
+    -- First request or config changed (hash mismatch): start from a full bucket
+    if current_tokens == nil or last_refill == nil or (stored_config and stored_config ~= config_hash) then
+        current_tokens = capacity
+        last_refill = now
     end
-end
+    -- A schedule switch keeps the tokens, a lowered capacity applies right away
+    current_tokens = math.min(capacity, current_tokens)
 
--- Get current bucket state
-local bucket = redis.call('HMGET', key, 'tokens', 'last_refill')
-local current_tokens = tonumber(bucket[1])
-local last_refill = tonumber(bucket[2])
-
--- Initialize if this is the first request
-if current_tokens == nil or last_refill == nil then
-    current_tokens = capacity
-    last_refill = now
-    redis.call('HMSET', key, 'tokens', current_tokens, 'last_refill', last_refill, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / refill_rate) * (refill_period / 1000)) + 60)
-end
+    -- Calculate tokens to add based on elapsed time
+    local time_elapsed = now - last_refill
+    if time_elapsed > 0 then
+        local periods_elapsed = math.floor(time_elapsed / refill_period)
+        if periods_elapsed > 0 then
+            local tokens_to_add = periods_elapsed * refill_rate
+            current_tokens = math.min(capacity, current_tokens + tokens_to_add)
+            last_refill = last_refill + (periods_elapsed * refill_period)
+        end
+    end
+
+    if current_tokens < cost then
+        -- Not enough tokens, retry after the refills that cover the cost (a full bucket at most)
+        -- A cost over the capacity only gets here while the adaptive global limit is shrunk
+        local refills = math.max(1, math.ceil((math.min(cost, capacity) - current_tokens) / refill_rate))
+        local next_refill = last_refill + refills * refill_period
+        return 0, 0, math.max(0, next_refill - now), nil
+    end
 
--- Calculate tokens to add based on elapsed time
-local time_elapsed = now - last_refill
-if time_elapsed > 0 then
-    local periods_elapsed = math.floor(time_elapsed / refill_period)
-    if periods_elapsed > 0 then
-        local tokens_to_add = periods_elapsed * refill_rate
-        current_tokens = math.min(capacity, current_tokens + tokens_to_add)
-        last_refill = last_refill + (periods_elapsed * refill_period)
+    local commit = function()
+        redis.call('HMSET', key, 'tokens', current_tokens - cost, 'last_refill', last_refill, 'config_hash', config_hash)
+        redis.call('EXPIRE', key, ttl)
     end
+
+    return 1, current_tokens - cost, 0, commit
 end
+`
+
+// Refunds put the tokens back into the stored bucket, the pending refill is added on the next request.
+const tokenBucketRefundLua = `
+local function token_bucket_refund(key, config_hash, now, admitted_at, cost, capacity)
+    local bucket = redis.call('HMGET', key, 'tokens', 'config_hash')
+    local current_tokens = tonumber(bucket[1])
+
+    -- Expired or config changed: the bucket the tokens came from is gone
+    if current_tokens == nil or bucket[2] ~= config_hash then
+        return
+    end
 
--- Try to consume a token
-if current_tokens >= 1 then
-    -- Consume token
-    current_tokens = current_tokens - 1
-    
-    -- Update state
-    redis.call('HMSET', key, 'tokens', current_tokens, 'last_refill', last_refill, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / refill_rate) * (refill_period / 1000)) + 60)
-    
-    return {1, current_tokens, 0}
-else
-    -- No tokens available
-    redis.call('HMSET', key, 'tokens', current_tokens, 'last_refill', last_refill, 'config_hash', config_hash)
-    redis.call('EXPIRE', key, math.ceil((capacity / refill_rate) * (refill_period / 1000)) + 60)
-    
-    -- Calculate retry after time
-    local next_refill = last_refill + refill_period
-    local retry_after = math.max(0, next_refill - now)
-    
-    return {0, current_tokens, retry_after}
+    redis.call('HSET', key, 'tokens', math.min(capacity, current_tokens + cost))
 end
 `
 
 func (rl *RateLimiter) TokenBucketLimiter(ctx context.Context, key string, algoConfig config.AlgorithmConfig,
 	configHash string) (*LimitResult, error) {
-	now := time.Now().UnixMilli()
+	algoConfig.Algorithm = string(config.TokenBucket)
+	return rl.checkSingleLevel(ctx, key, algoConfig, configHash)
+}
+
+type tokenBucketState struct {
+	tokens     float64
+	lastRefill float64
+	configHash string
+}
 
-	result := rl.redisClient.Eval(ctx, tokenBucketScript, []string{key},
-		configHash, *algoConfig.Capacity, *algoConfig.RefillRate, algoConfig.RefillPeriod.Milliseconds(), now)
+// memory store version of the token_bucket lua function
+func tokenBucketMemory(ms *MemoryStore, key, configHash string, now, cost float64,
+	p [3]float64, leaseID string) (bool, float64, float64, func()) {
+	capacity, refillRate, refillPeriod := p[0], p[1], p[2]
+	ttl := math.Ceil((capacity/refillRate)*(refillPeriod/1000)) + 60
 
-	if result.Err() != nil {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, result.Err()
+	// First request or config changed (hash mismatch): start from a full bucket
+	currentTokens, lastRefill := capacity, now
+	if state, ok := ms.get(key, now).(*tokenBucketState); ok && state.configHash == configHash {
+		currentTokens, lastRefill = state.tokens, state.lastRefill
 	}
+	// A schedule switch keeps the tokens, a lowered capacity applies right away
+	currentTokens = math.Min(capacity, currentTokens)
 
-	values, ok := result.Val().([]interface{})
-	if !ok || len(values) != 3 {
-		//==========================Metrics=======================
-		metrics.RedisErrors.Inc()
-		//========================================================
-		return nil, fmt.Errorf("unexpected response format from Redis script")
+	// Calculate tokens to add based on elapsed time
+	if timeElapsed := now - lastRefill; timeElapsed > 0 {
+		periodsElapsed := math.Floor(timeElapsed / refillPeriod)
+		if periodsElapsed > 0 {
+			currentTokens = math.Min(capacity, currentTokens+periodsElapsed*refillRate)
+			lastRefill = lastRefill + periodsElapsed*refillPeriod
+		}
 	}
 
-	allowedInt, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
-	remaining, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
-	retryAfterMs, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	if currentTokens < cost {
+		// Not enough tokens, retry after the refills that cover the cost (a full bucket at most)
+		// A cost over the capacity only gets here while the adaptive global limit is shrunk
+		refills := math.Max(1, math.Ceil((math.Min(cost, capacity)-currentTokens)/refillRate))
+		return false, 0, math.Max(0, lastRefill+refills*refillPeriod-now), nil
+	}
+
+	commit := func() {
+		ms.set(key, &tokenBucketState{tokens: currentTokens - cost, lastRefill: lastRefill, configHash: configHash},
+			now, ttl*1000)
+	}
+
+	return true, currentTokens - cost, 0, commit
+}
+
+// memory store version of the token_bucket_refund lua function
+func tokenBucketRefundMemory(ms *MemoryStore, key, configHash string, now, admittedAt, cost float64,
+	p [3]float64) {
+	capacity := p[0]
+
+	// Expired or config changed: the bucket the tokens came from is gone
+	state, ok := ms.get(key, now).(*tokenBucketState)
+	if !ok || state.configHash != configHash {
+		return
+	}
 
-	return &LimitResult{
-		Allowed:    allowedInt == 1,
-		Remaining:  remaining,
-		RetryAfter: time.Duration(retryAfterMs) * time.Millisecond,
-	}, nil
+	state.tokens = math.Min(capacity, state.tokens+cost)
 }
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+)
+
+// AccessControlMiddleware matches the client ip against the access_control lists:
+// denylisted clients are rejected with 403, allowlisted ones skip every limit middleware.
+func AccessControlMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		cfg := config.GetConfigFromContext(ctx)
+		clientIP := GetClientIP(ctx)
+
+		addr, err := netip.ParseAddr(clientIP)
+		if err != nil {
+			// nothing to match against, the limits still apply
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		switch cfg.Limiter.AccessControl.Check(addr) {
+		case config.AccessDeny:
+			reqLogger := newRequestLogger(lgr, req, GetRequestID(ctx), clientIP)
+			rejectDenylisted(res, reqLogger)
+			return
+
+		case config.AccessAllow:
+			//===========================Metrics==============================
+			metrics.AllowlistedRequests.Inc()
+			//================================================================
+
+			next.ServeHTTP(res, req.WithContext(setBypass(ctx, true)))
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"go.uber.org/zap"
+)
+
+// AdmissionMiddleware evaluates every enabled limit level and the tenant reputation in a
+// single redis call, the level middlewares after it only act on the stored result.
+// The tarpit runs a delayed request through it again once the hold is over.
+func AdmissionMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter) http.Handler {
+	var admit http.Handler
+	admit = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		cfg := config.GetConfigFromContext(ctx)
+		reqLogger := GetRequestLoggerFromContext(ctx)
+
+		if IsBypassEnabled(ctx) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		ctx = setAdmission(ctx, admit)
+
+		redisCtx := GetRedisContextFromContext(ctx)
+		tenantKey := GetTenantKeyFromContext(ctx)
+		endpointRule := GetEndpointRuleFromContext(ctx)
+		plan := GetPlanFromContext(ctx)
+
+		cost := int64(1)
+		if endpointRule != nil && endpointRule.Cost != nil {
+			var status int
+			var err error
+			if cost, status, err = requestCost(req, endpointRule.Cost); err != nil {
+				rejectInvalidCost(res, reqLogger, status, err)
+				return
+			}
+			reqLogger.Debug("request cost", zap.Int64("cost", cost))
+		}
+
+		admission, err := rateLimiter.CheckLimits(redisCtx, tenantKey, plan, cfg.Limiter, endpointRule, cost)
+		if errors.Is(err, limiter.ErrCostExceedsLimit) {
+			// never admitted whatever the state, no Retry-After
+			rejectInvalidCost(res, reqLogger, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			//============================Metrics============================
+			if cfg.Limiter.Global.Enabled {
+				metrics.GlobalLimitErrors.Inc()
+			}
+			if cfg.Limiter.PerTenant.Enabled {
+				metrics.TenantLimitErrors.Inc()
+			}
+			if endpointRule != nil && !endpointRule.Bypass {
+				metrics.EndpointLimitErrors.Inc()
+			}
+			//===============================================================
+
+			// local_fallback only gets here if the fallback failed too, it fails open
+			if cfg.Redis.FailureMode == config.FailClosed {
+				rejectUnavailable(res, reqLogger, plan, err)
+				return
+			}
+
+			reqLogger.Error("failed to enforce rate limits, forwarding request to server {fail open}",
+				zap.Error(err))
+			if retry := getTarpitRetry(ctx); retry != nil {
+				retry.admitted = true
+			}
+			next.ServeHTTP(res, req.WithContext(setBypass(ctx, true)))
+			return
+		}
+
+		if retry := getTarpitRetry(ctx); retry != nil {
+			retry.admitted = admission.Allowed
+		}
+
+		if admission.BannedFor > 0 {
+			rejectBanned(res, reqLogger, admission.BannedFor)
+			return
+		}
+
+		if leases := admission.Leases(); len(leases) > 0 {
+			// the slots are held until the backend response is written
+			defer releaseLeases(ctx, rateLimiter, leases)
+			defer renewLeases(ctx, rateLimiter, leases)()
+		}
+
+		// the proxy fills the outcome in once the backend answered
+		if admission.Allowed && endpointRule != nil &&
+			(len(endpointRule.RefundOn) > 0 || endpointRule.CountOn == config.CountOnResponse) {
+			outcome := &ResponseOutcome{}
+			ctx = setResponseOutcome(ctx, outcome)
+			defer refundAdmission(ctx, rateLimiter, admission, endpointRule, outcome)
+			defer countResponse(ctx, rateLimiter, admission, endpointRule, outcome)
+		}
+
+		next.ServeHTTP(res, req.WithContext(setAdmissionResult(ctx, admission)))
+	})
+	return admit
+}
+
+// gives the slots of concurrency levels back, the request context may be done by now
+func releaseLeases(ctx context.Context, rateLimiter *limiter.RateLimiter, leases []*limiter.Lease) {
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := rateLimiter.ReleaseLeases(releaseCtx, leases...); err != nil {
+		GetRequestLoggerFromContext(ctx).Error("failed to release concurrency slot, it expires with its lease",
+			zap.Error(err))
+	}
+}
+
+// renews the leases at half their duration until the returned stop is called, so requests
+// running longer than a lease keep their slots
+func renewLeases(ctx context.Context, rateLimiter *limiter.RateLimiter, leases []*limiter.Lease) (stop func()) {
+	interval := leases[0].Duration
+	for _, lease := range leases {
+		interval = min(interval, lease.Duration)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), interval/2)
+				if err := rateLimiter.RenewLeases(renewCtx, leases...); err != nil {
+					GetRequestLoggerFromContext(ctx).Warn("failed to renew concurrency slot, retrying",
+						zap.Error(err))
+				}
+				cancel()
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func setAdmission(ctx context.Context, admit http.Handler) context.Context {
+	return context.WithValue(ctx, AdmissionKey, admit)
+}
+
+// GetAdmissionFromContext returns the admission middleware (and the chain after it) the
+// request went through, nil when it didn't.
+func GetAdmissionFromContext(ctx context.Context) http.Handler {
+	if v := ctx.Value(AdmissionKey); v != nil {
+		if admit, ok := v.(http.Handler); ok {
+			return admit
+		}
+	}
+	return nil
+}
+
+func setAdmissionResult(ctx context.Context, result *limiter.AdmissionResult) context.Context {
+	return context.WithValue(ctx, AdmissionResultKey, result)
+}
+
+func GetAdmissionResultFromContext(ctx context.Context) *limiter.AdmissionResult {
+	if v := ctx.Value(AdmissionResultKey); v != nil {
+		if result, ok := v.(*limiter.AdmissionResult); ok {
+			return result
+		}
+	}
+	return nil
+}
@@ -2,17 +2,19 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/shared"
 	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 	"go.uber.org/zap"
 )
 
-func ClassifierMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
+func ClassifierMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter, lgr *logger.Logger) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
@@ -21,6 +23,12 @@ func ClassifierMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
 		reqLogger := newRequestLogger(lgr, req, GetRequestID(ctx), GetClientIP(ctx))
 		ctx = setRequestLogger(ctx, reqLogger)
 
+		// allowlisted, no tenant key, plan or token is needed
+		if IsBypassEnabled(ctx) {
+			next.ServeHTTP(res, req.WithContext(ctx))
+			return
+		}
+
 		endpointRule := shared.MapRequestToEndpointConfig(req, cfg.Limiter.PerEndpoint.Rules, lgr)
 		ctx = setEndpointRule(ctx, endpointRule)
 
@@ -36,7 +44,15 @@ func ClassifierMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
 			return
 		}
 
-		tenantKey, err := shared.ExtractTenantKey(req, endpointRule.TenantStrategy, lgr)
+		tenantKey, err := shared.ExtractTenantKey(req, endpointRule.TenantStrategy, GetClientIP(ctx), lgr)
+		if errors.Is(err, shared.ErrInvalidToken) {
+			rejectInvalidToken(res, reqLogger, err)
+			return
+		}
+		if errors.Is(err, shared.ErrMissingTenantPart) {
+			rejectMissingTenant(res, reqLogger, err)
+			return
+		}
 		if err != nil {
 			reqLogger.Error("failed to extract tenant key, forwarding request to server {fail open}",
 				zap.Error(err))
@@ -46,10 +62,25 @@ func ClassifierMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
 		}
 		ctx = setTenantKey(ctx, tenantKey)
 
+		// the limits are resolved at admission, this only records the endpoint's active schedule
+		if schedule := endpointRule.Schedules.Active(time.Now()); schedule != nil {
+			reqLogger.addFields(zap.String("schedule", schedule.String()))
+		}
+
 		redisCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 		ctx = setRedisContext(ctx, redisCtx)
 
+		if cfg.Limiter.Plans.Enabled() {
+			plan, err := rateLimiter.ResolvePlan(redisCtx, tenantKey, &cfg.Limiter.Plans)
+			if err != nil {
+				reqLogger.Warn("failed to resolve tenant plan, using default plan",
+					zap.String("plan", plan), zap.Error(err))
+			}
+			ctx = setPlan(ctx, plan)
+			reqLogger.addFields(zap.String("plan", plan))
+		}
+
 		//======================Metrics===========================================
 		track := metrics.TrackRequest(req.Method, endpointRule.Path)
 		defer track()
@@ -67,6 +98,10 @@ func setTenantKey(ctx context.Context, key string) context.Context {
 	return context.WithValue(ctx, TenantKeyKey, key)
 }
 
+func setPlan(ctx context.Context, plan string) context.Context {
+	return context.WithValue(ctx, PlanKey, plan)
+}
+
 func setRequestLogger(ctx context.Context, lgr *requestLogger) context.Context {
 	return context.WithValue(ctx, RequestLoggerKey, lgr)
 }
@@ -97,6 +132,16 @@ func GetTenantKeyFromContext(ctx context.Context) string {
 	return ""
 }
 
+// GetPlanFromContext returns the plan of the tenant, empty when plans aren't configured.
+func GetPlanFromContext(ctx context.Context) string {
+	if v := ctx.Value(PlanKey); v != nil {
+		if plan, ok := v.(string); ok {
+			return plan
+		}
+	}
+	return ""
+}
+
 func GetRequestLoggerFromContext(ctx context.Context) *requestLogger {
 	if v := ctx.Value(RequestLoggerKey); v != nil {
 		if lgr, ok := v.(*requestLogger); ok {
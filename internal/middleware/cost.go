@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// requestCost is the number of units a request consumes on every limit level (see config.Cost),
+// at least 1. A json_array cost reads the body and puts it back for the backend. A failed
+// request is answered with the returned status.
+func requestCost(req *http.Request, cost *config.Cost) (int64, int, error) {
+	var units int64
+	var err error
+
+	switch cost.Type {
+	case config.CostConstant:
+		units = cost.Value
+	case config.CostHeader:
+		units, err = parseCost(req.Header.Get(cost.Key), cost.Default)
+	case config.CostQueryParameter:
+		units, err = parseCost(req.URL.Query().Get(cost.Key), cost.Default)
+	case config.CostContentLength:
+		// unknown length (chunked body)
+		units = cost.Default
+		if req.ContentLength >= 0 {
+			units = int64(math.Ceil(float64(req.ContentLength) / 1024))
+		}
+	case config.CostJSONArray:
+		var status int
+		units, status, err = jsonArrayCost(req, cost)
+		if err != nil {
+			return 0, status, err
+		}
+	}
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+
+	units = max(1, units)
+	if cost.Max > 0 && units > cost.Max {
+		return 0, http.StatusBadRequest, fmt.Errorf("request cost %d exceeds the maximum of %d", units, cost.Max)
+	}
+	return units, 0, nil
+}
+
+// missing value: the default cost
+func parseCost(value string, defaultCost int64) (int64, error) {
+	if value == "" {
+		return defaultCost, nil
+	}
+	units, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || units < 0 {
+		return 0, fmt.Errorf("invalid request cost %q", value)
+	}
+	return units, nil
+}
+
+func jsonArrayCost(req *http.Request, cost *config.Cost) (int64, int, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return cost.Default, 0, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, config.MaxCostBodySize+1))
+	_ = req.Body.Close()
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(body) > config.MaxCostBodySize {
+		return 0, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body exceeds %d bytes, its cost can't be counted", config.MaxCostBodySize)
+	}
+	// the backend reads the same body
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return cost.Default, 0, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("invalid json body: %w", err)
+	}
+
+	if cost.Key != "" {
+		for _, field := range strings.Split(cost.Key, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return cost.Default, 0, nil
+			}
+			if value, ok = object[field]; !ok {
+				return cost.Default, 0, nil
+			}
+		}
+	}
+
+	items, ok := value.([]interface{})
+	if !ok {
+		return 0, http.StatusBadRequest, fmt.Errorf("json field %q is not an array", cost.Key)
+	}
+	return int64(len(items)), 0, nil
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected int64
+		wantErr  bool
+	}{
+		{name: "T01_Missing", value: "", expected: 3},
+		{name: "T02_Number", value: "5", expected: 5},
+		{name: "T03_Spaces", value: " 7 ", expected: 7},
+		{name: "T04_Zero", value: "0", expected: 0},
+		{name: "T05_Negative", value: "-1", wantErr: true},
+		{name: "T06_NotANumber", value: "ten", wantErr: true},
+		{name: "T07_Fraction", value: "1.5", wantErr: true},
+		{name: "T08_Overflow", value: "99999999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := parseCost(tt.value, 3)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	header := &config.Cost{Type: config.CostHeader, Key: "X-Cost", Default: 2, Max: 10}
+	query := &config.Cost{Type: config.CostQueryParameter, Key: "count", Default: 1}
+	contentLength := &config.Cost{Type: config.CostContentLength, Default: 4}
+	constant := &config.Cost{Type: config.CostConstant, Value: 5}
+	array := &config.Cost{Type: config.CostJSONArray, Default: 1, Max: 10}
+	nested := &config.Cost{Type: config.CostJSONArray, Key: "data.items", Default: 1}
+
+	tests := []struct {
+		name     string
+		cost     *config.Cost
+		target   string
+		header   string
+		body     string
+		expected int64
+		// 0 when the cost is valid
+		status int
+	}{
+		{name: "T01_Header", cost: header, header: "4", expected: 4},
+		{name: "T02_HeaderMissing", cost: header, expected: 2},
+		{name: "T03_HeaderZero", cost: header, header: "0", expected: 1},
+		{name: "T04_HeaderNegative", cost: header, header: "-3", status: http.StatusBadRequest},
+		{name: "T05_HeaderNotANumber", cost: header, header: "lots", status: http.StatusBadRequest},
+		{name: "T06_HeaderOverMax", cost: header, header: "11", status: http.StatusBadRequest},
+		{name: "T07_HeaderAtMax", cost: header, header: "10", expected: 10},
+		{name: "T08_Query", cost: query, target: "/api/batch?count=6", expected: 6},
+		{name: "T09_QueryNegative", cost: query, target: "/api/batch?count=-6", status: http.StatusBadRequest},
+		{name: "T10_ContentLength", cost: contentLength, body: strings.Repeat("x", 2049), expected: 3},
+		{name: "T11_Constant", cost: constant, expected: 5},
+		{name: "T12_Array", cost: array, body: `[1, 2, 3]`, expected: 3},
+		{name: "T13_EmptyArray", cost: array, body: `[]`, expected: 1},
+		{name: "T14_EmptyBody", cost: array, body: "  ", expected: 1},
+		{name: "T15_ArrayOverMax", cost: array, body: `[` + strings.Repeat(`0,`, 10) + `0]`, status: http.StatusBadRequest},
+		{name: "T16_BodyNotAnArray", cost: array, body: `{"items": [1, 2]}`, status: http.StatusBadRequest},
+		{name: "T17_InvalidJSON", cost: array, body: `[1, 2`, status: http.StatusBadRequest},
+		{name: "T18_NestedArray", cost: nested, body: `{"data": {"items": [1, 2, 3, 4]}}`, expected: 4},
+		{name: "T19_NestedFieldMissing", cost: nested, body: `{"data": {}}`, expected: 1},
+		{name: "T20_NestedFieldNotAnArray", cost: nested, body: `{"data": {"items": "all"}}`, status: http.StatusBadRequest},
+		{
+			name:   "T21_BodyOverReadLimit",
+			cost:   array,
+			body:   `[` + strings.Repeat(" ", config.MaxCostBodySize) + `]`,
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "/api/batch"
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest("POST", target, body)
+			if tt.header != "" {
+				req.Header.Set("X-Cost", tt.header)
+			}
+
+			actual, status, err := requestCost(req, tt.cost)
+			if tt.status != 0 {
+				assert.Error(t, err)
+				assert.Equal(t, tt.status, status)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+
+			// the backend reads the same body
+			if tt.body != "" {
+				forwarded, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tt.body, string(forwarded))
+			}
+		})
+	}
+}
+
+const costTestLimiter = `
+global:
+  enabled: false
+per_tenant:
+  enabled: false
+per_endpoint:
+  rules:
+    - path: "/api/batch"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      cost:
+        type: header
+        key: "X-Cost"
+      algorithm: token_bucket
+      capacity: 10
+      refill_rate: 1
+      refill_period: "1s"
+    - path: "/api/import"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      cost:
+        type: json_array
+      algorithm: fixed_window
+      window_size: "1m"
+      limit: 100
+`
+
+func TestAdmissionMiddleware_RejectsInvalidCost(t *testing.T) {
+	chain := setupTestChain(t, costTestLimiter)
+
+	tests := []struct {
+		name     string
+		path     string
+		cost     string
+		body     string
+		expected int
+	}{
+		{name: "T01_WithinCapacity", path: "/api/batch", cost: "10", expected: http.StatusOK},
+		// no request could ever cost this much, retrying is pointless
+		{name: "T02_OverCapacity", path: "/api/batch", cost: "11", expected: http.StatusRequestEntityTooLarge},
+		{name: "T03_NotANumber", path: "/api/batch", cost: "many", expected: http.StatusBadRequest},
+		{
+			name:     "T04_BodyOverReadLimit",
+			path:     "/api/import",
+			body:     `[` + strings.Repeat("1,", config.MaxCostBodySize/2) + `1]`,
+			expected: http.StatusRequestEntityTooLarge,
+		},
+		{name: "T05_BodyNotAnArray", path: "/api/import", body: `"items"`, expected: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := chain.backend.calls.Load()
+
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-API-Key", "acme-"+tt.name)
+			if tt.cost != "" {
+				req.Header.Set("X-Cost", tt.cost)
+			}
+			res := chain.serve(req)
+
+			assert.Equal(t, tt.expected, res.Code)
+			if tt.expected != http.StatusOK {
+				assert.Empty(t, res.Header().Get("Retry-After"))
+				assert.Equal(t, calls, chain.backend.calls.Load(), "nothing is forwarded")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"go.uber.org/zap"
+)
+
+// countResponse settles the endpoint limit of a count_on: response rule once the backend
+// answered: the admission reserved the request's units, they stay counted when the response
+// matched its count_statuses (e.g. a failed login) and are given back otherwise.
+// The request context may be done by now.
+func countResponse(ctx context.Context, rateLimiter *limiter.RateLimiter, admission *limiter.AdmissionResult,
+	endpointRule *config.EndpointRule, outcome *ResponseOutcome) {
+
+	if endpointRule.CountOn != config.CountOnResponse {
+		return
+	}
+
+	reqLogger := GetRequestLoggerFromContext(ctx)
+	status := outcome.backend()
+
+	if endpointRule.CountsStatus(status) {
+		//==========================Metrics=============================
+		metrics.CountedResponses.WithLabelValues(fmt.Sprintf("%dxx", status/100)).Inc()
+		//==============================================================
+
+		reqLogger.Debug("response counted against endpoint limit", zap.Int("status", status))
+		return
+	}
+
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := rateLimiter.ReleaseReservation(releaseCtx, admission); err != nil {
+		//==========================Metrics=============================
+		metrics.EndpointLimitErrors.Inc()
+		//==============================================================
+
+		reqLogger.Error("failed to give back endpoint limit of uncounted response, it stays counted",
+			zap.Int("status", status), zap.Error(err))
+		return
+	}
+
+	reqLogger.Debug("response not counted, endpoint limit given back", zap.Int("status", status))
+}
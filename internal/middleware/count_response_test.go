@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// two failed logins a minute, successful ones are never counted
+const countResponseTestLimiter = `
+global:
+  enabled: false
+per_tenant:
+  enabled: true
+  algorithm: fixed_window
+  window_size: "1m"
+  limit: 100
+per_endpoint:
+  rules:
+    - path: "/login"
+      methods: ["POST"]
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      count_on: response
+      count_statuses: ["401"]
+      algorithm: fixed_window
+      window_size: "1m"
+      limit: 2
+`
+
+func loginRequest(ctx context.Context) *http.Request {
+	req := httptest.NewRequest("POST", "/login", nil).WithContext(ctx)
+	req.Header.Set("X-API-Key", "acme")
+	return req
+}
+
+func TestCountResponse_OnlyMatchingStatusesCount(t *testing.T) {
+	chain := setupTestChain(t, countResponseTestLimiter)
+	ctx := context.Background()
+	counted := testutil.ToFloat64(metrics.CountedResponses.WithLabelValues("4xx"))
+
+	// successful logins give their reservation back
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, chain.serve(loginRequest(ctx)).Code)
+	}
+	// so does a backend failing to answer
+	chain.backend.status = 0
+	assert.Equal(t, http.StatusBadGateway, chain.serve(loginRequest(ctx)).Code)
+
+	// 403 isn't in count_statuses
+	chain.backend.status = http.StatusForbidden
+	assert.Equal(t, http.StatusForbidden, chain.serve(loginRequest(ctx)).Code)
+
+	chain.backend.status = http.StatusUnauthorized
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusUnauthorized, chain.serve(loginRequest(ctx)).Code)
+	}
+	assert.Equal(t, counted+2, testutil.ToFloat64(metrics.CountedResponses.WithLabelValues("4xx")))
+
+	// the next attempt is denied before reaching the backend, whatever it would answer
+	chain.backend.status = http.StatusOK
+	res := chain.serve(loginRequest(ctx))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.NotEmpty(t, res.Header().Get("Retry-After"))
+	assert.Equal(t, int64(9), chain.backend.calls.Load())
+}
+
+func TestCountResponse_ParallelRequestsCantOvershoot(t *testing.T) {
+	chain := setupTestChain(t, countResponseTestLimiter)
+	chain.backend.status = http.StatusUnauthorized
+
+	// every attempt is in flight before any of them is answered
+	release := make(chan struct{})
+	chain.backend.before = func(req *http.Request) { <-release }
+
+	const attempts = 6
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- chain.serve(loginRequest(context.Background())).Code
+		}()
+	}
+
+	// the denied ones return right away, the admitted ones wait for the backend
+	require.Eventually(t, func() bool { return len(codes) == attempts-2 }, 2*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(codes)
+
+	statuses := make(map[int]int)
+	for code := range codes {
+		statuses[code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusUnauthorized: 2, http.StatusTooManyRequests: attempts - 2}, statuses)
+	assert.Equal(t, int64(2), chain.backend.calls.Load())
+}
+
+func TestCountResponse_ReleasedAfterClientWentAway(t *testing.T) {
+	chain := setupTestChain(t, countResponseTestLimiter)
+
+	// the client goes away once the backend answered: the reservation is given back on a
+	// context of its own
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		chain.backend.before = func(req *http.Request) { cancel() }
+		assert.Equal(t, http.StatusOK, chain.serve(loginRequest(ctx)).Code)
+	}
+
+	chain.backend.before = nil
+	assert.Equal(t, http.StatusOK, chain.serve(loginRequest(context.Background())).Code)
+	assert.Equal(t, int64(5), chain.backend.calls.Load())
+}
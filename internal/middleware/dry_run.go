@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
@@ -8,6 +9,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// order the would-be rejections are logged in, the order the admission checks the levels
+var dryRunLevels = []config.LimitLevelType{config.GlobalLevel, config.PerTenantLevel, config.QuotaLevel,
+	config.PerEndpointLevel}
+
+// DryRunMiddleware peeks at every enabled limit level in one call and logs the ones that would
+// have rejected the request, nothing is consumed and the request is always forwarded.
 func DryRunMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
@@ -28,43 +35,53 @@ func DryRunMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter) http.
 		redisCtx := GetRedisContextFromContext(req.Context())
 		tenantKey := GetTenantKeyFromContext(req.Context())
 		endpointRule := GetEndpointRuleFromContext(req.Context())
+		plan := GetPlanFromContext(req.Context())
 
-		globalLimitResult, globalLimitError := rateLimiter.CheckGlobalLimit(redisCtx, &cfg.Limiter.Global)
-		if globalLimitError != nil {
-			reqLogger.Error("failed to check global limit (dry run)", zap.Error(globalLimitError))
-		}
-
-		tenantLimitResult, tenantLimitError := rateLimiter.CheckTenantLimit(redisCtx, tenantKey, &cfg.Limiter.PerTenant)
-		if tenantLimitError != nil {
-			reqLogger.Error("failed to check tenant limit (dry run)", zap.Error(tenantLimitError))
+		cost := int64(1)
+		if endpointRule != nil && endpointRule.Cost != nil {
+			units, _, err := requestCost(req, endpointRule.Cost)
+			if err != nil {
+				reqLogger.Warn("request would have been rejected, invalid cost (dry run)", zap.Error(err))
+			} else {
+				cost = units
+			}
 		}
 
-		endpointLimitResult, endpointLimitError := rateLimiter.CheckEndpointLimit(redisCtx, tenantKey, endpointRule)
-		if endpointLimitError != nil {
-			reqLogger.Error("failed to check endpoint limit (dry run)", zap.Error(endpointLimitError))
-		}
+		newCtx := setBypass(ctx, true)
 
-		if !globalLimitResult.Allowed {
-			reqLogger.Warn("global limit would have been exceeded (dry run)",
-				zap.Any("retry_after", globalLimitResult.RetryAfter.Seconds()))
+		admission, err := rateLimiter.PeekLimits(redisCtx, tenantKey, plan, cfg.Limiter, endpointRule, cost)
+		if errors.Is(err, limiter.ErrCostExceedsLimit) {
+			reqLogger.Warn("request would have been rejected, cost exceeds a limit (dry run)", zap.Error(err))
+			next.ServeHTTP(res, req.WithContext(newCtx))
+			return
 		}
-		if !tenantLimitResult.Allowed {
-			reqLogger.Warn("tenant limit would have been exceeded (dry run)",
-				zap.Any("retry_after", tenantLimitResult.RetryAfter.Seconds()))
+		if err != nil {
+			reqLogger.Error("failed to check rate limits (dry run)", zap.Error(err))
+			next.ServeHTTP(res, req.WithContext(newCtx))
+			return
 		}
-		if !endpointLimitResult.Allowed {
-			reqLogger.Warn("endpoint limit would have been exceeded (dry run)",
-				zap.Any("retry_after", endpointLimitResult.RetryAfter.Seconds()))
+
+		allowed := true
+		for _, level := range dryRunLevels {
+			result, ok := admission.Levels[level]
+			if !ok || result.Allowed {
+				continue
+			}
+			allowed = false
+			reqLogger.Warn(string(level)+" limit would have been exceeded (dry run)",
+				zap.Any("retry_after", result.RetryAfter.Seconds()))
 		}
 
-		if endpointLimitResult.Allowed && tenantLimitResult.Allowed && globalLimitResult.Allowed {
-			reqLogger.Debug("all rate limit checks passed (dry run)",
-				zap.Int("remaining_endpoint", int(endpointLimitResult.Remaining)),
-				zap.Int("remaining_tenant", int(tenantLimitResult.Remaining)),
-				zap.Int("remaining_global", int(globalLimitResult.Remaining)))
+		if allowed {
+			fields := make([]zap.Field, 0, len(admission.Levels))
+			for _, level := range dryRunLevels {
+				if result, ok := admission.Levels[level]; ok {
+					fields = append(fields, zap.Int64("remaining_"+string(level), result.Remaining))
+				}
+			}
+			reqLogger.Debug("all rate limit checks passed (dry run)", fields...)
 		}
 
-		newCtx := setBypass(ctx, true)
 		next.ServeHTTP(res, req.WithContext(newCtx))
 	})
 }
@@ -9,7 +9,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func EndpointLimitMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter) http.Handler {
+func EndpointLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
@@ -20,39 +20,31 @@ func EndpointLimitMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter
 			return
 		}
 
-		redisCtx := GetRedisContextFromContext(ctx)
-		tenantKey := GetTenantKeyFromContext(ctx)
-		endpointRule := GetEndpointRuleFromContext(ctx)
-
-		endpointLimitResult, err := rateLimiter.CheckEndpointLimit(redisCtx, tenantKey, endpointRule)
-		if err != nil {
-			reqLogger.Error("failed to enforce endpoint limit", zap.Error(err))
-			//============================Metrics============================
-			metrics.EndpointLimitErrors.Inc()
-			//===============================================================
+		admission := GetAdmissionResultFromContext(ctx)
+		if admission == nil {
 			next.ServeHTTP(res, req)
 			return
 		}
 
-		if !endpointLimitResult.Allowed {
-			_, err := rateLimiter.UpdateReputation(redisCtx, tenantKey, true)
-			if err != nil {
-				reqLogger.Error("failed to update reputation", zap.Error(err))
-			}
-			rejectRequest(res, reqLogger, endpointLimitResult, config.PerEndpointLevel)
+		endpointLimitResult := admission.Levels[config.PerEndpointLevel]
+		if admission.DeniedLevel == config.PerEndpointLevel {
+			denyRequest(res, req, endpointLimitResult, func(result *limiter.LimitResult) {
+				rejectRequest(res, reqLogger, GetPlanFromContext(ctx), result, config.PerEndpointLevel)
+			})
 			return
 		}
 
 		reqLogger.Debug("endpoint rate limit check passed",
 			zap.Int64("remaining_endpoint", endpointLimitResult.Remaining))
 
+		if !shapeRequest(res, req, admission) {
+			return
+		}
+
 		//==========================Metrics==================================
 		metrics.AllowedRequests.Inc()
+		metrics.AllowedRequestsByPlan.WithLabelValues(planLabel(GetPlanFromContext(ctx))).Inc()
 		//==========================Metrics==================================
-		_, err = rateLimiter.UpdateReputation(redisCtx, tenantKey, false)
-		if err != nil {
-			reqLogger.Error("failed to update reputation", zap.Error(err))
-		}
 		next.ServeHTTP(res, req)
 	})
 }
@@ -10,8 +10,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func GlobalLimitMiddleware(next http.Handler, lgr *logger.Logger,
-	rateLimiter *limiter.RateLimiter) http.Handler {
+func GlobalLimitMiddleware(next http.Handler, lgr *logger.Logger) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
@@ -28,22 +27,23 @@ func GlobalLimitMiddleware(next http.Handler, lgr *logger.Logger,
 			return
 		}
 
-		redisCtx := GetRedisContextFromContext(ctx)
-		tenantKey := GetTenantKeyFromContext(ctx)
-
-		globalLimitResult, err := rateLimiter.CheckGlobalLimit(redisCtx, &cfg.Limiter.Global)
-		if err != nil {
-			reqLogger.Error("failed to enforce global limit", zap.Error(err))
-			//============================Metrics============================
-			metrics.GlobalLimitErrors.Inc()
-			//===============================================================
+		admission := GetAdmissionResultFromContext(ctx)
+		if admission == nil {
 			next.ServeHTTP(res, req)
 			return
 		}
 
-		reputation, err := rateLimiter.GetTenantReputation(redisCtx, tenantKey)
-		if err != nil {
-			reqLogger.Error("failed to get tenant reputation")
+		globalLimitResult := admission.Levels[config.GlobalLevel]
+		reputation := admission.Reputation
+
+		// without reputation the global limit rejects every request over it
+		if !cfg.Limiter.Reputation.Model().Enabled {
+			if admission.DeniedLevel == config.GlobalLevel {
+				denyRequest(res, req, globalLimitResult, func(result *limiter.LimitResult) {
+					rejectRequest(res, reqLogger, GetPlanFromContext(ctx), result, config.GlobalLevel)
+				})
+				return
+			}
 			next.ServeHTTP(res, req)
 			return
 		}
@@ -55,8 +55,10 @@ func GlobalLimitMiddleware(next http.Handler, lgr *logger.Logger,
 		if !globalLimitResult.Allowed {
 			reqLogger.Debug("global limit is reached, server is on high load, applying reputation checks")
 
-			if reputation.Score <= rateLimiter.GetReputationThreshold() {
-				rejectBadReputationTenant(res, reqLogger, reputation, globalLimitResult)
+			if admission.DeniedLevel == config.GlobalLevel {
+				denyRequest(res, req, globalLimitResult, func(result *limiter.LimitResult) {
+					rejectBadReputationTenant(res, reqLogger, GetPlanFromContext(ctx), reputation, result)
+				})
 				return
 			} else {
 				reqLogger.Debug("reputation check passed",
@@ -5,13 +5,18 @@ import "context"
 type ctxKey string
 
 const (
-	RequestIDKey     ctxKey = "requestID"
-	ClientIPKey      ctxKey = "clientIP"
-	EndpointRuleKey  ctxKey = "endpointRule"
-	TenantKeyKey     ctxKey = "tenantKey"
-	RequestLoggerKey ctxKey = "requestLogger"
-	RedisContextKey  ctxKey = "redisContext"
-	BypassKey        ctxKey = "bypass"
+	RequestIDKey       ctxKey = "requestID"
+	ClientIPKey        ctxKey = "clientIP"
+	EndpointRuleKey    ctxKey = "endpointRule"
+	TenantKeyKey       ctxKey = "tenantKey"
+	RequestLoggerKey   ctxKey = "requestLogger"
+	RedisContextKey    ctxKey = "redisContext"
+	BypassKey          ctxKey = "bypass"
+	AdmissionResultKey ctxKey = "admissionResult"
+	PlanKey            ctxKey = "plan"
+	ResponseOutcomeKey ctxKey = "responseOutcome"
+	AdmissionKey       ctxKey = "admission"
+	TarpitRetryKey     ctxKey = "tarpitRetry"
 )
 
 func IsBypassEnabled(ctx context.Context) bool {
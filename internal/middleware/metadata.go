@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/google/uuid"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/shared"
 )
 
@@ -16,10 +17,10 @@ func MetadataMiddleware(next http.Handler) http.Handler {
 			r.Header.Set("X-Request-ID", reqID)
 		}
 
-		clientIP := shared.ExtractIP(r)
-		if r.Header.Get("X-Real-IP") == "" {
-			r.Header.Set("X-Real-IP", clientIP)
-		}
+		cfg := config.GetConfigFromContext(r.Context())
+		clientIP := shared.ExtractIP(r, cfg.Proxy.IsTrustedProxy)
+		// always overwritten, a value sent by an untrusted client must not reach the backend
+		r.Header.Set("X-Real-IP", clientIP)
 
 		ctx := setRequestID(r.Context(), reqID)
 		ctx = setClientIP(ctx, clientIP)
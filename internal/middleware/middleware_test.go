@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testBackend stands in for the reverse proxy: it answers with status and fills the response
+// outcome in like the proxy's recorder does, status 0 fails like an unreachable backend
+type testBackend struct {
+	status int
+	// runs before the answer, e.g. to hold requests or cancel them
+	before func(req *http.Request)
+	calls  atomic.Int64
+
+	mu sync.Mutex
+	// X-Request-ID of the forwarded requests, in arrival order
+	requestIDs []string
+}
+
+func (b *testBackend) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	b.calls.Add(1)
+	b.mu.Lock()
+	b.requestIDs = append(b.requestIDs, req.Header.Get("X-Request-ID"))
+	b.mu.Unlock()
+
+	if b.before != nil {
+		b.before(req)
+	}
+
+	status := b.status
+	outcome := GetResponseOutcomeFromContext(req.Context())
+	if status == 0 {
+		// the proxy's error handler answers 502
+		status = http.StatusBadGateway
+		if outcome != nil {
+			outcome.UpstreamErr = errors.New("upstream server failed to answer")
+		}
+	}
+	if outcome != nil {
+		outcome.Status = status
+	}
+	res.WriteHeader(status)
+}
+
+func (b *testBackend) forwarded() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.requestIDs...)
+}
+
+type testChain struct {
+	http.Handler
+	cfg         *config.Config
+	rateLimiter *limiter.RateLimiter
+	mr          *miniredis.Miniredis
+	backend     *testBackend
+}
+
+// loads limiterYAML with the repo's other config files, validation only runs on load
+func loadTestConfig(t *testing.T, limiterYAML string) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	for _, file := range []string{"logger.yaml", "redis.yaml", "proxy.yaml"} {
+		data, err := os.ReadFile(filepath.Join("..", "..", "config", file))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), data, 0o600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "limiter.yaml"), []byte(limiterYAML), 0o600))
+	t.Setenv("CONFIG_DIR", dir)
+
+	cfg, err := config.LoadConfigs()
+	require.NoError(t, err)
+	return cfg
+}
+
+// the proxy's middleware chain over miniredis, in front of a backend answering 200
+func setupTestChain(t *testing.T, limiterYAML string) *testChain {
+	t.Helper()
+	cfg := loadTestConfig(t, limiterYAML)
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+
+	rateLimiter := limiter.NewRateLimiter(limiter.NewRedisStore(rdb))
+	lgr := &logger.Logger{Logger: zap.NewNop()}
+	backend := &testBackend{status: http.StatusOK}
+
+	var next http.Handler = backend
+	next = EndpointLimitMiddleware(next)
+	next = QuotaMiddleware(next)
+	next = TenantLimitMiddleware(next)
+	next = GlobalLimitMiddleware(next, lgr)
+	next = AdmissionMiddleware(next, rateLimiter)
+	next = DryRunMiddleware(next, rateLimiter)
+	next = ClassifierMiddleware(next, rateLimiter, lgr)
+	next = AccessControlMiddleware(next, lgr)
+	next = MetadataMiddleware(next)
+
+	return &testChain{Handler: next, cfg: cfg, rateLimiter: rateLimiter, mr: mr, backend: backend}
+}
+
+// serves req with the chain's config snapshot, like the proxy's root handler
+func (c *testChain) serve(req *http.Request) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	c.ServeHTTP(res, req.WithContext(config.WithConfigSnapshot(req.Context(), c.cfg)))
+	return res
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import "context"
+
+// ResponseOutcome is how the backend answered a forwarded request, filled in by the proxy for
+// the refund_on and count_on of the request's endpoint rule.
+type ResponseOutcome struct {
+	// final status written, the proxy's own 502 when UpstreamErr is set, 0 when nothing was written
+	Status int
+	// the backend couldn't be reached or failed to answer
+	UpstreamErr error
+}
+
+// backend is the status of a response the backend sent, 0 when it sent none
+func (o *ResponseOutcome) backend() int {
+	if o.UpstreamErr != nil {
+		return 0
+	}
+	return o.Status
+}
+
+func setResponseOutcome(ctx context.Context, outcome *ResponseOutcome) context.Context {
+	return context.WithValue(ctx, ResponseOutcomeKey, outcome)
+}
+
+// GetResponseOutcomeFromContext returns the outcome to fill in, nil when the endpoint rule
+// doesn't look at the response.
+func GetResponseOutcomeFromContext(ctx context.Context) *ResponseOutcome {
+	if v := ctx.Value(ResponseOutcomeKey); v != nil {
+		if outcome, ok := v.(*ResponseOutcome); ok {
+			return outcome
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"go.uber.org/zap"
+)
+
+// QuotaMiddleware rejects tenants that used up the quota of the current period and adds
+// the X-Quota-* headers to the response.
+func QuotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		ctx := req.Context()
+		cfg := config.GetConfigFromContext(ctx)
+		reqLogger := GetRequestLoggerFromContext(ctx)
+
+		if IsBypassEnabled(ctx) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		if !cfg.Limiter.Quota.Enabled {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		admission := GetAdmissionResultFromContext(ctx)
+		if admission == nil {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		quotaResult := admission.Levels[config.QuotaLevel]
+		if quotaResult == nil {
+			next.ServeHTTP(res, req)
+			return
+		}
+		// a later level may have denied the request, then none of the quota was used
+		remaining, _ := admission.QuotaRemaining()
+
+		plan := GetPlanFromContext(ctx)
+		quotaConfig := cfg.Limiter.Quota.ConfigFor(plan)
+		_, reset := quotaConfig.Window(time.Now())
+
+		res.Header().Set("X-Quota-Limit", strconv.Itoa(quotaConfig.Limit))
+		res.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		res.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if admission.DeniedLevel == config.QuotaLevel {
+			rejectRequest(res, reqLogger, plan, quotaResult, config.QuotaLevel)
+			return
+		}
+
+		reqLogger.Debug("quota check passed",
+			zap.Int64("remaining_quota", remaining))
+
+		next.ServeHTTP(res, req)
+	})
+}
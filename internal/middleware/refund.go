@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"go.uber.org/zap"
+)
+
+// refundAdmission gives the units of an allowed request back when it ended the way the endpoint
+// rule's refund_on lists: a status of the backend, an upstream error or a cancelled request.
+// The request context may be done by now.
+func refundAdmission(ctx context.Context, rateLimiter *limiter.RateLimiter, admission *limiter.AdmissionResult,
+	endpointRule *config.EndpointRule, outcome *ResponseOutcome) {
+
+	var reason string
+	switch {
+	case outcome.backend() != 0:
+		if endpointRule.RefundsStatus(outcome.Status) {
+			reason = fmt.Sprintf("%dxx", outcome.Status/100)
+		}
+	case ctx.Err() != nil:
+		// went away before the backend answered, also while a shaping level held the request
+		if endpointRule.RefundsUpstreamError(true) {
+			reason = config.RefundCancelled
+		}
+	case outcome.UpstreamErr != nil:
+		if endpointRule.RefundsUpstreamError(false) {
+			reason = config.RefundUpstreamError
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	reqLogger := GetRequestLoggerFromContext(ctx)
+
+	refundCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := rateLimiter.Refund(refundCtx, admission); err != nil {
+		reqLogger.Error("failed to refund request", zap.String("reason", reason), zap.Error(err))
+		return
+	}
+
+	//==========================Metrics=============================
+	metrics.RefundedRequests.WithLabelValues(reason).Inc()
+	//==============================================================
+
+	reqLogger.Debug("request refunded", zap.String("reason", reason), zap.Int("status", outcome.Status))
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// two requests a minute, the ones failing on our side don't count
+const refundTestLimiter = `
+global:
+  enabled: false
+per_tenant:
+  enabled: true
+  algorithm: fixed_window
+  window_size: "1m"
+  limit: 100
+per_endpoint:
+  rules:
+    - path: "/api/*"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      refund_on: ["5xx", "upstream_error", "cancelled"]
+      algorithm: fixed_window
+      window_size: "1m"
+      limit: 2
+`
+
+func refundTestRequest(ctx context.Context) *http.Request {
+	req := httptest.NewRequest("GET", "/api/orders", nil).WithContext(ctx)
+	req.Header.Set("X-API-Key", "acme")
+	return req
+}
+
+// remaining of the tenant's per-tenant and endpoint levels, read without consuming them
+func refundTestRemaining(t *testing.T, chain *testChain) (int64, int64) {
+	t.Helper()
+	states, err := chain.rateLimiter.InspectTenant(context.Background(), "acme", "", chain.cfg.Limiter)
+	require.NoError(t, err)
+	require.Len(t, states, 2)
+	return states[0].Result.Remaining, states[1].Result.Remaining
+}
+
+func TestRefundAdmission(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// cancels the request while the backend handles it
+		cancel bool
+		reason string
+	}{
+		{name: "T01_ServerError", status: http.StatusServiceUnavailable, reason: "5xx"},
+		{name: "T02_UpstreamError", status: 0, reason: "upstream_error"},
+		{name: "T03_Cancelled", status: 0, cancel: true, reason: "cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := setupTestChain(t, refundTestLimiter)
+			chain.backend.status = tt.status
+			refunded := testutil.ToFloat64(metrics.RefundedRequests.WithLabelValues(tt.reason))
+
+			for i := 0; i < 4; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				if tt.cancel {
+					// the refund runs on a context of its own
+					chain.backend.before = func(req *http.Request) { cancel() }
+				}
+				chain.serve(refundTestRequest(ctx))
+				cancel()
+			}
+
+			assert.Equal(t, refunded+4, testutil.ToFloat64(metrics.RefundedRequests.WithLabelValues(tt.reason)))
+			tenant, endpoint := refundTestRemaining(t, chain)
+			assert.Equal(t, int64(100), tenant)
+			assert.Equal(t, int64(2), endpoint)
+			assert.Equal(t, int64(4), chain.backend.calls.Load())
+		})
+	}
+}
+
+func TestRefundAdmission_OtherOutcomesKeepTheirUnits(t *testing.T) {
+	chain := setupTestChain(t, refundTestLimiter)
+	ctx := context.Background()
+
+	// 4xx isn't in refund_on
+	chain.backend.status = http.StatusNotFound
+	assert.Equal(t, http.StatusNotFound, chain.serve(refundTestRequest(ctx)).Code)
+	chain.backend.status = http.StatusOK
+	assert.Equal(t, http.StatusOK, chain.serve(refundTestRequest(ctx)).Code)
+
+	tenant, endpoint := refundTestRemaining(t, chain)
+	assert.Equal(t, int64(98), tenant)
+	assert.Equal(t, int64(0), endpoint)
+
+	// denied requests consumed nothing, there is nothing to refund
+	chain.backend.status = http.StatusServiceUnavailable
+	assert.Equal(t, http.StatusTooManyRequests, chain.serve(refundTestRequest(ctx)).Code)
+	tenant, _ = refundTestRemaining(t, chain)
+	assert.Equal(t, int64(98), tenant)
+	assert.Equal(t, int64(2), chain.backend.calls.Load())
+}
@@ -27,6 +27,11 @@ func newRequestLogger(lgr *logger.Logger, req *http.Request, requestID, clientIP
 	}
 }
 
+// fields known later in the chain (tenant plan), added to every following log line
+func (rl *requestLogger) addFields(fields ...zap.Field) {
+	rl.baseFields = append(rl.baseFields, fields...)
+}
+
 func (rl *requestLogger) Info(msg string, fields ...zap.Field) {
 	rl.Logger.Info(msg, append(rl.baseFields, fields...)...)
 }
@@ -2,8 +2,10 @@ package middleware
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
@@ -11,11 +13,20 @@ import (
 	"go.uber.org/zap"
 )
 
-func rejectRequest(res http.ResponseWriter, reqLogger *requestLogger, result *limiter.LimitResult,
+// metrics label of a plan, "none" when plans aren't configured
+func planLabel(plan string) string {
+	if plan == "" {
+		return "none"
+	}
+	return plan
+}
+
+func rejectRequest(res http.ResponseWriter, reqLogger *requestLogger, plan string, result *limiter.LimitResult,
 	limitLevel config.LimitLevelType) {
 
 	//==========================Metrics=============================
 	metrics.DeniedRequests.WithLabelValues(string(limitLevel)).Inc()
+	metrics.DeniedRequestsByPlan.WithLabelValues(string(limitLevel), planLabel(plan)).Inc()
 	//==============================================================
 
 	reqLogger.Warn("rate limit exceeded, request denied",
@@ -41,11 +52,12 @@ func rejectRequest(res http.ResponseWriter, reqLogger *requestLogger, result *li
 	_ = json.NewEncoder(res).Encode(body)
 }
 
-func rejectBadReputationTenant(res http.ResponseWriter, reqLogger *requestLogger,
+func rejectBadReputationTenant(res http.ResponseWriter, reqLogger *requestLogger, plan string,
 	reputation *limiter.Reputation, result *limiter.LimitResult) {
 
 	//==========================Metrics=============================
 	metrics.DeniedRequests.WithLabelValues("global").Inc()
+	metrics.DeniedRequestsByPlan.WithLabelValues("global", planLabel(plan)).Inc()
 	//==============================================================
 
 	reqLogger.Warn("server on high load, tenants with bad reputation are banned",
@@ -66,3 +78,122 @@ func rejectBadReputationTenant(res http.ResponseWriter, reqLogger *requestLogger
 	}
 	_ = json.NewEncoder(res).Encode(body)
 }
+
+// used in fail_closed mode when the limits can't be checked
+func rejectUnavailable(res http.ResponseWriter, reqLogger *requestLogger, plan string, err error) {
+
+	//==========================Metrics=============================
+	metrics.DeniedRequests.WithLabelValues("unavailable").Inc()
+	metrics.DeniedRequestsByPlan.WithLabelValues("unavailable", planLabel(plan)).Inc()
+	//==============================================================
+
+	reqLogger.Error("failed to enforce rate limits, rejecting request {fail closed}", zap.Error(err))
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Retry-After", "1")
+
+	res.WriteHeader(http.StatusServiceUnavailable)
+
+	body := map[string]interface{}{
+		"error": "rate limiter unavailable",
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
+
+// client ip matched the access_control deny list
+func rejectDenylisted(res http.ResponseWriter, reqLogger *requestLogger) {
+
+	//==========================Metrics=============================
+	metrics.AccessDeniedRequests.WithLabelValues("denylist").Inc()
+	//==============================================================
+
+	reqLogger.Warn("client ip is denylisted, request denied")
+
+	res.Header().Set("Content-Type", "application/json")
+
+	res.WriteHeader(http.StatusForbidden)
+
+	body := map[string]interface{}{
+		"error": "access denied",
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
+
+// jwt tenant strategy with on_invalid_token: reject
+func rejectInvalidToken(res http.ResponseWriter, reqLogger *requestLogger, err error) {
+
+	//==========================Metrics=============================
+	metrics.AccessDeniedRequests.WithLabelValues("invalid_token").Inc()
+	//==============================================================
+
+	reqLogger.Warn("missing or invalid token, request denied", zap.Error(err))
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+
+	res.WriteHeader(http.StatusUnauthorized)
+
+	body := map[string]interface{}{
+		"error": "missing or invalid token",
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
+
+// composite tenant strategy with on_missing_part: reject
+func rejectMissingTenant(res http.ResponseWriter, reqLogger *requestLogger, err error) {
+
+	//==========================Metrics=============================
+	metrics.AccessDeniedRequests.WithLabelValues("missing_tenant").Inc()
+	//==============================================================
+
+	reqLogger.Warn("tenant attribute missing, request denied", zap.Error(err))
+
+	res.Header().Set("Content-Type", "application/json")
+
+	res.WriteHeader(http.StatusBadRequest)
+
+	body := map[string]interface{}{
+		"error": "missing tenant attribute",
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
+
+// request cost of the endpoint rule can't be counted or exceeds its max
+func rejectInvalidCost(res http.ResponseWriter, reqLogger *requestLogger, status int, err error) {
+
+	//==========================Metrics=============================
+	metrics.AccessDeniedRequests.WithLabelValues("invalid_cost").Inc()
+	//==============================================================
+
+	reqLogger.Warn("invalid request cost, request denied", zap.Error(err))
+
+	res.Header().Set("Content-Type", "application/json")
+
+	res.WriteHeader(status)
+
+	body := map[string]interface{}{
+		"error": err.Error(),
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
+
+// tenant banned through the admin api
+func rejectBanned(res http.ResponseWriter, reqLogger *requestLogger, bannedFor time.Duration) {
+
+	//==========================Metrics=============================
+	metrics.AccessDeniedRequests.WithLabelValues("banned").Inc()
+	//==============================================================
+
+	reqLogger.Warn("tenant is banned, request denied", zap.Float64("banned_for", bannedFor.Seconds()))
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(bannedFor.Seconds())), 10))
+
+	res.WriteHeader(http.StatusForbidden)
+
+	body := map[string]interface{}{
+		"error":       "tenant is banned",
+		"retry_after": bannedFor.Seconds(),
+	}
+	_ = json.NewEncoder(res).Encode(body)
+}
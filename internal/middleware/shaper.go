@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"go.uber.org/zap"
+)
+
+// requests held by shaping leaky buckets right now, across the whole proxy
+var shaped atomic.Int64
+
+// shapeRequest holds an allowed request until its turn in every leaky_bucket in shape mode it
+// passed (see limiter.LimitResult.Delay), the longest delay wins. Departures are handed out in
+// arrival order, so a tenant's requests leave in the order they came. Returns false when the
+// request must not be forwarded: rejected with 429 because shape.max_held requests are held
+// already, or the client went away while waiting and nothing is written.
+func shapeRequest(res http.ResponseWriter, req *http.Request, admission *limiter.AdmissionResult) bool {
+	var delay time.Duration
+	var level config.LimitLevelType
+	for resultLevel, result := range admission.Levels {
+		if result.Delay > delay {
+			delay, level = result.Delay, resultLevel
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	ctx := req.Context()
+	cfg := config.GetConfigFromContext(ctx)
+	reqLogger := GetRequestLoggerFromContext(ctx)
+
+	// the buckets only bound their own queues, this keeps held connections from exhausting the proxy
+	if shaped.Add(1) > int64(cfg.Limiter.Shape.MaxHeld) {
+		shaped.Add(-1)
+
+		//==========================Metrics=============================
+		metrics.ShapedRequests.WithLabelValues("overflow").Inc()
+		//==============================================================
+
+		// its departure stays taken, like the one of a client going away
+		reqLogger.Warn("too many requests held by leaky buckets, rejecting request right away",
+			zap.Int("max_held", cfg.Limiter.Shape.MaxHeld))
+		rejectRequest(res, reqLogger, GetPlanFromContext(ctx), &limiter.LimitResult{RetryAfter: delay}, level)
+		return false
+	}
+
+	reqLogger.Debug("holding request until its turn in the leaky bucket", zap.Float64("delay", delay.Seconds()))
+
+	//==========================Metrics=============================
+	metrics.ShapedActive.Inc()
+	//==============================================================
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	shaped.Add(-1)
+
+	//==========================Metrics=============================
+	metrics.ShapedActive.Dec()
+	//==============================================================
+
+	if ctx.Err() != nil {
+		//==========================Metrics=============================
+		metrics.ShapedRequests.WithLabelValues("abandoned").Inc()
+		//==============================================================
+
+		// its departure stays taken, the requests behind it don't move up
+		reqLogger.Debug("client went away while held by the leaky bucket", zap.Error(ctx.Err()))
+		return false
+	}
+
+	//==========================Metrics=============================
+	metrics.ShapedRequests.WithLabelValues("forwarded").Inc()
+	//==============================================================
+
+	return true
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shaperTestLimiter(maxHeld, leakRate int) string {
+	return fmt.Sprintf(`
+global:
+  enabled: false
+per_tenant:
+  enabled: false
+shape:
+  max_held: %d
+per_endpoint:
+  rules:
+    - path: "/api/*"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      algorithm: leaky_bucket
+      mode: shape
+      capacity: 10
+      leak_rate: %d
+      leak_period: "1s"
+`, maxHeld, leakRate)
+}
+
+func shaperTestRequest(ctx context.Context, tenant, requestID string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/upload", nil).WithContext(ctx)
+	req.Header.Set("X-API-Key", tenant)
+	req.Header.Set("X-Request-ID", requestID)
+	return req
+}
+
+// serves a request in the background once the ones before it are held, so arrivals are ordered
+func sendShapedRequest(t *testing.T, chain *testChain, ctx context.Context, tenant, requestID string,
+	held int64) <-chan *httptest.ResponseRecorder {
+
+	t.Helper()
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		responses <- chain.serve(shaperTestRequest(ctx, tenant, requestID))
+	}()
+	require.Eventually(t, func() bool { return shaped.Load() == held }, 2*time.Second, time.Millisecond,
+		"request %s wasn't held", requestID)
+	return responses
+}
+
+func TestShapeRequest_MaxHeldRejectsRightAway(t *testing.T) {
+	// one departure per second
+	chain := setupTestChain(t, shaperTestLimiter(2, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first request of a tenant leaves right away, the next one is held
+	res := chain.serve(shaperTestRequest(ctx, "acme", "acme-1"))
+	require.Equal(t, http.StatusOK, res.Code)
+	acme := sendShapedRequest(t, chain, ctx, "acme", "acme-2", 1)
+	res = chain.serve(shaperTestRequest(ctx, "other", "other-1"))
+	require.Equal(t, http.StatusOK, res.Code)
+	other := sendShapedRequest(t, chain, ctx, "other", "other-2", 2)
+
+	// max_held reached, whatever the tenant
+	for _, tenant := range []string{"acme", "other"} {
+		start := time.Now()
+		res = chain.serve(shaperTestRequest(context.Background(), tenant, tenant+"-3"))
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.NotEmpty(t, res.Header().Get("Retry-After"))
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "overflow must not be held")
+	}
+	assert.Equal(t, int64(2), shaped.Load())
+
+	// clients going away free their place
+	cancel()
+	waitResponse(t, acme)
+	waitResponse(t, other)
+	assert.Equal(t, int64(0), shaped.Load())
+	assert.Equal(t, []string{"acme-1", "other-1"}, chain.backend.forwarded())
+}
+
+func TestShapeRequest_FIFOPerTenant(t *testing.T) {
+	// a departure every 100ms per tenant
+	chain := setupTestChain(t, shaperTestLimiter(100, 10))
+	ctx := context.Background()
+
+	start := time.Now()
+	res := chain.serve(shaperTestRequest(ctx, "acme", "acme-1"))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	var responses []<-chan *httptest.ResponseRecorder
+	for i := 2; i <= 5; i++ {
+		responses = append(responses, sendShapedRequest(t, chain, ctx, "acme", fmt.Sprintf("acme-%d", i), int64(i-1)))
+	}
+
+	// another tenant's bucket is empty, it doesn't queue behind acme
+	res = chain.serve(shaperTestRequest(ctx, "other", "other-1"))
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	for _, done := range responses {
+		assert.Equal(t, http.StatusOK, waitResponse(t, done).Code)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "acme's requests are paced")
+
+	var acme []string
+	for _, requestID := range chain.backend.forwarded() {
+		if requestID != "other-1" {
+			acme = append(acme, requestID)
+		}
+	}
+	assert.Equal(t, []string{"acme-1", "acme-2", "acme-3", "acme-4", "acme-5"}, acme)
+	assert.Equal(t, []string{"acme-1", "other-1"}, chain.backend.forwarded()[:2])
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
+	"go.uber.org/zap"
+)
+
+// requests held by the tarpit right now, across the whole proxy
+var tarpitted atomic.Int64
+
+// a delayed request going through the admission again after its hold
+type tarpitRetry struct {
+	// set by the admission, false when it denied the request again
+	admitted bool
+}
+
+// denyRequest answers a request denied by the global, per-tenant or per-endpoint limit: reject
+// answers right away, delay and delay_then_reject hold it first (see config.Tarpit). A delayed
+// request that may retry within max_delay goes through the admission again once its wait is
+// over, it is forwarded if admitted and rejected right away if denied again.
+func denyRequest(res http.ResponseWriter, req *http.Request, result *limiter.LimitResult,
+	reject func(result *limiter.LimitResult)) {
+
+	ctx := req.Context()
+	cfg := config.GetConfigFromContext(ctx)
+	reqLogger := GetRequestLoggerFromContext(ctx)
+	tarpit := &cfg.Limiter.Tarpit
+
+	// denied again after a hold, a request is only held once
+	if getTarpitRetry(ctx) != nil {
+		reject(result)
+		return
+	}
+
+	score := 1.0
+	if admission := GetAdmissionResultFromContext(ctx); admission != nil && admission.Reputation != nil {
+		score = admission.Reputation.Score
+	}
+	var ruleAction config.ActionType
+	if rule := GetEndpointRuleFromContext(ctx); rule != nil {
+		ruleAction = rule.Action
+	}
+
+	action := tarpit.ActionFor(ruleAction, score)
+	if action == config.ActionReject {
+		reject(result)
+		return
+	}
+
+	maxDelay := tarpit.MaxDelay.Duration
+	wait := tarpit.Wait(result.RetryAfter, score)
+	delay := min(wait, maxDelay)
+
+	// the bound keeps held connections from exhausting the proxy
+	if tarpitted.Add(1) > int64(tarpit.MaxConcurrent) {
+		tarpitted.Add(-1)
+
+		//==========================Metrics=============================
+		metrics.TarpittedRequests.WithLabelValues("overflow").Inc()
+		//==============================================================
+
+		reqLogger.Warn("tarpit is full, rejecting denied request right away",
+			zap.Int("max_concurrent", tarpit.MaxConcurrent))
+		reject(result)
+		return
+	}
+
+	//==========================Metrics=============================
+	metrics.TarpitActive.Inc()
+	//==============================================================
+
+	reqLogger.Debug("holding denied request in tarpit", zap.String("action", string(action)),
+		zap.Float64("delay", delay.Seconds()))
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	tarpitted.Add(-1)
+
+	//==========================Metrics=============================
+	metrics.TarpitActive.Dec()
+	//==============================================================
+
+	if ctx.Err() != nil {
+		//==========================Metrics=============================
+		metrics.TarpittedRequests.WithLabelValues("abandoned").Inc()
+		//==============================================================
+
+		reqLogger.Debug("client went away while held in tarpit", zap.Error(ctx.Err()))
+		return
+	}
+
+	if admit := GetAdmissionFromContext(ctx); admit != nil && action == config.ActionDelay && wait <= maxDelay {
+		reqLogger.Debug("denied request delayed by tarpit, admitting it again",
+			zap.Float64("delay", delay.Seconds()))
+
+		// the classifier's redis context may be over by now
+		redisCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		retry := &tarpitRetry{}
+		retryCtx := setRedisContext(context.WithValue(ctx, TarpitRetryKey, retry), redisCtx)
+		admit.ServeHTTP(res, req.WithContext(retryCtx))
+
+		outcome := "rejected"
+		if retry.admitted {
+			outcome = "forwarded"
+		}
+		//==========================Metrics=============================
+		metrics.TarpittedRequests.WithLabelValues(outcome).Inc()
+		//==============================================================
+		return
+	}
+
+	//==========================Metrics=============================
+	metrics.TarpittedRequests.WithLabelValues("rejected").Inc()
+	//==============================================================
+
+	held := *result
+	held.RetryAfter = max(0, result.RetryAfter-delay)
+	reject(&held)
+}
+
+func getTarpitRetry(ctx context.Context) *tarpitRetry {
+	if v := ctx.Value(TarpitRetryKey); v != nil {
+		if retry, ok := v.(*tarpitRetry); ok {
+			return retry
+		}
+	}
+	return nil
+}
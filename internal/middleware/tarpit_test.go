@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tarpitTestLimiter = `
+global:
+  enabled: false
+per_tenant:
+  enabled: false
+tarpit:
+  max_delay: "3s"
+  max_concurrent: 1
+per_endpoint:
+  rules:
+    - path: "/api/*"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      action: delay
+      algorithm: fixed_window
+      window_size: "1s"
+      limit: 1
+    - path: "/export/*"
+      tenant_strategy:
+        type: header
+        key: "X-API-Key"
+      action: delay_then_reject
+      algorithm: fixed_window
+      window_size: "1m"
+      limit: 1
+`
+
+func tarpitTestRequest(ctx context.Context, path string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+	req.Header.Set("X-API-Key", "acme")
+	return req
+}
+
+// serves a request that is expected to be held, cancel ends the hold like a client going away
+func holdTarpitRequest(t *testing.T, chain *testChain, path string) (cancel func(), done <-chan *httptest.ResponseRecorder) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		responses <- chain.serve(tarpitTestRequest(ctx, path))
+	}()
+
+	require.Eventually(t, func() bool { return tarpitted.Load() == 1 }, 2*time.Second, time.Millisecond,
+		"request wasn't held")
+	return cancel, responses
+}
+
+func waitResponse(t *testing.T, done <-chan *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	t.Helper()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("held request never returned")
+		return nil
+	}
+}
+
+func TestTarpit_DelayedRequestIsAdmittedAgain(t *testing.T) {
+	chain := setupTestChain(t, tarpitTestLimiter)
+	ctx := context.Background()
+
+	res := chain.serve(tarpitTestRequest(ctx, "/api/orders"))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	// denied, held until the next window and forwarded once admitted there
+	res = chain.serve(tarpitTestRequest(ctx, "/api/orders"))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, int64(2), chain.backend.calls.Load())
+
+	// the retry used the new window, so the next request is held too. A ban while it
+	// waits shows it is checked again instead of being forwarded
+	_, done := holdTarpitRequest(t, chain, "/api/orders")
+	require.NoError(t, chain.rateLimiter.BanTenant(ctx, "acme", time.Minute))
+
+	res = waitResponse(t, done)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Equal(t, int64(2), chain.backend.calls.Load())
+	assert.Equal(t, int64(0), tarpitted.Load())
+}
+
+func TestTarpit_MaxConcurrentRejectsRightAway(t *testing.T) {
+	chain := setupTestChain(t, tarpitTestLimiter)
+
+	res := chain.serve(tarpitTestRequest(context.Background(), "/export/report"))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	cancel, done := holdTarpitRequest(t, chain, "/export/report")
+
+	// the tarpit is full
+	start := time.Now()
+	res = chain.serve(tarpitTestRequest(context.Background(), "/export/report"))
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.NotEmpty(t, res.Header().Get("Retry-After"))
+	assert.Less(t, time.Since(start), time.Second, "overflow must not be held")
+	assert.Equal(t, int64(1), tarpitted.Load())
+
+	cancel()
+	waitResponse(t, done)
+	assert.Equal(t, int64(1), chain.backend.calls.Load())
+}
+
+func TestTarpit_CancelledClientFreesSlot(t *testing.T) {
+	chain := setupTestChain(t, tarpitTestLimiter)
+
+	res := chain.serve(tarpitTestRequest(context.Background(), "/export/report"))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	cancel, done := holdTarpitRequest(t, chain, "/export/report")
+	start := time.Now()
+	cancel()
+	res = waitResponse(t, done)
+	assert.Less(t, time.Since(start), time.Second, "the hold ends with the client")
+	assert.Empty(t, res.Body.String(), "nothing is written to a client that went away")
+	assert.Equal(t, int64(0), tarpitted.Load())
+
+	// with max_concurrent 1 the freed slot takes the next denied request
+	cancel, done = holdTarpitRequest(t, chain, "/export/report")
+	cancel()
+	waitResponse(t, done)
+	assert.Equal(t, int64(1), chain.backend.calls.Load())
+}
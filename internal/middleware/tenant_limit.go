@@ -5,11 +5,10 @@ import (
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
-	"github.com/mostafa-mahmood/TrafficCTRL/metrics"
 	"go.uber.org/zap"
 )
 
-func TenantLimitMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter) http.Handler {
+func TenantLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
 		ctx := req.Context()
@@ -26,35 +25,23 @@ func TenantLimitMiddleware(next http.Handler, rateLimiter *limiter.RateLimiter)
 			return
 		}
 
-		redisCtx := GetRedisContextFromContext(ctx)
-		tenantKey := GetTenantKeyFromContext(ctx)
-		tenantLimitResult, err := rateLimiter.CheckTenantLimit(redisCtx, tenantKey, &cfg.Limiter.PerTenant)
-		if err != nil {
-			reqLogger.Error("failed to enforce tenant limit", zap.Error(err))
-			//============================Metrics============================
-			metrics.TenantLimitErrors.Inc()
-			//===============================================================
+		admission := GetAdmissionResultFromContext(ctx)
+		if admission == nil {
 			next.ServeHTTP(res, req)
 			return
 		}
 
-		if !tenantLimitResult.Allowed {
-			_, err := rateLimiter.UpdateReputation(redisCtx, tenantKey, true)
-			if err != nil {
-				reqLogger.Error("failed to update reputation", zap.Error(err))
-			}
-			rejectRequest(res, reqLogger, tenantLimitResult, config.PerTenantLevel)
+		tenantLimitResult := admission.Levels[config.PerTenantLevel]
+		if admission.DeniedLevel == config.PerTenantLevel {
+			denyRequest(res, req, tenantLimitResult, func(result *limiter.LimitResult) {
+				rejectRequest(res, reqLogger, GetPlanFromContext(ctx), result, config.PerTenantLevel)
+			})
 			return
 		}
 
 		reqLogger.Debug("tenant rate limit check passed",
 			zap.Int64("remaining_tenant", tenantLimitResult.Remaining))
 
-		_, err = rateLimiter.UpdateReputation(redisCtx, tenantKey, false)
-		if err != nil {
-			reqLogger.Error("failed to update reputation", zap.Error(err))
-		}
-
 		next.ServeHTTP(res, req)
 	})
 }
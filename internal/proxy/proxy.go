@@ -6,10 +6,47 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
 )
 
+type upstreamProxy struct {
+	snapshot  *config.Config
+	targetUrl string
+	proxy     *httputil.ReverseProxy
+	// the middleware chain in front of proxy
+	handler http.Handler
+}
+
+// keeps the handler of the latest snapshot: the middleware chain is built once per snapshot,
+// the reverse proxy behind it only when a reload changes target_url
+type proxyCache struct {
+	current atomic.Pointer[upstreamProxy]
+	chain   func(proxy *httputil.ReverseProxy) http.Handler
+}
+
+func (c *proxyCache) get(cfg *config.Config) (http.Handler, error) {
+	cur := c.current.Load()
+	if cur != nil && cur.snapshot == cfg {
+		return cur.handler, nil
+	}
+
+	var proxy *httputil.ReverseProxy
+	if cur != nil && cur.targetUrl == cfg.Proxy.TargetUrl {
+		proxy = cur.proxy
+	} else {
+		var err error
+		if proxy, err = createProxy(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	next := &upstreamProxy{snapshot: cfg, targetUrl: cfg.Proxy.TargetUrl, proxy: proxy, handler: c.chain(proxy)}
+	c.current.Store(next)
+	return next.handler, nil
+}
+
 // injects standard X-Forwarded-* headers for downstream services.
 func createProxy(cfg *config.Config) (*httputil.ReverseProxy, error) {
 	targetURL, err := url.Parse(cfg.Proxy.TargetUrl)
@@ -18,14 +55,22 @@ func createProxy(cfg *config.Config) (*httputil.ReverseProxy, error) {
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	// tells a backend that never answered apart from a 502 it sent, see recordResponse
+	proxy.ErrorHandler = handleUpstreamError
 
 	defaultDirector := proxy.Director
 
 	proxy.Director = func(req *http.Request) {
+		// server_name is read from the request snapshot so reloads apply without rebuilding the proxy
+		serverName := cfg.Proxy.ServerName
+		if snapshot := config.GetConfigFromContext(req.Context()); snapshot != nil {
+			serverName = snapshot.Proxy.ServerName
+		}
+
 		setForwardedHostHeader(req)
 		setForwardedPortHeader(req)
 		setForwardedProtoHeader(req)
-		setForwardedServerHeader(req, cfg.Proxy.ServerName)
+		setForwardedServerHeader(req, serverName)
 		defaultDirector(req)
 	}
 
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCache_ChainBuiltOncePerSnapshot(t *testing.T) {
+	var built []*httputil.ReverseProxy
+	cache := &proxyCache{chain: func(proxy *httputil.ReverseProxy) http.Handler {
+		built = append(built, proxy)
+		return proxy
+	}}
+
+	snapshot := &config.Config{Proxy: &config.ProxyConfig{TargetUrl: "http://localhost:5000"}}
+	first, err := cache.get(snapshot)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		handler, err := cache.get(snapshot)
+		require.NoError(t, err)
+		assert.Same(t, first, handler)
+	}
+	require.Len(t, built, 1)
+
+	// A reload keeping target_url gets a new chain around the same reverse proxy
+	reloaded := &config.Config{Proxy: &config.ProxyConfig{TargetUrl: "http://localhost:5000", ServerName: "v2"}}
+	_, err = cache.get(reloaded)
+	require.NoError(t, err)
+	require.Len(t, built, 2)
+	assert.Same(t, built[0], built[1])
+
+	// A new target_url gets a new reverse proxy
+	moved := &config.Config{Proxy: &config.ProxyConfig{TargetUrl: "http://localhost:6000"}}
+	_, err = cache.get(moved)
+	require.NoError(t, err)
+	require.Len(t, built, 3)
+	assert.NotSame(t, built[1], built[2])
+
+	// An invalid target_url fails and keeps the cached handler
+	_, err = cache.get(&config.Config{Proxy: &config.ProxyConfig{TargetUrl: "://bad"}})
+	assert.Error(t, err)
+	assert.Same(t, moved, cache.current.Load().snapshot)
+}
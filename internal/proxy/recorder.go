@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/middleware"
+	"go.uber.org/zap"
+)
+
+// responseRecorder keeps the final status of the response and when it was written
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	writtenAt time.Time
+	// set by handleUpstreamError, the status is then the proxy's own 502
+	upstreamErr error
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	// 1xx responses come before the final one
+	if r.status == 0 && status >= 200 {
+		r.status = status
+		r.writtenAt = time.Now()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+		r.writtenAt = time.Now()
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// the reverse proxy flushes and hijacks (upgrades) through http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recordResponse captures how the backend answered, for endpoint rules with refund_on or
+// count_on: response and for an adaptive global limit. Other requests go to the reverse proxy
+// untouched.
+func recordResponse(next http.Handler, rateLimiter *limiter.RateLimiter) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		global := &config.GetConfigFromContext(ctx).Limiter.Global
+		adaptive := global.Enabled && global.Adaptive.Enabled
+
+		outcome := middleware.GetResponseOutcomeFromContext(ctx)
+		if outcome == nil && !adaptive {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: res}
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		if outcome != nil {
+			outcome.Status = recorder.status
+			outcome.UpstreamErr = recorder.upstreamErr
+		}
+
+		// a client going away says nothing about the backend
+		if adaptive && ctx.Err() == nil {
+			if recorder.upstreamErr != nil {
+				rateLimiter.ObserveResponse(global, time.Since(start), true)
+			} else if recorder.status != 0 {
+				rateLimiter.ObserveResponse(global, recorder.writtenAt.Sub(start),
+					recorder.status >= http.StatusInternalServerError)
+			}
+		}
+	})
+}
+
+// answers 502 when the backend couldn't be reached or failed to answer, like the reverse
+// proxy's default handler, and records the failure so it isn't taken for a 502 of the backend
+func handleUpstreamError(res http.ResponseWriter, req *http.Request, err error) {
+	ctx := req.Context()
+
+	if recorder, ok := res.(*responseRecorder); ok {
+		recorder.upstreamErr = err
+	}
+
+	if reqLogger := middleware.GetRequestLoggerFromContext(ctx); reqLogger == nil {
+		log.Printf("http: proxy error: %v", err)
+	} else if ctx.Err() != nil {
+		reqLogger.Debug("client went away before upstream server answered", zap.Error(err))
+	} else {
+		reqLogger.Error("upstream server failed to answer", zap.Error(err))
+	}
+
+	res.WriteHeader(http.StatusBadGateway)
+}
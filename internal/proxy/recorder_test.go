@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordResponse_FillsOutcome(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/unavailable":
+			res.WriteHeader(http.StatusServiceUnavailable)
+		case "/bad-gateway":
+			// the backend's own 502 is a response, not an upstream error
+			res.WriteHeader(http.StatusBadGateway)
+		case "/early-hints":
+			res.Header().Set("Link", "</style.css>; rel=preload")
+			res.WriteHeader(http.StatusEarlyHints)
+			res.WriteHeader(http.StatusCreated)
+		default:
+			_, _ = res.Write([]byte("ok"))
+		}
+	}))
+	defer backend.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name        string
+		target      string
+		path        string
+		status      int
+		upstreamErr bool
+	}{
+		{name: "T01_ImplicitOK", target: backend.URL, path: "/", status: http.StatusOK},
+		{name: "T02_ServerError", target: backend.URL, path: "/unavailable", status: http.StatusServiceUnavailable},
+		{name: "T03_BackendBadGateway", target: backend.URL, path: "/bad-gateway", status: http.StatusBadGateway},
+		{name: "T04_InformationalSkipped", target: backend.URL, path: "/early-hints", status: http.StatusCreated},
+		{name: "T05_Unreachable", target: unreachable.URL, path: "/", status: http.StatusBadGateway, upstreamErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Proxy:   &config.ProxyConfig{TargetUrl: tt.target},
+				Limiter: &config.RateLimiterConfig{},
+			}
+			proxy, err := createProxy(cfg)
+			require.NoError(t, err)
+
+			outcome := &middleware.ResponseOutcome{}
+			ctx := config.WithConfigSnapshot(context.Background(), cfg)
+			ctx = context.WithValue(ctx, middleware.ResponseOutcomeKey, outcome)
+			req := httptest.NewRequest("GET", tt.path, nil).WithContext(ctx)
+			recordResponse(proxy, nil).ServeHTTP(httptest.NewRecorder(), req)
+
+			// the final status, the recorder sees the 103 first
+			assert.Equal(t, tt.status, outcome.Status)
+			if tt.upstreamErr {
+				assert.Error(t, outcome.UpstreamErr)
+			} else {
+				assert.NoError(t, outcome.UpstreamErr)
+			}
+		})
+	}
+}
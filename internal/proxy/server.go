@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"time"
 
 	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/admin"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/limiter"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
 	"github.com/mostafa-mahmood/TrafficCTRL/internal/middleware"
@@ -15,31 +17,33 @@ import (
 	"go.uber.org/zap"
 )
 
-func StartServer(cfg *config.Config, lgr *logger.Logger, rateLimiter *limiter.RateLimiter,
+func StartServer(cfgStore *config.Store, lgr *logger.Logger, rateLimiter *limiter.RateLimiter,
 	shutdown <-chan struct{}) error {
+	cfg := cfgStore.Load()
 	proxyAddr := net.JoinHostPort("0.0.0.0", fmt.Sprintf("%d", cfg.Proxy.ProxyPort))
 	metricsAddr := net.JoinHostPort("0.0.0.0", fmt.Sprintf("%d", cfg.Proxy.MetricsPort))
 
-	proxy, err := createProxy(cfg)
-	if err != nil {
+	proxies := &proxyCache{chain: func(proxy *httputil.ReverseProxy) http.Handler {
+		return buildChain(proxy, rateLimiter, lgr)
+	}}
+	if _, err := proxies.get(cfg); err != nil {
 		return err
 	}
 
 	rootHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := config.WithConfigSnapshot(r.Context(), cfg)
+		// one snapshot per request, a reload mid-request doesn't affect it
+		snapshot := cfgStore.Load()
+		ctx := config.WithConfigSnapshot(r.Context(), snapshot)
 		r = r.WithContext(ctx)
 
-		var next http.Handler = proxy
-
-		next = middleware.EndpointLimitMiddleware(next, rateLimiter)
-		next = middleware.TenantLimitMiddleware(next, rateLimiter)
-		next = middleware.GlobalLimitMiddleware(next, lgr, rateLimiter)
-		next = middleware.DryRunMiddleware(next, rateLimiter)
-		next = middleware.ClassifierMiddleware(next, lgr)
-		next = middleware.MetadataMiddleware(next)
-		next = middleware.RecoveryMiddleware(next, proxy, lgr)
+		handler, err := proxies.get(snapshot)
+		if err != nil {
+			lgr.Error("failed to build reverse proxy for reloaded config", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r)
 	})
 
 	proxyMux := http.NewServeMux()
@@ -56,7 +60,21 @@ func StartServer(cfg *config.Config, lgr *logger.Logger, rateLimiter *limiter.Ra
 		Handler: metricsMux,
 	}
 
-	errChan := make(chan error, 2)
+	// mounted even when disabled, a reload can enable it (the handler answers 404 until then)
+	adminHandler := admin.NewHandler(cfgStore, rateLimiter, lgr)
+	var adminServer *http.Server
+	if cfg.Proxy.Admin.Port == 0 {
+		metricsMux.Handle("/admin/", adminHandler)
+	} else {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/", adminHandler)
+		adminServer = &http.Server{
+			Addr:    net.JoinHostPort("0.0.0.0", fmt.Sprintf("%d", cfg.Proxy.Admin.Port)),
+			Handler: adminMux,
+		}
+	}
+
+	errChan := make(chan error, 3)
 
 	lgr.Info("proxy server starting", zap.String("address", proxyAddr),
 		zap.String("target_url", cfg.Proxy.TargetUrl))
@@ -73,6 +91,15 @@ func StartServer(cfg *config.Config, lgr *logger.Logger, rateLimiter *limiter.Ra
 		}
 	}()
 
+	if adminServer != nil {
+		lgr.Info("admin server starting", zap.String("address", adminServer.Addr))
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("admin server failed: %w", err)
+			}
+		}()
+	}
+
 	var runErr error
 	select {
 	case runErr = <-errChan:
@@ -90,6 +117,11 @@ func StartServer(cfg *config.Config, lgr *logger.Logger, rateLimiter *limiter.Ra
 	if shutdownErr := metricsServer.Shutdown(shutdownCtx); shutdownErr != nil {
 		lgr.Warn("metrics server shutdown failed", zap.Error(shutdownErr))
 	}
+	if adminServer != nil {
+		if shutdownErr := adminServer.Shutdown(shutdownCtx); shutdownErr != nil {
+			lgr.Warn("admin server shutdown failed", zap.Error(shutdownErr))
+		}
+	}
 
 	if runErr == nil {
 		return http.ErrServerClosed
@@ -97,3 +129,21 @@ func StartServer(cfg *config.Config, lgr *logger.Logger, rateLimiter *limiter.Ra
 
 	return runErr
 }
+
+// the middlewares read the config from the request snapshot, so the chain only depends on the proxy
+func buildChain(proxy *httputil.ReverseProxy, rateLimiter *limiter.RateLimiter, lgr *logger.Logger) http.Handler {
+	var next http.Handler = recordResponse(proxy, rateLimiter)
+
+	next = middleware.EndpointLimitMiddleware(next)
+	next = middleware.QuotaMiddleware(next)
+	next = middleware.TenantLimitMiddleware(next)
+	next = middleware.GlobalLimitMiddleware(next, lgr)
+	next = middleware.AdmissionMiddleware(next, rateLimiter)
+	next = middleware.DryRunMiddleware(next, rateLimiter)
+	next = middleware.ClassifierMiddleware(next, rateLimiter, lgr)
+	next = middleware.AccessControlMiddleware(next, lgr)
+	next = middleware.MetadataMiddleware(next)
+	next = middleware.RecoveryMiddleware(next, proxy, lgr)
+
+	return next
+}
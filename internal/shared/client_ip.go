@@ -0,0 +1,137 @@
+package shared
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// ExtractIP returns the client address of the request. Forwarding headers are only read when
+// the direct peer (RemoteAddr) is trusted (trusted_proxies), otherwise any client could pick its own ip.
+// The chain (Forwarded, else X-Forwarded-For) is walked right to left skipping trusted hops,
+// the first untrusted hop is the client. A hop that isn't an ip makes the whole chain untrusted and
+// the remote address is used. X-Real-IP is only used when there is no chain.
+func ExtractIP(req *http.Request, isTrusted func(netip.Addr) bool) string {
+	remote := remoteHost(req.RemoteAddr)
+
+	remoteAddr, err := netip.ParseAddr(remote)
+	if err != nil || !isTrusted(remoteAddr) {
+		return remote
+	}
+
+	hops := forwardedFor(req.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(req.Header.Values("X-Forwarded-For"))
+	}
+
+	if len(hops) == 0 {
+		if xri, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get("X-Real-IP"))); err == nil {
+			return xri.Unmap().String()
+		}
+		return remote
+	}
+
+	client := remoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// unknown, obfuscated or malformed hop: the chain can't be trusted, fall back to the peer
+			return remote
+		}
+		client = hop.Unmap()
+		if !isTrusted(client) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// tenantIP masks the client ip to the network of the tenant strategy (ipv4_prefix_length,
+// ipv6_prefix_length), so every address of an IPv6 /64 shares one tenant key.
+// A nil strategy uses the default lengths, values that aren't ips are returned unchanged.
+func tenantIP(clientIP string, tenantRule *config.TenantStrategy) string {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return clientIP
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := config.DefaultIPv6PrefixLength
+	if addr.Is4() {
+		bits = config.DefaultIPv4PrefixLength
+	}
+	if tenantRule != nil {
+		if addr.Is4() && tenantRule.IPv4PrefixLength != nil {
+			bits = *tenantRule.IPv4PrefixLength
+		} else if addr.Is6() && tenantRule.IPv6PrefixLength != nil {
+			bits = *tenantRule.IPv6PrefixLength
+		}
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	// network address only, "2001:db8:1:2::" for 2001:db8:1:2:a:b:c:d/64
+	return prefix.Addr().String()
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func xForwardedFor(values []string) []string {
+	hops := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, forwardedNode(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// for= values of RFC 7239 Forwarded headers, in order. Elements without for= are skipped,
+// values keep their form ("unknown", "_hidden") so the walk stops at them.
+func forwardedFor(values []string) []string {
+	hops := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				hops = append(hops, forwardedNode(node))
+			}
+		}
+	}
+	return hops
+}
+
+// strips quotes, brackets and port: "[2001:db8::1]:4711" -> 2001:db8::1, 192.0.2.1:80 -> 192.0.2.1,
+// some proxies add ports to X-Forwarded-For as well
+func forwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
@@ -0,0 +1,166 @@
+package shared
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+)
+
+// 10.0.0.0/8 and 2001:db8::/32 are the load balancers
+func isTrustedTestProxy(addr netip.Addr) bool {
+	return netip.MustParsePrefix("10.0.0.0/8").Contains(addr) ||
+		netip.MustParsePrefix("2001:db8::/32").Contains(addr)
+}
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "T01_NoHeaders",
+			remoteAddr: "203.0.113.5:4000",
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "T02_UntrustedPeer_HeadersIgnored",
+			remoteAddr: "203.0.113.5:4000",
+			headers: map[string][]string{
+				"X-Real-IP":       {"1.1.1.1"},
+				"X-Forwarded-For": {"2.2.2.2"},
+				"Forwarded":       {"for=3.3.3.3"},
+			},
+			expected: "203.0.113.5",
+		},
+		{
+			name:       "T03_TrustedPeer_XFFSingleHop",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "T04_TrustedPeer_SpoofedLeftmostHopIgnored",
+			remoteAddr: "10.0.0.1:4000",
+			// The client sent "1.1.1.1" itself, the load balancer appended the real address
+			headers:  map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.7"}},
+			expected: "198.51.100.7",
+		},
+		{
+			name:       "T05_TrustedPeer_SkipsTrustedHops",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.7, 10.1.1.1", "10.2.2.2"}},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "T06_TrustedPeer_AllHopsTrusted",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.3.3.3, 10.1.1.1"}},
+			expected:   "10.3.3.3",
+		},
+		{
+			name:       "T07_TrustedPeer_InvalidHopUsesRemoteAddr",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage, 10.1.1.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "T08_TrustedPeer_XRealIPWithoutChain",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.7"}},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "T09_TrustedPeer_InvalidXRealIP",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Real-IP": {"not-an-ip"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "T10_Forwarded_PreferredOverXFF",
+			remoteAddr: "10.0.0.1:4000",
+			headers: map[string][]string{
+				"Forwarded":       {`for=192.0.2.60;proto=http;by=10.0.0.1`},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			expected: "192.0.2.60",
+		},
+		{
+			name:       "T11_Forwarded_QuotedIPv6WithPort",
+			remoteAddr: "[2001:db8::1]:4000",
+			headers:    map[string][]string{"Forwarded": {`for=192.0.2.43, For="[2001:db9:cafe::17]:4711"`}},
+			expected:   "2001:db9:cafe::17",
+		},
+		{
+			name:       "T12_Forwarded_UnknownUsesRemoteAddr",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"Forwarded": {"for=192.0.2.43, for=unknown, for=10.1.1.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "T13_XFFWithPortAndMappedAddress",
+			remoteAddr: "10.0.0.1:4000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7:5555, ::ffff:10.1.1.1"}},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "T14_RemoteAddrWithoutPort",
+			remoteAddr: "203.0.113.5",
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "T15_TrustedPeer_MalformedHopBehindTrustedHopUsesRemoteAddr",
+			remoteAddr: "10.0.0.1:4000",
+			// Neither the trusted hop nor the spoofed address left of the garbage is the client
+			headers:  map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.7:abc:1, 10.1.1.1"}},
+			expected: "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(key, value)
+				}
+			}
+
+			if actual := ExtractIP(req, isTrustedTestProxy); actual != tt.expected {
+				t.Errorf("ExtractIP() = %q, expected %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTenantIP(t *testing.T) {
+	v4, v6 := 24, 48
+	aggregated := &config.TenantStrategy{Type: "ip", IPv4PrefixLength: &v4, IPv6PrefixLength: &v6}
+
+	tests := []struct {
+		name       string
+		clientIP   string
+		tenantRule *config.TenantStrategy
+		expected   string
+	}{
+		{"T01_DefaultIPv4Unchanged", "203.0.113.5", nil, "203.0.113.5"},
+		{"T02_DefaultIPv6Slash64", "2001:db8:1:2:a:b:c:d", nil, "2001:db8:1:2::"},
+		{"T03_SameSlash64SameKey", "2001:db8:1:2::ffff", nil, "2001:db8:1:2::"},
+		{"T04_ConfiguredIPv4", "203.0.113.5", aggregated, "203.0.113.0"},
+		{"T05_ConfiguredIPv6", "2001:db8:1:2:a:b:c:d", aggregated, "2001:db8:1::"},
+		{"T06_MappedAddressUsesIPv4Length", "::ffff:203.0.113.5", aggregated, "203.0.113.0"},
+		{"T07_NotAnIP", "unknown", aggregated, "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := tenantIP(tt.clientIP, tt.tenantRule); actual != tt.expected {
+				t.Errorf("tenantIP() = %q, expected %q", actual, tt.expected)
+			}
+		})
+	}
+}
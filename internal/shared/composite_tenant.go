@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"go.uber.org/zap"
+)
+
+// joins the parts of a composite key, sanitized values never contain it
+const compositeSeparator = "+"
+
+// ErrMissingTenantPart is returned by ExtractTenantKey when a composite part is missing
+// and on_missing_part is reject, the request has to be answered with 400.
+var ErrMissingTenantPart = errors.New("missing tenant attribute")
+
+func extractComposite(req *http.Request, tenantRule *config.TenantStrategy, clientIP string,
+	lgr *logger.Logger) (string, error) {
+	values := make([]string, len(tenantRule.Parts))
+	var missing []string
+
+	for i := range tenantRule.Parts {
+		part := &tenantRule.Parts[i]
+		value, err := extractAttribute(req, part, clientIP)
+		if err != nil {
+			return "", err
+		}
+
+		values[i] = sanitizeRedisKey(value)
+		if values[i] == "" {
+			missing = append(missing, partName(part))
+		}
+	}
+
+	if len(missing) == 0 {
+		return strings.Join(values, compositeSeparator), nil
+	}
+
+	switch tenantRule.OnMissingPart {
+	case config.MissingPartReject:
+		return "", fmt.Errorf("%w: %s", ErrMissingTenantPart, strings.Join(missing, ", "))
+	case config.MissingPartEmpty:
+		// positions are kept, "key+" and "+key" stay different tenants
+		return strings.Join(values, compositeSeparator), nil
+	default:
+		lgr.Warn("composite tenant key incomplete, falling back to IP",
+			zap.String("request_id", req.Header.Get("X-Request-ID")),
+			zap.Strings("missing", missing),
+			zap.String("path", req.URL.Path),
+			zap.String("method", req.Method))
+		return sanitizeRedisKey(tenantIP(clientIP, tenantRule)), nil
+	}
+}
+
+// header:x-api-key, ip, ...
+func partName(part *config.TenantStrategy) string {
+	if part.Key == "" {
+		return part.Type
+	}
+	return part.Type + ":" + part.Key
+}
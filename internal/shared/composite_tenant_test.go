@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"go.uber.org/zap"
+)
+
+func compositeRule(policy config.MissingPartPolicy) *config.TenantStrategy {
+	return &config.TenantStrategy{
+		Type: "composite",
+		Parts: []config.TenantStrategy{
+			{Type: "header", Key: "X-API-Key"},
+			{Type: "ip"},
+			{Type: "query_parameter", Key: "region"},
+		},
+		OnMissingPart: policy,
+	}
+}
+
+func TestExtractComposite(t *testing.T) {
+	lgr := &logger.Logger{Logger: zap.NewNop()}
+
+	tests := []struct {
+		name        string
+		target      string
+		headers     map[string]string
+		policy      config.MissingPartPolicy
+		expected    string
+		expectedErr error
+	}{
+		{
+			name:     "T01_AllPartsPresent",
+			target:   "/?region=eu",
+			headers:  map[string]string{"X-API-Key": "key-1"},
+			policy:   config.MissingPartIP,
+			expected: "key-1+203.0.113.5+eu",
+		},
+		{
+			name:     "T02_PartsAreSanitized",
+			target:   "/?region=eu%2Bwest",
+			headers:  map[string]string{"X-API-Key": "key 1*+x"},
+			policy:   config.MissingPartIP,
+			expected: "key1x+203.0.113.5+euwest",
+		},
+		{
+			name:     "T03_MissingPart_FallsBackToIP",
+			target:   "/",
+			headers:  map[string]string{"X-API-Key": "key-1"},
+			policy:   config.MissingPartIP,
+			expected: "203.0.113.5",
+		},
+		{
+			name:     "T04_MissingPart_KeptEmpty",
+			target:   "/",
+			headers:  map[string]string{"X-API-Key": "key-1"},
+			policy:   config.MissingPartEmpty,
+			expected: "key-1+203.0.113.5+",
+		},
+		{
+			name:        "T05_MissingPart_Rejected",
+			target:      "/?region=eu",
+			policy:      config.MissingPartReject,
+			expectedErr: ErrMissingTenantPart,
+		},
+		{
+			name:     "T06_SanitizedToEmptyCountsAsMissing",
+			target:   "/?region=eu",
+			headers:  map[string]string{"X-API-Key": "***"},
+			policy:   config.MissingPartIP,
+			expected: "203.0.113.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			actual, err := ExtractTenantKey(req, compositeRule(tt.policy), "203.0.113.5", lgr)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("ExtractTenantKey() error = %v, expected %v", err, tt.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExtractTenantKey() unexpected error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("ExtractTenantKey() = %q, expected %q", actual, tt.expected)
+			}
+		})
+	}
+}
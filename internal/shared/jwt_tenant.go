@@ -0,0 +1,81 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"go.uber.org/zap"
+)
+
+// tenant key of requests without a valid token when on_invalid_token is anonymous
+const AnonymousTenant = "anonymous"
+
+// ErrInvalidToken is returned by ExtractTenantKey when on_invalid_token is reject,
+// the request has to be answered with 401.
+var ErrInvalidToken = errors.New("missing or invalid token")
+
+func extractFromJWT(req *http.Request, tenantRule *config.TenantStrategy, clientIP string,
+	lgr *logger.Logger) (string, error) {
+	tenantKey, err := jwtClaim(req, tenantRule)
+	if err == nil {
+		if tenantKey = sanitizeRedisKey(tenantKey); tenantKey != "" {
+			return tenantKey, nil
+		}
+		err = fmt.Errorf("claim %s is empty", tenantRule.Claim)
+	}
+
+	switch tenantRule.OnInvalidToken {
+	case config.InvalidTokenReject:
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	case config.InvalidTokenAnonymous:
+		lgr.Debug("no valid token, using anonymous tenant",
+			zap.String("request_id", req.Header.Get("X-Request-ID")),
+			zap.String("path", req.URL.Path),
+			zap.Error(err))
+		return AnonymousTenant, nil
+	default:
+		lgr.Debug("no valid token, falling back to IP",
+			zap.String("request_id", req.Header.Get("X-Request-ID")),
+			zap.String("path", req.URL.Path),
+			zap.Error(err))
+		return sanitizeRedisKey(tenantIP(clientIP, tenantRule)), nil
+	}
+}
+
+// verified value of the configured claim, strings and numbers only
+func jwtClaim(req *http.Request, tenantRule *config.TenantStrategy) (string, error) {
+	verifier := tenantRule.JWTVerifier()
+	if verifier == nil {
+		return "", fmt.Errorf("jwt verifier not configured")
+	}
+
+	token := strings.TrimSpace(req.Header.Get(tenantRule.Key))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return "", fmt.Errorf("no token in %s header", tenantRule.Key)
+	}
+
+	claims, err := verifier.Verify(token, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	switch value := claims[tenantRule.Claim].(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case nil:
+		return "", fmt.Errorf("claim %s not found", tenantRule.Claim)
+	default:
+		return "", fmt.Errorf("claim %s is not a string or number", tenantRule.Claim)
+	}
+}
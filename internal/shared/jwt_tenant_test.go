@@ -0,0 +1,170 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mostafa-mahmood/TrafficCTRL/config"
+	"github.com/mostafa-mahmood/TrafficCTRL/internal/logger"
+	"go.uber.org/zap"
+)
+
+const jwtTestSecret = "jwt-test-secret"
+
+// the verifier is only built by config validation, so the rule is loaded like in production
+func loadJWTRule(t *testing.T, policy config.InvalidTokenPolicy) *config.TenantStrategy {
+	t.Helper()
+	dir := t.TempDir()
+	for _, file := range []string{"logger.yaml", "redis.yaml", "proxy.yaml"} {
+		data, err := os.ReadFile(filepath.Join("..", "..", "config", file))
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limiter := `
+global:
+  enabled: false
+per_tenant:
+  enabled: false
+per_endpoint:
+  rules:
+    - path: "/api/*"
+      algorithm: fixed_window
+      window_size: "1m"
+      limit: 10
+      tenant_strategy:
+        type: jwt
+        key: "Authorization"
+        claim: "org_id"
+        hmac_secrets: ["` + jwtTestSecret + `"]
+        on_invalid_token: ` + string(policy) + `
+`
+	if err := os.WriteFile(filepath.Join(dir, "limiter.yaml"), []byte(limiter), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_DIR", dir)
+
+	cfg, err := config.LoadConfigs()
+	if err != nil {
+		t.Fatalf("LoadConfigs() unexpected error: %v", err)
+	}
+	return cfg.Limiter.PerEndpoint.Rules[0].TenantStrategy
+}
+
+// HS256 token with the given claims
+func signJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	input := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestExtractFromJWT(t *testing.T) {
+	lgr := &logger.Logger{Logger: zap.NewNop()}
+	valid := time.Now().Add(time.Hour).Unix()
+	expired := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name          string
+		authorization string
+		// empty for invalid tokens, the policy decides
+		expected string
+	}{
+		{
+			name:          "T01_ValidToken_StringClaim",
+			authorization: "Bearer " + signJWT(t, jwtTestSecret, map[string]interface{}{"org_id": "acme", "exp": valid}),
+			expected:      "acme",
+		},
+		{
+			name:          "T02_ValidToken_NumericClaimWithoutBearerPrefix",
+			authorization: signJWT(t, jwtTestSecret, map[string]interface{}{"org_id": 42, "exp": valid}),
+			expected:      "42",
+		},
+		{
+			name: "T03_MissingToken",
+		},
+		{
+			name:          "T04_ExpiredToken",
+			authorization: "Bearer " + signJWT(t, jwtTestSecret, map[string]interface{}{"org_id": "acme", "exp": expired}),
+		},
+		{
+			name:          "T05_BadSignature",
+			authorization: "Bearer " + signJWT(t, "other-secret", map[string]interface{}{"org_id": "acme", "exp": valid}),
+		},
+		{
+			name:          "T06_MissingClaim",
+			authorization: "Bearer " + signJWT(t, jwtTestSecret, map[string]interface{}{"sub": "user-1", "exp": valid}),
+		},
+		{
+			name: "T07_NonStringClaim",
+			authorization: "Bearer " + signJWT(t, jwtTestSecret,
+				map[string]interface{}{"org_id": map[string]string{"id": "acme"}, "exp": valid}),
+		},
+		{
+			name:          "T08_ClaimSanitizedToEmpty",
+			authorization: "Bearer " + signJWT(t, jwtTestSecret, map[string]interface{}{"org_id": "***", "exp": valid}),
+		},
+	}
+
+	policies := []struct {
+		policy   config.InvalidTokenPolicy
+		fallback string
+	}{
+		{config.InvalidTokenIP, "203.0.113.5"},
+		{config.InvalidTokenAnonymous, AnonymousTenant},
+		{config.InvalidTokenReject, ""}, // ErrInvalidToken
+	}
+
+	for _, p := range policies {
+		rule := loadJWTRule(t, p.policy)
+
+		for _, tt := range tests {
+			t.Run(string(p.policy)+"/"+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "/api/orders", nil)
+				if tt.authorization != "" {
+					req.Header.Set("Authorization", tt.authorization)
+				}
+
+				actual, err := ExtractTenantKey(req, rule, "203.0.113.5", lgr)
+
+				expected := tt.expected
+				if expected == "" {
+					expected = p.fallback
+				}
+				if expected == "" {
+					if !errors.Is(err, ErrInvalidToken) {
+						t.Fatalf("ExtractTenantKey() error = %v, expected %v", err, ErrInvalidToken)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("ExtractTenantKey() unexpected error: %v", err)
+				}
+				if actual != expected {
+					t.Errorf("ExtractTenantKey() = %q, expected %q", actual, expected)
+				}
+			})
+		}
+	}
+}
@@ -2,7 +2,6 @@ package shared
 
 import (
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"unicode"
@@ -12,7 +11,8 @@ import (
 	"go.uber.org/zap"
 )
 
-func ExtractTenantKey(req *http.Request, tenantRule *config.TenantStrategy,
+// clientIP is the address resolved by ExtractIP, used by the ip strategy and as fallback
+func ExtractTenantKey(req *http.Request, tenantRule *config.TenantStrategy, clientIP string,
 	lgr *logger.Logger) (tenantKey string, err error) {
 	if tenantRule == nil {
 		lgr.Warn("tenant strategy is nil, falling back to IP",
@@ -20,19 +20,18 @@ func ExtractTenantKey(req *http.Request, tenantRule *config.TenantStrategy,
 			zap.String("path", req.URL.Path),
 			zap.String("method", req.Method),
 			zap.String("host", req.Host))
-		return sanitizeRedisKey(ExtractIP(req)), nil
+		return sanitizeRedisKey(tenantIP(clientIP, tenantRule)), nil
 	}
 	switch tenantRule.Type {
-	case "ip":
-		tenantKey = ExtractIP(req)
-	case "header":
-		tenantKey = extractFromHeader(req, tenantRule.Key)
-	case "cookie":
-		tenantKey = extractFromCookie(req, tenantRule.Key)
-	case "query_parameter":
-		tenantKey = extractFromParam(req, tenantRule.Key)
-	default:
-		return "", fmt.Errorf("unknown tenant strategy type: %s", tenantRule.Type)
+	case "jwt":
+		return extractFromJWT(req, tenantRule, clientIP, lgr)
+	case "composite":
+		return extractComposite(req, tenantRule, clientIP, lgr)
+	}
+
+	tenantKey, err = extractAttribute(req, tenantRule, clientIP)
+	if err != nil {
+		return "", err
 	}
 
 	if tenantKey == "" {
@@ -45,12 +44,28 @@ func ExtractTenantKey(req *http.Request, tenantRule *config.TenantStrategy,
 			zap.String("method", req.Method),
 			zap.String("host", req.Host),
 			zap.String("remoteAddr", req.RemoteAddr))
-		return sanitizeRedisKey(ExtractIP(req)), nil
+		return sanitizeRedisKey(tenantIP(clientIP, tenantRule)), nil
 	}
 
 	return sanitizeRedisKey(tenantKey), nil
 }
 
+// raw value of a single attribute strategy (ip, header, cookie, query_parameter)
+func extractAttribute(req *http.Request, tenantRule *config.TenantStrategy, clientIP string) (string, error) {
+	switch tenantRule.Type {
+	case "ip":
+		return tenantIP(clientIP, tenantRule), nil
+	case "header":
+		return extractFromHeader(req, tenantRule.Key), nil
+	case "cookie":
+		return extractFromCookie(req, tenantRule.Key), nil
+	case "query_parameter":
+		return extractFromParam(req, tenantRule.Key), nil
+	default:
+		return "", fmt.Errorf("unknown tenant strategy type: %s", tenantRule.Type)
+	}
+}
+
 func sanitizeRedisKey(input string) string {
 	if input == "" {
 		return input
@@ -80,26 +95,6 @@ func sanitizeRedisKey(input string) string {
 	return cleaned
 }
 
-func ExtractIP(req *http.Request) string {
-	if xri := req.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-
-	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		xff = strings.TrimSpace(xff)
-		arr := strings.Split(xff, ",")
-		if arr[0] != "" {
-			return strings.TrimSpace(arr[0])
-		}
-	}
-
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return req.RemoteAddr
-	}
-	return host
-}
-
 func extractFromHeader(req *http.Request, headerKey string) string {
 	return strings.TrimSpace(req.Header.Get(headerKey))
 }
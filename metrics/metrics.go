@@ -54,6 +54,83 @@ var (
 		[]string{"level"},
 	)
 
+	AllowedRequestsByPlan = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_requests_allowed_by_plan_total",
+			Help: "Total number of requests allowed by rate limiter, by tenant plan",
+		},
+		[]string{"plan"},
+	)
+
+	DeniedRequestsByPlan = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_requests_denied_by_plan_total",
+			Help: "Total number of requests denied by rate limiter, by level and tenant plan",
+		},
+		[]string{"level", "plan"},
+	)
+
+	AccessDeniedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "denied_requests_total",
+			Help: "Total number of requests denied before rate limiting (denylisted ip, invalid token, missing tenant attribute, banned tenant, invalid cost)",
+		},
+		[]string{"reason"},
+	)
+
+	AllowlistedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "requests_allowlisted_total",
+			Help: "Total number of requests from allowlisted clients, skipping all rate limits",
+		},
+	)
+
+	TarpittedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tarpit_requests_total",
+			Help: "Total number of denied requests handled by the tarpit, by outcome (forwarded || rejected || abandoned || overflow)",
+		},
+		[]string{"outcome"},
+	)
+
+	TarpitActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tarpit_active_requests",
+			Help: "Current number of denied requests held by the tarpit",
+		},
+	)
+
+	ShapedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shaped_requests_total",
+			Help: "Total number of allowed requests held by a leaky_bucket in shape mode, by outcome (forwarded || abandoned || overflow)",
+		},
+		[]string{"outcome"},
+	)
+
+	ShapedActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "shaped_active_requests",
+			Help: "Current number of allowed requests waiting for their turn in a leaky_bucket in shape mode",
+		},
+	)
+
+	RefundedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "refunded_requests_total",
+			Help: "Total number of forwarded requests whose units were given back by the endpoint rule's refund_on, by reason (status class || upstream_error || cancelled)",
+		},
+		[]string{"reason"},
+	)
+
+	CountedResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "counted_responses_total",
+			Help: "Total number of backend responses counted against an endpoint limit with count_on: response, by status class",
+		},
+		[]string{"status"},
+	)
+
 	ReputationDistribution = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "reputation_score_distribution",
@@ -96,6 +173,51 @@ var (
 			Help: "Total number of recovered panics",
 		},
 	)
+
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Total number of config reload attempts by status (success || failure)",
+		},
+		[]string{"status"},
+	)
+
+	ScriptReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_script_reloads_total",
+			Help: "Total number of lua scripts loaded again after NOSCRIPT (redis restart || failover)",
+		},
+		[]string{"script"},
+	)
+
+	StorageFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "storage_failovers_total",
+			Help: "Total number of switches between redis and the local fallback (failover || recovery)",
+		},
+		[]string{"event"},
+	)
+
+	AdaptiveGlobalLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "adaptive_global_limit",
+			Help: "Effective global limit of this instance with an adaptive global limit, in units of the configured limit",
+		},
+	)
+
+	FallbackActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "storage_fallback_active",
+			Help: "1 while limits are enforced by the local in-memory fallback, 0 otherwise",
+		},
+	)
+
+	FallbackRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "storage_fallback_requests_total",
+			Help: "Total number of requests checked by the local in-memory fallback",
+		},
+	)
 )
 
 func init() {
@@ -106,12 +228,28 @@ func init() {
 		RequestDuration,
 		AllowedRequests,
 		DeniedRequests,
+		AllowedRequestsByPlan,
+		DeniedRequestsByPlan,
+		AccessDeniedRequests,
+		AllowlistedRequests,
+		TarpittedRequests,
+		TarpitActive,
+		ShapedRequests,
+		ShapedActive,
+		RefundedRequests,
+		CountedResponses,
 		ReputationDistribution,
 		RedisErrors,
 		GlobalLimitErrors,
 		TenantLimitErrors,
 		EndpointLimitErrors,
 		PanicRecoveries,
+		ConfigReloads,
+		ScriptReloads,
+		StorageFailovers,
+		AdaptiveGlobalLimit,
+		FallbackActive,
+		FallbackRequests,
 	)
 }
 
@@ -105,7 +105,7 @@ func (s *E2ETestSuite) TestAlgorithmBehaviorComparison() {
 		}
 
 		for i := 0; i < 15; i++ {
-			result, err := s.rateLimiter.CheckTenantLimit(context.Background(), tenantKey, tenantConfig)
+			result, err := s.rateLimiter.CheckTenantLimit(context.Background(), tenantKey, "", tenantConfig)
 			assert.NoError(t, err)
 
 			if result.Allowed {
@@ -30,6 +30,7 @@ func (s *E2ETestSuite) TestConcurrentRateLimiting() {
 				result, err := s.rateLimiter.CheckTenantLimit(
 					context.Background(),
 					tenantKey,
+					"",
 					&s.proxyConfig.Limiter.PerTenant,
 				)
 				assert.NoError(t, err)
@@ -39,7 +39,7 @@ func (s *E2ETestSuite) SetupSuite() {
 
 	s.setupLogger()
 
-	s.rateLimiter = limiter.NewRateLimiter(s.redisClient)
+	s.rateLimiter = limiter.NewRateLimiter(limiter.NewRedisStore(s.redisClient))
 }
 
 func (s *E2ETestSuite) TearDownSuite() {
@@ -69,13 +69,13 @@ func setupTestEnvironment(t *testing.T) *testEnv {
 	lgr, err := logger.NewLogger(cfg.Logger)
 	require.NoError(t, err)
 
-	rateLimiter := limiter.NewRateLimiter(redisClient)
+	rateLimiter := limiter.NewRateLimiter(limiter.NewRedisStore(redisClient))
 
 	proxyAddr := fmt.Sprintf("localhost:%d", proxyPort)
 
 	go func() {
 		shutdownSignal := make(chan struct{})
-		if err := proxy.StartServer(cfg, lgr, rateLimiter, shutdownSignal); err != nil && err != http.ErrServerClosed {
+		if err := proxy.StartServer(config.NewStore(cfg), lgr, rateLimiter, shutdownSignal); err != nil && err != http.ErrServerClosed {
 			t.Logf("Proxy server error: %v", err)
 		}
 	}()
@@ -51,6 +51,7 @@ func (s *E2ETestSuite) TestPerTenantRateLimiting() {
 		result, err := s.rateLimiter.CheckTenantLimit(
 			context.Background(),
 			goodTenant,
+			"",
 			&s.proxyConfig.Limiter.PerTenant,
 		)
 		assert.NoError(t, err)
@@ -62,6 +63,7 @@ func (s *E2ETestSuite) TestPerTenantRateLimiting() {
 		result, err := s.rateLimiter.CheckTenantLimit(
 			context.Background(),
 			badTenant,
+			"",
 			&s.proxyConfig.Limiter.PerTenant,
 		)
 		assert.NoError(t, err)
@@ -77,6 +79,7 @@ func (s *E2ETestSuite) TestPerTenantRateLimiting() {
 	result, err := s.rateLimiter.CheckTenantLimit(
 		context.Background(),
 		goodTenant,
+		"",
 		&s.proxyConfig.Limiter.PerTenant,
 	)
 	assert.NoError(t, err)
@@ -93,6 +96,7 @@ func (s *E2ETestSuite) TestEndpointSpecificRateLimiting() {
 		result, err := s.rateLimiter.CheckEndpointLimit(
 			context.Background(),
 			tenantKey,
+			"",
 			&s.proxyConfig.Limiter.PerEndpoint.Rules[0],
 		)
 		assert.NoError(t, err)
@@ -107,6 +111,7 @@ func (s *E2ETestSuite) TestEndpointSpecificRateLimiting() {
 	result, err := s.rateLimiter.CheckEndpointLimit(
 		context.Background(),
 		tenantKey,
+		"",
 		&s.proxyConfig.Limiter.PerEndpoint.Rules[1],
 	)
 	assert.NoError(t, err)
@@ -136,7 +141,7 @@ func (s *E2ETestSuite) TestReputationSystem() {
 	rep, err := s.rateLimiter.GetTenantReputation(context.Background(), tenantKey)
 	assert.NoError(t, err)
 
-	assert.Less(t, rep.Score, s.rateLimiter.GetReputationThreshold(),
+	assert.Less(t, rep.Score, s.proxyConfig.Limiter.Reputation.Model().Threshold,
 		"Should be below threshold after many violations")
 	assert.Greater(t, rep.ViolationCount, int64(0), "Should track violation count")
 }